@@ -4,8 +4,11 @@
 package cache
 
 import (
+	"context"
 	"sync"
+	"time"
 
+	"github.com/hashicorp/go-hclog"
 	"github.com/vercel/turbo/cli/internal/turbopath"
 )
 
@@ -18,8 +21,24 @@ type asyncCache struct {
 	requests  chan cacheRequest
 	realCache Cache
 	wg        sync.WaitGroup
+	logger    hclog.Logger
+	// retries and retryDelay control how failed uploads are retried; see
+	// Opts.AsyncUploadRetries.
+	retries    int
+	retryDelay time.Duration
 }
 
+const (
+	// _asyncUploadQueueSize is how many Puts are queued with Opts.AsyncUploads
+	// before Put blocks.
+	_asyncUploadQueueSize = 1024
+	// _defaultAsyncUploadWorkers is the number of uploaders used with
+	// Opts.AsyncUploads if Opts.Workers isn't set.
+	_defaultAsyncUploadWorkers = 4
+	// _asyncUploadRetryDelay is the wait before retrying a failed upload.
+	_asyncUploadRetryDelay = time.Second
+)
+
 // A cacheRequest models an incoming cache request on our queue.
 type cacheRequest struct {
 	anchor   turbopath.AbsoluteSystemPath
@@ -32,9 +51,19 @@ func newAsyncCache(realCache Cache, opts Opts) Cache {
 	c := &asyncCache{
 		requests:  make(chan cacheRequest),
 		realCache: realCache,
+		logger:    opts.logger(),
 	}
-	c.wg.Add(opts.Workers)
-	for i := 0; i < opts.Workers; i++ {
+	workers := opts.Workers
+	if opts.AsyncUploads {
+		c.requests = make(chan cacheRequest, _asyncUploadQueueSize)
+		c.retries = opts.AsyncUploadRetries
+		c.retryDelay = _asyncUploadRetryDelay
+		if workers <= 0 {
+			workers = _defaultAsyncUploadWorkers
+		}
+	}
+	c.wg.Add(workers)
+	for i := 0; i < workers; i++ {
 		go c.run()
 	}
 	return c
@@ -50,10 +79,35 @@ func (c *asyncCache) Put(anchor turbopath.AbsoluteSystemPath, key string, durati
 	return nil
 }
 
+// PutImmutable isn't queued: it stores the artifact before returning, so
+// that the caller knows whether it was pinned.
+func (c *asyncCache) PutImmutable(anchor turbopath.AbsoluteSystemPath, key string, duration int, files []turbopath.AnchoredSystemPath) error {
+	return remoteOperations(c.realCache).PutImmutable(anchor, key, duration, files)
+}
+
+func (c *asyncCache) VerifyManifest(expected map[string]string) ([]ManifestDiscrepancy, error) {
+	return remoteOperations(c.realCache).VerifyManifest(expected)
+}
+
+func (c *asyncCache) EstimateRestoreSize(key string) (int64, error) {
+	return remoteOperations(c.realCache).EstimateRestoreSize(key)
+}
+
+func (c *asyncCache) Capabilities() (BackendCapabilities, error) {
+	return remoteOperations(c.realCache).Capabilities()
+}
+
 func (c *asyncCache) Fetch(anchor turbopath.AbsoluteSystemPath, key string, files []string) (ItemStatus, []turbopath.AnchoredSystemPath, int, error) {
 	return c.realCache.Fetch(anchor, key, files)
 }
 
+func (c *asyncCache) Ping(ctx context.Context) error {
+	if pinger, ok := c.realCache.(Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
 func (c *asyncCache) Exists(key string) ItemStatus {
 	return c.realCache.Exists(key)
 }
@@ -76,7 +130,14 @@ func (c *asyncCache) Shutdown() {
 // run implements the actual async logic.
 func (c *asyncCache) run() {
 	for r := range c.requests {
-		_ = c.realCache.Put(r.anchor, r.key, r.duration, r.files)
+		err := c.realCache.Put(r.anchor, r.key, r.duration, r.files)
+		for attempt := 0; err != nil && attempt < c.retries; attempt++ {
+			time.Sleep(c.retryDelay)
+			err = c.realCache.Put(r.anchor, r.key, r.duration, r.files)
+		}
+		if err != nil {
+			c.logger.Warn("failed to upload artifact in the background", "hash", r.key, "error", err)
+		}
 	}
 	c.wg.Done()
 }
@@ -6,10 +6,18 @@
 package cache
 
 import (
+	"context"
 	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
 	"sync"
+	"time"
 
+	"github.com/hashicorp/go-hclog"
 	"github.com/vercel/turbo/cli/internal/analytics"
+	"github.com/vercel/turbo/cli/internal/cacheitem"
 	"github.com/vercel/turbo/cli/internal/fs"
 	"github.com/vercel/turbo/cli/internal/turbopath"
 	"github.com/vercel/turbo/cli/internal/util"
@@ -34,8 +42,77 @@ type Cache interface {
 type ItemStatus struct {
 	Local  bool `json:"local"`
 	Remote bool `json:"remote"`
+	// Source is the caching layer a hit was served from, or ItemSourceNone on
+	// a miss. Local and Remote are kept for compatibility; a hit from the
+	// local mirror or a local fallback also sets Local.
+	Source ItemSource `json:"source,omitempty"`
+	// AlreadySatisfied is set, along with Local, when Fetch found the outputs
+	// already in place via Opts.OutputsSatisfied and restored nothing.
+	AlreadySatisfied bool `json:"alreadySatisfied,omitempty"`
+	// MissReason explains a miss that wasn't simply the artifact being absent.
+	// It is MissReasonNone on hits and ordinary misses.
+	MissReason MissReason `json:"missReason,omitempty"`
+	// SkipReason is set on a miss when the cache wasn't consulted at all, so
+	// the miss says nothing about whether the artifact exists. It is
+	// SkipReasonNone on hits and on genuine misses.
+	SkipReason SkipReason `json:"skipReason,omitempty"`
 }
 
+// MissReason explains why Fetch reported a miss.
+type MissReason string
+
+const (
+	// MissReasonNone indicates a hit, or a miss because there was no artifact
+	MissReasonNone MissReason = ""
+	// MissReasonVerificationFailed indicates the artifact failed verification,
+	// from every replica, and was treated as a miss so the task is rebuilt;
+	// see Opts.VerificationFailureAsMiss
+	MissReasonVerificationFailed MissReason = "VERIFICATION_FAILED"
+)
+
+// SkipReason explains why a lookup was skipped rather than answered.
+type SkipReason string
+
+const (
+	// SkipReasonNone indicates the lookup was made
+	SkipReasonNone SkipReason = ""
+	// SkipReasonDisabled indicates there was no cache to look in, e.g. because
+	// the remote cache was disabled partway through the run
+	SkipReasonDisabled SkipReason = "DISABLED"
+	// SkipReasonBypassed indicates cache reads were turned off for the task,
+	// e.g. with --force
+	SkipReasonBypassed SkipReason = "BYPASSED"
+	// SkipReasonExcluded indicates the hash was excluded by Opts.CacheablePredicate
+	SkipReasonExcluded SkipReason = "EXCLUDED"
+	// SkipReasonTooSmall indicates the artifact is known to be under
+	// Opts.MinRemoteArtifactSize, so it was never uploaded
+	SkipReasonTooSmall SkipReason = "TOO_SMALL"
+	// SkipReasonBudgetExceeded indicates the run's download budget was spent
+	SkipReasonBudgetExceeded SkipReason = "BUDGET_EXCEEDED"
+	// SkipReasonRunBudgetExhausted indicates the run's deadline was too close
+	// to start another request
+	SkipReasonRunBudgetExhausted SkipReason = "RUN_BUDGET_EXHAUSTED"
+	// SkipReasonTooSlow indicates the download was abandoned because it was
+	// slower than rebuilding; see Opts.MaxFetchDurationRatio
+	SkipReasonTooSlow SkipReason = "TOO_SLOW"
+)
+
+// ItemSource identifies the caching layer that served a hit.
+type ItemSource string
+
+const (
+	// ItemSourceNone indicates a miss
+	ItemSourceNone ItemSource = ""
+	// ItemSourceLocal indicates a hit in the local filesystem cache
+	ItemSourceLocal ItemSource = CacheSourceFS
+	// ItemSourceRemote indicates a hit downloaded from the remote cache, or
+	// a mirrored copy the remote cache confirmed is still current
+	ItemSourceRemote ItemSource = CacheSourceRemote
+	// ItemSourceLocalMirror indicates a hit served from the local mirror of
+	// the remote cache without contacting it, see Opts.LocalMirrorDir
+	ItemSourceLocalMirror ItemSource = "LOCAL_MIRROR"
+)
+
 const (
 	// CacheSourceFS is a constant to indicate local cache hit
 	CacheSourceFS = "LOCAL"
@@ -45,13 +122,47 @@ const (
 	CacheEventHit = "HIT"
 	// CacheEventMiss is a constant to indicate a cache miss
 	CacheEventMiss = "MISS"
+	// CacheEventSkipped is a constant to indicate the cache wasn't consulted;
+	// see ItemStatus.SkipReason
+	CacheEventSkipped = "SKIPPED"
+	// CacheEventError is a constant to indicate a failed cache operation
+	CacheEventError = "ERROR"
+	// CacheEventUpload is a constant to indicate an artifact was uploaded
+	CacheEventUpload = "UPLOAD"
+	// CacheEventBudgetExceeded is a constant to indicate a fetch was skipped
+	// because the run's download budget has been spent
+	CacheEventBudgetExceeded = "BUDGET_EXCEEDED"
+	// CacheEventClockSkew is a constant to indicate the remote cache's clock
+	// differs significantly from ours. It is reported at most once per run.
+	CacheEventClockSkew = "CLOCK_SKEW"
+	// CacheEventSkippedTooSmall is a constant to indicate the remote cache
+	// was skipped because an artifact is under Opts.MinRemoteArtifactSize
+	CacheEventSkippedTooSmall = "SKIPPED_TOO_SMALL"
 )
 
+// CacheEvent describes a single cache operation
 type CacheEvent struct {
 	Source   string `mapstructure:"source"`
 	Event    string `mapstructure:"event"`
 	Hash     string `mapstructure:"hash"`
 	Duration int    `mapstructure:"duration"`
+	// CompressedSize is the number of bytes of artifact transferred to or from
+	// the remote cache, including any failed attempts, for remote uploads and
+	// fetches. UncompressedSize is the size of the files in an uploaded
+	// artifact. Both are zero when the size isn't known, e.g. for local
+	// cache events and failed uploads.
+	CompressedSize   int64 `mapstructure:"compressedSize,omitempty"`
+	UncompressedSize int64 `mapstructure:"uncompressedSize,omitempty"`
+	// ClockSkewSeconds is how far the remote cache's clock is ahead of ours
+	// (negative if behind). It is only set for CacheEventClockSkew.
+	ClockSkewSeconds int64 `mapstructure:"clockSkewSeconds,omitempty"`
+	// SampleRate is the fraction of events like this one sent to analytics,
+	// if they are sampled; see Opts.AnalyticsSampleRate. Each sampled event
+	// stands for 1/SampleRate events.
+	SampleRate float64 `mapstructure:"sampleRate,omitempty"`
+	// Codec is the codec an uploaded artifact was compressed with, e.g.
+	// "zstd-3", if it was chosen by Opts.AutoCodec.
+	Codec string `mapstructure:"codec,omitempty"`
 }
 
 // DefaultLocation returns the default filesystem cache location, given a repo root
@@ -59,14 +170,132 @@ func DefaultLocation(repoRoot turbopath.AbsoluteSystemPath) turbopath.AbsoluteSy
 	return repoRoot.UntypedJoin("node_modules", ".cache", "turbo")
 }
 
+// OnCacheEvent defines a callback that the cache system calls for every cache event.
+// It is invoked synchronously, on the goroutine performing the cache operation, after
+// the analytics recorder has been notified. Events for a single operation arrive in the
+// order they happen, but events from concurrent operations may interleave, so the
+// callback must be safe for concurrent use.
+type OnCacheEvent = func(event CacheEvent)
+
 // OnCacheRemoved defines a callback that the cache system calls if a particular cache
 // needs to be removed. In practice, this happens when Remote Caching has been disabled
 // the but CLI continues to try to use it.
 type OnCacheRemoved = func(cache Cache, err error)
 
+// SignatureScope is what an artifact signature covers.
+type SignatureScope string
+
+const (
+	// SignatureScopeBody signs the artifact's hash, team and contents. Verifying
+	// it requires reading the whole artifact before trusting any of it.
+	SignatureScopeBody SignatureScope = "body"
+	// SignatureScopeHashOnly signs only the artifact's hash and team. It only
+	// proves that someone with the key uploaded something under that hash, not
+	// what: anyone able to tamper with artifacts in transit or in storage can
+	// substitute the contents undetected. In exchange, artifacts can be restored
+	// as they download even with signing on. Only use it where the network and
+	// the backend are fully trusted and signatures are wanted for provenance.
+	SignatureScopeHashOnly SignatureScope = "hash-only"
+)
+
 // ErrNoCachesEnabled is returned when both the filesystem and http cache are unavailable
 var ErrNoCachesEnabled = errors.New("no caches are enabled")
 
+// ErrRemoteCacheUnreachable is returned by Ping when the remote cache can't be contacted
+var ErrRemoteCacheUnreachable = errors.New("remote cache is unreachable")
+
+// ErrRemoteCacheUnauthorized is returned by Ping when the remote cache rejects our credentials
+var ErrRemoteCacheUnauthorized = errors.New("remote cache rejected the provided credentials")
+
+// ErrTarConstructionTimeout is returned by Put when building an artifact takes longer than Opts.TarBuildTimeout
+var ErrTarConstructionTimeout = errors.New("timed out building artifact")
+
+// ErrUnauthorized is returned when the remote cache rejects our credentials with
+// a 401 or 403, e.g. because a short-lived token expired partway through a run.
+var ErrUnauthorized = util.ErrUnauthorized
+
+// ErrTokenUnavailable is returned when Opts.TokenProvider fails to supply a token.
+var ErrTokenUnavailable = util.ErrTokenUnavailable
+
+// ErrArtifactImmutable is returned by Put when the remote cache refuses to
+// overwrite an artifact stored with RemoteOperations.PutImmutable.
+var ErrArtifactImmutable = util.ErrArtifactImmutable
+
+// ErrDeniedContent is returned by Put when an artifact would contain a file
+// excluded by Opts.DeniedPatterns or Opts.AllowedPatterns. The error names
+// the file.
+var ErrDeniedContent = errors.New("artifact contains denied content")
+
+// ErrVerificationFailed is returned when a downloaded artifact's signature is
+// missing or doesn't match, see Opts.Signature.
+var ErrVerificationFailed = errors.New("artifact verification failed")
+
+// ErrRunBudgetExhausted is returned when too little time remains before Opts.Deadline to start a remote cache operation
+var ErrRunBudgetExhausted = errors.New("not enough time left in the run for a remote cache operation")
+
+// ErrInvalidHashNamespace is returned by New when Opts.HashNamespace can't be
+// used as part of a file name.
+var ErrInvalidHashNamespace = errors.New("invalid cache hash namespace")
+
+// ErrNoRemoteCache is returned by the RemoteOperations that need a remote
+// cache when there isn't one, e.g. with Opts.SkipRemote.
+var ErrNoRemoteCache = errors.New("no remote cache is configured")
+
+// Pinger is implemented by caches that can verify their backend is available,
+// e.g. for `turbo cache status` or to fail fast before a build starts.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// RemoteOperations are the remote cache operations beyond Cache. Every Cache
+// returned by New implements them, whichever caches and wrappers it is made
+// of; the operations that need a remote cache return ErrNoRemoteCache if
+// there isn't one.
+type RemoteOperations interface {
+	// PutImmutable is like Put, but pins the artifact in the remote cache;
+	// see httpCache.PutImmutable. Other caches store it as Put does.
+	PutImmutable(anchor turbopath.AbsoluteSystemPath, key string, duration int, files []turbopath.AnchoredSystemPath) error
+	// VerifyManifest checks the remote cache against a map of hash to
+	// content digest; see httpCache.VerifyManifest.
+	VerifyManifest(expected map[string]string) ([]ManifestDiscrepancy, error)
+	// EstimateRestoreSize returns how many bytes restoring the remote
+	// artifact for key would write; see httpCache.EstimateRestoreSize.
+	EstimateRestoreSize(key string) (int64, error)
+	// Capabilities reports which optional features the remote cache
+	// supports; see httpCache.Capabilities.
+	Capabilities() (BackendCapabilities, error)
+}
+
+// remoteOperations returns c's RemoteOperations. A Cache without them, such
+// as a test double, stores immutable artifacts as regular ones and has no
+// remote cache.
+func remoteOperations(c Cache) RemoteOperations {
+	if ops, ok := c.(RemoteOperations); ok {
+		return ops
+	}
+	return noRemoteOperations{c}
+}
+
+type noRemoteOperations struct {
+	Cache
+}
+
+func (c noRemoteOperations) PutImmutable(anchor turbopath.AbsoluteSystemPath, key string, duration int, files []turbopath.AnchoredSystemPath) error {
+	return c.Put(anchor, key, duration, files)
+}
+
+func (c noRemoteOperations) VerifyManifest(_ map[string]string) ([]ManifestDiscrepancy, error) {
+	return nil, ErrNoRemoteCache
+}
+
+func (c noRemoteOperations) EstimateRestoreSize(_ string) (int64, error) {
+	return 0, ErrNoRemoteCache
+}
+
+func (c noRemoteOperations) Capabilities() (BackendCapabilities, error) {
+	return BackendCapabilities{}, ErrNoRemoteCache
+}
+
 // Opts holds configuration options for the cache
 // TODO(gsoltis): further refactor this into fs cache opts and http cache opts
 type Opts struct {
@@ -75,6 +304,408 @@ type Opts struct {
 	SkipFilesystem  bool
 	Workers         int
 	RemoteCacheOpts fs.RemoteCacheOptions
+
+	// AsyncUploads queues Puts for a pool of Workers background uploaders,
+	// so Put returns as soon as the artifact is queued rather than waiting for
+	// an uploader to be free, e.g. to keep rebuilds in watch mode fast. Up to
+	// 1024 Puts are queued before Put blocks. The artifact may not have been
+	// uploaded, or even packed, by the time Put returns, and failures are
+	// logged rather than returned. Shutdown waits for the queue to drain.
+	// Without it, Workers > 0 still uploads in the background, but Put waits
+	// for a free worker. If Workers isn't set, 4 are used.
+	AsyncUploads bool
+	// AsyncUploadRetries is how many more times a failed background upload is
+	// tried with AsyncUploads, a second apart, before it is logged and dropped.
+	AsyncUploadRetries int
+	// CompressionThreads is the number of threads used to compress artifacts
+	// uploaded to the remote cache. 0 uses one thread per CPU.
+	CompressionThreads int
+	// CompressionLevel is the zstd level used to compress artifacts uploaded to
+	// the remote cache, from 1 (fastest) to 22 (smallest). 0 uses zstd's
+	// default. See BenchmarkCompression for help choosing one.
+	CompressionLevel int
+	// AdaptiveCompression picks the compression level for each uploaded artifact
+	// from the total size of its files, instead of using CompressionLevel: fast
+	// levels for small artifacts, where latency dominates, and higher levels for
+	// large ones, where transfer size dominates. The size ranges are given by
+	// CompressionTiers.
+	AdaptiveCompression bool
+	// CompressionTiers configures AdaptiveCompression. Defaults to
+	// DefaultCompressionTiers.
+	CompressionTiers []CompressionTier
+	// AutoCodec picks the compression level for each uploaded artifact by
+	// compressing a sample of its files at a few candidate levels and
+	// estimating which would pack and upload the whole artifact soonest.
+	// Already-compressed files, like images and archives, are packed at the
+	// fastest level, since higher ones would barely shrink them. It overrides
+	// CompressionLevel and AdaptiveCompression, at the cost of compressing the
+	// sample up front. The chosen codec is reported in CacheEvent.Codec.
+	AutoCodec bool
+	// OnCacheEvent, if set, is called for every hit, miss, error, and upload.
+	// It is called in addition to the analytics recorder.
+	OnCacheEvent OnCacheEvent
+	// AnalyticsSampleRate, if between 0 and 1, is the fraction of cache events
+	// sent to the analytics recorder, chosen at random, to cut telemetry volume
+	// on very large builds. Sampled events carry the rate in
+	// CacheEvent.SampleRate so totals can be estimated. OnCacheEvent and the
+	// remote cache's metrics still see every event, so local counts stay
+	// exact. 0 and 1 both send every event.
+	AnalyticsSampleRate float64
+	// MaxFetchDurationRatio, if positive, abandons a remote cache download
+	// that has taken longer than this multiple of the time the task took to
+	// run, as reported by the artifact's x-artifact-duration, and treats it
+	// as a miss, since rebuilding would be quicker. For example, 1.5 gives up
+	// on fetching the outputs of a 2s task after 3s. Nothing is restored
+	// from an abandoned download, except with ResumableRestore, where the
+	// files already written are kept for the next restore to resume from.
+	// Artifacts without a duration are never abandoned.
+	MaxFetchDurationRatio float64
+	// MaxDownloadBytes caps the total number of bytes fetched from the remote cache
+	// during a run. Once exceeded, remote fetches are treated as misses.
+	// The cap is advisory: the fetch that crosses it is allowed to finish. 0 disables it.
+	MaxDownloadBytes int64
+	// PreserveXattrs stores extended attributes (e.g. macOS code-signing metadata)
+	// in artifacts and reapplies them on restore, where the platform supports it.
+	PreserveXattrs bool
+	// StreamVerifySignatures verifies artifact signatures while the artifact is
+	// being restored instead of buffering the whole artifact first. The
+	// artifact is extracted into a staging directory in TempDir and only
+	// moved into place once its signature is known to be valid, so an
+	// artifact failing verification leaves the repo untouched.
+	StreamVerifySignatures bool
+	// VerificationFailureAsMiss makes Fetch report an artifact that fails
+	// signature or integrity verification, from every replica, as a miss with
+	// MissReasonVerificationFailed, so the task is rebuilt instead of the run
+	// failing. The failure is still logged as an error and listed in the
+	// remote cache's FailedOps. Off by default, since a verification failure
+	// can mean tampering that warrants stopping.
+	VerificationFailureAsMiss bool
+	// QuarantineBadArtifacts quarantines remote artifacts that fail signature
+	// verification: the failure is reported to the remote cache, if the
+	// client supports it, so operators can investigate and purge the
+	// artifact, and later fetches of it in this process are misses with
+	// MissReasonVerificationFailed, without downloading it again.
+	QuarantineBadArtifacts bool
+	// CacheablePredicate, if set, is consulted before every remote cache operation.
+	// Hashes for which it returns false bypass the remote cache entirely.
+	CacheablePredicate func(hash string) bool
+	// MinRemoteArtifactSize, if positive, skips uploading artifacts whose
+	// files total fewer than this many bytes, since for trivial outputs the
+	// round trip to the remote cache can cost more than rebuilding them.
+	// Skipped uploads are reported as CacheEventSkippedTooSmall.
+	MinRemoteArtifactSize int64
+	// SkipSmallRemoteFetches also skips fetching artifacts from the remote
+	// cache that MinRemoteArtifactSize kept from being uploaded earlier in
+	// this process, e.g. in watch mode, rather than looking for copies
+	// uploaded from elsewhere. Skipped fetches are misses.
+	SkipSmallRemoteFetches bool
+	// HashNamespace, if set, is prefixed to every hash before it reaches a cache.
+	// Environments that share a cache backend but use different namespaces never
+	// share artifacts, even if their task hashes collide. Hashes reported to
+	// OnCacheEvent and CacheablePredicate include the namespace. Since hashes
+	// name files in the local caches, it may not contain path separators or "..".
+	HashNamespace string
+	// OutputsSatisfied, if set, is called by Fetch before anything else. If it
+	// reports that the outputs for hash are already present and valid under
+	// anchor, Fetch skips the caches entirely and reports a local hit with
+	// ItemStatus.AlreadySatisfied set. No files are returned in that case. The
+	// hash is the one passed to Fetch, before HashNamespace is applied.
+	OutputsSatisfied func(anchor turbopath.AbsoluteSystemPath, hash string) bool
+	// CacheJournalPath, if set, is a file that every Put and Fetch appends a
+	// JSON line to, recording the hash and the files stored or restored, so
+	// that what a cache entry represented can be reconstructed later. See
+	// JournalEntry. Relative paths are resolved against the repo root. The
+	// hash is the one passed to Put or Fetch, before HashNamespace is applied.
+	// If the journal can't be opened, a warning is logged and caching carries
+	// on without it.
+	CacheJournalPath string
+	// HashRewriter, if set, transforms every hash before it is sent to the remote
+	// cache, e.g. to isolate a cache-key experiment from regular artifacts. It
+	// must be the same for the runs that write artifacts and the runs that read
+	// them, or they won't see each other's artifacts. Hashes reported to
+	// OnCacheEvent and CacheablePredicate are the rewritten ones. The local
+	// filesystem cache is unaffected.
+	HashRewriter func(hash string) string
+	// RetryBudgetRatio caps retries of remote cache requests, across the whole run,
+	// at this fraction of successful requests (e.g. 0.1 for 10%). Once the budget is
+	// spent, failing requests fail fast instead of retrying. 0 disables the budget.
+	RetryBudgetRatio float64
+	// LocalMirrorDir, if set, is a directory where every artifact fetched from the
+	// remote cache is also stored. Later fetches of the same hash on this machine
+	// are served from the mirror without contacting the remote cache. Unlike the
+	// filesystem cache, the mirror is never written to by Put.
+	LocalMirrorDir string
+	// TarBuildTimeout bounds how long Put may spend reading files and building an
+	// artifact for the remote cache, e.g. when a read from a network filesystem
+	// hangs. Put then fails with ErrTarConstructionTimeout. 0 disables the timeout.
+	TarBuildTimeout time.Duration
+	// NewArtifactPacker, if set, creates the packer used to build artifacts for the
+	// remote cache, writing to w. It can be used to filter files or add synthetic
+	// ones. The packer must close w when it is closed. Defaults to cacheitem.CreateWriter.
+	NewArtifactPacker func(w io.WriteCloser) ArtifactPacker
+	// WarnOnOverwriteDivergence logs a warning for every existing file that a
+	// restore overwrites with different contents, to surface restores that
+	// clobber uncommitted edits in output directories.
+	WarnOnOverwriteDivergence bool
+	// RestoreMode controls whether restores overwrite existing files. Defaults
+	// to overwriting, which CI needs for correctness. cacheitem.RestoreModeMerge
+	// keeps files edited since the artifact was created, for incremental local
+	// development; see it for the tradeoffs. Remote artifacts have no known
+	// creation time, so in merge mode they only fill in missing files.
+	RestoreMode cacheitem.RestoreMode
+	// ResumableRestore checkpoints restores in the cache directory so that a
+	// restore interrupted partway through (e.g. a killed process) skips the
+	// files it already wrote when the same artifact is next restored. This is
+	// meant for very large artifacts, and gives up some safety to get there:
+	// files skipped on resume are trusted to be unchanged since they were
+	// written, and an interrupted restore leaves a partial output behind,
+	// since resumable restores are written in place rather than staged in
+	// TempDir.
+	ResumableRestore bool
+	// MaxConcurrentRestores, if positive, caps how many artifacts are extracted
+	// to disk at once across the local and remote caches, so that many
+	// simultaneous cache hits don't thrash slow storage. It is separate from the
+	// limit on concurrent remote requests. A remote artifact that is restored
+	// as it streams in keeps its request open while it waits for a slot.
+	MaxConcurrentRestores int
+	// MaxFilesPerArtifact caps how many files, directories and symlinks a
+	// single artifact may restore, so a corrupt or malicious artifact can't
+	// exhaust inodes. Restores are staged in TempDir, so an artifact over the
+	// cap leaves nothing behind, except with ResumableRestore. Defaults to
+	// DefaultMaxFilesPerArtifact; negative values remove the cap.
+	MaxFilesPerArtifact int
+	// MaxDecompressedSize, if positive, caps how many bytes a single artifact
+	// may decompress to on restore, so that a small artifact from a shared
+	// cache can't expand to fill the disk. Restores that cross it fail with
+	// cacheitem.ErrDecompressionBomb, leaving nothing behind unless
+	// ResumableRestore is set.
+	MaxDecompressedSize int64
+	// MaxCompressionRatio, if positive, additionally fails restores of
+	// artifacts that decompress to more than this many times their compressed
+	// size. See cacheitem.CacheItem.MaxCompressionRatio.
+	MaxCompressionRatio int
+	// FsyncAfterRestore flushes every restored file, and the directories
+	// holding them, to stable storage before a fetch returns, for pipelines
+	// where another process reads outputs straight after a restore on a
+	// filesystem that doesn't guarantee it sees them. It is off by default
+	// since a sync per file can make restoring many small files several times
+	// slower, depending on the disk.
+	FsyncAfterRestore bool
+	// VerifyRestoreCount fails a fetch with cacheitem.ErrIncompleteRestore if
+	// the artifact has entries that weren't restored, although no error was
+	// reported for them. It is a cheap check against restore bugs. See
+	// cacheitem.CacheItem.VerifyRestoreCount.
+	VerifyRestoreCount bool
+	// RestoreUmask, if non-zero, is cleared from the permissions of restored
+	// files and directories, e.g. 0o077 so that outputs in locked-down
+	// environments aren't readable by other users. Zero leaves permissions to
+	// the process umask, as before. It is a no-op on Windows.
+	RestoreUmask os.FileMode
+	// CompressionDictionary is an experimental zstd dictionary used to compress
+	// artifacts uploaded to the remote cache, and to restore artifacts that were
+	// compressed with it. Artifacts are compressed without a dictionary if unset.
+	CompressionDictionary []byte
+	// TokenRefresh, if set, is called to obtain a fresh token when the remote
+	// cache rejects our credentials. The failed request is retried once with it.
+	TokenRefresh func() (string, error)
+	// TokenProvider, if set, supplies the remote cache token and when it
+	// expires, e.g. so a long-running daemon's scoped token can rotate without
+	// a restart. Unlike TokenRefresh it is proactive: the token is kept until
+	// shortly before it expires, or until the remote cache rejects it, and a
+	// new one is fetched before the next request. Requests fail with
+	// ErrTokenUnavailable if the provider does. It only takes effect with
+	// clients that support token providers.
+	TokenProvider func() (token string, expiry time.Time, err error)
+	// IncludeManifest adds a manifest listing every file and its digest to
+	// artifacts uploaded to the remote cache. See cacheitem.Manifest.
+	IncludeManifest bool
+	// ManifestHashAlgorithm names the algorithm used for manifest digests, e.g.
+	// to match what a backend or another turbo version uses. See
+	// cacheitem.NewHasher for the supported names. Defaults to SHA-256.
+	ManifestHashAlgorithm string
+	// Deadline, if set, returns the time by which the whole run must finish, e.g.
+	// a CI job's timeout. Remote cache operations fail fast with
+	// ErrRunBudgetExhausted once the deadline is nearly reached, rather than risk
+	// running past it. Ping is additionally bounded by the deadline.
+	Deadline func() time.Time
+	// MissStatusCodes lists the HTTP statuses with which the remote cache reports
+	// that an artifact isn't present. Any other non-200 status is an error.
+	// Defaults to [404]. Statuses the client itself turns into errors, such as
+	// 403 from the Vercel API client, can't be treated as misses.
+	MissStatusCodes []int
+	// PreUploadHook, if set, is called by Put with the complete artifact (the
+	// compressed tar, exactly as it will be uploaded) before it is sent to the
+	// remote cache, e.g. to scan outputs for secrets. Returning an error aborts
+	// the upload. The hook receives a copy, so changes to it are not uploaded.
+	// It depends on the artifact being buffered in memory before upload, so it
+	// can't be supported by a streaming upload path.
+	PreUploadHook func(tarBytes []byte) error
+	// DeniedPatterns are doublestar globs for files that must never be
+	// uploaded to the remote cache, e.g. "**/.env" or "**/*.pem". They are
+	// matched against each file's path relative to the anchor, with forward
+	// slashes; patterns without "**/" only match at the top level. Put fails
+	// with ErrDeniedContent, naming the first offending file, before anything
+	// is uploaded. Unlike PreUploadHook, it's declarative and works with every
+	// upload path. If a pattern is malformed, the remote cache is made
+	// read-only.
+	DeniedPatterns []string
+	// AllowedPatterns, if set, are the only files that may be uploaded to the
+	// remote cache: Put fails with ErrDeniedContent if any other file would be
+	// included. They are matched like DeniedPatterns, which take precedence.
+	// Directories are exempt, since they're only included to recreate the
+	// tree around allowed files.
+	AllowedPatterns []string
+	// SpillToDisk buffers artifacts larger than a few tens of megabytes in a
+	// temporary file rather than in memory while they are signed and uploaded,
+	// so memory-constrained machines can handle large signed artifacts. It only
+	// takes effect with clients that can upload from a file, and not while a
+	// PreUploadHook is set, since the hook needs the whole artifact in memory.
+	SpillToDisk bool
+	// RemoteReadOnlyReason, if set, makes the remote cache read-only: artifacts
+	// are still fetched, but never uploaded. It says why, e.g. "PR build" or
+	// "read-only token", and is reported by the remote cache's Writable method.
+	RemoteReadOnlyReason string
+	// SeekableCompression uploads artifacts in the seekable zstd format, so that
+	// parts of an artifact can be read without decompressing all of it. See
+	// cacheitem.CreateOpts.SeekableCompression; artifacts are a few percent
+	// larger. Artifacts remain readable by turbo versions without support.
+	SeekableCompression bool
+	// SolidCompression packs the small files of uploaded artifacts into solid
+	// blocks, see cacheitem.CreateOpts.SolidCompression. This can shrink
+	// artifacts made of thousands of tiny files, like node_modules,
+	// dramatically, but reading selected files out of an artifact gets less
+	// efficient, and turbo versions without support can't restore them.
+	SolidCompression bool
+	// ParallelDownloadChunks, if greater than 1, downloads large artifacts from
+	// the remote cache as up to this many byte ranges fetched in parallel, which
+	// can make better use of high-latency, high-bandwidth links than a single
+	// stream. It only takes effect with clients that can request ranges, and
+	// falls back to a single request for backends that don't honor them. The
+	// artifact is reassembled in memory before it is verified and restored, so
+	// signed artifacts are checked exactly as with a single request, but
+	// artifacts aren't restored as they stream in.
+	ParallelDownloadChunks int
+	// HedgeDelay, if positive, cuts tail latency for remote cache reads: a
+	// fetch or existence check that hasn't received a response within this
+	// long is sent again in parallel, and whichever response arrives first is
+	// used. Set it to around the backend's 95th or 99th percentile response
+	// time, so that only the slowest requests are duplicated. Uploads are
+	// never hedged, and nor are downloads in parallel chunks.
+	HedgeDelay time.Duration
+	// RemoteCacheReplicas lists the base URLs of read replicas of the remote
+	// cache, e.g. "https://cache-eu.example.com". Artifacts are fetched from
+	// the primary as usual, but one that fails signature verification is
+	// fetched again from each replica in turn, in case only one copy is
+	// corrupt. Uploads only go to the primary. It only takes effect with
+	// clients that support replicas.
+	RemoteCacheReplicas []string
+	// MaxCacheMemoryBytes, if positive, bounds the total size of artifacts
+	// held in memory by concurrent downloads, e.g. while signed artifacts are
+	// verified before they're restored. A download waits until its declared
+	// Content-Length fits in the budget before buffering it; one larger than
+	// the whole budget waits to run alone. Artifacts restored as they stream
+	// in hold no buffer and aren't counted, and nor are uploads, whose size
+	// isn't known until they're built; see SpillToDisk for those.
+	MaxCacheMemoryBytes int64
+	// DeltaUploads is an experimental option that lets PutWithBase upload an
+	// artifact as a delta against an earlier artifact the remote cache already
+	// has, which the backend applies to reconstruct the full artifact. It only
+	// takes effect with clients and backends that support deltas; otherwise
+	// artifacts are uploaded in full. Pairs well with SeekableCompression.
+	DeltaUploads bool
+	// Provenance, if set, describes the build producing artifacts, and Put
+	// attaches a signed SLSA provenance attestation to every artifact it
+	// uploads, stored as a sidecar under the artifact's hash plus
+	// "-provenance". It is signed with the key in
+	// TURBO_REMOTE_CACHE_PROVENANCE_KEY, or the artifact signing key if that
+	// isn't set. If neither key is set, or BuilderID is empty, the remote
+	// cache is read-only rather than uploading artifacts without attestations.
+	Provenance *Provenance
+	// VerifyProvenance makes GetMetadata look up each artifact's provenance
+	// attestation, and verify it with the same key Provenance signs with.
+	VerifyProvenance bool
+	// TempDir is where the cache stages temporary files: restores are
+	// extracted here before being moved into place, and artifacts are
+	// spilled here with SpillToDisk. Relative paths are resolved against the
+	// repo root. It defaults to a directory inside the repo root rather than
+	// the system temp directory, so that staged files are on the same
+	// filesystem as the repo and can be moved into place with a rename
+	// instead of a copy.
+	TempDir string
+	// DialContext, if set, is used by the remote cache client to open
+	// connections instead of the standard dialer, e.g. to resolve the cache host
+	// with a custom resolver in split-horizon DNS setups, or to connect through a
+	// service mesh sidecar.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+	// ArtifactPathPrefix, if set, is prepended to the hash in the key the
+	// remote cache stores each artifact under, e.g. "team-a/ci/", so teams or
+	// pipelines sharing a backend get separate storage. Unlike HashNamespace it
+	// only affects the backend's storage layout, not cache keys: hashes passed
+	// to OnCacheEvent and signatures are unchanged. It applies within the
+	// team's artifacts, so team-scoped keys become team plus prefix plus hash.
+	// Reads and writes only hit each other with the same prefix. If the
+	// client can't apply it, the remote cache is made read-only.
+	ArtifactPathPrefix string
+	// ShardKeys stores each artifact under a shard derived from a hash of
+	// its key, after ArtifactPathPrefix, so that backends which partition
+	// storage by key prefix don't get hot shards when task hashes cluster.
+	// Like ArtifactPathPrefix it only affects the storage layout. Reads and
+	// writes must agree: turning it on or off, or changing how shards are
+	// derived, means existing artifacts are no longer found. If the client
+	// can't apply it, the remote cache is made read-only.
+	ShardKeys bool
+	// ContentAddressed stores artifacts in the remote cache under the sha256
+	// of their contents rather than the task hash, for backends fronting a
+	// shared content-addressable store, so identical artifacts from
+	// different tasks are stored once. Each upload also stores a small signed
+	// index entry mapping the task hash to the digest, and each fetch or
+	// existence check reads that index first, which costs an extra round
+	// trip per artifact. Reads and writes must agree on it.
+	ContentAddressed bool
+	// MaxIdleConns caps the idle connections the remote cache client keeps open
+	// across all hosts. Defaults to 100.
+	MaxIdleConns int
+	// MaxIdleConnsPerHost caps the idle connections kept open to each host.
+	// Defaults to the number of concurrent remote cache requests, so that a
+	// single-host backend can reuse a warm connection for every request rather
+	// than paying for new TCP and TLS handshakes.
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout is how long an idle connection is kept open. Defaults to
+	// 90 seconds.
+	IdleConnTimeout time.Duration
+	// PipelineRequests multiplexes concurrent remote cache requests over a
+	// single HTTP/2 connection, if the backend supports it, instead of
+	// opening a connection for each of a burst of requests, which saves
+	// connection setup when fetching many small artifacts. The first request
+	// of the run is made on its own to establish the connection. Concurrency
+	// is still bounded as usual; a backend's limit on streams per connection
+	// just opens another connection.
+	PipelineRequests bool
+	// SignatureScope controls what artifact signatures cover when signing is
+	// enabled. Defaults to SignatureScopeBody.
+	SignatureScope SignatureScope
+	// SignatureFreshness, if set, timestamps artifact signatures and rejects
+	// downloaded artifacts signed longer ago than this, limiting how long an
+	// old but validly signed artifact can be replayed. The signing time is sent
+	// as x-artifact-signed-at and covered by the signature, so the backend must
+	// store and return that header. Artifacts signed without a timestamp are
+	// rejected while it is set.
+	SignatureFreshness time.Duration
+	// DebugCaptureHeaders keeps the headers of remote cache responses to
+	// fetches and existence checks, so they can be inspected with the remote
+	// cache's LastResponseHeaders when diagnosing backend issues. It is off by
+	// default since it holds on to the headers of every artifact checked.
+	DebugCaptureHeaders bool
+	// Logger receives warnings about unexpected cache behavior. Defaults to a null logger.
+	Logger hclog.Logger
+}
+
+// logger returns the configured logger, or a null logger if there isn't one.
+func (o *Opts) logger() hclog.Logger {
+	if o.Logger == nil {
+		return hclog.NewNullLogger()
+	}
+	return o.Logger
 }
 
 // resolveCacheDir calculates the location turbo should use to cache artifacts,
@@ -86,16 +717,106 @@ func (o *Opts) resolveCacheDir(repoRoot turbopath.AbsoluteSystemPath) turbopath.
 	return DefaultLocation(repoRoot)
 }
 
+// Connection pool defaults; see Opts.MaxIdleConns and Opts.IdleConnTimeout.
+const (
+	_defaultMaxIdleConns    = 100
+	_defaultIdleConnTimeout = 90 * time.Second
+)
+
+// resolveConnPool returns the connection pool settings for the remote cache
+// client, replacing unset or invalid values with defaults.
+func (o *Opts) resolveConnPool() (int, int, time.Duration) {
+	maxIdleConns, maxIdleConnsPerHost, idleConnTimeout := o.MaxIdleConns, o.MaxIdleConnsPerHost, o.IdleConnTimeout
+	if maxIdleConns < 0 || maxIdleConnsPerHost < 0 || idleConnTimeout < 0 {
+		o.logger().Warn("ignoring negative remote cache connection pool settings", "maxIdleConns", maxIdleConns, "maxIdleConnsPerHost", maxIdleConnsPerHost, "idleConnTimeout", idleConnTimeout)
+	}
+	if maxIdleConnsPerHost <= 0 {
+		maxIdleConnsPerHost = _maxConcurrentRequests
+	}
+	if maxIdleConns <= 0 {
+		maxIdleConns = _defaultMaxIdleConns
+	}
+	if maxIdleConns < maxIdleConnsPerHost {
+		// The total cap would quietly undercut the per-host one.
+		maxIdleConns = maxIdleConnsPerHost
+	}
+	if idleConnTimeout <= 0 {
+		idleConnTimeout = _defaultIdleConnTimeout
+	}
+	return maxIdleConns, maxIdleConnsPerHost, idleConnTimeout
+}
+
+// DefaultMaxFilesPerArtifact is the default for Opts.MaxFilesPerArtifact. It is
+// far beyond what real task outputs contain.
+const DefaultMaxFilesPerArtifact = 1 << 20
+
+// resolveMaxFiles returns the cacheitem.CacheItem.MaxFiles to restore with.
+func (o *Opts) resolveMaxFiles() int {
+	if o.MaxFilesPerArtifact == 0 {
+		return DefaultMaxFilesPerArtifact
+	}
+	if o.MaxFilesPerArtifact < 0 {
+		return 0
+	}
+	return o.MaxFilesPerArtifact
+}
+
+// mirrorOpts are the options for the Opts.LocalMirrorDir cache. Artifacts
+// are restored from the mirror as they would be from the local cache; its
+// events are reported as the remote cache's.
+func (o *Opts) mirrorOpts() Opts {
+	return Opts{
+		OverrideDir:         o.LocalMirrorDir,
+		Logger:              o.Logger,
+		TempDir:             o.TempDir,
+		PreserveXattrs:      o.PreserveXattrs,
+		RestoreMode:         o.RestoreMode,
+		ResumableRestore:    o.ResumableRestore,
+		MaxFilesPerArtifact: o.MaxFilesPerArtifact,
+		MaxDecompressedSize: o.MaxDecompressedSize,
+		MaxCompressionRatio: o.MaxCompressionRatio,
+		FsyncAfterRestore:   o.FsyncAfterRestore,
+		VerifyRestoreCount:  o.VerifyRestoreCount,
+		RestoreUmask:        o.RestoreUmask,
+	}
+}
+
+// resolveTempDir calculates the location turbo should use for temporary files,
+// based on the options supplied by the user.
+func (o *Opts) resolveTempDir(repoRoot turbopath.AbsoluteSystemPath) turbopath.AbsoluteSystemPath {
+	if o.TempDir != "" {
+		return fs.ResolveUnknownPath(repoRoot, o.TempDir)
+	}
+	return DefaultLocation(repoRoot).UntypedJoin("tmp")
+}
+
 var _remoteOnlyHelp = `Ignore the local filesystem cache for all tasks. Only
 allow reading and caching artifacts using the remote cache.`
 
-// New creates a new cache
+// New creates a new cache. The cache also implements RemoteOperations.
 func New(opts Opts, repoRoot turbopath.AbsoluteSystemPath, client client, recorder analytics.Recorder, onCacheRemoved OnCacheRemoved) (Cache, error) {
+	if err := validateNamespace(opts.HashNamespace); err != nil {
+		return nil, err
+	}
 	c, err := newSyncCache(opts, repoRoot, client, recorder, onCacheRemoved)
 	if err != nil && !errors.Is(err, ErrNoCachesEnabled) {
 		return nil, err
 	}
-	if opts.Workers > 0 {
+	if opts.HashNamespace != "" {
+		c = newNamespacedCache(c, opts.HashNamespace)
+	}
+	if opts.OutputsSatisfied != nil {
+		c = newSatisfiedCache(c, opts.OutputsSatisfied)
+	}
+	if opts.CacheJournalPath != "" {
+		journalPath := fs.ResolveUnknownPath(repoRoot, opts.CacheJournalPath)
+		if journaled, journalErr := newJournaledCache(c, journalPath, opts.logger()); journalErr != nil {
+			opts.logger().Warn("failed to open cache journal", "path", journalPath, "error", journalErr)
+		} else {
+			c = journaled
+		}
+	}
+	if opts.Workers > 0 || opts.AsyncUploads {
 		return newAsyncCache(c, opts), err
 	}
 	return c, err
@@ -116,20 +837,30 @@ func newSyncCache(opts Opts, repoRoot turbopath.AbsoluteSystemPath, client clien
 	//
 	// This is reduced from (!useFsCache && !useHTTPCache) || (!useFsCache & useHTTPCache)
 	useNoopCache := !useFsCache
+	recorder = newSampledRecorder(recorder, opts.AnalyticsSampleRate)
 
 	// Build up an array of cache implementations, we can only ever have 1 or 2.
 	cacheImplementations := make([]Cache, 0, 2)
 
+	// Restores are throttled across both caches, independently of how many
+	// remote requests are in flight.
+	var restoreLimiter limiter
+	if opts.MaxConcurrentRestores > 0 {
+		restoreLimiter = make(limiter, opts.MaxConcurrentRestores)
+	}
+
 	if useFsCache {
 		implementation, err := newFsCache(opts, recorder, repoRoot)
 		if err != nil {
 			return nil, err
 		}
+		implementation.restoreLimiter = restoreLimiter
 		cacheImplementations = append(cacheImplementations, implementation)
 	}
 
 	if useHTTPCache {
 		implementation := newHTTPCache(opts, client, recorder, repoRoot)
+		implementation.setRestoreLimiter(restoreLimiter)
 		cacheImplementations = append(cacheImplementations, implementation)
 	}
 
@@ -162,6 +893,64 @@ func newSyncCache(opts Opts, repoRoot turbopath.AbsoluteSystemPath, client clien
 	return implementation, nil
 }
 
+// recordEvent logs an event to the analytics recorder. Embedders that don't
+// wire up analytics may pass a nil recorder, in which case this is a no-op.
+func recordEvent(recorder analytics.Recorder, payload *CacheEvent) {
+	if recorder != nil {
+		recorder.LogEvent(payload)
+	}
+}
+
+// sampledRecorder is an analytics.Recorder that passes on a random sample of
+// events; see Opts.AnalyticsSampleRate.
+type sampledRecorder struct {
+	recorder analytics.Recorder
+	rate     float64
+}
+
+// _sampleFloat returns a random number in [0, 1) to sample events with.
+var _sampleFloat = rand.Float64
+
+// newSampledRecorder returns a recorder passing on the given fraction of the
+// events logged to recorder. Rates outside (0, 1) keep every event, and a nil
+// recorder stays nil.
+func newSampledRecorder(recorder analytics.Recorder, rate float64) analytics.Recorder {
+	if recorder == nil || rate <= 0 || rate >= 1 {
+		return recorder
+	}
+	return &sampledRecorder{recorder: recorder, rate: rate}
+}
+
+func (sr *sampledRecorder) LogEvent(payload analytics.EventPayload) {
+	if _sampleFloat() >= sr.rate {
+		return
+	}
+	if event, ok := payload.(*CacheEvent); ok {
+		sampled := *event
+		sampled.SampleRate = sr.rate
+		payload = &sampled
+	}
+	sr.recorder.LogEvent(payload)
+}
+
+// divergenceWarner returns a callback for cacheitem.CacheItem.OnDivergentOverwrite
+// that logs each overwritten file, or nil if warnings are disabled.
+func divergenceWarner(enabled bool, logger hclog.Logger) func(path turbopath.AnchoredSystemPath) {
+	if !enabled {
+		return nil
+	}
+	return func(path turbopath.AnchoredSystemPath) {
+		logger.Warn("cache restore overwrote a file with different contents", "path", path.ToString())
+	}
+}
+
+// emitCacheEvent invokes the user-supplied callback, if there is one.
+func emitCacheEvent(onCacheEvent OnCacheEvent, event CacheEvent) {
+	if onCacheEvent != nil {
+		onCacheEvent(event)
+	}
+}
+
 // A cacheMultiplexer multiplexes several caches into one.
 // Used when we have several active (eg. http, dir).
 type cacheMultiplexer struct {
@@ -175,6 +964,59 @@ func (mplex *cacheMultiplexer) Put(anchor turbopath.AbsoluteSystemPath, key stri
 	return mplex.storeUntil(anchor, key, duration, files, len(mplex.caches))
 }
 
+// PutImmutable stores the artifact in every cache, pinning it in the remote
+// cache.
+func (mplex *cacheMultiplexer) PutImmutable(anchor turbopath.AbsoluteSystemPath, key string, duration int, files []turbopath.AnchoredSystemPath) error {
+	return mplex.storeWith(len(mplex.caches), func(c Cache) error {
+		return remoteOperations(c).PutImmutable(anchor, key, duration, files)
+	})
+}
+
+// remote runs op against the first cache that has a remote cache behind it.
+func (mplex *cacheMultiplexer) remote(op func(ops RemoteOperations) error) error {
+	mplex.mu.RLock()
+	caches := make([]Cache, len(mplex.caches))
+	copy(caches, mplex.caches)
+	mplex.mu.RUnlock()
+
+	for _, cache := range caches {
+		if err := op(remoteOperations(cache)); !errors.Is(err, ErrNoRemoteCache) {
+			return err
+		}
+	}
+	return ErrNoRemoteCache
+}
+
+func (mplex *cacheMultiplexer) VerifyManifest(expected map[string]string) ([]ManifestDiscrepancy, error) {
+	var discrepancies []ManifestDiscrepancy
+	err := mplex.remote(func(ops RemoteOperations) error {
+		var err error
+		discrepancies, err = ops.VerifyManifest(expected)
+		return err
+	})
+	return discrepancies, err
+}
+
+func (mplex *cacheMultiplexer) EstimateRestoreSize(key string) (int64, error) {
+	var size int64
+	err := mplex.remote(func(ops RemoteOperations) error {
+		var err error
+		size, err = ops.EstimateRestoreSize(key)
+		return err
+	})
+	return size, err
+}
+
+func (mplex *cacheMultiplexer) Capabilities() (BackendCapabilities, error) {
+	var caps BackendCapabilities
+	err := mplex.remote(func(ops RemoteOperations) error {
+		var err error
+		caps, err = ops.Capabilities()
+		return err
+	})
+	return caps, err
+}
+
 type cacheRemoval struct {
 	cache Cache
 	err   *util.CacheDisabledError
@@ -184,6 +1026,14 @@ type cacheRemoval struct {
 // Used after artifact retrieval to ensure we have them in eg. the directory cache after
 // downloading from the RPC cache.
 func (mplex *cacheMultiplexer) storeUntil(anchor turbopath.AbsoluteSystemPath, key string, duration int, files []turbopath.AnchoredSystemPath, stopAt int) error {
+	return mplex.storeWith(stopAt, func(c Cache) error {
+		return c.Put(anchor, key, duration, files)
+	})
+}
+
+// storeWith stores an artifact into the caches before stopAt with put,
+// removing any cache that turns out to be disabled.
+func (mplex *cacheMultiplexer) storeWith(stopAt int, put func(c Cache) error) error {
 	// Attempt to store on all caches simultaneously.
 	toRemove := make([]*cacheRemoval, stopAt)
 	g := &errgroup.Group{}
@@ -195,7 +1045,7 @@ func (mplex *cacheMultiplexer) storeUntil(anchor turbopath.AbsoluteSystemPath, k
 		c := cache
 		i := i
 		g.Go(func() error {
-			err := c.Put(anchor, key, duration, files)
+			err := put(c)
 			if err != nil {
 				cd := &util.CacheDisabledError{}
 				if errors.As(err, &cd) {
@@ -251,12 +1101,25 @@ func (mplex *cacheMultiplexer) Fetch(anchor turbopath.AbsoluteSystemPath, key st
 	// Initialize the empty struct so we can assign values to it. This is similar
 	// to how the Exists() method works.
 	combinedCacheState := ItemStatus{}
+	missReason := MissReasonNone
+	// A lookup only counts as skipped if every cache skipped it.
+	skipReason := SkipReasonNone
+	consulted := false
+	var verificationErr error
 
 	// Retrieve from caches sequentially; if we did them simultaneously we could
 	// easily write the same file from two goroutines at once.
 	for i, cache := range caches {
 		itemStatus, actualFiles, duration, err := cache.Fetch(anchor, key, files)
 		ok := itemStatus.Local || itemStatus.Remote
+		if itemStatus.MissReason != MissReasonNone {
+			missReason = itemStatus.MissReason
+		}
+		if itemStatus.SkipReason == SkipReasonNone {
+			consulted = true
+		} else if skipReason == SkipReasonNone {
+			skipReason = itemStatus.SkipReason
+		}
 
 		if err != nil {
 			cd := &util.CacheDisabledError{}
@@ -265,6 +1128,11 @@ func (mplex *cacheMultiplexer) Fetch(anchor turbopath.AbsoluteSystemPath, key st
 					cache: cache,
 					err:   cd,
 				})
+			} else if errors.Is(err, ErrVerificationFailed) {
+				// Unless Opts.VerificationFailureAsMiss says otherwise, an
+				// artifact that fails verification fails the fetch if no other
+				// cache has it.
+				verificationErr = err
 			}
 			// We're ignoring the error in the else case, since with this cache
 			// abstraction, we want to check lower priority caches rather than fail
@@ -280,19 +1148,52 @@ func (mplex *cacheMultiplexer) Fetch(anchor turbopath.AbsoluteSystemPath, key st
 			// If another cache had already set this to true, we don't need to set it again from this cache
 			combinedCacheState.Local = combinedCacheState.Local || itemStatus.Local
 			combinedCacheState.Remote = combinedCacheState.Remote || itemStatus.Remote
+			combinedCacheState.Source = itemStatus.Source
 			return combinedCacheState, actualFiles, duration, err
 		}
 	}
 
-	return ItemStatus{Local: false, Remote: false}, nil, 0, nil
+	if consulted {
+		skipReason = SkipReasonNone
+	}
+	return ItemStatus{Local: false, Remote: false, MissReason: missReason, SkipReason: skipReason}, nil, 0, verificationErr
+}
+
+// Ping checks every cache that supports it, returning the first failure.
+func (mplex *cacheMultiplexer) Ping(ctx context.Context) error {
+	mplex.mu.RLock()
+	caches := make([]Cache, len(mplex.caches))
+	copy(caches, mplex.caches)
+	mplex.mu.RUnlock()
+
+	for _, cache := range caches {
+		if pinger, ok := cache.(Pinger); ok {
+			if err := pinger.Ping(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 func (mplex *cacheMultiplexer) Exists(target string) ItemStatus {
 	syncCacheState := ItemStatus{}
+	consulted := false
 	for _, cache := range mplex.caches {
 		itemStatus := cache.Exists(target)
 		syncCacheState.Local = syncCacheState.Local || itemStatus.Local
 		syncCacheState.Remote = syncCacheState.Remote || itemStatus.Remote
+		if syncCacheState.Source == ItemSourceNone {
+			syncCacheState.Source = itemStatus.Source
+		}
+		if itemStatus.SkipReason == SkipReasonNone {
+			consulted = true
+		} else if syncCacheState.SkipReason == SkipReasonNone {
+			syncCacheState.SkipReason = itemStatus.SkipReason
+		}
+	}
+	if consulted || syncCacheState.Local || syncCacheState.Remote {
+		syncCacheState.SkipReason = SkipReasonNone
 	}
 
 	return syncCacheState
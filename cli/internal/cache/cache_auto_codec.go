@@ -0,0 +1,114 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/DataDog/zstd"
+	"github.com/vercel/turbo/cli/internal/turbopath"
+)
+
+// autoCodecCandidate is a zstd level Opts.AutoCodec can choose, with a rough
+// single-threaded compression speed, in bytes per second, to weigh it by.
+// Speeds are fixed rather than measured so that the same files always get
+// the same level, and so byte-identical artifacts.
+type autoCodecCandidate struct {
+	level int
+	speed float64
+}
+
+// _autoCodecCandidates are the levels tried by Opts.AutoCodec, fastest first.
+var _autoCodecCandidates = []autoCodecCandidate{
+	{level: 1, speed: 400 << 20},
+	{level: 3, speed: 250 << 20},
+	{level: 9, speed: 60 << 20},
+	{level: 15, speed: 12 << 20},
+}
+
+const (
+	// _autoCodecSampleSize is how many bytes of input Opts.AutoCodec samples.
+	_autoCodecSampleSize = 512 << 10
+	// _autoCodecChunkSize is how many bytes are sampled from the start of
+	// each file, so that the sample spans many files.
+	_autoCodecChunkSize = 32 << 10
+	// _autoCodecBandwidth is the upload speed, in bytes per second, assumed
+	// when weighing a smaller artifact against the time to compress it.
+	_autoCodecBandwidth = 10 << 20
+	// _autoCodecIncompressible is the compression ratio at the fastest level
+	// above which the input is treated as already compressed.
+	_autoCodecIncompressible = 0.95
+)
+
+// codecName names the codec used at a zstd level, for CacheEvent.Codec.
+func codecName(level int) string {
+	return fmt.Sprintf("zstd-%v", level)
+}
+
+// chooseLevel picks the compression level for files; see Opts.AutoCodec.
+// fallback is used if there's nothing to sample.
+func (cache *httpCache) chooseLevel(anchor turbopath.AbsoluteSystemPath, files []turbopath.AnchoredSystemPath, fallback int) int {
+	sample, inputSize := sampleFiles(anchor, files)
+	if len(sample) == 0 {
+		return fallback
+	}
+	best, bestCost := fallback, -1.0
+	for _, candidate := range _autoCodecCandidates {
+		compressTime := float64(inputSize) / candidate.speed
+		if bestCost >= 0 && compressTime >= bestCost {
+			// Slower levels can only cost more.
+			break
+		}
+		compressed, err := zstd.CompressLevel(nil, sample, candidate.level)
+		if err != nil {
+			break
+		}
+		ratio := float64(len(compressed)) / float64(len(sample))
+		cost := compressTime + float64(inputSize)*ratio/_autoCodecBandwidth
+		if bestCost < 0 || cost < bestCost {
+			best, bestCost = candidate.level, cost
+		}
+		if candidate.level == _autoCodecCandidates[0].level && ratio > _autoCodecIncompressible {
+			break
+		}
+	}
+	return best
+}
+
+// sampleFiles reads up to _autoCodecSampleSize bytes from the start of the
+// regular files among files, in a stable order, and returns them along with
+// the total size of those files.
+func sampleFiles(anchor turbopath.AbsoluteSystemPath, files []turbopath.AnchoredSystemPath) ([]byte, int64) {
+	sortedFiles := make([]turbopath.AnchoredSystemPath, len(files))
+	copy(sortedFiles, files)
+	sort.Slice(sortedFiles, func(i, j int) bool {
+		return sortedFiles[i].ToUnixPath() < sortedFiles[j].ToUnixPath()
+	})
+
+	var sample []byte
+	var inputSize int64
+	for _, file := range sortedFiles {
+		path := file.RestoreAnchor(anchor)
+		info, err := path.Lstat()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		inputSize += info.Size()
+		chunk := _autoCodecSampleSize - len(sample)
+		if chunk > _autoCodecChunkSize {
+			chunk = _autoCodecChunkSize
+		}
+		if chunk == 0 {
+			continue
+		}
+		f, err := path.Open()
+		if err != nil {
+			continue
+		}
+		buf := make([]byte, chunk)
+		n, _ := io.ReadFull(f, buf)
+		_ = f.Close()
+		sample = append(sample, buf[:n]...)
+	}
+	return sample, inputSize
+}
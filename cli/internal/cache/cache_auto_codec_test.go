@@ -0,0 +1,55 @@
+package cache
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/vercel/turbo/cli/internal/fs"
+	"github.com/vercel/turbo/cli/internal/turbopath"
+	"gotest.tools/v3/assert"
+)
+
+func TestAutoCodec(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	media := make([]byte, 256<<10)
+	rand.New(rand.NewSource(1)).Read(media)
+	_ = root.Join("media.bin").WriteFile(media, 0644)
+	_ = root.Join("dir").MkdirAll(0755)
+
+	var events []CacheEvent
+	cache := newHTTPCache(Opts{
+		AutoCodec:        true,
+		CompressionLevel: 19,
+		OnCacheEvent:     func(event CacheEvent) { events = append(events, event) },
+	}, &artifactResp{}, &nullRecorder{}, root)
+
+	// Already-compressed input gets the fastest level.
+	files := turbopath.AnchoredUnixPathArray{"media.bin"}.ToSystemPathArray()
+	assert.Equal(t, cache.chooseLevel(root, files, 19), 1)
+	assert.NilError(t, cache.Put(root, "the-hash", 0, files), "Put")
+	assert.Equal(t, len(events), 1)
+	assert.Equal(t, events[0].Event, CacheEventUpload)
+	assert.Equal(t, events[0].Codec, "zstd-1")
+
+	// Compressible input gets one of the candidates, the same every time.
+	text := bytes.Repeat([]byte("export const answer = 42;\n"), 20000)
+	_ = root.Join("dir", "index.js").WriteFile(text, 0644)
+	files = turbopath.AnchoredUnixPathArray{"dir", "dir/index.js"}.ToSystemPathArray()
+	level := cache.chooseLevel(root, files, 19)
+	assert.Assert(t, level != 19, "level %v isn't a candidate", level)
+	assert.Equal(t, cache.chooseLevel(root, files, 19), level)
+
+	// With nothing to sample, the configured level is kept.
+	files = turbopath.AnchoredUnixPathArray{"dir"}.ToSystemPathArray()
+	assert.Equal(t, cache.chooseLevel(root, files, 19), 19)
+
+	// Without AutoCodec, no codec is reported.
+	events = nil
+	cache = newHTTPCache(Opts{
+		OnCacheEvent: func(event CacheEvent) { events = append(events, event) },
+	}, &artifactResp{}, &nullRecorder{}, root)
+	assert.NilError(t, cache.Put(root, "the-hash", 0, files), "Put")
+	assert.Equal(t, len(events), 1)
+	assert.Equal(t, events[0].Codec, "")
+}
@@ -0,0 +1,70 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/vercel/turbo/cli/internal/turbopath"
+)
+
+// _benchmarkLevels are the zstd levels tried by BenchmarkCompression.
+var _benchmarkLevels = []int{1, 3, 6, 9, 12, 15, 19}
+
+// CompressionResult is the outcome of packing an artifact at one compression level.
+type CompressionResult struct {
+	Level    int
+	Size     int64
+	Duration time.Duration
+}
+
+// countingWriter discards what is written to it, counting the bytes.
+type countingWriter struct {
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.n += int64(len(p))
+	return len(p), nil
+}
+
+func (cw *countingWriter) Close() error {
+	return nil
+}
+
+// BenchmarkCompression packs files, relative to anchor, into an artifact at a
+// range of zstd levels and reports the size and time taken for each, to help
+// choose Opts.CompressionLevel. Nothing is uploaded. Compression is single
+// threaded, so durations are comparable across machines with different numbers
+// of CPUs.
+func BenchmarkCompression(files []turbopath.AnchoredSystemPath, anchor turbopath.AbsoluteSystemPath) ([]CompressionResult, error) {
+	results := make([]CompressionResult, 0, len(_benchmarkLevels))
+	for _, level := range _benchmarkLevels {
+		cache := &httpCache{compressionThreads: 1, compressionLevel: level}
+		counter := &countingWriter{}
+		cacheErrorChan := make(chan error, 1)
+
+		start := time.Now()
+		cache.write(counter, anchor, files, nil, cacheErrorChan)
+		if err := <-cacheErrorChan; err != nil {
+			return nil, fmt.Errorf("failed to pack artifact at level %v: %w", level, err)
+		}
+		results = append(results, CompressionResult{
+			Level:    level,
+			Size:     counter.n,
+			Duration: time.Since(start),
+		})
+	}
+	return results, nil
+}
+
+// WriteCompressionResults writes results to w as a table.
+func WriteCompressionResults(w io.Writer, results []CompressionResult) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
+	fmt.Fprintln(tw, "Level\tSize\tTime\t")
+	for _, result := range results {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t\n", result.Level, result.Size, result.Duration.Round(time.Millisecond))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,35 @@
+package cache
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/vercel/turbo/cli/internal/fs"
+	"github.com/vercel/turbo/cli/internal/turbopath"
+	"gotest.tools/v3/assert"
+)
+
+func TestBenchmarkCompression(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	_ = root.Join("a").WriteFile(bytes.Repeat([]byte("compressible "), 1000), 0644)
+	files := turbopath.AnchoredUnixPathArray{"a"}.ToSystemPathArray()
+
+	results, err := BenchmarkCompression(files, root)
+	assert.NilError(t, err, "BenchmarkCompression")
+	assert.Equal(t, len(results), len(_benchmarkLevels))
+	for i, result := range results {
+		assert.Equal(t, result.Level, _benchmarkLevels[i])
+		assert.Assert(t, result.Size > 0)
+		assert.Assert(t, result.Size < 13000, "level %v didn't compress", result.Level)
+	}
+
+	var table bytes.Buffer
+	assert.NilError(t, WriteCompressionResults(&table, results), "WriteCompressionResults")
+	lines := strings.Split(strings.TrimSpace(table.String()), "\n")
+	assert.Equal(t, len(lines), len(results)+1)
+	assert.Assert(t, strings.HasPrefix(lines[0], "Level"))
+
+	_, err = BenchmarkCompression(turbopath.AnchoredUnixPathArray{"missing"}.ToSystemPathArray(), root)
+	assert.ErrorContains(t, err, "level 1")
+}
@@ -0,0 +1,116 @@
+package cache
+
+// Names with which a backend advertises each optional feature in its
+// capability discovery response; see httpCache.Capabilities.
+const (
+	_capabilityRanges      = "ranges"
+	_capabilityConditional = "conditional"
+	_capabilityDeltas      = "deltas"
+	_capabilityImmutable   = "immutable"
+	_capabilityAliases     = "aliases"
+	_capabilityReports     = "reports"
+)
+
+// BackendCapabilities describes which optional features the remote cache
+// supports, so that they can be used only where they'll work.
+type BackendCapabilities struct {
+	// Discovered is true if the backend described its own capabilities.
+	// Otherwise, each feature is assumed to be supported if the client can
+	// use it, and backends that refuse are handled as they are refused.
+	Discovered bool
+	// RangeRequests is true if artifacts can be downloaded in byte ranges;
+	// see Opts.ParallelDownloadChunks.
+	RangeRequests bool
+	// ConditionalRequests is true if downloads can be revalidated with an
+	// ETag; see Opts.LocalMirrorDir.
+	ConditionalRequests bool
+	// Deltas is true if artifacts can be uploaded as deltas; see
+	// httpCache.PutWithBase.
+	Deltas bool
+	// Immutable is true if artifacts can be pinned; see httpCache.PutImmutable.
+	Immutable bool
+	// Aliases is true if a hash can point at another hash's artifact; see
+	// httpCache.PutWithAliases.
+	Aliases bool
+	// BadArtifactReports is true if artifacts failing verification can be
+	// reported; see Opts.QuarantineBadArtifacts.
+	BadArtifactReports bool
+}
+
+// capabilityDiscoverer is implemented by clients that can ask the backend
+// which optional features it supports. ok is false if the backend doesn't
+// say.
+type capabilityDiscoverer interface {
+	FetchCapabilities() (capabilities []string, ok bool, err error)
+}
+
+// Capabilities reports which optional features the remote cache supports.
+// Backends describe themselves through a discovery endpoint; the Vercel API
+// client asks GET /v8/artifacts/capabilities, which responds with
+// {"capabilities": [...]} naming any of "ranges", "conditional", "deltas",
+// "immutable", "aliases" and "reports". If the backend has no
+// discovery endpoint, or it can't be reached, features are assumed to be
+// supported if the client can use them, and the error, if any, is returned
+// along with those capabilities. The backend is only asked once per process,
+// and not until Capabilities is called or a configured feature needs to know.
+func (cache *httpCache) Capabilities() (BackendCapabilities, error) {
+	cache.capsOnce.Do(func() {
+		cache.caps, cache.capsErr = cache.discoverCapabilities()
+	})
+	return cache.caps, cache.capsErr
+}
+
+// capabilities is Capabilities, for features deciding whether to try
+// themselves, which fall back to what the client can do on errors.
+func (cache *httpCache) capabilities() BackendCapabilities {
+	caps, _ := cache.Capabilities()
+	return caps
+}
+
+func (cache *httpCache) discoverCapabilities() (BackendCapabilities, error) {
+	caps := cache.clientCapabilities()
+	discoverer, ok := cache.client.(capabilityDiscoverer)
+	if !ok {
+		return caps, nil
+	}
+	names, discovered, err := discoverer.FetchCapabilities()
+	if err != nil {
+		cache.logger.Debug("failed to discover remote cache capabilities, assuming the client's", "error", err)
+		return caps, err
+	}
+	if !discovered {
+		return caps, nil
+	}
+	advertised := make(map[string]bool, len(names))
+	for _, name := range names {
+		advertised[name] = true
+	}
+	// A feature needs both the backend and the client to support it.
+	return BackendCapabilities{
+		Discovered:          true,
+		RangeRequests:       caps.RangeRequests && advertised[_capabilityRanges],
+		ConditionalRequests: caps.ConditionalRequests && advertised[_capabilityConditional],
+		Deltas:              caps.Deltas && advertised[_capabilityDeltas],
+		Immutable:           caps.Immutable && advertised[_capabilityImmutable],
+		Aliases:             caps.Aliases && advertised[_capabilityAliases],
+		BadArtifactReports:  caps.BadArtifactReports && advertised[_capabilityReports],
+	}, nil
+}
+
+// clientCapabilities reports the optional features the client can use.
+func (cache *httpCache) clientCapabilities() BackendCapabilities {
+	_, ranges := cache.client.(rangeFetcher)
+	_, conditional := cache.client.(conditionalFetcher)
+	_, deltas := cache.client.(deltaPutter)
+	_, immutable := cache.client.(immutablePutter)
+	_, aliases := cache.client.(aliasRegistrar)
+	_, reports := cache.client.(badArtifactReporter)
+	return BackendCapabilities{
+		RangeRequests:       ranges,
+		ConditionalRequests: conditional,
+		Deltas:              deltas,
+		Immutable:           immutable,
+		Aliases:             aliases,
+		BadArtifactReports:  reports,
+	}
+}
@@ -0,0 +1,63 @@
+package cache
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"github.com/vercel/turbo/cli/internal/fs"
+	"github.com/vercel/turbo/cli/internal/turbopath"
+	"gotest.tools/v3/assert"
+)
+
+// discoveringClient is an immutableClient whose backend describes its
+// capabilities.
+type discoveringClient struct {
+	immutableClient
+	capabilities []string
+	discovered   bool
+	err          error
+	calls        int32
+}
+
+func (dc *discoveringClient) FetchCapabilities() ([]string, bool, error) {
+	atomic.AddInt32(&dc.calls, 1)
+	return dc.capabilities, dc.discovered, dc.err
+}
+
+func TestCapabilities(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	_ = root.Join("a").WriteFile([]byte("a"), 0644)
+	files := turbopath.AnchoredUnixPathArray{"a"}.ToSystemPathArray()
+
+	// Without discovery, the client's capabilities are assumed.
+	caps, err := newHTTPCache(Opts{}, &immutableClient{}, &nullRecorder{}, root).Capabilities()
+	assert.NilError(t, err, "Capabilities")
+	assert.DeepEqual(t, caps, BackendCapabilities{Immutable: true})
+
+	client := &discoveringClient{immutableClient: immutableClient{pinned: map[string]bool{}}, capabilities: []string{"immutable", "ranges"}, discovered: true}
+	cache := newHTTPCache(Opts{}, client, &nullRecorder{}, root)
+	// The backend is only asked once a feature needs to know.
+	assert.NilError(t, cache.Put(root, "plain-hash", 0, files), "Put")
+	_, _, _, err = cache.Fetch(root, "plain-hash", nil)
+	assert.NilError(t, err, "Fetch")
+	assert.Equal(t, atomic.LoadInt32(&client.calls), int32(0))
+	caps, err = cache.Capabilities()
+	assert.NilError(t, err, "Capabilities")
+	assert.DeepEqual(t, caps, BackendCapabilities{Discovered: true, Immutable: true})
+	_, _ = cache.Capabilities()
+	assert.Equal(t, atomic.LoadInt32(&client.calls), int32(1))
+
+	// A backend that doesn't advertise a feature isn't asked to use it.
+	client = &discoveringClient{immutableClient: immutableClient{pinned: map[string]bool{}}, discovered: true}
+	cache = newHTTPCache(Opts{}, client, &nullRecorder{}, root)
+	assert.NilError(t, cache.PutImmutable(root, "the-hash", 0, files), "PutImmutable")
+	assert.Assert(t, !client.pinned["the-hash"], "artifact pinned by a backend without immutability")
+	assert.Assert(t, client.body != nil, "artifact not uploaded")
+
+	// Failed discovery falls back to the client's capabilities.
+	client = &discoveringClient{immutableClient: immutableClient{pinned: map[string]bool{}}, err: errors.New("unreachable")}
+	caps, err = newHTTPCache(Opts{}, client, &nullRecorder{}, root).Capabilities()
+	assert.ErrorContains(t, err, "unreachable")
+	assert.DeepEqual(t, caps, BackendCapabilities{Immutable: true})
+}
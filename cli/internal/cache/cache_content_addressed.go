@@ -0,0 +1,107 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+const (
+	// _contentIndexSuffix is appended to an artifact's hash to get the key of
+	// its index entry, which holds the digest of the artifact's contents; see
+	// Opts.ContentAddressed.
+	_contentIndexSuffix = "-cas-index"
+	// _maxContentIndexSize bounds how much of an index entry we'll read.
+	_maxContentIndexSize = 1 << 12
+)
+
+// contentIndex is the body of an index entry.
+type contentIndex struct {
+	// Digest is the hex sha256 of the artifact, which it is stored under.
+	Digest string `json:"digest"`
+}
+
+// uploadContentAddressed uploads an artifact under the digest of its
+// contents, then an index entry mapping hash to that digest. The index entry
+// is written last so that it never points at an artifact that isn't there.
+func (cache *httpCache) uploadContentAddressed(hash string, artifactBody []byte, duration int) error {
+	sum := sha256.Sum256(artifactBody)
+	digest := hex.EncodeToString(sum[:])
+	if err := cache.uploadAs(digest, artifactBody, duration); err != nil {
+		return err
+	}
+	index, err := json.Marshal(contentIndex{Digest: digest})
+	if err != nil {
+		return fmt.Errorf("failed to store artifact index: %w", err)
+	}
+	if err := cache.uploadAs(hash+_contentIndexSuffix, index, duration); err != nil {
+		return fmt.Errorf("failed to store artifact index: %w", err)
+	}
+	return nil
+}
+
+// artifactKey returns the key the artifact for hash, which has already been
+// rewritten, is stored under: with Opts.ContentAddressed, the digest its index
+// entry points at, or "" if there is no index entry; otherwise hash itself.
+// Every read of an artifact goes through it.
+func (cache *httpCache) artifactKey(hash string) (string, error) {
+	if !cache.contentAddressed {
+		return hash, nil
+	}
+	return cache.contentDigest(hash)
+}
+
+// contentDigest downloads the index entry for hash and returns the digest of
+// the artifact stored for it, or "" if there is none.
+func (cache *httpCache) contentDigest(hash string) (string, error) {
+	key := hash + _contentIndexSuffix
+	resp, err := cache.hedge(func() (*http.Response, error) {
+		return cache.client.FetchArtifact(key)
+	})
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if cache.isMiss(resp.StatusCode) {
+		return "", nil
+	} else if isUnauthorizedStatus(resp.StatusCode) {
+		return "", ErrUnauthorized
+	} else if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get artifact index: %v", resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, _maxContentIndexSize))
+	if err != nil {
+		return "", fmt.Errorf("failed to get artifact index: %w", err)
+	}
+
+	if cache.signerVerifier.isEnabled() {
+		signer, err := cache.signerVerifier.verifierFor(resp.Header.Get("x-artifact-signed-at"))
+		if err != nil {
+			return "", &verificationError{err: err}
+		}
+		isValid, err := signer.validate(key, body, resp.Header.Get("x-artifact-tag"))
+		if err != nil {
+			return "", &verificationError{err: err}
+		}
+		if !isValid {
+			return "", &verificationError{fmt.Errorf("index for %v has an invalid signature", hash)}
+		}
+	}
+	return parseContentIndex(hash, body)
+}
+
+// parseContentIndex returns the digest held by the index entry for hash.
+func parseContentIndex(hash string, body []byte) (string, error) {
+	var index contentIndex
+	if err := json.Unmarshal(body, &index); err != nil {
+		return "", fmt.Errorf("failed to parse artifact index: %w", err)
+	}
+	if decoded, err := hex.DecodeString(index.Digest); err != nil || len(decoded) != sha256.Size {
+		return "", fmt.Errorf("artifact index for %v has an invalid digest %q", hash, index.Digest)
+	}
+	return index.Digest, nil
+}
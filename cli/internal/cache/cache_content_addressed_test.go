@@ -0,0 +1,128 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/vercel/turbo/cli/internal/fs"
+	"github.com/vercel/turbo/cli/internal/turbopath"
+	"gotest.tools/v3/assert"
+)
+
+// contentStoreClient is a taggedClient that also answers existence checks.
+type contentStoreClient struct {
+	taggedClient
+}
+
+func (cc *contentStoreClient) ArtifactExists(hash string) (*http.Response, error) {
+	status := http.StatusOK
+	if _, ok := cc.artifacts[hash]; !ok {
+		status = http.StatusNotFound
+	}
+	return &http.Response{StatusCode: status, Body: ioutil.NopCloser(&bytes.Buffer{})}, nil
+}
+
+func TestContentAddressed(t *testing.T) {
+	t.Setenv("TURBO_REMOTE_CACHE_SIGNATURE_KEY", "key")
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	_ = root.Join("a").WriteFile([]byte("a"), 0644)
+	files := turbopath.AnchoredUnixPathArray{"a"}.ToSystemPathArray()
+
+	client := &contentStoreClient{taggedClient{artifacts: map[string][]byte{}, tags: map[string]string{}}}
+	cache := newHTTPCache(Opts{ContentAddressed: true, RemoteCacheOpts: fs.RemoteCacheOptions{Signature: true}}, client, &nullRecorder{}, root)
+	assert.NilError(t, cache.Put(root, "the-hash", 0, files), "Put")
+	assert.NilError(t, cache.Put(root, "other-hash", 0, files), "Put")
+
+	// Identical artifacts are stored once, under their digest.
+	_, ok := client.artifacts["the-hash"]
+	assert.Assert(t, !ok, "artifact stored under its hash")
+	assert.Equal(t, len(client.artifacts), 3)
+	var digest string
+	for key, body := range client.artifacts {
+		if len(key) == 2*sha256.Size {
+			sum := sha256.Sum256(body)
+			assert.Equal(t, key, hex.EncodeToString(sum[:]))
+			digest = key
+		}
+	}
+	assert.Assert(t, digest != "", "artifact not stored under its digest")
+
+	assert.Assert(t, cache.Exists("the-hash").Remote)
+	assert.Assert(t, !cache.Exists("missing-hash").Remote)
+	_ = root.Join("a").Remove()
+	itemStatus, restored, _, err := cache.Fetch(root, "other-hash", nil)
+	assert.NilError(t, err, "Fetch")
+	assert.Assert(t, itemStatus.Remote)
+	assert.DeepEqual(t, restored, files)
+	itemStatus, _, _, err = cache.Fetch(root, "missing-hash", nil)
+	assert.NilError(t, err, "Fetch")
+	assert.Assert(t, !itemStatus.Remote)
+
+	// An index entry pointing elsewhere is rejected.
+	client.artifacts["the-hash"+_contentIndexSuffix] = []byte(`{"digest":"` + hex.EncodeToString(make([]byte, sha256.Size)) + `"}`)
+	_, _, _, err = cache.Fetch(root, "the-hash", nil)
+	assert.ErrorIs(t, err, ErrVerificationFailed)
+}
+
+func TestContentAddressedReads(t *testing.T) {
+	t.Setenv("TURBO_REMOTE_CACHE_SIGNATURE_KEY", "key")
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	_ = root.Join("a").WriteFile([]byte("a"), 0644)
+	files := turbopath.AnchoredUnixPathArray{"a"}.ToSystemPathArray()
+
+	client := &contentStoreClient{taggedClient{artifacts: map[string][]byte{}, tags: map[string]string{}}}
+	cache := newHTTPCache(Opts{ContentAddressed: true, RemoteCacheOpts: fs.RemoteCacheOptions{Signature: true}}, client, &nullRecorder{}, root)
+	assert.NilError(t, cache.Put(root, "the-hash", 0, files), "Put")
+	var digest string
+	for key := range client.artifacts {
+		if len(key) == 2*sha256.Size {
+			digest = key
+		}
+	}
+
+	metadata, err := cache.GetMetadata("the-hash")
+	assert.NilError(t, err, "GetMetadata")
+	assert.Equal(t, metadata.Hash, "the-hash")
+	_, err = cache.GetMetadata("missing-hash")
+	assert.ErrorIs(t, err, ErrArtifactNotFound)
+
+	size, err := cache.EstimateRestoreSize("the-hash")
+	assert.NilError(t, err, "EstimateRestoreSize")
+	assert.Equal(t, size, int64(1))
+
+	exported := root.UntypedJoin("exported.tar.zst")
+	assert.NilError(t, cache.ExportArtifact("the-hash", exported), "ExportArtifact")
+	contents, err := exported.ReadFile()
+	assert.NilError(t, err, "ReadFile")
+	assert.Assert(t, bytes.Equal(contents, client.artifacts[digest]))
+	assert.ErrorIs(t, cache.ExportArtifact("missing-hash", root.UntypedJoin("missing.tar.zst")), ErrArtifactNotFound)
+
+	diffs, err := cache.DiffArtifacts("the-hash", "the-hash")
+	assert.NilError(t, err, "DiffArtifacts")
+	assert.Equal(t, len(diffs), 0)
+
+	discrepancies, err := cache.VerifyManifest(map[string]string{"the-hash": digest})
+	assert.NilError(t, err, "VerifyManifest")
+	assert.Equal(t, len(discrepancies), 0)
+
+	// Re-signing covers the index entry as well as the artifact, so that
+	// both verify under the new key.
+	cache.signerVerifier = &ArtifactSignatureAuthentication{
+		teamID:                    cache.signerVerifier.teamID,
+		secretKeyOverride:         []byte("new"),
+		previousSecretKeyOverride: []byte("key"),
+		enabled:                   true,
+	}
+	_, err = cache.EstimateRestoreSize("the-hash")
+	assert.ErrorIs(t, err, ErrVerificationFailed)
+	assert.NilError(t, cache.Resign("the-hash"), "Resign")
+	_ = root.Join("a").Remove()
+	itemStatus, restored, _, err := cache.Fetch(root, "the-hash", nil)
+	assert.NilError(t, err, "Fetch")
+	assert.Assert(t, itemStatus.Remote)
+	assert.DeepEqual(t, restored, files)
+}
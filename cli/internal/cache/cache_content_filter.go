@@ -0,0 +1,66 @@
+package cache
+
+import (
+	"archive/tar"
+	"fmt"
+	"strings"
+
+	"github.com/vercel/turbo/cli/internal/doublestar"
+	"github.com/vercel/turbo/cli/internal/turbopath"
+)
+
+// validatePatterns checks that Opts.DeniedPatterns and Opts.AllowedPatterns
+// are well-formed, so a typo can't silently let files through.
+func validatePatterns(denied []string, allowed []string) error {
+	for _, patterns := range [][]string{denied, allowed} {
+		for _, pattern := range patterns {
+			if !doublestar.ValidatePattern(pattern) {
+				return fmt.Errorf("invalid content pattern %q", pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// checkContent returns an error matching ErrDeniedContent if file mustn't be
+// uploaded; see Opts.DeniedPatterns and Opts.AllowedPatterns.
+func (cache *httpCache) checkContent(anchor turbopath.AbsoluteSystemPath, file turbopath.AnchoredSystemPath) error {
+	return cache.checkContentName(file.ToUnixPath().ToString(), func() bool {
+		info, err := file.RestoreAnchor(anchor).Lstat()
+		return err == nil && info.IsDir()
+	})
+}
+
+// checkEntries is checkContent for the entries of an artifact that has
+// already been built, e.g. one being imported.
+func (cache *httpCache) checkEntries(entries []*tar.Header) error {
+	for _, entry := range entries {
+		isDir := entry.Typeflag == tar.TypeDir
+		if err := cache.checkContentName(strings.TrimSuffix(entry.Name, "/"), func() bool { return isDir }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkContentName checks the file at name, a path relative to the anchor
+// with forward slashes. isDir is only called if the answer matters.
+func (cache *httpCache) checkContentName(name string, isDir func() bool) error {
+	for _, pattern := range cache.deniedPatterns {
+		if matched, _ := doublestar.Match(pattern, name); matched {
+			return fmt.Errorf("%w: %v matches %q", ErrDeniedContent, name, pattern)
+		}
+	}
+	if len(cache.allowedPatterns) == 0 {
+		return nil
+	}
+	for _, pattern := range cache.allowedPatterns {
+		if matched, _ := doublestar.Match(pattern, name); matched {
+			return nil
+		}
+	}
+	if isDir() {
+		return nil
+	}
+	return fmt.Errorf("%w: %v doesn't match any allowed pattern", ErrDeniedContent, name)
+}
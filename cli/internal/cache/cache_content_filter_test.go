@@ -0,0 +1,38 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/vercel/turbo/cli/internal/fs"
+	"github.com/vercel/turbo/cli/internal/turbopath"
+	"gotest.tools/v3/assert"
+)
+
+func TestContentPatterns(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	assert.NilError(t, root.Join("dist").MkdirAll(0755), "MkdirAll")
+	_ = root.Join("dist", "index.js").WriteFile([]byte("index"), 0644)
+	_ = root.Join("dist", ".env").WriteFile([]byte("SECRET=1"), 0644)
+	_ = root.Join("README.md").WriteFile([]byte("readme"), 0644)
+	dist := turbopath.AnchoredUnixPathArray{"dist", "dist/index.js"}.ToSystemPathArray()
+
+	client := &artifactResp{}
+	cache := newHTTPCache(Opts{DeniedPatterns: []string{"**/.env"}}, client, &nullRecorder{}, root)
+	err := cache.Put(root, "the-hash", 0, append(dist, turbopath.AnchoredUnixPath("dist/.env").ToSystemPath()))
+	assert.ErrorIs(t, err, ErrDeniedContent)
+	assert.ErrorContains(t, err, "dist/.env")
+	assert.Assert(t, client.body == nil, "denied artifact uploaded")
+	assert.NilError(t, cache.Put(root, "the-hash", 0, dist), "Put")
+
+	cache = newHTTPCache(Opts{AllowedPatterns: []string{"dist/**/*.js"}}, client, &nullRecorder{}, root)
+	assert.NilError(t, cache.Put(root, "the-hash", 0, dist), "Put")
+	err = cache.Put(root, "the-hash", 0, append(dist, "README.md"))
+	assert.ErrorIs(t, err, ErrDeniedContent)
+	assert.ErrorContains(t, err, "README.md")
+
+	// A malformed pattern could let files through, so nothing is uploaded.
+	cache = newHTTPCache(Opts{DeniedPatterns: []string{"[.env"}}, client, &nullRecorder{}, root)
+	writable, reason := cache.Writable()
+	assert.Assert(t, !writable)
+	assert.ErrorContains(t, validatePatterns(cache.deniedPatterns, nil), reason)
+}
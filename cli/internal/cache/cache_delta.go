@@ -0,0 +1,200 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/vercel/turbo/cli/internal/turbopath"
+	"github.com/vercel/turbo/cli/internal/util"
+)
+
+// A delta reconstructs a target artifact from a base artifact. It is a header
+// followed by a series of operations, each either copying a range of the base
+// or inserting literal bytes:
+//
+//	magic "TDLT" | base size (uvarint) | target size (uvarint)
+//	0x01 | offset (uvarint) | length (uvarint)   copy from the base
+//	0x02 | length (uvarint) | bytes              insert literal bytes
+//
+// Matches are found on _deltaBlockSize boundaries of the base, so deltas work
+// best when unchanged content compresses to identical bytes, e.g. with
+// Opts.SeekableCompression.
+const (
+	_deltaMagic     = "TDLT"
+	_deltaOpCopy    = 0x01
+	_deltaOpInsert  = 0x02
+	_deltaBlockSize = 1 << 12
+)
+
+// deltaPutter is implemented by clients that can upload an artifact as a delta
+// against an artifact the backend already has.
+type deltaPutter interface {
+	PutArtifactDelta(hash string, baseHash string, delta []byte, duration int, tag string, signedAt string) error
+}
+
+// PutWithBase stores an artifact under hash like Put, but with
+// Opts.DeltaUploads set it uploads only a delta against the artifact stored
+// under baseHash, typically the previous version of the same task's outputs.
+// The base is downloaded to compute the delta. It falls back to a full upload
+// if the base isn't in the remote cache, the delta isn't smaller than the
+// artifact, or the backend doesn't accept deltas, and always with
+// Opts.ContentAddressed, since the backend dedupes by content instead.
+func (cache *httpCache) PutWithBase(anchor turbopath.AbsoluteSystemPath, hash string, baseHash string, duration int, files []turbopath.AnchoredSystemPath) error {
+	if baseHash != "" {
+		baseHash = cache.rewriteHash(baseHash)
+	}
+	return cache.putWithResult(anchor, hash, duration, files, putOptions{baseHash: baseHash}).Err
+}
+
+// uploadDelta uploads artifactBody as a delta against baseHash if it can,
+// and in full otherwise.
+func (cache *httpCache) uploadDelta(hash string, baseHash string, artifactBody []byte, duration int) error {
+	putter, ok := cache.client.(deltaPutter)
+	if !ok || !cache.deltaUploads || cache.contentAddressed || !cache.capabilities().Deltas || atomic.LoadInt32(&cache.deltaUnsupported) != 0 || baseHash == "" || baseHash == hash {
+		return cache.upload(hash, artifactBody, duration)
+	}
+	base, err := cache.fetchBase(baseHash)
+	if err != nil {
+		cache.logger.Debug("no base for delta upload, uploading in full", "hash", hash, "base", baseHash, "error", err)
+		return cache.upload(hash, artifactBody, duration)
+	}
+	delta := makeDelta(base, artifactBody)
+	if len(delta) >= len(artifactBody) {
+		return cache.upload(hash, artifactBody, duration)
+	}
+
+	tag, signedAt, err := cache.sign(hash, artifactBody)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = putter.PutArtifactDelta(hash, baseHash, delta, duration, tag, signedAt)
+	cache.metrics.timePhase("upload", start)
+	if err == nil || errors.Is(err, util.ErrUnauthorized) {
+		return err
+	}
+	if errors.Is(err, util.ErrDeltaUnsupported) {
+		// Don't keep computing deltas the backend will refuse.
+		atomic.StoreInt32(&cache.deltaUnsupported, 1)
+	}
+	cache.logger.Debug("delta upload failed, uploading in full", "hash", hash, "base", baseHash, "error", err)
+	return cache.upload(hash, artifactBody, duration)
+}
+
+// fetchBase downloads the artifact for baseHash exactly as the backend holds
+// it, since that's what the delta will be applied to.
+func (cache *httpCache) fetchBase(baseHash string) ([]byte, error) {
+	resp, err := cache.client.FetchArtifact(baseHash)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("base artifact not available: %v", resp.Status)
+	}
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && encoding != "zstd" {
+		// The backend re-encoded the artifact for us; these aren't its bytes.
+		return nil, fmt.Errorf("base artifact served with Content-Encoding %v", encoding)
+	}
+	release := cache.memory.acquire(resp.ContentLength)
+	defer release()
+	return ioutil.ReadAll(&countingReader{reader: resp.Body, total: &cache.downloadedBytes})
+}
+
+// makeDelta encodes target as a delta against base.
+func makeDelta(base []byte, target []byte) []byte {
+	var out bytes.Buffer
+	out.WriteString(_deltaMagic)
+	writeUvarint(&out, uint64(len(base)))
+	writeUvarint(&out, uint64(len(target)))
+
+	// Index every whole block of the base by its weak hash.
+	blocks := make(map[uint32][]int)
+	for offset := 0; offset+_deltaBlockSize <= len(base); offset += _deltaBlockSize {
+		sum := newRollingHash(base[offset : offset+_deltaBlockSize]).sum()
+		blocks[sum] = append(blocks[sum], offset)
+	}
+
+	literalStart := 0
+	flushLiteral := func(end int) {
+		if end > literalStart {
+			out.WriteByte(_deltaOpInsert)
+			writeUvarint(&out, uint64(end-literalStart))
+			out.Write(target[literalStart:end])
+		}
+	}
+
+	i := 0
+	var hash *rollingHash
+	for i+_deltaBlockSize <= len(target) {
+		if hash == nil {
+			hash = newRollingHash(target[i : i+_deltaBlockSize])
+		}
+		match := -1
+		for _, offset := range blocks[hash.sum()] {
+			if bytes.Equal(base[offset:offset+_deltaBlockSize], target[i:i+_deltaBlockSize]) {
+				match = offset
+				break
+			}
+		}
+		if match < 0 {
+			if i+_deltaBlockSize < len(target) {
+				hash.roll(target[i], target[i+_deltaBlockSize])
+			}
+			i++
+			continue
+		}
+
+		// Extend the match as far as the two agree.
+		length := _deltaBlockSize
+		for match+length < len(base) && i+length < len(target) && base[match+length] == target[i+length] {
+			length++
+		}
+		flushLiteral(i)
+		out.WriteByte(_deltaOpCopy)
+		writeUvarint(&out, uint64(match))
+		writeUvarint(&out, uint64(length))
+		i += length
+		literalStart = i
+		hash = nil
+	}
+	flushLiteral(len(target))
+	return out.Bytes()
+}
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	var scratch [binary.MaxVarintLen64]byte
+	buf.Write(scratch[:binary.PutUvarint(scratch[:], v)])
+}
+
+// rollingHash is an Adler-32 style checksum over a fixed-size window that can
+// be slid forward one byte at a time.
+type rollingHash struct {
+	a, b uint32
+	n    uint32
+}
+
+func newRollingHash(window []byte) *rollingHash {
+	h := &rollingHash{n: uint32(len(window))}
+	for i, c := range window {
+		h.a += uint32(c)
+		h.b += uint32(len(window)-i) * uint32(c)
+	}
+	return h
+}
+
+// roll slides the window forward, dropping out and taking in in.
+func (h *rollingHash) roll(out byte, in byte) {
+	h.a = h.a - uint32(out) + uint32(in)
+	h.b = h.b - h.n*uint32(out) + h.a
+}
+
+func (h *rollingHash) sum() uint32 {
+	return h.a&0xffff | h.b<<16
+}
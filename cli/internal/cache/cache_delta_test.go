@@ -0,0 +1,200 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/vercel/turbo/cli/internal/fs"
+	"github.com/vercel/turbo/cli/internal/turbopath"
+	"github.com/vercel/turbo/cli/internal/util"
+	"gotest.tools/v3/assert"
+)
+
+var errMalformedDelta = errors.New("malformed artifact delta")
+
+// applyDelta reconstructs the target of a delta made by makeDelta from base,
+// as a backend that accepts delta uploads would. Only deltaClient uses it;
+// turbo itself never applies deltas.
+func applyDelta(base []byte, delta []byte) ([]byte, error) {
+	if !bytes.HasPrefix(delta, []byte(_deltaMagic)) {
+		return nil, errMalformedDelta
+	}
+	r := bytes.NewReader(delta[len(_deltaMagic):])
+	baseSize, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, errMalformedDelta
+	}
+	if baseSize != uint64(len(base)) {
+		return nil, fmt.Errorf("%w: expected a base of %v bytes, got %v", errMalformedDelta, baseSize, len(base))
+	}
+	targetSize, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, errMalformedDelta
+	}
+
+	var target []byte
+	for r.Len() > 0 {
+		op, _ := r.ReadByte()
+		switch op {
+		case _deltaOpCopy:
+			offset, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, errMalformedDelta
+			}
+			length, err := binary.ReadUvarint(r)
+			if err != nil || length > uint64(len(base)) || offset > uint64(len(base))-length {
+				return nil, errMalformedDelta
+			}
+			target = append(target, base[offset:offset+length]...)
+		case _deltaOpInsert:
+			length, err := binary.ReadUvarint(r)
+			if err != nil || length > uint64(r.Len()) {
+				return nil, errMalformedDelta
+			}
+			literal := make([]byte, length)
+			_, _ = r.Read(literal)
+			target = append(target, literal...)
+		default:
+			return nil, errMalformedDelta
+		}
+		if uint64(len(target)) > targetSize {
+			return nil, errMalformedDelta
+		}
+	}
+	if uint64(len(target)) != targetSize {
+		return nil, errMalformedDelta
+	}
+	return target, nil
+}
+
+func TestDelta(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	base := make([]byte, 64<<10)
+	rng.Read(base)
+
+	edited := append([]byte(nil), base[:10000]...)
+	edited = append(edited, []byte("inserted")...)
+	edited = append(edited, base[10000:50000]...)
+	edited = append(edited, base[52000:]...)
+
+	tests := []struct {
+		name   string
+		base   []byte
+		target []byte
+	}{
+		{name: "identical", base: base, target: base},
+		{name: "edited", base: base, target: edited},
+		{name: "empty base", base: nil, target: edited},
+		{name: "empty target", base: base, target: nil},
+		{name: "shorter than a block", base: base, target: []byte("small")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delta := makeDelta(tt.base, tt.target)
+			got, err := applyDelta(tt.base, delta)
+			assert.NilError(t, err, "applyDelta")
+			assert.Assert(t, bytes.Equal(got, tt.target), "reconstructed target matches")
+		})
+	}
+
+	delta := makeDelta(base, edited)
+	assert.Assert(t, len(delta) < 4<<10, "delta is small: %v bytes", len(delta))
+	_, err := applyDelta(base[1:], delta)
+	assert.ErrorIs(t, err, errMalformedDelta)
+	_, err = applyDelta(base, delta[:len(delta)-1])
+	assert.ErrorIs(t, err, errMalformedDelta)
+
+	// A copy whose end overflows is rejected rather than sliced.
+	var overflow bytes.Buffer
+	overflow.WriteString(_deltaMagic)
+	writeUvarint(&overflow, uint64(len(base)))
+	writeUvarint(&overflow, 1)
+	overflow.WriteByte(_deltaOpCopy)
+	writeUvarint(&overflow, 2)
+	writeUvarint(&overflow, ^uint64(0))
+	_, err = applyDelta(base, overflow.Bytes())
+	assert.ErrorIs(t, err, errMalformedDelta)
+}
+
+// deltaClient stores artifacts by hash and applies deltas against them, like
+// a backend that supports delta uploads.
+type deltaClient struct {
+	artifactResp
+	artifacts   map[string][]byte
+	deltas      int
+	unsupported bool
+}
+
+func (dc *deltaClient) PutArtifact(hash string, body []byte, duration int, tag string) error {
+	dc.artifacts[hash] = body
+	return nil
+}
+
+func (dc *deltaClient) FetchArtifact(hash string) (*http.Response, error) {
+	body, ok := dc.artifacts[hash]
+	if !ok {
+		return &http.Response{StatusCode: http.StatusNotFound, Body: ioutil.NopCloser(&bytes.Buffer{})}, nil
+	}
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(bytes.NewReader(body))}, nil
+}
+
+func (dc *deltaClient) PutArtifactDelta(hash string, baseHash string, delta []byte, duration int, tag string, signedAt string) error {
+	if dc.unsupported {
+		return util.ErrDeltaUnsupported
+	}
+	body, err := applyDelta(dc.artifacts[baseHash], delta)
+	if err != nil {
+		return err
+	}
+	dc.deltas++
+	dc.artifacts[hash] = body
+	return nil
+}
+
+func TestDeltaUploads(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	rng := rand.New(rand.NewSource(1))
+	base := make([]byte, 64<<10)
+	rng.Read(base)
+	edited := append(append([]byte(nil), base...), []byte("more")...)
+
+	client := &deltaClient{artifacts: map[string][]byte{"base": base}}
+	cache := newHTTPCache(Opts{DeltaUploads: true}, client, &nullRecorder{}, root)
+	assert.NilError(t, cache.uploadDelta("next", "base", edited, 0), "uploadDelta")
+	assert.Equal(t, client.deltas, 1, "uploaded as a delta")
+	assert.Assert(t, bytes.Equal(client.artifacts["next"], edited), "backend reconstructs the artifact")
+
+	assert.NilError(t, cache.uploadDelta("other", "missing", edited, 0), "uploadDelta")
+	assert.Equal(t, client.deltas, 1, "no base, uploaded in full")
+	assert.Assert(t, bytes.Equal(client.artifacts["other"], edited), "full upload")
+
+	client.unsupported = true
+	assert.NilError(t, cache.uploadDelta("third", "base", edited, 0), "uploadDelta")
+	assert.Assert(t, bytes.Equal(client.artifacts["third"], edited), "falls back to a full upload")
+	client.unsupported = false
+	assert.NilError(t, cache.uploadDelta("fourth", "base", edited, 0), "uploadDelta")
+	assert.Equal(t, client.deltas, 1, "deltas aren't retried once the backend refuses them")
+
+	_ = root.Join("a").WriteFile([]byte("a"), 0644)
+	files := turbopath.AnchoredUnixPathArray{"a"}.ToSystemPathArray()
+	disabled := newHTTPCache(Opts{}, &deltaClient{artifacts: map[string][]byte{"base": base}}, &nullRecorder{}, root)
+	assert.NilError(t, disabled.PutWithBase(root, "fifth", "base", 0, files), "PutWithBase")
+	assert.Equal(t, disabled.client.(*deltaClient).deltas, 0, "deltas are opt-in")
+	assert.Assert(t, disabled.client.(*deltaClient).artifacts["fifth"] != nil, "uploaded in full")
+
+	// PutWithBase is checked like Put.
+	client = &deltaClient{artifacts: map[string][]byte{"base": base}}
+	budgeted := newHTTPCache(Opts{DeltaUploads: true, Deadline: func() time.Time { return time.Now() }}, client, &nullRecorder{}, root)
+	assert.ErrorIs(t, budgeted.PutWithBase(root, "sixth", "base", 0, files), ErrRunBudgetExhausted)
+	assert.Assert(t, client.artifacts["sixth"] == nil, "nothing uploaded")
+	small := newHTTPCache(Opts{DeltaUploads: true, MinRemoteArtifactSize: 1 << 20}, client, &nullRecorder{}, root)
+	assert.NilError(t, small.PutWithBase(root, "seventh", "base", 0, files), "PutWithBase")
+	assert.Assert(t, client.artifacts["seventh"] == nil, "too small to upload")
+}
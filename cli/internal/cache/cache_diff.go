@@ -0,0 +1,125 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/vercel/turbo/cli/internal/turbopath"
+)
+
+// FileChange is how a file differs between two artifacts.
+type FileChange string
+
+const (
+	// FileAdded is a file present only in the second artifact.
+	FileAdded FileChange = "added"
+	// FileRemoved is a file present only in the first artifact.
+	FileRemoved FileChange = "removed"
+	// FileChanged is a file present in both artifacts with different contents.
+	FileChanged FileChange = "changed"
+)
+
+// FileDiff describes a file that differs between two artifacts. Digests are
+// hex-encoded SHA-256 of the file's contents, or of the target of a symlink,
+// and are empty for the artifact the file is missing from.
+type FileDiff struct {
+	Path    turbopath.AnchoredUnixPath
+	Change  FileChange
+	DigestA string
+	DigestB string
+}
+
+// DiffArtifacts compares the artifacts stored under hashA and hashB, e.g. to
+// explain a cache-key change in terms of how the outputs differ. Both are
+// downloaded and extracted to a temporary directory, which is removed
+// afterwards, without touching the working tree. Directories aren't reported;
+// differences are sorted by path.
+func (cache *httpCache) DiffArtifacts(hashA string, hashB string) ([]FileDiff, error) {
+	if err := cache.tempDir.MkdirAll(0755); err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir(cache.tempDir.ToString(), "turbo-diff-*")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	root := turbopath.AbsoluteSystemPathFromUpstream(dir)
+
+	digestsA, err := cache.artifactDigests(hashA, root.UntypedJoin("a"))
+	if err != nil {
+		return nil, err
+	}
+	digestsB, err := cache.artifactDigests(hashB, root.UntypedJoin("b"))
+	if err != nil {
+		return nil, err
+	}
+
+	var diffs []FileDiff
+	for path, digestA := range digestsA {
+		digestB, ok := digestsB[path]
+		if !ok {
+			diffs = append(diffs, FileDiff{Path: path, Change: FileRemoved, DigestA: digestA})
+		} else if digestA != digestB {
+			diffs = append(diffs, FileDiff{Path: path, Change: FileChanged, DigestA: digestA, DigestB: digestB})
+		}
+	}
+	for path, digestB := range digestsB {
+		if _, ok := digestsA[path]; !ok {
+			diffs = append(diffs, FileDiff{Path: path, Change: FileAdded, DigestB: digestB})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].Path < diffs[j].Path
+	})
+	return diffs, nil
+}
+
+// artifactDigests extracts the artifact for hash into dir and digests every
+// file and symlink in it.
+func (cache *httpCache) artifactDigests(hash string, dir turbopath.AbsoluteSystemPath) (map[turbopath.AnchoredUnixPath]string, error) {
+	body, err := cache.fetchVerified(hash)
+	if err != nil {
+		return nil, err
+	}
+	files, err := cache.restoreItem(bytes.NewReader(body), true).Restore(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	digests := make(map[turbopath.AnchoredUnixPath]string, len(files))
+	for _, file := range files {
+		path := file.RestoreAnchor(dir)
+		info, err := path.Lstat()
+		if err != nil {
+			return nil, err
+		}
+		hasher := sha256.New()
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := path.Readlink()
+			if err != nil {
+				return nil, err
+			}
+			_, _ = hasher.Write([]byte(target))
+		case info.Mode().IsRegular():
+			f, err := path.Open()
+			if err != nil {
+				return nil, err
+			}
+			_, err = io.Copy(hasher, f)
+			_ = f.Close()
+			if err != nil {
+				return nil, err
+			}
+		default:
+			continue
+		}
+		digests[file.ToUnixPath()] = hex.EncodeToString(hasher.Sum(nil))
+	}
+	return digests, nil
+}
@@ -0,0 +1,52 @@
+package cache
+
+import (
+	"os"
+	"testing"
+
+	"github.com/vercel/turbo/cli/internal/fs"
+	"github.com/vercel/turbo/cli/internal/turbopath"
+	"gotest.tools/v3/assert"
+)
+
+func TestDiffArtifacts(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	client := &deltaClient{artifacts: map[string][]byte{}}
+	cache := newHTTPCache(Opts{}, client, &nullRecorder{}, root)
+
+	write := func(name string, contents string) {
+		path := root.UntypedJoin("out", name)
+		assert.NilError(t, path.EnsureDir(), "EnsureDir")
+		assert.NilError(t, path.WriteFile([]byte(contents), 0644), "WriteFile")
+	}
+	write("same", "same")
+	write("changed", "before")
+	write("removed", "removed")
+	files := turbopath.AnchoredUnixPathArray{"out", "out/changed", "out/removed", "out/same"}.ToSystemPathArray()
+	assert.NilError(t, cache.Put(root, "hash-a", 0, files), "Put")
+
+	write("changed", "after")
+	write("added", "added")
+	assert.NilError(t, root.UntypedJoin("out", "removed").Remove(), "Remove")
+	files = turbopath.AnchoredUnixPathArray{"out", "out/added", "out/changed", "out/same"}.ToSystemPathArray()
+	assert.NilError(t, cache.Put(root, "hash-b", 0, files), "Put")
+
+	diffs, err := cache.DiffArtifacts("hash-a", "hash-b")
+	assert.NilError(t, err, "DiffArtifacts")
+	assert.Equal(t, len(diffs), 3)
+	assert.Equal(t, diffs[0].Path, turbopath.AnchoredUnixPath("out/added"))
+	assert.Equal(t, diffs[0].Change, FileAdded)
+	assert.Assert(t, diffs[0].DigestA == "" && diffs[0].DigestB != "")
+	assert.Equal(t, diffs[1].Path, turbopath.AnchoredUnixPath("out/changed"))
+	assert.Equal(t, diffs[1].Change, FileChanged)
+	assert.Assert(t, diffs[1].DigestA != diffs[1].DigestB)
+	assert.Equal(t, diffs[2].Path, turbopath.AnchoredUnixPath("out/removed"))
+	assert.Equal(t, diffs[2].Change, FileRemoved)
+
+	entries, err := os.ReadDir(cache.tempDir.ToString())
+	assert.NilError(t, err, "ReadDir")
+	assert.Equal(t, len(entries), 0, "temporary directories are removed")
+
+	_, err = cache.DiffArtifacts("hash-a", "missing")
+	assert.ErrorIs(t, err, ErrArtifactNotFound)
+}
@@ -0,0 +1,155 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// _downloadProbeSize is how much of an artifact the first range request of a
+// chunked download asks for. Artifacts no larger than this are downloaded in a
+// single request, and larger ones learn their total size from it.
+const _downloadProbeSize = 4 << 20
+
+// _minDownloadChunkSize is the smallest range worth its own request.
+const _minDownloadChunkSize = 1 << 20
+
+// _maxChunkedDownloadSize is the largest artifact downloaded in chunks, since
+// its total size, which comes from the server, is allocated up front. Larger
+// artifacts are fetched with a single GET.
+const _maxChunkedDownloadSize = 1 << 30
+
+// rangeFetcher is implemented by clients that can fetch a byte range of an
+// artifact.
+type rangeFetcher interface {
+	FetchArtifactRange(hash string, start int64, end int64) (*http.Response, error)
+}
+
+// fetchChunked downloads an artifact as several byte ranges in parallel, see
+// Opts.ParallelDownloadChunks, and returns a response holding the reassembled
+// artifact as if it had been fetched with a single GET. The artifact counts
+// against the memory budget until the response body is closed. If the backend doesn't
+// honor the first range request, its response is returned as is, and if a
+// later range request fails, or the artifact is too large to buffer, it is
+// fetched again with a single GET. Bytes are counted toward MaxDownloadBytes as
+// the ranges come in.
+func (cache *httpCache) fetchChunked(fetcher rangeFetcher, hash string) (*http.Response, error) {
+	resp, err := fetcher.FetchArtifactRange(hash, 0, _downloadProbeSize-1)
+	if err != nil || resp.StatusCode != http.StatusPartialContent {
+		// A miss, or a backend that ignores ranges and sent the whole artifact.
+		return resp, err
+	}
+	total, ok := parseContentRangeTotal(resp.Header.Get("Content-Range"))
+	if !ok || total > cache.maxChunkedDownloadSize() {
+		_ = resp.Body.Close()
+		return cache.client.FetchArtifact(hash)
+	}
+	first, err := ioutil.ReadAll(&countingReader{reader: resp.Body, total: &cache.downloadedBytes})
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch artifact: %w", err)
+	}
+
+	release := cache.memory.acquire(total)
+	body := make([]byte, total)
+	copied := int64(copy(body, first))
+	if copied < total {
+		if err := cache.fetchRanges(fetcher, hash, body, copied); err != nil {
+			release()
+			cache.logger.Debug("chunked download failed, fetching in one request", "hash", hash, "error", err)
+			return cache.client.FetchArtifact(hash)
+		}
+	}
+
+	header := resp.Header.Clone()
+	header.Del("Content-Range")
+	header.Set("Content-Length", strconv.FormatInt(total, 10))
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Header:        header,
+		ContentLength: total,
+		Body:          &bufferedBody{Reader: bytes.NewReader(body), data: body, release: release},
+	}, nil
+}
+
+// fetchRanges fills body from offset onwards with parallel range requests.
+func (cache *httpCache) fetchRanges(fetcher rangeFetcher, hash string, body []byte, offset int64) error {
+	remaining := int64(len(body)) - offset
+	chunks := int64(cache.downloadChunks - 1)
+	if maxChunks := (remaining + _minDownloadChunkSize - 1) / _minDownloadChunkSize; chunks > maxChunks {
+		chunks = maxChunks
+	}
+	if chunks < 1 {
+		chunks = 1
+	}
+	chunkSize := (remaining + chunks - 1) / chunks
+
+	var wg sync.WaitGroup
+	errs := make(chan error, chunks)
+	for start := offset; start < int64(len(body)); start += chunkSize {
+		end := start + chunkSize
+		if end > int64(len(body)) {
+			end = int64(len(body))
+		}
+		wg.Add(1)
+		go func(start int64, end int64) {
+			defer wg.Done()
+			errs <- cache.fetchRange(fetcher, hash, body[start:end], start)
+		}(start, end)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxChunkedDownloadSize returns the largest artifact fetchChunked will buffer.
+func (cache *httpCache) maxChunkedDownloadSize() int64 {
+	if cache.maxDownloadBytes > 0 && cache.maxDownloadBytes < _maxChunkedDownloadSize {
+		return cache.maxDownloadBytes
+	}
+	return _maxChunkedDownloadSize
+}
+
+// fetchRange reads the range of the artifact starting at start into chunk.
+func (cache *httpCache) fetchRange(fetcher rangeFetcher, hash string, chunk []byte, start int64) error {
+	resp, err := fetcher.FetchArtifactRange(hash, start, start+int64(len(chunk))-1)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("range request failed: %v", resp.Status)
+	}
+	if _, err := io.ReadFull(&countingReader{reader: resp.Body, total: &cache.downloadedBytes}, chunk); err != nil {
+		return fmt.Errorf("range request failed: %w", err)
+	}
+	return nil
+}
+
+// parseContentRangeTotal returns the complete length from a Content-Range
+// header such as "bytes 0-1023/4096".
+func parseContentRangeTotal(contentRange string) (int64, bool) {
+	if !strings.HasPrefix(contentRange, "bytes ") {
+		return 0, false
+	}
+	slash := strings.LastIndex(contentRange, "/")
+	if slash < 0 {
+		return 0, false
+	}
+	total, err := strconv.ParseInt(contentRange[slash+1:], 10, 64)
+	if err != nil || total <= 0 {
+		return 0, false
+	}
+	return total, true
+}
@@ -0,0 +1,131 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/vercel/turbo/cli/internal/fs"
+	"gotest.tools/v3/assert"
+)
+
+// rangeClient serves an artifact, honoring range requests unless ignoreRanges
+// is set. If claimTotal is set, it's sent as the artifact's total size.
+type rangeClient struct {
+	artifactResp
+	mu            sync.Mutex
+	rangeRequests int
+	fullRequests  int
+	ignoreRanges  bool
+	failAfter     int
+	claimTotal    int64
+}
+
+func (rc *rangeClient) FetchArtifact(hash string) (*http.Response, error) {
+	rc.mu.Lock()
+	rc.fullRequests++
+	rc.mu.Unlock()
+	return rc.artifactResp.FetchArtifact(hash)
+}
+
+func (rc *rangeClient) FetchArtifactRange(hash string, start int64, end int64) (*http.Response, error) {
+	rc.mu.Lock()
+	rc.rangeRequests++
+	requests := rc.rangeRequests
+	rc.mu.Unlock()
+	if rc.ignoreRanges {
+		return rc.artifactResp.FetchArtifact(hash)
+	}
+	if rc.failAfter > 0 && requests > rc.failAfter {
+		return &http.Response{StatusCode: http.StatusInternalServerError, Status: "500 Internal Server Error", Body: ioutil.NopCloser(&bytes.Buffer{})}, nil
+	}
+	if end >= int64(len(rc.body)) {
+		end = int64(len(rc.body)) - 1
+	}
+	header := rc.headers.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	total := int64(len(rc.body))
+	if rc.claimTotal > 0 {
+		total = rc.claimTotal
+	}
+	header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, total))
+	return &http.Response{
+		StatusCode: http.StatusPartialContent,
+		Header:     header,
+		Body:       ioutil.NopCloser(bytes.NewReader(rc.body[start : end+1])),
+	}, nil
+}
+
+func TestFetchChunked(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	artifact := make([]byte, 10<<20)
+	rand.New(rand.NewSource(1)).Read(artifact)
+
+	tests := []struct {
+		name             string
+		client           *rangeClient
+		maxDownloadBytes int64
+		rangeRequests    int
+		fullRequests     int
+	}{
+		{name: "ranges", client: &rangeClient{}, rangeRequests: 4},
+		{name: "ranges ignored", client: &rangeClient{ignoreRanges: true}, rangeRequests: 1},
+		{name: "range fails", client: &rangeClient{failAfter: 2}, rangeRequests: 4, fullRequests: 1},
+		{name: "implausible total", client: &rangeClient{claimTotal: 1 << 62}, rangeRequests: 1, fullRequests: 1},
+		{name: "total over MaxDownloadBytes", client: &rangeClient{}, maxDownloadBytes: 5 << 20, rangeRequests: 1, fullRequests: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.client.body = artifact
+			tt.client.headers = http.Header{"X-Artifact-Tag": []string{"tag"}}
+			cache := newHTTPCache(Opts{ParallelDownloadChunks: 4, MaxDownloadBytes: tt.maxDownloadBytes}, tt.client, &nullRecorder{}, root)
+			resp, err := cache.fetchArtifact("some-hash", "", 0)
+			assert.NilError(t, err, "fetchArtifact")
+			body, err := ioutil.ReadAll(resp.Body)
+			assert.NilError(t, err, "ReadAll")
+			assert.Equal(t, resp.StatusCode, http.StatusOK)
+			assert.Assert(t, bytes.Equal(body, artifact), "artifact reassembled")
+			assert.Equal(t, resp.Header.Get("X-Artifact-Tag"), "tag")
+			assert.Equal(t, tt.client.rangeRequests, tt.rangeRequests)
+			assert.Equal(t, tt.client.fullRequests, tt.fullRequests)
+		})
+	}
+}
+
+func TestFetchChunkedRestores(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	client := &rangeClient{artifactResp: artifactResp{body: makeValidTar(t).Bytes()}}
+	cache := newHTTPCache(Opts{ParallelDownloadChunks: 4}, client, &nullRecorder{}, root)
+	var downloaded int64
+	hit, files, _, err := cache.retrieve("some-hash", "", &downloaded)
+	assert.NilError(t, err, "retrieve")
+	assert.Assert(t, hit)
+	assert.Assert(t, len(files) > 0)
+	assert.Equal(t, downloaded, int64(len(client.body)))
+	assert.Equal(t, cache.downloadedBytes, int64(len(client.body)), "bytes are counted once")
+	assert.Equal(t, client.rangeRequests, 1, "small artifacts need a single request")
+}
+
+func TestParseContentRangeTotal(t *testing.T) {
+	tests := []struct {
+		header string
+		total  int64
+		ok     bool
+	}{
+		{header: "bytes 0-1023/4096", total: 4096, ok: true},
+		{header: "bytes 0-1023/*"},
+		{header: "items 0-1/2"},
+		{header: ""},
+	}
+	for _, tt := range tests {
+		total, ok := parseContentRangeTotal(tt.header)
+		assert.Equal(t, total, tt.total, tt.header)
+		assert.Equal(t, ok, tt.ok, tt.header)
+	}
+}
@@ -8,7 +8,9 @@ package cache
 import (
 	"encoding/json"
 	"fmt"
+	"os"
 
+	"github.com/hashicorp/go-hclog"
 	"github.com/vercel/turbo/cli/internal/analytics"
 	"github.com/vercel/turbo/cli/internal/cacheitem"
 	"github.com/vercel/turbo/cli/internal/turbopath"
@@ -18,6 +20,24 @@ import (
 type fsCache struct {
 	cacheDirectory turbopath.AbsoluteSystemPath
 	recorder       analytics.Recorder
+	onCacheEvent   OnCacheEvent
+	preserveXattrs bool
+
+	warnOnDivergence bool
+	restoreMode      cacheitem.RestoreMode
+	resumable        bool
+	maxFiles         int
+	maxDecompressed  int64
+	maxRatio         int
+	fsync            bool
+	verifyCount      bool
+	umask            os.FileMode
+	// tempDir is where restores are staged, unless they're resumable; see
+	// Opts.TempDir.
+	tempDir turbopath.AbsoluteSystemPath
+	// restoreLimiter bounds concurrent restores; see Opts.MaxConcurrentRestores.
+	restoreLimiter limiter
+	logger         hclog.Logger
 }
 
 // newFsCache creates a new filesystem cache
@@ -29,11 +49,33 @@ func newFsCache(opts Opts, recorder analytics.Recorder, repoRoot turbopath.Absol
 	return &fsCache{
 		cacheDirectory: cacheDir,
 		recorder:       recorder,
+		onCacheEvent:   opts.OnCacheEvent,
+		preserveXattrs: opts.PreserveXattrs,
+
+		warnOnDivergence: opts.WarnOnOverwriteDivergence,
+		restoreMode:      opts.RestoreMode,
+		resumable:        opts.ResumableRestore,
+		maxFiles:         opts.resolveMaxFiles(),
+		maxDecompressed:  opts.MaxDecompressedSize,
+		maxRatio:         opts.MaxCompressionRatio,
+		fsync:            opts.FsyncAfterRestore,
+		verifyCount:      opts.VerifyRestoreCount,
+		umask:            opts.RestoreUmask,
+		tempDir:          opts.resolveTempDir(repoRoot),
+		logger:           opts.logger(),
 	}, nil
 }
 
 // Fetch returns true if items are cached. It moves them into position as a side effect.
 func (f *fsCache) Fetch(anchor turbopath.AbsoluteSystemPath, hash string, _ []string) (ItemStatus, []turbopath.AnchoredSystemPath, int, error) {
+	itemStatus, restoredFiles, duration, err := f.fetch(anchor, hash)
+	if err != nil {
+		f.logError(hash)
+	}
+	return itemStatus, restoredFiles, duration, err
+}
+
+func (f *fsCache) fetch(anchor turbopath.AbsoluteSystemPath, hash string) (ItemStatus, []turbopath.AnchoredSystemPath, int, error) {
 	uncompressedCachePath := f.cacheDirectory.UntypedJoin(hash + ".tar")
 	compressedCachePath := f.cacheDirectory.UntypedJoin(hash + ".tar.zst")
 
@@ -52,8 +94,24 @@ func (f *fsCache) Fetch(anchor turbopath.AbsoluteSystemPath, hash string, _ []st
 	if openErr != nil {
 		return ItemStatus{Local: false}, nil, 0, openErr
 	}
+	cacheItem.PreserveXattrs = f.preserveXattrs
+	cacheItem.OnDivergentOverwrite = divergenceWarner(f.warnOnDivergence, f.logger)
+	cacheItem.RestoreMode = f.restoreMode
+	cacheItem.MaxFiles = f.maxFiles
+	cacheItem.MaxDecompressedSize = f.maxDecompressed
+	cacheItem.MaxCompressionRatio = f.maxRatio
+	cacheItem.Fsync = f.fsync
+	cacheItem.VerifyRestoreCount = f.verifyCount
+	cacheItem.Umask = f.umask
+	if f.resumable {
+		cacheItem.CheckpointPath = restoreCheckpointPath(f.cacheDirectory, hash)
+	} else {
+		cacheItem.StagingDir = f.tempDir
+	}
 
+	f.restoreLimiter.acquire()
 	restoredFiles, restoreErr := cacheItem.Restore(anchor)
+	f.restoreLimiter.release()
 	if restoreErr != nil {
 		_ = cacheItem.Close()
 		return ItemStatus{Local: false}, nil, 0, restoreErr
@@ -71,7 +129,7 @@ func (f *fsCache) Fetch(anchor turbopath.AbsoluteSystemPath, hash string, _ []st
 	if closeErr != nil {
 		return ItemStatus{Local: false}, restoredFiles, 0, closeErr
 	}
-	return ItemStatus{Local: true}, restoredFiles, meta.Duration, nil
+	return ItemStatus{Local: true, Source: ItemSourceLocal}, restoredFiles, meta.Duration, nil
 }
 
 func (f *fsCache) Exists(hash string) ItemStatus {
@@ -79,7 +137,7 @@ func (f *fsCache) Exists(hash string) ItemStatus {
 	compressedCachePath := f.cacheDirectory.UntypedJoin(hash + ".tar.zst")
 
 	if compressedCachePath.FileExists() || uncompressedCachePath.FileExists() {
-		return ItemStatus{Local: true}
+		return ItemStatus{Local: true, Source: ItemSourceLocal}
 	}
 
 	return ItemStatus{Local: false}
@@ -98,15 +156,65 @@ func (f *fsCache) logFetch(hit bool, hash string, duration int) {
 		Hash:     hash,
 		Duration: duration,
 	}
-	f.recorder.LogEvent(payload)
+	recordEvent(f.recorder, payload)
+	emitCacheEvent(f.onCacheEvent, *payload)
+}
+
+func (f *fsCache) logError(hash string) {
+	emitCacheEvent(f.onCacheEvent, CacheEvent{
+		Source: CacheSourceFS,
+		Event:  CacheEventError,
+		Hash:   hash,
+	})
+}
+
+// logPut reports an artifact stored in the local cache. Like errors, local
+// writes only go to OnCacheEvent; the analytics recorder counts uploads to
+// the remote cache.
+func (f *fsCache) logPut(hash string, duration int) {
+	emitCacheEvent(f.onCacheEvent, CacheEvent{
+		Source:   CacheSourceFS,
+		Event:    CacheEventUpload,
+		Hash:     hash,
+		Duration: duration,
+	})
 }
 
 func (f *fsCache) Put(anchor turbopath.AbsoluteSystemPath, hash string, duration int, files []turbopath.AnchoredSystemPath) error {
+	err := f.put(anchor, hash, duration, files)
+	if err != nil {
+		f.logError(hash)
+	} else {
+		f.logPut(hash, duration)
+	}
+	return err
+}
+
+// PutImmutable stores the artifact as Put does: there's nothing to pin an
+// artifact against in the local cache.
+func (f *fsCache) PutImmutable(anchor turbopath.AbsoluteSystemPath, hash string, duration int, files []turbopath.AnchoredSystemPath) error {
+	return f.Put(anchor, hash, duration, files)
+}
+
+func (f *fsCache) VerifyManifest(_ map[string]string) ([]ManifestDiscrepancy, error) {
+	return nil, ErrNoRemoteCache
+}
+
+func (f *fsCache) EstimateRestoreSize(_ string) (int64, error) {
+	return 0, ErrNoRemoteCache
+}
+
+func (f *fsCache) Capabilities() (BackendCapabilities, error) {
+	return BackendCapabilities{}, ErrNoRemoteCache
+}
+
+func (f *fsCache) put(anchor turbopath.AbsoluteSystemPath, hash string, duration int, files []turbopath.AnchoredSystemPath) error {
 	cachePath := f.cacheDirectory.UntypedJoin(hash + ".tar.zst")
 	cacheItem, err := cacheitem.Create(cachePath)
 	if err != nil {
 		return err
 	}
+	cacheItem.PreserveXattrs = f.preserveXattrs
 
 	for _, file := range files {
 		err := cacheItem.AddFile(anchor, file)
@@ -172,3 +280,9 @@ func ReadCacheMetaFile(path turbopath.AbsoluteSystemPath) (*CacheMetadata, error
 	}
 	return &config, nil
 }
+
+// restoreCheckpointPath is where progress restoring the given artifact is
+// checkpointed when restores are resumable.
+func restoreCheckpointPath(dir turbopath.AbsoluteSystemPath, hash string) turbopath.AbsoluteSystemPath {
+	return dir.UntypedJoin(hash + ".restore-checkpoint")
+}
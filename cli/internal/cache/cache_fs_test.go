@@ -251,3 +251,48 @@ func TestFetch(t *testing.T) {
 	assert.NilError(t, circleReadlinkErr, "Circle Readlink")
 	assert.Equal(t, circleTarget, srcCircleLinkTarget.ToString())
 }
+
+func TestFsCacheEvents(t *testing.T) {
+	src := turbopath.AbsoluteSystemPath(t.TempDir())
+	assert.NilError(t, src.UntypedJoin("a").WriteFile([]byte("a"), 0644), "WriteFile")
+	files := turbopath.AnchoredUnixPathArray{"a"}.ToSystemPathArray()
+
+	var events []CacheEvent
+	cache, err := newFsCache(Opts{
+		OverrideDir:  t.TempDir(),
+		OnCacheEvent: func(event CacheEvent) { events = append(events, event) },
+	}, &dummyRecorder{}, src)
+	assert.NilError(t, err, "newFsCache")
+
+	assert.NilError(t, cache.Put(src, "the-hash", 10, files), "Put")
+	err = cache.Put(src, "other-hash", 10, turbopath.AnchoredUnixPathArray{"missing"}.ToSystemPathArray())
+	assert.Assert(t, err != nil, "Put of a missing file")
+	_, _, _, err = cache.Fetch(src, "the-hash", nil)
+	assert.NilError(t, err, "Fetch")
+
+	assert.DeepEqual(t, events, []CacheEvent{
+		{Source: CacheSourceFS, Event: CacheEventUpload, Hash: "the-hash", Duration: 10},
+		{Source: CacheSourceFS, Event: CacheEventError, Hash: "other-hash"},
+		{Source: CacheSourceFS, Event: CacheEventHit, Hash: "the-hash", Duration: 10},
+	})
+}
+
+func TestFsCacheTempDir(t *testing.T) {
+	src := turbopath.AbsoluteSystemPath(t.TempDir())
+	assert.NilError(t, src.UntypedJoin("a").WriteFile([]byte("a"), 0644), "WriteFile")
+	files := turbopath.AnchoredUnixPathArray{"a"}.ToSystemPathArray()
+	tempDir := turbopath.AbsoluteSystemPath(t.TempDir()).UntypedJoin("staging")
+
+	cache, err := newFsCache(Opts{OverrideDir: t.TempDir(), TempDir: tempDir.ToString()}, &dummyRecorder{}, src)
+	assert.NilError(t, err, "newFsCache")
+	assert.NilError(t, cache.Put(src, "the-hash", 10, files), "Put")
+	assert.NilError(t, src.UntypedJoin("a").Remove(), "Remove")
+
+	_, restored, _, err := cache.Fetch(src, "the-hash", nil)
+	assert.NilError(t, err, "Fetch")
+	assert.DeepEqual(t, restored, files)
+	assert.Assert(t, tempDir.DirExists(), "restore is staged in TempDir")
+	staged, err := filepath.Glob(tempDir.UntypedJoin("*").ToString())
+	assert.NilError(t, err, "Glob")
+	assert.Equal(t, len(staged), 0, "staging dir is cleaned up")
+}
@@ -0,0 +1,53 @@
+package cache
+
+import (
+	"net/http"
+	"time"
+)
+
+// hedgeResult is the outcome of one of the requests raced by hedge.
+type hedgeResult struct {
+	resp *http.Response
+	err  error
+}
+
+// hedge makes request, and makes it again in parallel if it hasn't completed
+// within the hedge delay, returning whichever completes first. The client
+// can't abort a request in flight, so the slower response is discarded when
+// it arrives. If the first request to complete fails, hedge waits for the
+// other instead. request must be idempotent; see Opts.HedgeDelay.
+func (cache *httpCache) hedge(request func() (*http.Response, error)) (*http.Response, error) {
+	if cache.hedgeDelay <= 0 {
+		return request()
+	}
+	results := make(chan hedgeResult, 2)
+	do := func() {
+		resp, err := request()
+		results <- hedgeResult{resp, err}
+	}
+	go do()
+
+	timer := time.NewTimer(cache.hedgeDelay)
+	select {
+	case result := <-results:
+		timer.Stop()
+		return result.resp, result.err
+	case <-timer.C:
+	}
+	go do()
+
+	first := <-results
+	if first.err != nil {
+		second := <-results
+		return second.resp, second.err
+	}
+	go discardResponse(results)
+	return first.resp, first.err
+}
+
+// discardResponse closes the body of the response that lost a hedged race.
+func discardResponse(results <-chan hedgeResult) {
+	if result := <-results; result.resp != nil {
+		_ = result.resp.Body.Close()
+	}
+}
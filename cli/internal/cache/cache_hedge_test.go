@@ -0,0 +1,89 @@
+package cache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vercel/turbo/cli/internal/fs"
+	"gotest.tools/v3/assert"
+)
+
+// slowFirstClient stalls its first request until release is closed, and
+// answers the rest immediately.
+type slowFirstClient struct {
+	artifactResp
+	requests int32
+	release  chan struct{}
+}
+
+func (sc *slowFirstClient) wait() {
+	if atomic.AddInt32(&sc.requests, 1) == 1 {
+		<-sc.release
+	}
+}
+
+func (sc *slowFirstClient) FetchArtifact(hash string) (*http.Response, error) {
+	sc.wait()
+	return sc.artifactResp.FetchArtifact(hash)
+}
+
+func (sc *slowFirstClient) ArtifactExists(hash string) (*http.Response, error) {
+	sc.wait()
+	return sc.artifactResp.ArtifactExists(hash)
+}
+
+func TestHedgeDelay(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+
+	t.Run("hedges slow reads", func(t *testing.T) {
+		client := &slowFirstClient{release: make(chan struct{})}
+		defer close(client.release)
+		cache := newHTTPCache(Opts{HedgeDelay: 10 * time.Millisecond}, client, &nullRecorder{}, root)
+		assert.Assert(t, cache.Exists("the-hash").Remote)
+		assert.Equal(t, atomic.LoadInt32(&client.requests), int32(2))
+	})
+
+	t.Run("doesn't hedge fast reads", func(t *testing.T) {
+		client := &slowFirstClient{release: make(chan struct{})}
+		close(client.release)
+		cache := newHTTPCache(Opts{HedgeDelay: time.Minute}, client, &nullRecorder{}, root)
+		assert.Assert(t, cache.Exists("the-hash").Remote)
+		assert.Equal(t, atomic.LoadInt32(&client.requests), int32(1))
+	})
+
+	t.Run("closes the losing response", func(t *testing.T) {
+		cache := newHTTPCache(Opts{HedgeDelay: time.Millisecond}, &artifactResp{}, &nullRecorder{}, root)
+		release := make(chan struct{})
+		closed := make(chan struct{})
+		var requests int32
+		resp, err := cache.hedge(func() (*http.Response, error) {
+			if atomic.AddInt32(&requests, 1) == 1 {
+				<-release
+				return &http.Response{Body: &closeNotifier{closed: closed}}, nil
+			}
+			return &http.Response{Body: ioutil.NopCloser(&bytes.Buffer{})}, nil
+		})
+		assert.NilError(t, err)
+		_ = resp.Body.Close()
+		close(release)
+		select {
+		case <-closed:
+		case <-time.After(10 * time.Second):
+			t.Error("losing response was never closed")
+		}
+	})
+}
+
+type closeNotifier struct {
+	bytes.Buffer
+	closed chan struct{}
+}
+
+func (cn *closeNotifier) Close() error {
+	close(cn.closed)
+	return nil
+}
@@ -5,16 +5,26 @@ package cache
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/hashicorp/go-hclog"
 	"github.com/vercel/turbo/cli/internal/analytics"
 	"github.com/vercel/turbo/cli/internal/cacheitem"
 	"github.com/vercel/turbo/cli/internal/turbopath"
+	"github.com/vercel/turbo/cli/internal/util"
 )
 
 type client interface {
@@ -24,97 +34,1082 @@ type client interface {
 	GetTeamID() string
 }
 
+// ArtifactPacker builds an artifact for the remote cache out of files on disk.
+// *cacheitem.CacheItem is the default implementation.
+type ArtifactPacker interface {
+	// AddFile adds a file, relative to fsAnchor, to the artifact.
+	AddFile(fsAnchor turbopath.AbsoluteSystemPath, filePath turbopath.AnchoredSystemPath) error
+	// Close finishes the artifact and closes the underlying writer.
+	Close() error
+}
+
+var _ RemoteOperations = (*httpCache)(nil)
+
 type httpCache struct {
+	// Must be used via atomic package. Kept first in the struct to guarantee
+	// 64-bit alignment on 32-bit platforms.
+	downloadedBytes int64
+
 	writable       bool
+	writableReason string // why writable is false, e.g. "PR build"
 	client         client
 	requestLimiter limiter
 	recorder       analytics.Recorder
 	signerVerifier *ArtifactSignatureAuthentication
 	repoRoot       turbopath.AbsoluteSystemPath
+
+	compressionThreads int
+	compressionLevel   int
+	compressionTiers   []CompressionTier
+	autoCodec          bool
+	seekable           bool
+	solid              bool
+	onCacheEvent       OnCacheEvent
+	maxDownloadBytes   int64
+	preserveXattrs     bool
+	streamVerify       bool
+	verifyFailureMiss  bool
+	quarantineBad      bool
+	contentAddressed   bool
+	deniedPatterns     []string
+	allowedPatterns    []string
+	isCacheable        func(hash string) bool
+	minArtifactSize    int64
+	skipSmallFetches   bool
+	maxFetchRatio      float64
+	hashRewriter       func(hash string) string
+	logger             hclog.Logger
+	retryBudget        *util.RetryBudget
+	tarBuildTimeout    time.Duration
+	newArtifactPacker  func(w io.WriteCloser) ArtifactPacker
+	warnOnDivergence   bool
+	restoreMode        cacheitem.RestoreMode
+	maxFiles           int
+	maxDecompressed    int64
+	maxRatio           int
+	fsync              bool
+	verifyCount        bool
+	umask              os.FileMode
+	downloadChunks     int
+	hedgeDelay         time.Duration
+	deltaUploads       bool
+	// deltaUnsupported is set once the backend has refused a delta upload.
+	deltaUnsupported int32
+	// checkpointDir is where restore checkpoints are kept, if restores are
+	// resumable.
+	checkpointDir    turbopath.AbsoluteSystemPath
+	dictionary       []byte
+	tokenRefresh     func() (string, error)
+	includeManifest  bool
+	manifestHashAlgo string
+	deadline         func() time.Time
+	missStatusCodes  []int
+	preUploadHook    func(tarBytes []byte) error
+	// spillThreshold is the artifact size above which Put buffers to a
+	// temporary file instead of memory. Zero disables spilling.
+	spillThreshold int64
+	// tempDir is where temporary files are staged; see Opts.TempDir.
+	tempDir turbopath.AbsoluteSystemPath
+	// failedOps holds the first _maxFailedOps failed operations of the run.
+	failedOps   []FailedOp
+	failedOpsMu sync.Mutex
+	// clockSkewOnce ensures clock skew is reported at most once.
+	clockSkewOnce sync.Once
+	// etags holds the ETag of every artifact mirrored during this run.
+	etags   map[string]string
+	etagMu  sync.Mutex
+	tokenMu sync.Mutex
+	// captureHeaders enables LastResponseHeaders; see Opts.DebugCaptureHeaders.
+	captureHeaders bool
+	headersMu      sync.Mutex
+	lastHeaders    http.Header
+	headersByHash  map[string]http.Header
+	// mirror, if set, holds a local copy of every artifact fetched from the
+	// remote cache so that repeat fetches on this machine are served locally.
+	mirror *fsCache
+	// restoreLimiter bounds concurrent restores, separately from requestLimiter.
+	// It is shared with the filesystem cache; see Opts.MaxConcurrentRestores.
+	restoreLimiter limiter
+	metrics        httpMetrics
+	// verificationFailures counts artifacts that failed verification from
+	// each replica, with the primary first. It is nil without replicas; see
+	// Opts.RemoteCacheReplicas. Must be used via atomic package.
+	verificationFailures []int64
+	// memory bounds the buffers held by downloads; see Opts.MaxCacheMemoryBytes.
+	memory *memoryBudget
+	// provenance, if set, is attested to for every upload; see Opts.Provenance.
+	provenance *Provenance
+	// verifyProvenance is Opts.VerifyProvenance.
+	verifyProvenance bool
+	// smallArtifacts holds the hashes of artifacts not uploaded in this run
+	// because they were under Opts.MinRemoteArtifactSize.
+	smallArtifacts map[string]bool
+	smallMu        sync.Mutex
+	// quarantine maps the hashes of artifacts that failed verification to
+	// the reason; see Opts.QuarantineBadArtifacts.
+	quarantine   map[string]string
+	quarantineMu sync.Mutex
+	// caps are the backend's capabilities, discovered once; see Capabilities.
+	capsOnce sync.Once
+	caps     BackendCapabilities
+	capsErr  error
 }
 
+// limiter bounds concurrency to its capacity. A nil limiter doesn't limit.
 type limiter chan struct{}
 
 func (l limiter) acquire() {
-	l <- struct{}{}
+	if l != nil {
+		l <- struct{}{}
+	}
 }
 
 func (l limiter) release() {
-	<-l
+	if l != nil {
+		<-l
+	}
+}
+
+// UploadResult describes the outcome of a Put in a uniform, machine-readable
+// form, e.g. to aggregate across a run for dashboards.
+type UploadResult struct {
+	Hash string
+	// Uploaded is true if the artifact was sent to the remote cache.
+	Uploaded bool
+	// Skipped is true if the artifact was deliberately not sent, e.g. because
+	// its hash is excluded by Opts.CacheablePredicate or the remote cache is
+	// read-only.
+	Skipped bool
+	// CompressedBytes and UncompressedBytes are the size of the uploaded
+	// artifact and of the files in it. They are only set if it was uploaded.
+	CompressedBytes   int64
+	UncompressedBytes int64
+	// Duration is how long the upload took, including building the artifact.
+	Duration time.Duration
+	// Attempts is how many times the upload was tried, e.g. 2 if it was tried
+	// again after refreshing an expired token. Retries made by the client
+	// within an attempt aren't counted.
+	Attempts int
+	// Err is the error Put would have returned.
+	Err error
 }
 
 func (cache *httpCache) Put(anchor turbopath.AbsoluteSystemPath, hash string, duration int, files []turbopath.AnchoredSystemPath) error {
-	// if cache.writable {
+	return cache.PutWithResult(anchor, hash, duration, files).Err
+}
+
+// PutWithResult is like Put, but reports what happened to the artifact, e.g.
+// for summaries like "uploaded 3, skipped 17".
+func (cache *httpCache) PutWithResult(anchor turbopath.AbsoluteSystemPath, hash string, duration int, files []turbopath.AnchoredSystemPath) UploadResult {
+	return cache.putWithResult(anchor, hash, duration, files, putOptions{})
+}
+
+// putOptions are what the ways of storing an artifact, such as
+// PutWithAliases, add to a plain Put.
+type putOptions struct {
+	// aliases are more hashes the artifact is made available under.
+	aliases []string
+	// artifact, if set, is uploaded instead of building one from files; see
+	// ImportArtifact.
+	artifact []byte
+	// immutable pins the artifact; see PutImmutable.
+	immutable bool
+	// baseHash, if set, is the artifact to upload a delta against; see
+	// PutWithBase.
+	baseHash string
+}
+
+// putWithResult does the work of every Put variant, so that they all share the
+// same checks, retries and reporting.
+func (cache *httpCache) putWithResult(anchor turbopath.AbsoluteSystemPath, hash string, duration int, files []turbopath.AnchoredSystemPath, opts putOptions) UploadResult {
+	result := UploadResult{Hash: hash}
+	hash = cache.rewriteHash(hash)
+	if !cache.writable || !cache.cacheable(hash) {
+		result.Skipped = true
+		return result
+	}
+	if cache.minArtifactSize > 0 && opts.artifact == nil && inputSize(anchor, files) < cache.minArtifactSize {
+		cache.rememberSmall(hash)
+		cache.logTooSmall(hash)
+		result.Skipped = true
+		return result
+	}
+	if result.Err = cache.checkRunBudget(); result.Err != nil {
+		return result
+	}
+
 	cache.requestLimiter.acquire()
 	defer cache.requestLimiter.release()
 
+	start := time.Now()
+	result.Attempts = 1
+	size, err := cache.put(anchor, hash, duration, files, opts)
+	if cache.refreshToken(err) {
+		result.Attempts++
+		size, err = cache.put(anchor, hash, duration, files, opts)
+	}
+	result.Duration = time.Since(start)
+	cache.metrics.observe("put", result.Duration)
+	cache.logPut(err, hash, duration, size)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	result.Uploaded = true
+	result.CompressedBytes = size.compressed
+	result.UncompressedBytes = size.uncompressed
+	return result
+}
+
+// artifactSize is the size of an uploaded artifact, for CacheEvent.
+type artifactSize struct {
+	compressed   int64
+	uncompressed int64
+	// digest is the hex sha256 of the artifact, only computed if provenance
+	// is attached.
+	digest string
+	// codec is the codec chosen by Opts.AutoCodec, if it's set.
+	codec string
+}
+
+func (cache *httpCache) put(anchor turbopath.AbsoluteSystemPath, hash string, duration int, files []turbopath.AnchoredSystemPath, opts putOptions) (artifactSize, error) {
+	size, err := cache.putArtifact(anchor, hash, duration, files, opts)
+	if err == nil && cache.provenance != nil {
+		err = cache.putProvenance(hash, size.digest)
+	}
+	return size, err
+}
+
+func (cache *httpCache) putArtifact(anchor turbopath.AbsoluteSystemPath, hash string, duration int, files []turbopath.AnchoredSystemPath, opts putOptions) (artifactSize, error) {
+	// Aliases may need the artifact again, so it's kept in memory.
+	if cache.spillThreshold > 0 && cache.preUploadHook == nil && !cache.contentAddressed && len(opts.aliases) == 0 && opts.artifact == nil && !opts.immutable && opts.baseHash == "" {
+		if putter, ok := cache.client.(readerPutter); ok {
+			return cache.putSpilled(putter, anchor, hash, duration, files)
+		}
+	}
+
+	var artifactBody []byte
+	var size artifactSize
+	var err error
+	if opts.artifact != nil {
+		artifactBody, size = opts.artifact, artifactSize{compressed: int64(len(opts.artifact))}
+		if cache.provenance != nil {
+			size.digest, err = artifactDigest(bytes.NewReader(artifactBody))
+		}
+	} else {
+		artifactBody, size, err = cache.buildArtifact(anchor, files)
+	}
+	if err != nil {
+		return artifactSize{}, err
+	}
+	switch {
+	case opts.immutable:
+		err = cache.uploadImmutable(hash, artifactBody, duration)
+	case opts.baseHash != "":
+		err = cache.uploadDelta(hash, opts.baseHash, artifactBody, duration)
+	default:
+		err = cache.upload(hash, artifactBody, duration)
+	}
+	if err != nil {
+		return size, err
+	}
+	return size, cache.putAliases(hash, opts.aliases, artifactBody, duration, size)
+}
+
+// buildArtifact packs files into an artifact, ready to be signed and uploaded.
+func (cache *httpCache) buildArtifact(anchor turbopath.AbsoluteSystemPath, files []turbopath.AnchoredSystemPath) ([]byte, artifactSize, error) {
+	start := time.Now()
 	r, w := io.Pipe()
 
+	var size artifactSize
 	cacheErrorChan := make(chan error, 1)
-	go cache.write(w, anchor, files, cacheErrorChan)
+	go cache.write(w, anchor, files, &size, cacheErrorChan)
 
 	// Read the entire artifact tar into memory so we can easily compute the signature.
 	// Note: retryablehttp.NewRequest reads the files into memory anyways so there's no
 	// additional overhead by doing the ioutil.ReadAll here instead.
-	artifactBody, err := ioutil.ReadAll(r)
+	artifactBody, err := cache.readArtifact(r)
 	if err != nil {
-		return fmt.Errorf("failed to store files in HTTP cache: %w", err)
+		return nil, artifactSize{}, fmt.Errorf("failed to store files in HTTP cache: %w", err)
 	}
-	tag := ""
-	if cache.signerVerifier.isEnabled() {
-		tag, err = cache.signerVerifier.generateTag(hash, artifactBody)
+
+	cacheCreateError := <-cacheErrorChan
+	if cacheCreateError != nil {
+		return nil, artifactSize{}, cacheCreateError
+	}
+	cache.metrics.timePhase("compress", start)
+
+	if cache.preUploadHook != nil {
+		// Hand the hook a copy, so it can't change what we sign and upload by
+		// mutating the buffer in place.
+		if err := cache.preUploadHook(append([]byte(nil), artifactBody...)); err != nil {
+			return nil, artifactSize{}, fmt.Errorf("pre-upload hook rejected artifact: %w", err)
+		}
+	}
+	size.compressed = int64(len(artifactBody))
+	if cache.provenance != nil {
+		size.digest, _ = artifactDigest(bytes.NewReader(artifactBody))
+	}
+	return artifactBody, size, nil
+}
+
+// upload stores an artifact for hash, under its content digest if
+// Opts.ContentAddressed is set.
+func (cache *httpCache) upload(hash string, artifactBody []byte, duration int) error {
+	if cache.contentAddressed {
+		return cache.uploadContentAddressed(hash, artifactBody, duration)
+	}
+	return cache.uploadAs(hash, artifactBody, duration)
+}
+
+// uploadAs signs an artifact for key, if signing is enabled, and uploads it.
+func (cache *httpCache) uploadAs(key string, artifactBody []byte, duration int) error {
+	tag, signedAt, err := cache.sign(key, artifactBody)
+	if err != nil {
+		return err
+	}
+	defer cache.metrics.timePhase("upload", time.Now())
+	if signedAt != "" {
+		return cache.putTimestamped(key, bytes.NewReader(artifactBody), int64(len(artifactBody)), duration, tag, signedAt)
+	}
+	return cache.client.PutArtifact(key, artifactBody, duration, tag)
+}
+
+// sign returns the tag and signing time for an artifact, which are empty if
+// signing is disabled.
+func (cache *httpCache) sign(hash string, artifactBody []byte) (tag string, signedAt string, err error) {
+	return cache.signReader(hash, bytes.NewReader(artifactBody))
+}
+
+// signReader is like sign, but streams the artifact from body, e.g. from a
+// file it was spilled to.
+func (cache *httpCache) signReader(hash string, body io.Reader) (tag string, signedAt string, err error) {
+	if !cache.signerVerifier.isEnabled() {
+		return "", "", nil
+	}
+	signedAt = cache.signerVerifier.signingTime()
+	tag, err = cache.signerVerifier.stamp(signedAt).generateTagReader(hash, body)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to store files in HTTP cache: %w", err)
+	}
+	return tag, signedAt, nil
+}
+
+// timestampedPutter is implemented by clients that can send the time an
+// artifact was signed alongside it, as x-artifact-signed-at.
+type timestampedPutter interface {
+	PutArtifactSignedAt(hash string, body io.ReadSeeker, size int64, duration int, tag string, signedAt string) error
+}
+
+// putTimestamped uploads an artifact whose tag covers signedAt. See
+// Opts.SignatureFreshness.
+func (cache *httpCache) putTimestamped(hash string, body io.ReadSeeker, size int64, duration int, tag string, signedAt string) error {
+	putter, ok := cache.client.(timestampedPutter)
+	if !ok {
+		return errors.New("failed to store files in HTTP cache: the remote cache client can't send signing timestamps")
+	}
+	return putter.PutArtifactSignedAt(hash, body, size, duration, tag, signedAt)
+}
+
+// aliasRegistrar is implemented by clients whose backend can point an alias
+// hash at an existing artifact without a second upload.
+type aliasRegistrar interface {
+	RegisterArtifactAlias(hash string, alias string) error
+}
+
+// PutWithAliases stores an artifact under hash and also makes it available
+// under each of aliases, e.g. while migrating between hashing schemes so that
+// consumers on either scheme get hits. The artifact is built once. Aliases are
+// registered as pointers when the backend supports it and artifacts aren't
+// signed (since signatures are bound to the hash); otherwise the artifact is
+// uploaded again under each alias. Otherwise it is stored as Put stores it.
+func (cache *httpCache) PutWithAliases(anchor turbopath.AbsoluteSystemPath, hash string, aliases []string, duration int, files []turbopath.AnchoredSystemPath) error {
+	return cache.putWithResult(anchor, hash, duration, files, putOptions{aliases: aliases}).Err
+}
+
+// putAliases makes artifactBody, which has been stored under hash, available
+// under each of aliases too; see PutWithAliases.
+func (cache *httpCache) putAliases(hash string, aliases []string, artifactBody []byte, duration int, size artifactSize) error {
+	if len(aliases) == 0 {
+		return nil
+	}
+	registrar, canRegister := cache.client.(aliasRegistrar)
+	// Content-addressed artifacts aren't stored under hash, so there's
+	// nothing to point an alias at; each alias gets an index entry instead.
+	canRegister = canRegister && !cache.signerVerifier.isEnabled() && !cache.contentAddressed && cache.capabilities().Aliases
+	for _, alias := range aliases {
+		alias = cache.rewriteHash(alias)
+		var err error
+		if canRegister {
+			err = registrar.RegisterArtifactAlias(hash, alias)
+		} else {
+			err = cache.upload(alias, artifactBody, duration)
+		}
+		cache.logPut(err, alias, duration, size)
 		if err != nil {
-			return fmt.Errorf("failed to store files in HTTP cache: %w", err)
+			return fmt.Errorf("failed to store alias %v: %w", alias, err)
 		}
 	}
+	return nil
+}
 
-	cacheCreateError := <-cacheErrorChan
-	if cacheCreateError != nil {
-		return cacheCreateError
+// immutablePutter is implemented by clients that can ask the remote cache to
+// protect an artifact from being overwritten.
+type immutablePutter interface {
+	PutArtifactImmutable(hash string, body io.ReadSeeker, size int64, duration int, tag string, signedAt string) error
+}
+
+// PutImmutable is like Put, but pins the artifact so that the remote cache
+// rejects later uploads for hash with ErrArtifactImmutable, e.g. for release
+// builds that must never be replaced. Backends that don't support immutable
+// artifacts store it as a regular, overwritable artifact; PutImmutable can't
+// tell the difference, so the pin is best-effort. Content-addressed
+// artifacts, which other tasks' artifacts may share, are never pinned.
+func (cache *httpCache) PutImmutable(anchor turbopath.AbsoluteSystemPath, hash string, duration int, files []turbopath.AnchoredSystemPath) error {
+	return cache.putWithResult(anchor, hash, duration, files, putOptions{immutable: cache.canPin(hash)}).Err
+}
+
+// canPin reports whether PutImmutable can pin the artifact for hash.
+func (cache *httpCache) canPin(hash string) bool {
+	_, ok := cache.client.(immutablePutter)
+	if ok && cache.contentAddressed {
+		cache.logger.Debug("content-addressed artifacts can't be pinned, uploading as a regular artifact", "hash", hash)
+		return false
+	}
+	if !ok || !cache.capabilities().Immutable {
+		cache.logger.Debug("remote cache can't pin artifacts, uploading as a regular artifact", "hash", hash)
+		return false
+	}
+	return true
+}
+
+// uploadImmutable is like uploadAs, but asks the remote cache to pin the
+// artifact. See PutImmutable.
+func (cache *httpCache) uploadImmutable(hash string, artifactBody []byte, duration int) error {
+	tag, signedAt, err := cache.sign(hash, artifactBody)
+	if err != nil {
+		return err
 	}
+	defer cache.metrics.timePhase("upload", time.Now())
+	return cache.client.(immutablePutter).PutArtifactImmutable(hash, bytes.NewReader(artifactBody), int64(len(artifactBody)), duration, tag, signedAt)
+}
+
+// readArtifact reads the artifact being built by write into memory.
+func (cache *httpCache) readArtifact(r *io.PipeReader) ([]byte, error) {
+	var body []byte
+	err := cache.readWithTimeout(r, func() error {
+		var err error
+		body, err = ioutil.ReadAll(r)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// readWithTimeout runs read, which consumes the artifact being built by write,
+// giving up after tarBuildTimeout if one is configured. On timeout the pipe is
+// closed, so both write and read fail on their next use of it rather than
+// blocking forever.
+func (cache *httpCache) readWithTimeout(r *io.PipeReader, read func() error) error {
+	if cache.tarBuildTimeout <= 0 {
+		return read()
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- read()
+	}()
+
+	timer := time.NewTimer(cache.tarBuildTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+		_ = r.CloseWithError(ErrTarConstructionTimeout)
+		return ErrTarConstructionTimeout
+	}
+}
+
+// newPacker returns the packer used to build an artifact into w.
+func (cache *httpCache) newPacker(w io.WriteCloser, level int) ArtifactPacker {
+	if cache.newArtifactPacker != nil {
+		return cache.newArtifactPacker(w)
+	}
+	cacheItem := cacheitem.CreateWriter(w, cacheitem.CreateOpts{
+		CompressionThreads:    cache.compressionThreads,
+		CompressionLevel:      level,
+		Dictionary:            cache.dictionary,
+		IncludeManifest:       cache.includeManifest,
+		ManifestHashAlgorithm: cache.manifestHashAlgo,
+		SeekableCompression:   cache.seekable,
+		SolidCompression:      cache.solid,
+	})
+	cacheItem.PreserveXattrs = cache.preserveXattrs
+	return cacheItem
+}
+
+// CompressionTier selects the compression level for artifacts whose files
+// total at least MinInputSize bytes. See Opts.AdaptiveCompression.
+type CompressionTier struct {
+	MinInputSize int64
+	Level        int
+}
 
-	return cache.client.PutArtifact(hash, artifactBody, duration, tag)
+// DefaultCompressionTiers are the tiers used by Opts.AdaptiveCompression unless
+// others are configured.
+var DefaultCompressionTiers = []CompressionTier{
+	{MinInputSize: 0, Level: 1},
+	{MinInputSize: 4 << 20, Level: 3},
+	{MinInputSize: 64 << 20, Level: 9},
 }
 
-// write writes a series of files into the given Writer.
-func (cache *httpCache) write(w io.WriteCloser, anchor turbopath.AbsoluteSystemPath, files []turbopath.AnchoredSystemPath, cacheErrorChan chan error) {
-	cacheItem := cacheitem.CreateWriter(w)
+// levelFor picks the compression level for an artifact of the given files.
+// The compressed size isn't known until the artifact is packed, so adaptive
+// compression goes by the total size of the inputs.
+func (cache *httpCache) levelFor(anchor turbopath.AbsoluteSystemPath, files []turbopath.AnchoredSystemPath) int {
+	if len(cache.compressionTiers) == 0 {
+		return cache.compressionLevel
+	}
+	inputSize := inputSize(anchor, files)
+	level := cache.compressionLevel
+	var best *CompressionTier
+	for i, tier := range cache.compressionTiers {
+		if tier.MinInputSize <= inputSize && (best == nil || tier.MinInputSize > best.MinInputSize) {
+			best = &cache.compressionTiers[i]
+		}
+	}
+	if best != nil {
+		level = best.Level
+	}
+	return level
+}
 
+// inputSize returns the total size of the regular files among files.
+func inputSize(anchor turbopath.AbsoluteSystemPath, files []turbopath.AnchoredSystemPath) int64 {
+	var size int64
 	for _, file := range files {
-		err := cacheItem.AddFile(anchor, file)
+		if info, err := file.RestoreAnchor(anchor).Lstat(); err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// write writes a series of files into the given Writer. If size is set, the
+// total size of the regular files written, and the codec chosen by
+// Opts.AutoCodec, are stored in it before the result is sent on cacheErrorChan.
+func (cache *httpCache) write(w io.WriteCloser, anchor turbopath.AbsoluteSystemPath, files []turbopath.AnchoredSystemPath, size *artifactSize, cacheErrorChan chan error) {
+	level := cache.levelFor(anchor, files)
+	if cache.autoCodec {
+		level = cache.chooseLevel(anchor, files, level)
+		if size != nil {
+			size.codec = codecName(level)
+		}
+	}
+	cacheItem := cache.newPacker(w, level)
+
+	// Add files in a stable order so that identical file sets always produce
+	// byte-identical artifacts, regardless of the order the caller found them in.
+	sortedFiles := make([]turbopath.AnchoredSystemPath, len(files))
+	copy(sortedFiles, files)
+	sort.Slice(sortedFiles, func(i, j int) bool {
+		return sortedFiles[i].ToUnixPath() < sortedFiles[j].ToUnixPath()
+	})
+
+	for _, file := range sortedFiles {
+		err := cache.checkContent(anchor, file)
+		if err == nil {
+			err = cacheItem.AddFile(anchor, file)
+		}
 		if err != nil {
 			_ = cacheItem.Close()
 			cacheErrorChan <- err
 			return
 		}
+		if size != nil {
+			if info, err := file.RestoreAnchor(anchor).Lstat(); err == nil && info.Mode().IsRegular() {
+				size.uncompressed += info.Size()
+			}
+		}
 	}
 
 	cacheErrorChan <- cacheItem.Close()
 }
 
-func (cache *httpCache) Fetch(_ turbopath.AbsoluteSystemPath, key string, _ []string) (ItemStatus, []turbopath.AnchoredSystemPath, int, error) {
+// FetchResult describes the outcome of a Fetch in the same form as
+// UploadResult.
+type FetchResult struct {
+	Hash   string
+	Status ItemStatus
+	// Files are the files restored on a hit.
+	Files []turbopath.AnchoredSystemPath
+	// TimeSaved is the duration recorded with the artifact, in milliseconds.
+	TimeSaved int
+	// Duration is how long the fetch took, including restoring the artifact.
+	Duration time.Duration
+	// Attempts is how many times the artifact was requested from the remote
+	// cache, which is 0 if it was served from the local mirror or skipped.
+	Attempts int
+	// Err is the error Fetch would have returned.
+	Err error
+}
+
+func (cache *httpCache) Fetch(anchor turbopath.AbsoluteSystemPath, key string, files []string) (ItemStatus, []turbopath.AnchoredSystemPath, int, error) {
+	result := cache.FetchWithResult(anchor, key, files)
+	return result.Status, result.Files, result.TimeSaved, result.Err
+}
+
+// FetchWithResult is like Fetch, but reports the outcome as a FetchResult.
+func (cache *httpCache) FetchWithResult(_ turbopath.AbsoluteSystemPath, key string, _ []string) FetchResult {
+	start := time.Now()
+	result := FetchResult{Hash: key}
+	result.Status, result.Files, result.TimeSaved, result.Err = cache.fetch(key, &result.Attempts)
+	result.Duration = time.Since(start)
+	return result
+}
+
+// fetch does the work of Fetch, counting requests for the artifact in attempts.
+func (cache *httpCache) fetch(key string, attempts *int) (ItemStatus, []turbopath.AnchoredSystemPath, int, error) {
+	key = cache.rewriteHash(key)
+	if !cache.cacheable(key) {
+		return ItemStatus{Remote: false, SkipReason: SkipReasonExcluded}, nil, 0, nil
+	}
+	if cache.knownSmall(key) {
+		cache.logTooSmall(key)
+		return ItemStatus{Remote: false, SkipReason: SkipReasonTooSmall}, nil, 0, nil
+	}
+	if cache.quarantined(key) {
+		cache.logFetch(false, key, 0, 0)
+		return ItemStatus{MissReason: MissReasonVerificationFailed}, nil, 0, nil
+	}
+	// If we downloaded this artifact earlier in the run, revalidate our mirrored
+	// copy with a conditional request. Otherwise, trust the mirror outright.
+	ifNoneMatch := ""
+	if cache.mirror != nil {
+		ifNoneMatch = cache.lookupETag(key)
+		if ifNoneMatch == "" {
+			itemStatus, files, duration, err := cache.mirror.fetch(cache.repoRoot, key)
+			if err == nil && itemStatus.Local {
+				itemStatus.Source = ItemSourceLocalMirror
+				return itemStatus, files, duration, nil
+			}
+		}
+	}
+	if cache.downloadBudgetExceeded() {
+		cache.logBudgetExceeded(key)
+		return ItemStatus{Remote: false, SkipReason: SkipReasonBudgetExceeded}, nil, 0, nil
+	}
+	if err := cache.checkRunBudget(); err != nil {
+		return ItemStatus{Remote: false, SkipReason: SkipReasonRunBudgetExhausted}, nil, 0, err
+	}
+
 	cache.requestLimiter.acquire()
 	defer cache.requestLimiter.release()
-	hit, files, duration, err := cache.retrieve(key)
+	start := time.Now()
+	defer func() { cache.metrics.observe("fetch", time.Since(start)) }()
+	*attempts++
+	var downloaded int64
+	hit, files, duration, err := cache.retrieve(key, ifNoneMatch, &downloaded)
+	if cache.refreshToken(err) {
+		*attempts++
+		hit, files, duration, err = cache.retrieve(key, ifNoneMatch, &downloaded)
+	}
+	resetErr := &connectionResetError{}
+	if errors.As(err, &resetErr) {
+		cache.logger.Debug("remote cache connection was reset, retrying download", "hash", key, "error", err)
+		*attempts++
+		hit, files, duration, err = cache.retrieve(key, ifNoneMatch, &downloaded)
+	}
+	if errors.Is(err, errFetchTooSlow) {
+		cache.logger.Debug("remote cache download is slower than rebuilding, treating it as a miss", "hash", key)
+		cache.logFetch(false, key, 0, downloaded)
+		return ItemStatus{Remote: false, SkipReason: SkipReasonTooSlow}, nil, 0, nil
+	}
+	if errors.Is(err, errNotModified) {
+		itemStatus, files, duration, err := cache.mirror.fetch(cache.repoRoot, key)
+		if err == nil && itemStatus.Local {
+			cache.logFetch(true, key, duration, downloaded)
+			return ItemStatus{Remote: true, Source: ItemSourceRemote}, files, duration, nil
+		}
+		// Our copy has gone missing; download it again.
+		*attempts++
+		hit, files, duration, err = cache.retrieve(key, "", &downloaded)
+	}
+	if err != nil && cache.quarantineBad && errors.Is(err, ErrVerificationFailed) {
+		cache.quarantineArtifact(key, err)
+	}
+	if err != nil && cache.verifyFailureMiss && errors.Is(err, ErrVerificationFailed) {
+		cache.recordFailure("fetch", key, err)
+		cache.logger.Error("artifact failed verification, treating it as a miss and rebuilding", "hash", key, "error", err)
+		cache.logFetch(false, key, 0, downloaded)
+		return ItemStatus{MissReason: MissReasonVerificationFailed}, nil, 0, nil
+	}
 	if err != nil {
-		// TODO: analytics event?
+		cache.recordFailure("fetch", key, err)
+		payload := &CacheEvent{
+			Source: CacheSourceRemote,
+			Event:  CacheEventError,
+			Hash:   key,
+		}
+		recordEvent(cache.recorder, payload)
+		emitCacheEvent(cache.onCacheEvent, *payload)
 		return ItemStatus{Remote: false}, files, duration, fmt.Errorf("failed to retrieve files from HTTP cache: %w", err)
 	}
-	cache.logFetch(hit, key, duration)
-	return ItemStatus{Remote: hit}, files, duration, err
+	cache.logFetch(hit, key, duration, downloaded)
+	if hit && cache.mirror != nil {
+		if err := cache.mirror.put(cache.repoRoot, key, duration, files); err != nil {
+			cache.logger.Warn("failed to mirror artifact locally", "hash", key, "error", err)
+		}
+	}
+	return remoteStatus(hit), files, duration, err
 }
 
 func (cache *httpCache) Exists(key string) ItemStatus {
+	key = cache.rewriteHash(key)
+	if reason := cache.skipReason(key); reason != SkipReasonNone {
+		return ItemStatus{Remote: false, SkipReason: reason}
+	}
+	if cache.quarantined(key) {
+		return ItemStatus{Remote: false}
+	}
 	cache.requestLimiter.acquire()
 	defer cache.requestLimiter.release()
 	hit, err := cache.exists(key)
+	if cache.refreshToken(err) {
+		hit, err = cache.exists(key)
+	}
 	if err != nil {
+		cache.recordFailure("exists", key, err)
+		return ItemStatus{Remote: false}
+	}
+	return remoteStatus(hit)
+}
+
+// skipReason reports why Exists wouldn't ask the remote cache about hash.
+func (cache *httpCache) skipReason(hash string) SkipReason {
+	switch {
+	case !cache.cacheable(hash):
+		return SkipReasonExcluded
+	case cache.knownSmall(hash):
+		return SkipReasonTooSmall
+	case cache.checkRunBudget() != nil:
+		return SkipReasonRunBudgetExhausted
+	}
+	return SkipReasonNone
+}
+
+// remoteStatus is the ItemStatus of a remote cache hit or miss.
+func remoteStatus(hit bool) ItemStatus {
+	if !hit {
 		return ItemStatus{Remote: false}
 	}
-	return ItemStatus{Remote: hit}
+	return ItemStatus{Remote: true, Source: ItemSourceRemote}
+}
+
+// Writable reports whether artifacts are uploaded to the remote cache, and if
+// not, why not, e.g. so a run summary can explain "remote cache is read-only:
+// PR build" rather than silently skipping uploads.
+func (cache *httpCache) Writable() (bool, string) {
+	return cache.writable, cache.writableReason
+}
+
+// FailedOp describes a remote cache operation that failed.
+type FailedOp struct {
+	Hash string
+	// Op is the operation that failed: "fetch", "put" or "exists".
+	Op  string
+	Err error
+}
+
+// _maxFailedOps bounds how many failures are kept, so that a backend that is
+// down for the whole run doesn't grow the list without limit.
+const _maxFailedOps = 100
+
+// FailedOps returns the operations that have failed so far this run, oldest
+// first, e.g. so a run summary can list the artifacts that failed to upload.
+// Only the first 100 failures are kept.
+func (cache *httpCache) FailedOps() []FailedOp {
+	cache.failedOpsMu.Lock()
+	defer cache.failedOpsMu.Unlock()
+	return append([]FailedOp(nil), cache.failedOps...)
+}
+
+func (cache *httpCache) recordFailure(op string, hash string, err error) {
+	cache.metrics.failed()
+	cache.failedOpsMu.Lock()
+	defer cache.failedOpsMu.Unlock()
+	if len(cache.failedOps) < _maxFailedOps {
+		cache.failedOps = append(cache.failedOps, FailedOp{Hash: hash, Op: op, Err: err})
+	}
+}
+
+// ArtifactMetadata describes a remote artifact without its contents.
+// Fields whose header was absent from the response are left at their zero value.
+type ArtifactMetadata struct {
+	Hash string
+	// Size is the size of the artifact in bytes, from Content-Length.
+	Size int64
+	// Duration is the time in milliseconds the task took to run, from x-artifact-duration.
+	Duration int
+	// Tag is the artifact signature, from x-artifact-tag.
+	Tag string
+	// UploadedAt is when the artifact was stored, from Last-Modified.
+	UploadedAt time.Time
+	// Headers holds every x-artifact-* header returned, including ones we don't interpret.
+	Headers http.Header
+	// Provenance is the artifact's verified provenance attestation, if it has
+	// one. It is only looked up if Opts.VerifyProvenance is set.
+	Provenance *ProvenanceStatement
+}
+
+// ErrArtifactNotFound is returned by GetMetadata when the remote cache has no artifact for a hash
+var ErrArtifactNotFound = errors.New("artifact not found")
+
+// GetMetadata returns the metadata for an artifact using a HEAD request,
+// without downloading the artifact itself.
+func (cache *httpCache) GetMetadata(hash string) (ArtifactMetadata, error) {
+	hash = cache.rewriteHash(hash)
+	cache.requestLimiter.acquire()
+	defer cache.requestLimiter.release()
+
+	key, err := cache.artifactKey(hash)
+	if err != nil {
+		return ArtifactMetadata{}, err
+	} else if key == "" {
+		return ArtifactMetadata{}, ErrArtifactNotFound
+	}
+	resp, err := cache.client.ArtifactExists(key)
+	if err != nil {
+		return ArtifactMetadata{}, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if cache.isMiss(resp.StatusCode) {
+		return ArtifactMetadata{}, ErrArtifactNotFound
+	} else if resp.StatusCode != http.StatusOK {
+		return ArtifactMetadata{}, fmt.Errorf("failed to get artifact metadata: %v", resp.Status)
+	}
+
+	metadata := ArtifactMetadata{
+		Hash:     hash,
+		Duration: cache.parseDuration(hash, resp.Header.Get("x-artifact-duration")),
+		Tag:      resp.Header.Get("x-artifact-tag"),
+		Headers:  http.Header{},
+	}
+	if size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err == nil && size >= 0 {
+		metadata.Size = size
+	}
+	if uploadedAt, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		metadata.UploadedAt = uploadedAt
+	}
+	for name, values := range resp.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-artifact-") {
+			metadata.Headers[name] = values
+		}
+	}
+	if cache.verifyProvenance {
+		if metadata.Provenance, err = cache.getProvenance(hash); err != nil {
+			return ArtifactMetadata{}, err
+		}
+	}
+	return metadata, nil
+}
+
+// EstimateRestoreSize returns how many bytes of files restoring the artifact
+// for key would write, e.g. to check for enough free disk space before a
+// large restore. The artifact is streamed through to read its tar headers,
+// but nothing is written or kept in memory. The sizes are as declared in the
+// artifact, whose signature isn't checked. It returns ErrArtifactNotFound on
+// a miss.
+func (cache *httpCache) EstimateRestoreSize(key string) (int64, error) {
+	cache.requestLimiter.acquire()
+	defer cache.requestLimiter.release()
+
+	key, err := cache.artifactKey(cache.rewriteHash(key))
+	if err != nil {
+		return 0, err
+	} else if key == "" {
+		return 0, ErrArtifactNotFound
+	}
+	resp, err := cache.client.FetchArtifact(key)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if cache.isMiss(resp.StatusCode) {
+		return 0, ErrArtifactNotFound
+	} else if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("failed to fetch artifact: %v", resp.Status)
+	}
+	compressed, err := parseContentEncoding(resp.Header.Get("Content-Encoding"))
+	if err != nil {
+		return 0, err
+	}
+
+	body := &countingReader{reader: resp.Body, total: &cache.downloadedBytes}
+	size, err := cache.restoreItem(body, compressed).RestoreSize()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read artifact headers: %w", err)
+	}
+	return size, nil
+}
+
+// Resign re-signs an existing artifact with the current signing key, e.g. after
+// rotating keys. The artifact is downloaded, its tag is checked against the
+// previous key (from TURBO_REMOTE_CACHE_PREVIOUS_SIGNATURE_KEY), and it is
+// uploaded again under a tag computed with the current key. With
+// Opts.ContentAddressed, the index entry for hash is re-signed too, after the
+// artifact it points at.
+func (cache *httpCache) Resign(hash string) error {
+	hash = cache.rewriteHash(hash)
+	previous, err := cache.signerVerifier.previousKeySigner()
+	if err != nil {
+		return err
+	}
+
+	cache.requestLimiter.acquire()
+	defer cache.requestLimiter.release()
+
+	if !cache.contentAddressed {
+		artifact, err := cache.fetchSignedWith(hash, previous)
+		if err != nil {
+			return err
+		}
+		return cache.resign(hash, artifact)
+	}
+	// The index entry is still signed with the previous key, so it can't be
+	// resolved through artifactKey.
+	indexKey := hash + _contentIndexSuffix
+	index, err := cache.fetchSignedWith(indexKey, previous)
+	if err != nil {
+		return err
+	}
+	digest, err := parseContentIndex(hash, index.body)
+	if err != nil {
+		return err
+	}
+	artifact, err := cache.fetchSignedWith(digest, previous)
+	if err != nil {
+		return err
+	}
+	if err := cache.resign(digest, artifact); err != nil {
+		return err
+	}
+	return cache.resign(indexKey, index)
+}
+
+// signedArtifact is an artifact downloaded to be re-signed.
+type signedArtifact struct {
+	body     []byte
+	signedAt string
+	duration int
 }
 
-func (cache *httpCache) logFetch(hit bool, hash string, duration int) {
+// fetchSignedWith downloads what is stored under key, checking that it was
+// signed with previous.
+func (cache *httpCache) fetchSignedWith(key string, previous *ArtifactSignatureAuthentication) (signedArtifact, error) {
+	resp, err := cache.client.FetchArtifact(key)
+	if err != nil {
+		return signedArtifact{}, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if cache.isMiss(resp.StatusCode) {
+		return signedArtifact{}, ErrArtifactNotFound
+	} else if resp.StatusCode != http.StatusOK {
+		return signedArtifact{}, fmt.Errorf("failed to fetch artifact to re-sign: %v", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return signedArtifact{}, fmt.Errorf("failed to fetch artifact to re-sign: %w", err)
+	}
+
+	// Keep the original signing time, so re-signing doesn't make a stale
+	// artifact fresh again.
+	signedAt := resp.Header.Get("x-artifact-signed-at")
+	isValid, err := previous.stamp(signedAt).validate(key, body, resp.Header.Get("x-artifact-tag"))
+	if err != nil {
+		return signedArtifact{}, err
+	}
+	if !isValid {
+		return signedArtifact{}, errors.New("refusing to re-sign artifact: its tag does not match the previous signing key")
+	}
+	return signedArtifact{
+		body:     body,
+		signedAt: signedAt,
+		duration: cache.parseDuration(key, resp.Header.Get("x-artifact-duration")),
+	}, nil
+}
+
+// resign uploads artifact again under key, tagged with the current key.
+func (cache *httpCache) resign(key string, artifact signedArtifact) error {
+	tag, err := cache.signerVerifier.stamp(artifact.signedAt).generateTag(key, artifact.body)
+	if err != nil {
+		return fmt.Errorf("failed to re-sign artifact: %w", err)
+	}
+	if artifact.signedAt != "" {
+		return cache.putTimestamped(key, bytes.NewReader(artifact.body), int64(len(artifact.body)), artifact.duration, tag, artifact.signedAt)
+	}
+	return cache.client.PutArtifact(key, artifact.body, artifact.duration, tag)
+}
+
+// _pingHash is a hash that should never exist, used to probe the remote cache.
+const _pingHash = "turbo-remote-cache-ping"
+
+// Ping checks that the remote cache is reachable and accepts our credentials.
+// It returns ErrRemoteCacheUnauthorized or ErrRemoteCacheUnreachable (or a
+// util.CacheDisabledError) so callers can report a clear reason up front.
+func (cache *httpCache) Ping(ctx context.Context) error {
+	if cache.deadline != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, cache.deadline())
+		defer cancel()
+	}
+	result := make(chan error, 1)
+	go func() {
+		cache.requestLimiter.acquire()
+		defer cache.requestLimiter.release()
+		result <- cache.ping()
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %v", ErrRemoteCacheUnreachable, ctx.Err())
+	}
+}
+
+func (cache *httpCache) ping() error {
+	resp, err := cache.client.ArtifactExists(_pingHash)
+	if err != nil {
+		cd := &util.CacheDisabledError{}
+		if errors.As(err, &cd) {
+			return err
+		}
+		if errors.Is(err, ErrUnauthorized) {
+			return ErrRemoteCacheUnauthorized
+		}
+		return fmt.Errorf("%w: %v", ErrRemoteCacheUnreachable, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNotFound:
+		return nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrRemoteCacheUnauthorized
+	default:
+		return fmt.Errorf("%w: unexpected status %v", ErrRemoteCacheUnreachable, resp.StatusCode)
+	}
+}
+
+// logFetch records a fetch that downloaded compressedSize bytes, counting
+// every attempt.
+func (cache *httpCache) logFetch(hit bool, hash string, duration int, compressedSize int64) {
+	cache.metrics.fetched(hit)
 	var event string
 	if hit {
 		event = CacheEventHit
@@ -122,87 +1117,767 @@ func (cache *httpCache) logFetch(hit bool, hash string, duration int) {
 		event = CacheEventMiss
 	}
 	payload := &CacheEvent{
-		Source:   CacheSourceRemote,
-		Event:    event,
-		Hash:     hash,
-		Duration: duration,
+		Source:         CacheSourceRemote,
+		Event:          event,
+		Hash:           hash,
+		Duration:       duration,
+		CompressedSize: compressedSize,
+	}
+	recordEvent(cache.recorder, payload)
+	emitCacheEvent(cache.onCacheEvent, *payload)
+}
+
+// _maxClockSkew is how far the remote cache's clock may drift from ours before
+// we report it.
+const _maxClockSkew = 5 * time.Minute
+
+// checkClockSkew compares the response's Date header with our clock, and warns
+// once per run if they differ by more than _maxClockSkew. A skewed clock on
+// either side can confuse reasoning about TTLs and signing times. This is
+// purely informational.
+func (cache *httpCache) checkClockSkew(resp *http.Response) {
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return
+	}
+	skew := date.Sub(time.Now())
+	if skew <= _maxClockSkew && skew >= -_maxClockSkew {
+		return
+	}
+	cache.clockSkewOnce.Do(func() {
+		cache.logger.Warn("remote cache clock differs from local clock", "skew", skew.Round(time.Second))
+		payload := &CacheEvent{
+			Source:           CacheSourceRemote,
+			Event:            CacheEventClockSkew,
+			ClockSkewSeconds: int64(skew / time.Second),
+		}
+		recordEvent(cache.recorder, payload)
+		emitCacheEvent(cache.onCacheEvent, *payload)
+	})
+}
+
+// recordHeaders keeps the response's headers for LastResponseHeaders, if
+// capturing is enabled.
+func (cache *httpCache) recordHeaders(hash string, resp *http.Response) {
+	if !cache.captureHeaders {
+		return
+	}
+	headers := resp.Header.Clone()
+	cache.headersMu.Lock()
+	defer cache.headersMu.Unlock()
+	if cache.headersByHash == nil {
+		cache.headersByHash = make(map[string]http.Header)
+	}
+	cache.lastHeaders = headers
+	cache.headersByHash[hash] = headers
+}
+
+// LastResponseHeaders returns the headers of the most recent response to a
+// fetch or existence check, for debugging. Operations run concurrently, so
+// "most recent" is only meaningful when one is in flight at a time; use
+// ResponseHeadersFor to look up a particular artifact. It returns nil unless
+// Opts.DebugCaptureHeaders is set.
+func (cache *httpCache) LastResponseHeaders() http.Header {
+	cache.headersMu.Lock()
+	defer cache.headersMu.Unlock()
+	return cache.lastHeaders.Clone()
+}
+
+// ResponseHeadersFor returns the headers of the most recent response to a
+// fetch or existence check for hash, or nil if there wasn't one or
+// Opts.DebugCaptureHeaders isn't set.
+func (cache *httpCache) ResponseHeadersFor(hash string) http.Header {
+	hash = cache.rewriteHash(hash)
+	cache.headersMu.Lock()
+	defer cache.headersMu.Unlock()
+	return cache.headersByHash[hash].Clone()
+}
+
+// _minRunBudget is the least time that must remain before the run's deadline
+// for us to start a new remote cache operation.
+const _minRunBudget = 5 * time.Second
+
+// checkRunBudget fails fast with ErrRunBudgetExhausted when the run's deadline
+// is too close to risk starting another remote cache operation.
+func (cache *httpCache) checkRunBudget() error {
+	if cache.deadline == nil {
+		return nil
+	}
+	if time.Until(cache.deadline()) < _minRunBudget {
+		return ErrRunBudgetExhausted
+	}
+	return nil
+}
+
+// rewriteHash applies Opts.HashRewriter, if any, to a hash passed in by the
+// caller. Everything past the public methods works with the rewritten hash.
+func (cache *httpCache) rewriteHash(hash string) string {
+	if cache.hashRewriter == nil {
+		return hash
+	}
+	return cache.hashRewriter(hash)
+}
+
+// cacheable returns false for hashes that have been excluded from remote caching.
+func (cache *httpCache) cacheable(hash string) bool {
+	return cache.isCacheable == nil || cache.isCacheable(hash)
+}
+
+// rememberSmall records that the artifact for hash wasn't uploaded because
+// it was too small; see Opts.MinRemoteArtifactSize.
+func (cache *httpCache) rememberSmall(hash string) {
+	cache.smallMu.Lock()
+	defer cache.smallMu.Unlock()
+	if cache.smallArtifacts == nil {
+		cache.smallArtifacts = make(map[string]bool)
+	}
+	cache.smallArtifacts[hash] = true
+}
+
+// knownSmall reports whether the remote cache should be skipped for hash
+// because its artifact is known to be too small to be worth fetching; see
+// Opts.SkipSmallRemoteFetches.
+func (cache *httpCache) knownSmall(hash string) bool {
+	if !cache.skipSmallFetches {
+		return false
+	}
+	cache.smallMu.Lock()
+	defer cache.smallMu.Unlock()
+	return cache.smallArtifacts[hash]
+}
+
+func (cache *httpCache) logTooSmall(hash string) {
+	payload := &CacheEvent{
+		Source: CacheSourceRemote,
+		Event:  CacheEventSkippedTooSmall,
+		Hash:   hash,
+	}
+	recordEvent(cache.recorder, payload)
+	emitCacheEvent(cache.onCacheEvent, *payload)
+}
+
+// downloadBudgetExceeded returns true once this cache has fetched more than MaxDownloadBytes.
+func (cache *httpCache) downloadBudgetExceeded() bool {
+	return cache.maxDownloadBytes > 0 && atomic.LoadInt64(&cache.downloadedBytes) >= cache.maxDownloadBytes
+}
+
+func (cache *httpCache) logBudgetExceeded(hash string) {
+	payload := &CacheEvent{
+		Source: CacheSourceRemote,
+		Event:  CacheEventBudgetExceeded,
+		Hash:   hash,
+	}
+	recordEvent(cache.recorder, payload)
+	emitCacheEvent(cache.onCacheEvent, *payload)
+}
+
+// countingReader tallies every byte read through it into total.
+type countingReader struct {
+	reader io.Reader
+	total  *int64
+	// fetched, if set, also tallies the bytes read, for a single fetch.
+	fetched *int64
+	// err is the first error reading, other than io.EOF.
+	err error
+	// waited is the time spent blocked in reads.
+	waited time.Duration
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := cr.reader.Read(p)
+	cr.waited += time.Since(start)
+	atomic.AddInt64(cr.total, int64(n))
+	if cr.fetched != nil {
+		*cr.fetched += int64(n)
+	}
+	if err != nil && err != io.EOF && cr.err == nil {
+		cr.err = err
+	}
+	return n, err
+}
+
+// timedReader tallies the time spent blocked reading from reader.
+type timedReader struct {
+	reader io.Reader
+	waited time.Duration
+}
+
+func (tr *timedReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := tr.reader.Read(p)
+	tr.waited += time.Since(start)
+	return n, err
+}
+
+func (cache *httpCache) logPut(err error, hash string, duration int, size artifactSize) {
+	event := CacheEventUpload
+	if err != nil {
+		event = CacheEventError
+		cache.recordFailure("put", hash, err)
+		size = artifactSize{}
+	} else {
+		cache.metrics.uploaded(size.compressed)
+	}
+	payload := &CacheEvent{
+		Source:           CacheSourceRemote,
+		Event:            event,
+		Hash:             hash,
+		Duration:         duration,
+		CompressedSize:   size.compressed,
+		UncompressedSize: size.uncompressed,
+		Codec:            size.codec,
+	}
+	recordEvent(cache.recorder, payload)
+	emitCacheEvent(cache.onCacheEvent, *payload)
+}
+
+// isMiss reports whether a response status means the artifact isn't present.
+func (cache *httpCache) isMiss(status int) bool {
+	if len(cache.missStatusCodes) == 0 {
+		return status == http.StatusNotFound
+	}
+	for _, missStatus := range cache.missStatusCodes {
+		if status == missStatus {
+			return true
+		}
+	}
+	return false
+}
+
+// isHardError reports whether err will recur for every request we make, such as
+// rejected credentials or remote caching being disabled, as opposed to a
+// transient failure of a single request.
+func isHardError(err error) bool {
+	cd := &util.CacheDisabledError{}
+	return errors.Is(err, ErrUnauthorized) || errors.As(err, &cd)
+}
+
+// BatchExists checks whether each of hashes exists in the remote cache,
+// issuing requests concurrently. Transient failures are treated as misses. On
+// the first hard error, such as rejected credentials, requests that haven't
+// started yet are cancelled and the error is returned, since they would all
+// fail the same way.
+func (cache *httpCache) BatchExists(ctx context.Context, hashes []string) (map[string]ItemStatus, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	results := make(map[string]ItemStatus, len(hashes))
+	var hardErr error
+
+	var wg sync.WaitGroup
+	for _, hash := range hashes {
+		hash := hash
+		key := cache.rewriteHash(hash)
+		if !cache.cacheable(key) {
+			mu.Lock()
+			results[hash] = ItemStatus{Remote: false, SkipReason: SkipReasonExcluded}
+			mu.Unlock()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cache.requestLimiter.acquire()
+			defer cache.requestLimiter.release()
+			if ctx.Err() != nil {
+				return
+			}
+
+			hit, err := cache.exists(key)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil && isHardError(err) {
+				if hardErr == nil {
+					hardErr = err
+					cancel()
+				}
+				return
+			}
+			results[hash] = remoteStatus(hit && err == nil)
+		}()
+	}
+	wg.Wait()
+
+	if hardErr != nil {
+		return nil, hardErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// isUnauthorizedStatus reports whether a response status means our credentials were rejected.
+func isUnauthorizedStatus(status int) bool {
+	return status == http.StatusUnauthorized || status == http.StatusForbidden
+}
+
+// refreshToken obtains a fresh token through the configured TokenRefresh hook
+// after a request failed with ErrUnauthorized. It reports whether the request
+// should be retried with the new token.
+func (cache *httpCache) refreshToken(err error) bool {
+	if cache.tokenRefresh == nil || !errors.Is(err, ErrUnauthorized) {
+		return false
+	}
+	setter, ok := cache.client.(tokenSetter)
+	if !ok {
+		return false
+	}
+
+	cache.tokenMu.Lock()
+	defer cache.tokenMu.Unlock()
+	token, refreshErr := cache.tokenRefresh()
+	if refreshErr != nil {
+		cache.logger.Warn("failed to refresh remote cache token", "error", refreshErr)
+		return false
 	}
-	cache.recorder.LogEvent(payload)
+	setter.SetToken(token)
+	return true
 }
 
 func (cache *httpCache) exists(hash string) (bool, error) {
-	resp, err := cache.client.ArtifactExists(hash)
+	key := hash
+	if cache.contentAddressed {
+		key = hash + _contentIndexSuffix
+	}
+	resp, err := cache.hedge(func() (*http.Response, error) {
+		return cache.client.ArtifactExists(key)
+	})
 	if err != nil {
+		if isHardError(err) {
+			return false, err
+		}
 		return false, nil
 	}
+	cache.checkClockSkew(resp)
+	cache.recordHeaders(hash, resp)
 
 	defer func() { err = resp.Body.Close() }()
 
-	if resp.StatusCode == http.StatusNotFound {
+	if cache.isMiss(resp.StatusCode) {
 		return false, nil
+	} else if isUnauthorizedStatus(resp.StatusCode) {
+		return false, ErrUnauthorized
 	} else if resp.StatusCode != http.StatusOK {
 		return false, fmt.Errorf("%s", strconv.Itoa(resp.StatusCode))
 	}
 	return true, err
 }
 
-func (cache *httpCache) retrieve(hash string) (bool, []turbopath.AnchoredSystemPath, int, error) {
-	resp, err := cache.client.FetchArtifact(hash)
+// retrieveFrom downloads and restores an artifact from the given replica of
+// the remote cache. If ifNoneMatch is set and the backend reports that it
+// still matches, errNotModified is returned instead. The compressed bytes
+// downloaded are added to downloaded.
+func (cache *httpCache) retrieveFrom(hash string, ifNoneMatch string, replica int, downloaded *int64) (hit bool, files []turbopath.AnchoredSystemPath, duration int, err error) {
+	start := time.Now()
+	resp, err := cache.fetchArtifact(hash, ifNoneMatch, replica)
 	if err != nil {
 		return false, nil, 0, err
 	}
+	waitedForResponse := time.Since(start)
+	cache.checkClockSkew(resp)
+	cache.recordHeaders(hash, resp)
 	defer resp.Body.Close()
-	if resp.StatusCode == http.StatusNotFound {
+	if cache.isMiss(resp.StatusCode) {
 		return false, nil, 0, nil // doesn't exist - not an error
+	} else if ifNoneMatch != "" && (resp.StatusCode == http.StatusNotModified || etagsMatch(resp.Header.Get("ETag"), ifNoneMatch)) {
+		return false, nil, 0, errNotModified
+	} else if isUnauthorizedStatus(resp.StatusCode) {
+		return false, nil, 0, ErrUnauthorized
 	} else if resp.StatusCode != http.StatusOK {
 		b, _ := ioutil.ReadAll(resp.Body)
 		return false, nil, 0, fmt.Errorf("%s", string(b))
 	}
 	// If present, extract the duration from the response.
-	duration := 0
-	if resp.Header.Get("x-artifact-duration") != "" {
-		intVar, err := strconv.Atoi(resp.Header.Get("x-artifact-duration"))
-		if err != nil {
-			return false, nil, 0, fmt.Errorf("invalid x-artifact-duration header: %w", err)
-		}
-		duration = intVar
+	duration = cache.parseDuration(hash, resp.Header.Get("x-artifact-duration"))
+	compressed, err := parseContentEncoding(resp.Header.Get("Content-Encoding"))
+	if err != nil {
+		return false, nil, 0, err
 	}
 	var tarReader io.Reader
+	deadline := cache.fetchDeadline(start, duration)
+	var timedOut int32
+	if !deadline.IsZero() {
+		// Closing the body unblocks a download stalled on the network.
+		timer := time.AfterFunc(time.Until(deadline), func() {
+			atomic.StoreInt32(&timedOut, 1)
+			_ = resp.Body.Close()
+		})
+		defer timer.Stop()
+	}
+	total := &cache.downloadedBytes
+	if _, ok := resp.Body.(*bufferedBody); ok {
+		// Already counted as it was downloaded; see fetchChunked.
+		total = new(int64)
+	}
+	body := &countingReader{reader: &deadlineReader{reader: resp.Body, deadline: deadline}, total: total, fetched: downloaded}
+	defer func() {
+		// However the body's contents were being used, a failure caused by
+		// the connection dropping, or by running out of time, should be
+		// reported as such, so the fetch can be retried or abandoned. An
+		// artifact that fails verification is reported as it is, however
+		// long that took, so that it's handled as a verification failure.
+		verifyErr := &verificationError{}
+		if err == nil || errors.As(err, &verifyErr) {
+			return
+		}
+		if errors.Is(body.err, errFetchTooSlow) || (body.err != nil && atomic.LoadInt32(&timedOut) == 1) {
+			err = errFetchTooSlow
+		} else if util.IsConnectionReset(body.err) {
+			err = &connectionResetError{err: body.err}
+		}
+	}()
+	defer func() {
+		if hit {
+			cache.metrics.observePhase("download", waitedForResponse+body.waited)
+		}
+	}()
 
 	defer func() { _ = resp.Body.Close() }()
 	if cache.signerVerifier.isEnabled() {
 		expectedTag := resp.Header.Get("x-artifact-tag")
 		if expectedTag == "" {
 			// If the verifier is enabled all incoming artifact downloads must have a signature
-			return false, nil, 0, errors.New("artifact verification failed: Downloaded artifact is missing required x-artifact-tag header")
+			return false, nil, 0, &verificationError{err: errors.New("Downloaded artifact is missing required x-artifact-tag header")}
 		}
-		b, err := ioutil.ReadAll(resp.Body)
+		signer, err := cache.signerVerifier.verifierFor(resp.Header.Get("x-artifact-signed-at"))
 		if err != nil {
-			return false, nil, 0, fmt.Errorf("artifact verification failed: %w", err)
+			return false, nil, 0, &verificationError{err: err}
 		}
-		isValid, err := cache.signerVerifier.validate(hash, b, expectedTag)
-		if err != nil {
-			return false, nil, 0, fmt.Errorf("artifact verification failed: %w", err)
-		}
-		if !isValid {
-			err = fmt.Errorf("artifact verification failed: artifact tag does not match expected tag %s", expectedTag)
-			return false, nil, 0, err
+		if signer.signatureScope == SignatureScopeHashOnly {
+			// Only the hash is signed, so the tag can be checked up front and
+			// the body restored as it streams in.
+			isValid, err := signer.validate(hash, nil, expectedTag)
+			if err != nil {
+				return false, nil, 0, &verificationError{err: err}
+			}
+			if !isValid {
+				return false, nil, 0, &verificationError{err: fmt.Errorf("artifact tag does not match expected tag %s", expectedTag)}
+			}
+			tarReader = body
+		} else if cache.streamVerify {
+			files, err := cache.restoreVerified(signer, hash, body, expectedTag, compressed)
+			if err != nil {
+				return false, nil, 0, err
+			}
+			return true, files, duration, nil
+		} else {
+			validator, err := signer.newStreamValidator(hash)
+			if err != nil {
+				return false, nil, 0, &verificationError{err: err}
+			}
+			var b []byte
+			if buffered, ok := resp.Body.(*bufferedBody); ok {
+				// Already in memory, counted against the memory budget, and
+				// counted as downloaded.
+				b = buffered.data
+				*downloaded += int64(len(b))
+				_, _ = validator.Write(b)
+			} else {
+				release := cache.memory.acquire(resp.ContentLength)
+				defer release()
+				b, err = readAllValidating(body, resp.ContentLength, validator)
+				if err != nil {
+					return false, nil, 0, fmt.Errorf("artifact verification failed: %w", err)
+				}
+			}
+			if !validator.Validate(expectedTag) {
+				err = &verificationError{err: fmt.Errorf("artifact tag does not match expected tag %s", expectedTag)}
+				return false, nil, 0, err
+			}
+			// The artifact has been verified and the body can be read and untarred
+			tarReader = bytes.NewReader(b)
 		}
-		// The artifact has been verified and the body can be read and untarred
-		tarReader = bytes.NewReader(b)
 	} else {
-		tarReader = resp.Body
+		// Nothing to verify, so files are restored as the body streams in and
+		// the artifact is never held in memory; see BenchmarkStreamRestore.
+		tarReader = body
 	}
-	files, err := restoreTar(cache.repoRoot, tarReader)
+	files, err = cache.restoreTar(hash, tarReader, compressed, nil)
 	if err != nil {
 		return false, nil, 0, err
 	}
+	cache.rememberETag(hash, resp.Header.Get("ETag"))
 	return true, files, duration, nil
 }
 
-func restoreTar(root turbopath.AbsoluteSystemPath, reader io.Reader) ([]turbopath.AnchoredSystemPath, error) {
-	cache := cacheitem.FromReader(reader, true)
-	return cache.Restore(root)
+// errFetchTooSlow is returned by retrieve when a download runs past the
+// point where rebuilding would have been quicker; see
+// Opts.MaxFetchDurationRatio.
+var errFetchTooSlow = errors.New("remote cache download is slower than rebuilding")
+
+// fetchDeadline returns when a fetch that started at start, for an artifact
+// that took duration milliseconds to produce, should be abandoned, or the zero
+// time if it shouldn't be.
+func (cache *httpCache) fetchDeadline(start time.Time, duration int) time.Time {
+	if cache.maxFetchRatio <= 0 || duration <= 0 {
+		return time.Time{}
+	}
+	return start.Add(time.Duration(cache.maxFetchRatio * float64(duration) * float64(time.Millisecond)))
+}
+
+// deadlineReader fails reads with errFetchTooSlow once deadline has passed.
+// A zero deadline never passes.
+type deadlineReader struct {
+	reader   io.Reader
+	deadline time.Time
+}
+
+func (dr *deadlineReader) Read(p []byte) (int, error) {
+	if !dr.deadline.IsZero() && time.Now().After(dr.deadline) {
+		return 0, errFetchTooSlow
+	}
+	return dr.reader.Read(p)
+}
+
+// connectionResetError is returned by retrieve when the connection dropped
+// while the artifact was being downloaded; see util.IsConnectionReset.
+type connectionResetError struct {
+	err error
+}
+
+func (ce *connectionResetError) Error() string {
+	return "connection to the remote cache was reset during download: " + ce.err.Error()
+}
+
+func (ce *connectionResetError) Unwrap() error {
+	return ce.err
+}
+
+// errNotModified is returned by retrieve when a conditional fetch finds that our
+// local copy of an artifact is still current.
+var errNotModified = errors.New("artifact not modified")
+
+// conditionalFetcher is implemented by clients that can make conditional requests.
+type conditionalFetcher interface {
+	FetchArtifactIfNoneMatch(hash string, etag string) (*http.Response, error)
+}
+
+// fetchArtifact requests an artifact, conditionally if we have an ETag for it
+// and the client supports it, or in parallel chunks if configured. Whole
+// artifacts from the primary are hedged; see Opts.HedgeDelay. Replicas other
+// than the primary, 0, are always asked for the whole artifact.
+func (cache *httpCache) fetchArtifact(hash string, ifNoneMatch string, replica int) (*http.Response, error) {
+	if replica > 0 {
+		return cache.client.(replicaFetcher).FetchArtifactFromReplica(hash, replica)
+	}
+	if fetcher, ok := cache.client.(conditionalFetcher); ok && ifNoneMatch != "" && cache.capabilities().ConditionalRequests {
+		return cache.hedge(func() (*http.Response, error) {
+			return fetcher.FetchArtifactIfNoneMatch(hash, ifNoneMatch)
+		})
+	}
+	if fetcher, ok := cache.client.(rangeFetcher); ok && cache.downloadChunks > 1 && cache.capabilities().RangeRequests {
+		return cache.fetchChunked(fetcher, hash)
+	}
+	return cache.hedge(func() (*http.Response, error) {
+		return cache.client.FetchArtifact(hash)
+	})
+}
+
+// rememberETag records the ETag of an artifact we've mirrored locally, so a
+// later fetch in this process can revalidate it instead of downloading it again.
+func (cache *httpCache) rememberETag(hash string, etag string) {
+	if cache.mirror == nil || etag == "" {
+		return
+	}
+	cache.etagMu.Lock()
+	defer cache.etagMu.Unlock()
+	if cache.etags == nil {
+		cache.etags = make(map[string]string)
+	}
+	cache.etags[hash] = etag
+}
+
+func (cache *httpCache) lookupETag(hash string) string {
+	cache.etagMu.Lock()
+	defer cache.etagMu.Unlock()
+	return cache.etags[hash]
+}
+
+// etagsMatch compares two ETags using the weak comparison function from
+// RFC 7232: W/"x" and "x" match, since we only care whether the contents
+// we already have are still current.
+func etagsMatch(a string, b string) bool {
+	a = strings.TrimPrefix(a, "W/")
+	b = strings.TrimPrefix(b, "W/")
+	return a != "" && a == b
+}
+
+// parseContentEncoding reports whether an artifact served with the given
+// Content-Encoding is compressed. We ask for zstd or gzip; the tar reader tells
+// the two apart by their magic bytes. Backends that don't advertise an encoding
+// are assumed to serve zstd, which is what we upload.
+func parseContentEncoding(contentEncoding string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(contentEncoding)) {
+	case "", "zstd", "gzip":
+		return true, nil
+	case "identity":
+		return false, nil
+	default:
+		return false, fmt.Errorf("unsupported artifact Content-Encoding %q", contentEncoding)
+	}
+}
+
+// _maxArtifactDuration is the largest task duration, in milliseconds, that we
+// accept from a backend. Anything longer is almost certainly a backend bug.
+const _maxArtifactDuration = int(24 * time.Hour / time.Millisecond)
+
+// parseDuration reads the x-artifact-duration header. Since the value feeds
+// "time saved" reporting, malformed or implausible values are logged and
+// replaced rather than trusted or allowed to fail the fetch.
+func (cache *httpCache) parseDuration(hash string, header string) int {
+	if header == "" {
+		return 0
+	}
+	duration, err := strconv.Atoi(header)
+	if err != nil {
+		cache.logger.Warn("ignoring invalid x-artifact-duration header", "hash", hash, "value", header)
+		return 0
+	}
+	if duration < 0 {
+		cache.logger.Warn("ignoring negative x-artifact-duration header", "hash", hash, "value", duration)
+		return 0
+	}
+	if duration > _maxArtifactDuration {
+		cache.logger.Warn("clamping implausible x-artifact-duration header", "hash", hash, "value", duration)
+		return _maxArtifactDuration
+	}
+	return duration
+}
+
+// _validateChunkSize is the size of the chunks readAllValidating hands off to
+// be hashed.
+const _validateChunkSize = 64 << 10
+
+// _maxValidatePrealloc caps how much readAllValidating allocates up front from
+// the size hint, which comes from the server and may be wrong; past it, the
+// buffer grows as the body is read.
+const _maxValidatePrealloc = 8 << 20
+
+// readAllValidating reads r to EOF, feeding it into validator on another
+// goroutine as it arrives. The tag is computed while we wait on the network
+// rather than in a second pass once the download completes, so only the last
+// chunk remains to be hashed at EOF. sizeHint, if positive, is the expected
+// size of the body.
+func readAllValidating(r io.Reader, sizeHint int64, validator *StreamValidator) ([]byte, error) {
+	chunks := make(chan []byte, 16)
+	hashed := make(chan struct{})
+	go func() {
+		defer close(hashed)
+		for chunk := range chunks {
+			_, _ = validator.Write(chunk)
+		}
+	}()
+
+	initialSize := int64(_validateChunkSize)
+	if sizeHint > 0 && sizeHint < _maxValidatePrealloc {
+		initialSize = sizeHint + 1 // +1 so that reading EOF doesn't grow the buffer
+	} else if sizeHint > 0 {
+		initialSize = _maxValidatePrealloc
+	}
+	body := make([]byte, 0, initialSize)
+	var err error
+	for {
+		if cap(body)-len(body) < _validateChunkSize {
+			// Bytes already handed to the hashing goroutine are never written
+			// again, so it can keep reading them from the old buffer.
+			grown := make([]byte, len(body), 2*cap(body)+_validateChunkSize)
+			copy(grown, body)
+			body = grown
+		}
+		var n int
+		n, err = r.Read(body[len(body) : len(body)+_validateChunkSize])
+		if n > 0 {
+			chunks <- body[len(body) : len(body)+n]
+			body = body[:len(body)+n]
+		}
+		if err != nil {
+			break
+		}
+	}
+	close(chunks)
+	<-hashed
+	if err != io.EOF {
+		return nil, err
+	}
+	return body, nil
+}
+
+// restoreVerified restores an artifact while computing its signature, checking the
+// signature once the whole body has been read. The artifact is extracted into a
+// staging directory, and only moved into the repo if the signature is valid.
+func (cache *httpCache) restoreVerified(signer *ArtifactSignatureAuthentication, hash string, body io.Reader, expectedTag string, compressed bool) ([]turbopath.AnchoredSystemPath, error) {
+	validator, err := signer.newStreamValidator(hash)
+	if err != nil {
+		return nil, &verificationError{err: err}
+	}
+	tee := io.TeeReader(body, validator)
+	return cache.restoreTar(hash, tee, compressed, func() error {
+		// The tar reader can stop before the end of the stream. The signature
+		// covers every byte, so drain the remainder.
+		if _, err := io.Copy(ioutil.Discard, tee); err != nil {
+			return err
+		}
+		if !validator.Validate(expectedTag) {
+			return &verificationError{err: fmt.Errorf("artifact tag does not match expected tag %s", expectedTag)}
+		}
+		return nil
+	})
+}
+
+// restoreTar extracts an artifact into the repo root. compressed is a hint used
+// when the compression format can't be detected from the artifact itself.
+// Artifacts are extracted into a staging directory in Opts.TempDir and moved
+// into place once they've been read completely, and verify, if set, has
+// accepted them, so a failed restore leaves the repo untouched. Resumable
+// restores are written in place instead, unless there's something to verify.
+func (cache *httpCache) restoreTar(hash string, reader io.Reader, compressed bool, verify func() error) ([]turbopath.AnchoredSystemPath, error) {
+	// Time spent waiting on a download as it streams in isn't restoring.
+	timed := &timedReader{reader: reader}
+	cacheItem := cache.restoreItem(timed, compressed)
+	if cache.checkpointDir != "" && verify == nil {
+		cacheItem.CheckpointPath = restoreCheckpointPath(cache.checkpointDir, hash)
+	} else {
+		cacheItem.StagingDir = cache.tempDir
+		cacheItem.BeforeCommit = verify
+	}
+	cache.restoreLimiter.acquire()
+	defer cache.restoreLimiter.release()
+	start := time.Now()
+	files, err := cacheItem.Restore(cache.repoRoot)
+	if err == nil {
+		cache.metrics.observePhase("restore", time.Since(start)-timed.waited)
+	}
+	return files, err
+}
+
+// restoreItem wraps an artifact in a CacheItem configured to restore it with
+// this cache's options.
+func (cache *httpCache) restoreItem(reader io.Reader, compressed bool) *cacheitem.CacheItem {
+	cacheItem := cacheitem.FromReader(reader, compressed)
+	cacheItem.PreserveXattrs = cache.preserveXattrs
+	cacheItem.OnDivergentOverwrite = divergenceWarner(cache.warnOnDivergence, cache.logger)
+	cacheItem.RestoreMode = cache.restoreMode
+	cacheItem.MaxFiles = cache.maxFiles
+	cacheItem.MaxDecompressedSize = cache.maxDecompressed
+	cacheItem.MaxCompressionRatio = cache.maxRatio
+	cacheItem.Fsync = cache.fsync
+	cacheItem.VerifyRestoreCount = cache.verifyCount
+	cacheItem.Umask = cache.umask
+	if cache.dictionary != nil {
+		cacheItem.Dictionaries = map[uint32][]byte{cacheitem.DictionaryID(cache.dictionary): cache.dictionary}
+	}
+	return cacheItem
+}
+
+// setRestoreLimiter shares l with this cache and its local mirror.
+func (cache *httpCache) setRestoreLimiter(l limiter) {
+	cache.restoreLimiter = l
+	if cache.mirror != nil {
+		cache.mirror.restoreLimiter = l
+	}
 }
 
 func (cache *httpCache) Clean(_ turbopath.AbsoluteSystemPath) {
@@ -215,18 +1890,248 @@ func (cache *httpCache) CleanAll() {
 
 func (cache *httpCache) Shutdown() {}
 
+// tokenSetter is implemented by clients whose token can be replaced mid-run.
+type tokenSetter interface {
+	SetToken(token string)
+}
+
+// tokenProviderSetter is implemented by clients that can get their token from
+// a provider before each request.
+type tokenProviderSetter interface {
+	SetTokenProvider(provider func() (string, time.Time, error))
+}
+
+// _retryBudgetReserve is the number of retries allowed before any request has
+// succeeded, when a retry budget is configured.
+const _retryBudgetReserve = 10
+
+// retryBudgeter is implemented by clients that can limit their retries with a
+// budget shared across all requests.
+type retryBudgeter interface {
+	SetRetryBudget(budget *util.RetryBudget)
+}
+
+// dialerSetter is implemented by clients that can open connections with a
+// custom dialer.
+type dialerSetter interface {
+	SetDialContext(dialContext func(ctx context.Context, network, addr string) (net.Conn, error))
+}
+
+// pathPrefixSetter is implemented by clients that can store artifacts under a
+// path prefix.
+type pathPrefixSetter interface {
+	SetArtifactPathPrefix(prefix string) error
+}
+
+// keySharder is implemented by clients that can shard artifact keys.
+type keySharder interface {
+	SetShardKeys(enabled bool)
+}
+
+// pipeliner is implemented by clients that can multiplex concurrent requests
+// over a single HTTP/2 connection.
+type pipeliner interface {
+	SetPipelining(enabled bool)
+}
+
+// connPoolSetter is implemented by clients whose connection pool can be tuned.
+type connPoolSetter interface {
+	SetConnectionPool(maxIdleConns int, maxIdleConnsPerHost int, idleConnTimeout time.Duration)
+}
+
+// _maxConcurrentRequests is the number of remote cache requests made at once.
+const _maxConcurrentRequests = 20
+
 func newHTTPCache(opts Opts, client client, recorder analytics.Recorder, repoRoot turbopath.AbsoluteSystemPath) *httpCache {
-	return &httpCache{
-		writable:       true,
-		client:         client,
-		requestLimiter: make(limiter, 20),
-		recorder:       recorder,
-		repoRoot:       repoRoot,
+	if opts.SignatureFreshness > 0 && opts.RemoteCacheOpts.Signature {
+		if _, ok := client.(timestampedPutter); !ok {
+			opts.logger().Warn("remote cache client can't send signing timestamps, uploads will fail with SignatureFreshness set")
+		}
+	}
+	if opts.TokenProvider != nil {
+		if setter, ok := client.(tokenProviderSetter); ok {
+			setter.SetTokenProvider(opts.TokenProvider)
+		} else {
+			opts.logger().Warn("remote cache client does not support token providers, using its current token")
+		}
+	}
+	if opts.DialContext != nil {
+		if setter, ok := client.(dialerSetter); ok {
+			setter.SetDialContext(opts.DialContext)
+		} else {
+			opts.logger().Warn("remote cache client does not support a custom dialer, using the standard one")
+		}
+	}
+	// Signatures cover the team ID, so an artifact signed for one team fails
+	// verification for another even if they share a key. The repository's
+	// configured team takes precedence over the one we're authenticated as.
+	signingTeamID := opts.RemoteCacheOpts.TeamID
+	if signingTeamID == "" {
+		signingTeamID = client.GetTeamID()
+	}
+	if opts.RemoteCacheOpts.Signature && signingTeamID == "" {
+		opts.logger().Warn("signing artifacts without a team ID, so they aren't bound to a team")
+	}
+	writableReason := opts.RemoteReadOnlyReason
+	if opts.ArtifactPathPrefix != "" {
+		setter, ok := client.(pathPrefixSetter)
+		var err error
+		if !ok {
+			err = errors.New("remote cache client does not support artifact path prefixes")
+		} else {
+			err = setter.SetArtifactPathPrefix(opts.ArtifactPathPrefix)
+		}
+		if err != nil {
+			// Uploading without the prefix would write into the shared layout.
+			opts.logger().Warn("not uploading to the remote cache", "error", err)
+			if writableReason == "" {
+				writableReason = fmt.Sprintf("artifact path prefix not applied: %v", err)
+			}
+		}
+	}
+	if opts.ShardKeys {
+		if sharder, ok := client.(keySharder); ok {
+			sharder.SetShardKeys(true)
+		} else {
+			// Uploading unsharded would write outside the sharded layout.
+			opts.logger().Warn("not uploading to the remote cache", "error", "remote cache client does not support sharded keys")
+			if writableReason == "" {
+				writableReason = "sharded keys not applied: remote cache client does not support sharded keys"
+			}
+		}
+	}
+	if err := validatePatterns(opts.DeniedPatterns, opts.AllowedPatterns); err != nil {
+		// Uploading without the patterns could leak what they're meant to stop.
+		opts.logger().Warn("not uploading to the remote cache", "error", err)
+		if writableReason == "" {
+			writableReason = err.Error()
+		}
+	}
+	if setter, ok := client.(connPoolSetter); ok {
+		setter.SetConnectionPool(opts.resolveConnPool())
+	}
+	if opts.PipelineRequests {
+		if p, ok := client.(pipeliner); ok {
+			p.SetPipelining(true)
+		} else {
+			opts.logger().Debug("remote cache client can't pipeline requests, using a connection per request")
+		}
+	}
+	var verificationFailures []int64
+	if len(opts.RemoteCacheReplicas) > 0 {
+		if fetcher, ok := client.(replicaFetcher); ok {
+			fetcher.SetReadReplicas(opts.RemoteCacheReplicas)
+			verificationFailures = make([]int64, len(opts.RemoteCacheReplicas)+1)
+		} else {
+			opts.logger().Warn("remote cache client does not support read replicas, using only the primary")
+		}
+	}
+	var retryBudget *util.RetryBudget
+	if opts.RetryBudgetRatio > 0 {
+		retryBudget = util.NewRetryBudget(opts.RetryBudgetRatio, _retryBudgetReserve)
+		if budgeter, ok := client.(retryBudgeter); ok {
+			budgeter.SetRetryBudget(retryBudget)
+		}
+	}
+	var mirror *fsCache
+	if opts.LocalMirrorDir != "" {
+		var err error
+		mirror, err = newFsCache(opts.mirrorOpts(), nil, repoRoot)
+		if err != nil {
+			opts.logger().Warn("failed to create local mirror directory, not mirroring", "dir", opts.LocalMirrorDir, "error", err)
+			mirror = nil
+		}
+	}
+	var spillThreshold int64
+	if opts.SpillToDisk {
+		spillThreshold = _spillThreshold
+	}
+	var compressionTiers []CompressionTier
+	if opts.AdaptiveCompression {
+		compressionTiers = opts.CompressionTiers
+		if len(compressionTiers) == 0 {
+			compressionTiers = DefaultCompressionTiers
+		}
+	}
+	var checkpointDir turbopath.AbsoluteSystemPath
+	if opts.ResumableRestore {
+		checkpointDir = opts.resolveCacheDir(repoRoot)
+		if err := checkpointDir.MkdirAll(0755); err != nil {
+			opts.logger().Warn("failed to create restore checkpoint directory, restores will not be resumable", "dir", checkpointDir, "error", err)
+			checkpointDir = ""
+		}
+	}
+	cache := &httpCache{
+		writable:             writableReason == "",
+		writableReason:       writableReason,
+		client:               client,
+		requestLimiter:       make(limiter, _maxConcurrentRequests),
+		recorder:             recorder,
+		repoRoot:             repoRoot,
+		compressionThreads:   opts.CompressionThreads,
+		compressionLevel:     opts.CompressionLevel,
+		compressionTiers:     compressionTiers,
+		autoCodec:            opts.AutoCodec,
+		seekable:             opts.SeekableCompression,
+		solid:                opts.SolidCompression,
+		onCacheEvent:         opts.OnCacheEvent,
+		maxDownloadBytes:     opts.MaxDownloadBytes,
+		preserveXattrs:       opts.PreserveXattrs,
+		streamVerify:         opts.StreamVerifySignatures,
+		verifyFailureMiss:    opts.VerificationFailureAsMiss,
+		quarantineBad:        opts.QuarantineBadArtifacts,
+		contentAddressed:     opts.ContentAddressed,
+		deniedPatterns:       opts.DeniedPatterns,
+		allowedPatterns:      opts.AllowedPatterns,
+		isCacheable:          opts.CacheablePredicate,
+		minArtifactSize:      opts.MinRemoteArtifactSize,
+		skipSmallFetches:     opts.SkipSmallRemoteFetches,
+		maxFetchRatio:        opts.MaxFetchDurationRatio,
+		hashRewriter:         opts.HashRewriter,
+		logger:               opts.logger(),
+		retryBudget:          retryBudget,
+		mirror:               mirror,
+		verificationFailures: verificationFailures,
+		memory:               newMemoryBudget(opts.MaxCacheMemoryBytes),
+		provenance:           opts.Provenance,
+		verifyProvenance:     opts.VerifyProvenance,
+		tarBuildTimeout:      opts.TarBuildTimeout,
+		newArtifactPacker:    opts.NewArtifactPacker,
+		warnOnDivergence:     opts.WarnOnOverwriteDivergence,
+		restoreMode:          opts.RestoreMode,
+		maxFiles:             opts.resolveMaxFiles(),
+		deltaUploads:         opts.DeltaUploads,
+		captureHeaders:       opts.DebugCaptureHeaders,
+		maxDecompressed:      opts.MaxDecompressedSize,
+		maxRatio:             opts.MaxCompressionRatio,
+		fsync:                opts.FsyncAfterRestore,
+		verifyCount:          opts.VerifyRestoreCount,
+		umask:                opts.RestoreUmask,
+		downloadChunks:       opts.ParallelDownloadChunks,
+		hedgeDelay:           opts.HedgeDelay,
+		checkpointDir:        checkpointDir,
+		dictionary:           opts.CompressionDictionary,
+		tokenRefresh:         opts.TokenRefresh,
+		includeManifest:      opts.IncludeManifest,
+		manifestHashAlgo:     opts.ManifestHashAlgorithm,
+		deadline:             opts.Deadline,
+		missStatusCodes:      opts.MissStatusCodes,
+		preUploadHook:        opts.PreUploadHook,
+		spillThreshold:       spillThreshold,
+		tempDir:              opts.resolveTempDir(repoRoot),
 		signerVerifier: &ArtifactSignatureAuthentication{
-			// TODO(Gaspar): this should use RemoteCacheOptions.TeamId once we start
-			// enforcing team restrictions for repositories.
-			teamID:  client.GetTeamID(),
-			enabled: opts.RemoteCacheOpts.Signature,
+			teamID:         signingTeamID,
+			enabled:        opts.RemoteCacheOpts.Signature,
+			signatureScope: opts.SignatureScope,
+			freshness:      opts.SignatureFreshness,
+			key:            &cachedKey{},
 		},
 	}
+	if err := cache.checkProvenance(); err != nil && cache.writable {
+		// Uploading without attestations would defeat the point of them.
+		cache.logger.Warn("not uploading to the remote cache", "error", err)
+		cache.writable = false
+		cache.writableReason = err.Error()
+	}
+	return cache
 }
@@ -3,10 +3,25 @@ package cache
 import (
 	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/DataDog/zstd"
 	"github.com/vercel/turbo/cli/internal/cacheitem"
@@ -200,7 +215,8 @@ func TestRestoreTar(t *testing.T) {
 		turbopath.AnchoredUnixPath("my-pkg/link-to-extra-file").ToSystemPath(),
 		turbopath.AnchoredUnixPath("my-pkg/broken-link").ToSystemPath(),
 	}
-	files, err := restoreTar(root, tar)
+	cache := &httpCache{repoRoot: root}
+	files, err := cache.restoreTar("some-hash", tar, true, nil)
 	assert.NilError(t, err, "readTar")
 
 	expectedSet := make(util.Set)
@@ -243,7 +259,8 @@ func TestRestoreInvalidTar(t *testing.T) {
 	// use a child directory so that blindly untarring will squash the file
 	// that we just wrote above.
 	repoRoot := root.UntypedJoin("repo")
-	_, err = restoreTar(repoRoot, tar)
+	cache := &httpCache{repoRoot: repoRoot}
+	_, err = cache.restoreTar("some-hash", tar, true, nil)
 	if err == nil {
 		t.Error("expected error untarring invalid tar")
 	}
@@ -253,6 +270,41 @@ func TestRestoreInvalidTar(t *testing.T) {
 	assert.Equal(t, string(contents), string(expectedContents), "expected to not overwrite file")
 }
 
+func TestRestoreCorruptTar(t *testing.T) {
+	notATar := &bytes.Buffer{}
+	zw := zstd.NewWriter(notATar)
+	_, err := zw.Write(bytes.Repeat([]byte("not a tar header"), 64))
+	assert.NilError(t, err, "Write")
+	assert.NilError(t, zw.Close(), "Close")
+
+	notZstd := bytes.NewBufferString("this was never compressed with zstd")
+
+	tests := []struct {
+		name    string
+		body    *bytes.Buffer
+		wantErr error
+	}{
+		{
+			name:    "valid zstd, invalid tar",
+			body:    notATar,
+			wantErr: cacheitem.ErrMalformedArchive,
+		},
+		{
+			name:    "invalid zstd",
+			body:    notZstd,
+			wantErr: cacheitem.ErrDecompressionFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+			cache := &httpCache{repoRoot: root}
+			_, err := cache.restoreTar("some-hash", tt.body, true, nil)
+			assert.ErrorIs(t, err, tt.wantErr)
+		})
+	}
+}
+
 func Test_httpCache_Put(t *testing.T) {
 	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
 	_ = root.Join("one").WriteFile(nil, 0644)
@@ -284,3 +336,1683 @@ func Test_httpCache_Put(t *testing.T) {
 		"Errors with missing file at first load.",
 	)
 }
+
+func TestOnCacheEvent(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	_ = root.Join("one").WriteFile(nil, 0644)
+	_ = root.Join("two").WriteFile(nil, 0644)
+
+	var events []CacheEvent
+	opts := Opts{
+		OnCacheEvent: func(event CacheEvent) {
+			events = append(events, event)
+		},
+	}
+	clientErr := errors.New("PutArtifact")
+	cache := newHTTPCache(opts, &errorResp{err: clientErr, t: t}, &nullRecorder{}, root)
+
+	_ = cache.Put(root, "put-hash", 10, []turbopath.AnchoredSystemPath{"one", "two"})
+	_, _, _, _ = cache.Fetch(root, "fetch-hash", nil)
+
+	assert.DeepEqual(t, events, []CacheEvent{
+		{Source: CacheSourceRemote, Event: CacheEventError, Hash: "put-hash", Duration: 10},
+		{Source: CacheSourceRemote, Event: CacheEventError, Hash: "fetch-hash"},
+	})
+}
+
+func TestMaxDownloadBytes(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	client := &artifactResp{body: makeValidTar(t).Bytes()}
+
+	var events []string
+	opts := Opts{
+		MaxDownloadBytes: 1,
+		OnCacheEvent: func(event CacheEvent) {
+			events = append(events, event.Event)
+		},
+	}
+	cache := newHTTPCache(opts, client, &nullRecorder{}, root)
+
+	itemStatus, _, _, err := cache.Fetch(root, "first", nil)
+	assert.NilError(t, err, "Fetch")
+	assert.Assert(t, itemStatus.Remote, "first fetch is within budget")
+
+	itemStatus, _, _, err = cache.Fetch(root, "second", nil)
+	assert.NilError(t, err, "Fetch")
+	assert.Assert(t, !itemStatus.Remote, "second fetch exceeds the budget")
+
+	assert.DeepEqual(t, events, []string{CacheEventHit, CacheEventBudgetExceeded})
+}
+
+type bufferWriteCloser struct {
+	bytes.Buffer
+}
+
+func (*bufferWriteCloser) Close() error { return nil }
+
+func Test_httpCache_write_deterministic(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	assert.NilError(t, root.Join("dir").MkdirAll(0755), "MkdirAll")
+	_ = root.Join("dir", "a").WriteFile([]byte("a"), 0644)
+	_ = root.Join("dir", "b").WriteFile([]byte("b"), 0644)
+	_ = root.Join("c").WriteFile([]byte("c"), 0644)
+
+	cache := newHTTPCache(Opts{}, &errorResp{t: t}, &nullRecorder{}, root)
+	write := func(files []turbopath.AnchoredSystemPath) []byte {
+		w := &bufferWriteCloser{}
+		cacheErrorChan := make(chan error, 1)
+		cache.write(w, root, files, nil, cacheErrorChan)
+		assert.NilError(t, <-cacheErrorChan, "write")
+		return w.Bytes()
+	}
+
+	one := write(turbopath.AnchoredUnixPathArray{"dir", "dir/a", "dir/b", "c"}.ToSystemPathArray())
+	two := write(turbopath.AnchoredUnixPathArray{"c", "dir/b", "dir/a", "dir"}.ToSystemPathArray())
+	assert.Assert(t, bytes.Equal(one, two), "artifacts are byte-identical")
+}
+
+func TestStreamVerifySignatures(t *testing.T) {
+	body := makeValidTar(t).Bytes()
+	signer := &ArtifactSignatureAuthentication{
+		teamID:            "team_id",
+		secretKeyOverride: []byte("secret"),
+		enabled:           true,
+	}
+	validTag, err := signer.generateTag("the-hash", body)
+	assert.NilError(t, err, "generateTag")
+
+	tests := []struct {
+		name    string
+		tag     string
+		wantHit bool
+	}{
+		{name: "valid tag restores", tag: validTag, wantHit: true},
+		{name: "invalid tag discards", tag: "not-the-tag", wantHit: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+			assert.NilError(t, root.Join("extra-file").WriteFile([]byte("existing"), 0644), "WriteFile")
+			client := &artifactResp{
+				body:    body,
+				headers: http.Header{"X-Artifact-Tag": []string{tt.tag}},
+			}
+			cache := newHTTPCache(Opts{StreamVerifySignatures: true}, client, &nullRecorder{}, root)
+			cache.signerVerifier = signer
+
+			itemStatus, _, _, err := cache.Fetch(root, "the-hash", nil)
+			assert.Equal(t, itemStatus.Remote, tt.wantHit)
+			assert.Equal(t, err == nil, tt.wantHit)
+			assert.Equal(t, root.UntypedJoin("my-pkg", "some-file").FileExists(), tt.wantHit)
+
+			// Existing outputs are only replaced once the artifact is verified.
+			extra, err := root.Join("extra-file").ReadFile()
+			assert.NilError(t, err, "ReadFile")
+			if tt.wantHit {
+				assert.Equal(t, string(extra), "extra-file-contents")
+			} else {
+				assert.Equal(t, string(extra), "existing")
+			}
+			staged, err := ioutil.ReadDir(cache.tempDir.ToString())
+			assert.Assert(t, err != nil || len(staged) == 0, "staging dir not cleaned up")
+		})
+	}
+}
+
+func TestCacheablePredicate(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	_ = root.Join("one").WriteFile(nil, 0644)
+	_ = root.Join("two").WriteFile(nil, 0644)
+
+	clientErr := errors.New("client should not be called")
+	opts := Opts{
+		CacheablePredicate: func(hash string) bool {
+			return hash != "excluded"
+		},
+	}
+	cache := newHTTPCache(opts, &errorResp{err: clientErr, t: t}, &nullRecorder{}, root)
+
+	assert.NilError(t, cache.Put(root, "excluded", 10, []turbopath.AnchoredSystemPath{"one", "two"}), "Put")
+	itemStatus, _, _, err := cache.Fetch(root, "excluded", nil)
+	assert.NilError(t, err, "Fetch")
+	assert.Equal(t, itemStatus, ItemStatus{SkipReason: SkipReasonExcluded})
+	assert.Equal(t, cache.Exists("excluded"), ItemStatus{SkipReason: SkipReasonExcluded})
+
+	_, _, _, err = cache.Fetch(root, "included", nil)
+	assert.ErrorIs(t, err, clientErr)
+}
+
+func TestImplausibleDurationHeader(t *testing.T) {
+	tests := []struct {
+		header string
+		want   int
+	}{
+		{header: "", want: 0},
+		{header: "1500", want: 1500},
+		{header: "-20", want: 0},
+		{header: "not-a-number", want: 0},
+		{header: "172800000", want: _maxArtifactDuration},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+			client := &artifactResp{
+				body:    makeValidTar(t).Bytes(),
+				headers: http.Header{"X-Artifact-Duration": []string{tt.header}},
+			}
+			cache := newHTTPCache(Opts{}, client, &nullRecorder{}, root)
+
+			itemStatus, _, duration, err := cache.Fetch(root, "some-hash", nil)
+			assert.NilError(t, err, "Fetch")
+			assert.Assert(t, itemStatus.Remote)
+			assert.Equal(t, duration, tt.want)
+		})
+	}
+}
+
+// stallingBody serves the start of an artifact, then stalls until closed.
+type stallingBody struct {
+	start  io.Reader
+	closed chan struct{}
+}
+
+func (sb *stallingBody) Read(p []byte) (int, error) {
+	if n, err := sb.start.Read(p); err != io.EOF {
+		return n, err
+	}
+	<-sb.closed
+	return 0, errors.New("read on closed body")
+}
+
+func (sb *stallingBody) Close() error {
+	select {
+	case <-sb.closed:
+	default:
+		close(sb.closed)
+	}
+	return nil
+}
+
+// stallingClient serves artifacts whose downloads stall partway through.
+type stallingClient struct {
+	artifactResp
+}
+
+func (sc *stallingClient) FetchArtifact(hash string) (*http.Response, error) {
+	resp, err := sc.artifactResp.FetchArtifact(hash)
+	resp.Body = &stallingBody{start: bytes.NewReader(sc.body[:len(sc.body)/2]), closed: make(chan struct{})}
+	return resp, err
+}
+
+func TestMaxFetchDurationRatio(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	client := &stallingClient{artifactResp{
+		body:    makeValidTar(t).Bytes(),
+		headers: http.Header{"X-Artifact-Duration": []string{"20"}},
+	}}
+	cache := newHTTPCache(Opts{MaxFetchDurationRatio: 1.5}, client, &nullRecorder{}, root)
+
+	start := time.Now()
+	itemStatus, files, _, err := cache.Fetch(root, "some-hash", nil)
+	assert.NilError(t, err, "Fetch")
+	assert.Assert(t, !itemStatus.Remote)
+	assert.Equal(t, len(files), 0)
+	assert.Assert(t, time.Since(start) < 10*time.Second, "download wasn't abandoned")
+	assert.Assert(t, !root.UntypedJoin("my-pkg", "some-file").FileExists(), "partial restore kept")
+
+	// A download within the ratio is unaffected.
+	client.headers.Set("X-Artifact-Duration", "3600000")
+	fast := newHTTPCache(Opts{MaxFetchDurationRatio: 1.5}, &client.artifactResp, &nullRecorder{}, root)
+	itemStatus, _, _, err = fast.Fetch(root, "some-hash", nil)
+	assert.NilError(t, err, "Fetch")
+	assert.Assert(t, itemStatus.Remote)
+}
+
+// slowResponseClient takes delay to respond, then responds instantly.
+type slowResponseClient struct {
+	artifactResp
+	delay time.Duration
+}
+
+func (sc *slowResponseClient) FetchArtifact(hash string) (*http.Response, error) {
+	time.Sleep(sc.delay)
+	return sc.artifactResp.FetchArtifact(hash)
+}
+
+func TestMaxFetchDurationRatioVerificationFailure(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	client := &slowResponseClient{
+		artifactResp: artifactResp{
+			body:    makeValidTar(t).Bytes(),
+			headers: http.Header{"X-Artifact-Duration": []string{"1"}},
+		},
+		delay: 10 * time.Millisecond,
+	}
+	cache := newHTTPCache(Opts{MaxFetchDurationRatio: 1}, client, &nullRecorder{}, root)
+	cache.signerVerifier = &ArtifactSignatureAuthentication{
+		teamID:            "team_id",
+		secretKeyOverride: []byte("secret"),
+		enabled:           true,
+	}
+
+	// The artifact is unsigned, and the deadline has passed, but that isn't
+	// why it's rejected.
+	var downloaded int64
+	_, _, _, err := cache.retrieveFrom("some-hash", "", 0, &downloaded)
+	verifyErr := &verificationError{}
+	assert.Assert(t, errors.As(err, &verifyErr), "got %v", err)
+}
+
+func TestPing(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	tests := []struct {
+		name    string
+		client  client
+		wantErr error
+	}{
+		{name: "reachable", client: &statusResp{status: http.StatusNotFound}},
+		{name: "unauthorized", client: &statusResp{status: http.StatusUnauthorized}, wantErr: ErrRemoteCacheUnauthorized},
+		{name: "server error", client: &statusResp{status: http.StatusBadGateway}, wantErr: ErrRemoteCacheUnreachable},
+		{name: "network error", client: &errorResp{err: errors.New("connection refused")}, wantErr: ErrRemoteCacheUnreachable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := newHTTPCache(Opts{}, tt.client, &nullRecorder{}, root)
+			err := cache.Ping(context.Background())
+			if tt.wantErr == nil {
+				assert.NilError(t, err)
+			} else {
+				assert.ErrorIs(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNilRecorder(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	client := &artifactResp{body: makeValidTar(t).Bytes()}
+	cache := newHTTPCache(Opts{}, client, nil, root)
+
+	itemStatus, _, _, err := cache.Fetch(root, "some-hash", nil)
+	assert.NilError(t, err, "Fetch")
+	assert.Assert(t, itemStatus.Remote)
+
+	fsCache, err := newFsCache(Opts{OverrideDir: t.TempDir()}, nil, root)
+	assert.NilError(t, err, "newFsCache")
+	itemStatus, _, _, err = fsCache.Fetch(root, "some-hash", nil)
+	assert.NilError(t, err, "Fetch")
+	assert.Assert(t, !itemStatus.Local)
+}
+
+func TestGetMetadata(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	client := &artifactResp{
+		headers: http.Header{
+			"Content-Length":       []string{"1234"},
+			"Last-Modified":        []string{"Wed, 21 Oct 2015 07:28:00 GMT"},
+			"X-Artifact-Duration":  []string{"500"},
+			"X-Artifact-Tag":       []string{"some-tag"},
+			"X-Artifact-Client-Ci": []string{"github"},
+		},
+	}
+	cache := newHTTPCache(Opts{}, client, &nullRecorder{}, root)
+
+	metadata, err := cache.GetMetadata("some-hash")
+	assert.NilError(t, err, "GetMetadata")
+	assert.Equal(t, metadata.Hash, "some-hash")
+	assert.Equal(t, metadata.Size, int64(1234))
+	assert.Equal(t, metadata.Duration, 500)
+	assert.Equal(t, metadata.Tag, "some-tag")
+	assert.Equal(t, metadata.UploadedAt.Unix(), int64(1445412480))
+	assert.Equal(t, metadata.Headers.Get("x-artifact-client-ci"), "github")
+	assert.Equal(t, metadata.Headers.Get("Content-Length"), "")
+
+	client.headers = http.Header{}
+	metadata, err = cache.GetMetadata("some-hash")
+	assert.NilError(t, err, "GetMetadata")
+	assert.Equal(t, metadata.Size, int64(0))
+	assert.Equal(t, metadata.Tag, "")
+	assert.Assert(t, metadata.UploadedAt.IsZero())
+
+	statusCache := newHTTPCache(Opts{}, &statusResp{status: http.StatusNotFound}, &nullRecorder{}, root)
+	_, err = statusCache.GetMetadata("some-hash")
+	assert.ErrorIs(t, err, ErrArtifactNotFound)
+}
+
+func TestEstimateRestoreSize(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	cache := newHTTPCache(Opts{}, &artifactResp{body: makeValidTar(t).Bytes()}, &nullRecorder{}, root)
+
+	size, err := cache.EstimateRestoreSize("some-hash")
+	assert.NilError(t, err, "EstimateRestoreSize")
+	assert.Equal(t, size, int64(len("some-file-contents")+len("extra-file-contents")))
+	assert.Assert(t, !root.UntypedJoin("my-pkg").Exists(), "nothing is restored")
+
+	statusCache := newHTTPCache(Opts{}, &statusResp{status: http.StatusNotFound}, &nullRecorder{}, root)
+	_, err = statusCache.EstimateRestoreSize("some-hash")
+	assert.ErrorIs(t, err, ErrArtifactNotFound)
+}
+
+type budgetedClient struct {
+	statusResp
+	budget *util.RetryBudget
+}
+
+func (bc *budgetedClient) SetRetryBudget(budget *util.RetryBudget) {
+	bc.budget = budget
+}
+
+func TestRetryBudgetRatio(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+
+	client := &budgetedClient{}
+	newHTTPCache(Opts{}, client, &nullRecorder{}, root)
+	assert.Assert(t, client.budget == nil, "no budget unless a ratio is configured")
+
+	cache := newHTTPCache(Opts{RetryBudgetRatio: 0.1}, client, &nullRecorder{}, root)
+	assert.Assert(t, client.budget != nil)
+	assert.Assert(t, client.budget == cache.retryBudget, "client and cache share one budget")
+	for i := 0; i < _retryBudgetReserve; i++ {
+		assert.Assert(t, client.budget.TryRetry())
+	}
+	assert.Assert(t, !client.budget.TryRetry())
+}
+
+type countingFetchClient struct {
+	artifactResp
+	fetches int
+}
+
+func (cc *countingFetchClient) FetchArtifact(hash string) (*http.Response, error) {
+	cc.fetches++
+	return cc.artifactResp.FetchArtifact(hash)
+}
+
+type skippingPacker struct {
+	ArtifactPacker
+	skip turbopath.AnchoredSystemPath
+}
+
+func (sp *skippingPacker) AddFile(fsAnchor turbopath.AbsoluteSystemPath, filePath turbopath.AnchoredSystemPath) error {
+	if filePath == sp.skip {
+		return nil
+	}
+	return sp.ArtifactPacker.AddFile(fsAnchor, filePath)
+}
+
+func TestNewArtifactPacker(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	_ = root.Join("a").WriteFile([]byte("a"), 0644)
+	_ = root.Join("b").WriteFile([]byte("b"), 0644)
+	files := turbopath.AnchoredUnixPathArray{"a", "b"}.ToSystemPathArray()
+
+	client := &artifactResp{}
+	cache := newHTTPCache(Opts{
+		NewArtifactPacker: func(w io.WriteCloser) ArtifactPacker {
+			return &skippingPacker{
+				ArtifactPacker: cacheitem.CreateWriter(w, cacheitem.CreateOpts{}),
+				skip:           turbopath.AnchoredUnixPath("b").ToSystemPath(),
+			}
+		},
+	}, client, &nullRecorder{}, root)
+	assert.NilError(t, cache.Put(root, "some-hash", 0, files), "Put")
+
+	restoreRoot := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	restored, err := cacheitem.FromReader(bytes.NewReader(client.body), true).Restore(restoreRoot)
+	assert.NilError(t, err, "Restore")
+	assert.DeepEqual(t, restored, turbopath.AnchoredUnixPathArray{"a"}.ToSystemPathArray())
+}
+
+func TestTarBuildTimeout(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	cache := newHTTPCache(Opts{TarBuildTimeout: 10 * time.Millisecond}, &artifactResp{}, &nullRecorder{}, root)
+
+	// Nothing is ever written to the pipe, as when reading a file hangs.
+	r, w := io.Pipe()
+	_, err := cache.readArtifact(r)
+	assert.ErrorIs(t, err, ErrTarConstructionTimeout)
+
+	// The stuck writer fails on its next write rather than blocking forever.
+	_, err = w.Write([]byte("data"))
+	assert.ErrorIs(t, err, ErrTarConstructionTimeout)
+}
+
+func TestContentEncoding(t *testing.T) {
+	rawTar, err := zstd.Decompress(nil, makeValidTar(t).Bytes())
+	assert.NilError(t, err, "Decompress")
+	gzipped := &bytes.Buffer{}
+	gw := gzip.NewWriter(gzipped)
+	_, err = gw.Write(rawTar)
+	assert.NilError(t, err, "Write")
+	assert.NilError(t, gw.Close(), "Close")
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		wantErr  bool
+	}{
+		{name: "none advertised", encoding: "", body: makeValidTar(t).Bytes()},
+		{name: "zstd", encoding: "zstd", body: makeValidTar(t).Bytes()},
+		{name: "gzip", encoding: "gzip", body: gzipped.Bytes()},
+		{name: "identity", encoding: "identity", body: rawTar},
+		// Older turbo versions uploaded uncompressed tars without saying so.
+		{name: "legacy raw tar", encoding: "", body: rawTar},
+		{name: "unsupported", encoding: "br", body: rawTar, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+			client := &artifactResp{
+				body:    tt.body,
+				headers: http.Header{"Content-Encoding": []string{tt.encoding}},
+			}
+			cache := newHTTPCache(Opts{}, client, &nullRecorder{}, root)
+
+			itemStatus, _, _, err := cache.Fetch(root, "some-hash", nil)
+			if tt.wantErr {
+				assert.ErrorContains(t, err, "unsupported artifact Content-Encoding")
+				return
+			}
+			assert.NilError(t, err, "Fetch")
+			assert.Assert(t, itemStatus.Remote)
+			assert.Assert(t, root.UntypedJoin("my-pkg", "some-file").FileExists())
+		})
+	}
+}
+
+func TestPutWithResult(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	_ = root.Join("a").WriteFile([]byte("a"), 0644)
+	files := turbopath.AnchoredUnixPathArray{"a"}.ToSystemPathArray()
+
+	cache := newHTTPCache(Opts{
+		CacheablePredicate: func(hash string) bool { return hash != "excluded" },
+	}, &artifactResp{}, &nullRecorder{}, root)
+
+	result := cache.PutWithResult(root, "some-hash", 0, files)
+	assert.NilError(t, result.Err, "PutWithResult")
+	assert.Equal(t, result.Hash, "some-hash")
+	assert.Assert(t, result.Uploaded && !result.Skipped)
+	assert.Equal(t, result.Attempts, 1)
+	assert.Equal(t, result.UncompressedBytes, int64(1))
+	assert.Assert(t, result.CompressedBytes > 0)
+	assert.Assert(t, result.Duration > 0)
+
+	result = cache.PutWithResult(root, "excluded", 0, files)
+	assert.NilError(t, result.Err, "PutWithResult")
+	assert.DeepEqual(t, result, UploadResult{Hash: "excluded", Skipped: true})
+
+	failing := newHTTPCache(Opts{}, &statusResp{putErr: errors.New("boom")}, &nullRecorder{}, root)
+	result = failing.PutWithResult(root, "some-hash", 0, files)
+	assert.ErrorContains(t, result.Err, "boom")
+	assert.Assert(t, !result.Uploaded && !result.Skipped)
+	assert.Equal(t, result.CompressedBytes, int64(0))
+}
+
+func TestFetchWithResult(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	client := &artifactResp{body: makeValidTar(t).Bytes(), headers: http.Header{"X-Artifact-Duration": []string{"42"}}}
+	cache := newHTTPCache(Opts{
+		CacheablePredicate: func(hash string) bool { return hash != "excluded" },
+	}, client, &nullRecorder{}, root)
+
+	result := cache.FetchWithResult(root, "some-hash", nil)
+	assert.NilError(t, result.Err, "FetchWithResult")
+	assert.Equal(t, result.Hash, "some-hash")
+	assert.Assert(t, result.Status.Remote)
+	assert.Assert(t, len(result.Files) > 0)
+	assert.Equal(t, result.TimeSaved, 42)
+	assert.Equal(t, result.Attempts, 1)
+
+	result = cache.FetchWithResult(root, "excluded", nil)
+	assert.NilError(t, result.Err, "FetchWithResult")
+	assert.Assert(t, !result.Status.Remote)
+	assert.Equal(t, result.Attempts, 0)
+}
+
+func TestCompressionDictionary(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	_ = root.Join("a").WriteFile([]byte("module.exports = {};"), 0644)
+	files := turbopath.AnchoredUnixPathArray{"a"}.ToSystemPathArray()
+	dict := []byte("module.exports = require('./index.js');")
+
+	client := &artifactResp{}
+	uploader := newHTTPCache(Opts{CompressionDictionary: dict}, client, &nullRecorder{}, root)
+	assert.NilError(t, uploader.Put(root, "some-hash", 0, files), "Put")
+
+	restoreRoot := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	downloader := newHTTPCache(Opts{CompressionDictionary: dict}, client, &nullRecorder{}, restoreRoot)
+	itemStatus, _, _, err := downloader.Fetch(restoreRoot, "some-hash", nil)
+	assert.NilError(t, err, "Fetch")
+	assert.Assert(t, itemStatus.Remote)
+	assert.Assert(t, restoreRoot.UntypedJoin("a").FileExists())
+
+	withoutDict := newHTTPCache(Opts{}, client, &nullRecorder{}, fs.AbsoluteSystemPathFromUpstream(t.TempDir()))
+	_, _, _, err = withoutDict.Fetch(root, "some-hash", nil)
+	assert.ErrorIs(t, err, cacheitem.ErrMissingDictionary)
+}
+
+type resignClient struct {
+	artifactResp
+	putTag string
+}
+
+func (rc *resignClient) PutArtifact(hash string, body []byte, duration int, tag string) error {
+	rc.putTag = tag
+	return rc.artifactResp.PutArtifact(hash, body, duration, tag)
+}
+
+func TestResign(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	body := makeValidTar(t).Bytes()
+	oldSigner := &ArtifactSignatureAuthentication{teamID: "team_id", secretKeyOverride: []byte("old"), enabled: true}
+	newSigner := &ArtifactSignatureAuthentication{teamID: "team_id", secretKeyOverride: []byte("new"), enabled: true}
+	oldTag, err := oldSigner.generateTag("the-hash", body)
+	assert.NilError(t, err, "generateTag")
+	newTag, err := newSigner.generateTag("the-hash", body)
+	assert.NilError(t, err, "generateTag")
+
+	tests := []struct {
+		name    string
+		tag     string
+		wantErr bool
+	}{
+		{name: "signed with previous key", tag: oldTag},
+		{name: "signed with unknown key", tag: "not-the-tag", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &resignClient{artifactResp: artifactResp{
+				body:    body,
+				headers: http.Header{"X-Artifact-Tag": []string{tt.tag}},
+			}}
+			cache := newHTTPCache(Opts{}, client, &nullRecorder{}, root)
+			cache.signerVerifier = &ArtifactSignatureAuthentication{
+				teamID:                    "team_id",
+				secretKeyOverride:         []byte("new"),
+				previousSecretKeyOverride: []byte("old"),
+				enabled:                   true,
+			}
+
+			err := cache.Resign("the-hash")
+			if tt.wantErr {
+				assert.ErrorContains(t, err, "does not match the previous signing key")
+				assert.Equal(t, client.putTag, "")
+				return
+			}
+			assert.NilError(t, err, "Resign")
+			assert.Equal(t, client.putTag, newTag)
+			assert.Assert(t, bytes.Equal(client.body, body))
+		})
+	}
+}
+
+type tokenClient struct {
+	artifactResp
+	token string
+}
+
+func (tc *tokenClient) SetToken(token string) {
+	tc.token = token
+}
+
+func (tc *tokenClient) FetchArtifact(hash string) (*http.Response, error) {
+	if tc.token != "fresh" {
+		return &http.Response{
+			StatusCode: http.StatusUnauthorized,
+			Body:       ioutil.NopCloser(&bytes.Buffer{}),
+		}, nil
+	}
+	return tc.artifactResp.FetchArtifact(hash)
+}
+
+func TestTokenRefresh(t *testing.T) {
+	body := makeValidTar(t).Bytes()
+
+	t.Run("without a refresh hook", func(t *testing.T) {
+		root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+		client := &tokenClient{artifactResp: artifactResp{body: body}, token: "expired"}
+		cache := newHTTPCache(Opts{}, client, &nullRecorder{}, root)
+
+		_, _, _, err := cache.Fetch(root, "some-hash", nil)
+		assert.ErrorIs(t, err, ErrUnauthorized)
+	})
+
+	t.Run("with a refresh hook", func(t *testing.T) {
+		root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+		client := &tokenClient{artifactResp: artifactResp{body: body}, token: "expired"}
+		refreshes := 0
+		cache := newHTTPCache(Opts{
+			TokenRefresh: func() (string, error) {
+				refreshes++
+				return "fresh", nil
+			},
+		}, client, &nullRecorder{}, root)
+
+		itemStatus, _, _, err := cache.Fetch(root, "some-hash", nil)
+		assert.NilError(t, err, "Fetch")
+		assert.Assert(t, itemStatus.Remote)
+		assert.Equal(t, refreshes, 1)
+	})
+
+	t.Run("refresh fails", func(t *testing.T) {
+		root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+		client := &tokenClient{artifactResp: artifactResp{body: body}, token: "expired"}
+		cache := newHTTPCache(Opts{
+			TokenRefresh: func() (string, error) {
+				return "", errors.New("no credentials")
+			},
+		}, client, &nullRecorder{}, root)
+
+		_, _, _, err := cache.Fetch(root, "some-hash", nil)
+		assert.ErrorIs(t, err, ErrUnauthorized)
+	})
+}
+
+func TestIncludeManifest(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	_ = root.Join("a").WriteFile([]byte("a"), 0644)
+	files := turbopath.AnchoredUnixPathArray{"a"}.ToSystemPathArray()
+
+	client := &artifactResp{}
+	uploader := newHTTPCache(Opts{IncludeManifest: true}, client, &nullRecorder{}, root)
+	assert.NilError(t, uploader.Put(root, "some-hash", 0, files), "Put")
+
+	restoreRoot := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	downloader := newHTTPCache(Opts{}, client, &nullRecorder{}, restoreRoot)
+	_, restored, _, err := downloader.Fetch(restoreRoot, "some-hash", nil)
+	assert.NilError(t, err, "Fetch")
+	assert.DeepEqual(t, restored, files)
+	assert.Assert(t, !restoreRoot.UntypedJoin(cacheitem.ManifestName).Exists())
+}
+
+func TestSolidCompression(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	_ = root.Join("a").WriteFile([]byte("a"), 0644)
+	_ = root.Join("b").WriteFile([]byte("b"), 0644)
+	files := turbopath.AnchoredUnixPathArray{"a", "b"}.ToSystemPathArray()
+
+	client := &artifactResp{}
+	uploader := newHTTPCache(Opts{SolidCompression: true}, client, &nullRecorder{}, root)
+	assert.NilError(t, uploader.Put(root, "some-hash", 0, files), "Put")
+
+	restoreRoot := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	downloader := newHTTPCache(Opts{}, client, &nullRecorder{}, restoreRoot)
+	_, restored, _, err := downloader.Fetch(restoreRoot, "some-hash", nil)
+	assert.NilError(t, err, "Fetch")
+	assert.DeepEqual(t, restored, files)
+	contents, err := restoreRoot.Join("b").ReadFile()
+	assert.NilError(t, err, "ReadFile")
+	assert.Equal(t, string(contents), "b")
+}
+
+func TestDeadline(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	client := &countingFetchClient{artifactResp: artifactResp{body: makeValidTar(t).Bytes()}}
+	deadline := time.Now().Add(time.Hour)
+	cache := newHTTPCache(Opts{
+		Deadline: func() time.Time { return deadline },
+	}, client, &nullRecorder{}, root)
+
+	itemStatus, _, _, err := cache.Fetch(root, "some-hash", nil)
+	assert.NilError(t, err, "Fetch")
+	assert.Assert(t, itemStatus.Remote)
+
+	deadline = time.Now().Add(time.Second)
+	_, _, _, err = cache.Fetch(root, "some-hash", nil)
+	assert.ErrorIs(t, err, ErrRunBudgetExhausted)
+	assert.Equal(t, client.fetches, 1, "no request is made once the budget is exhausted")
+	assert.Assert(t, !cache.Exists("some-hash").Remote)
+	assert.ErrorIs(t, cache.Put(root, "some-hash", 0, nil), ErrRunBudgetExhausted)
+}
+
+type etagClient struct {
+	countingFetchClient
+	etag          string
+	notModified   int
+	lastCondition string
+	unreachable   bool
+}
+
+func (ec *etagClient) FetchArtifact(hash string) (*http.Response, error) {
+	resp, err := ec.countingFetchClient.FetchArtifact(hash)
+	resp.Header.Set("ETag", ec.etag)
+	return resp, err
+}
+
+func (ec *etagClient) FetchArtifactIfNoneMatch(hash string, etag string) (*http.Response, error) {
+	ec.lastCondition = etag
+	if ec.unreachable {
+		return nil, errors.New("connection refused")
+	}
+	if etagsMatch(etag, ec.etag) {
+		ec.notModified++
+		return &http.Response{
+			StatusCode: http.StatusNotModified,
+			Header:     http.Header{"Etag": []string{ec.etag}},
+			Body:       ioutil.NopCloser(&bytes.Buffer{}),
+		}, nil
+	}
+	return ec.FetchArtifact(hash)
+}
+
+// resettingClient serves its artifact, but the connection drops partway
+// through the body of the first fetch.
+type resettingClient struct {
+	artifactResp
+	fetches int
+}
+
+func (rc *resettingClient) FetchArtifact(hash string) (*http.Response, error) {
+	rc.fetches++
+	resp, err := rc.artifactResp.FetchArtifact(hash)
+	if rc.fetches == 1 {
+		resp.Body = ioutil.NopCloser(io.MultiReader(
+			bytes.NewReader(rc.body[:len(rc.body)/2]),
+			iotest.ErrReader(syscall.ECONNRESET),
+		))
+	}
+	return resp, err
+}
+
+func TestConnectionResetRetried(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	client := &resettingClient{artifactResp: artifactResp{body: makeValidTar(t).Bytes()}}
+	cache := newHTTPCache(Opts{}, client, &nullRecorder{}, root)
+
+	result := cache.FetchWithResult(root, "some-hash", nil)
+	assert.NilError(t, result.Err, "Fetch")
+	assert.Assert(t, result.Status.Remote)
+	assert.Equal(t, result.Attempts, 2)
+	assert.Equal(t, client.fetches, 2)
+}
+
+func TestConditionalFetch(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	client := &etagClient{
+		countingFetchClient: countingFetchClient{artifactResp: artifactResp{body: makeValidTar(t).Bytes(), headers: http.Header{}}},
+		etag:                `W/"v1"`,
+	}
+	cache := newHTTPCache(Opts{LocalMirrorDir: t.TempDir()}, client, &nullRecorder{}, root)
+
+	itemStatus, _, _, err := cache.Fetch(root, "some-hash", nil)
+	assert.NilError(t, err, "Fetch")
+	assert.Assert(t, itemStatus.Remote)
+	assert.Equal(t, client.fetches, 1)
+
+	// Unchanged: the mirrored copy is revalidated rather than downloaded again.
+	itemStatus, _, _, err = cache.Fetch(root, "some-hash", nil)
+	assert.NilError(t, err, "Fetch")
+	assert.Assert(t, itemStatus.Remote)
+	assert.Equal(t, client.lastCondition, `W/"v1"`)
+	assert.Equal(t, client.notModified, 1)
+	assert.Equal(t, client.fetches, 1)
+
+	// Changed: the new version is downloaded.
+	client.etag = `"v2"`
+	itemStatus, _, _, err = cache.Fetch(root, "some-hash", nil)
+	assert.NilError(t, err, "Fetch")
+	assert.Assert(t, itemStatus.Remote)
+	assert.Equal(t, client.fetches, 2)
+	assert.Equal(t, cache.lookupETag("some-hash"), `"v2"`)
+}
+
+func TestItemSource(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	client := &etagClient{
+		countingFetchClient: countingFetchClient{artifactResp: artifactResp{body: makeValidTar(t).Bytes(), headers: http.Header{}}},
+		etag:                `"v1"`,
+	}
+	cache := newHTTPCache(Opts{LocalMirrorDir: t.TempDir()}, client, &nullRecorder{}, root)
+
+	itemStatus, _, _, err := cache.Fetch(root, "some-hash", nil)
+	assert.NilError(t, err, "Fetch")
+	assert.Equal(t, itemStatus.Source, ItemSourceRemote)
+	assert.Equal(t, cache.Exists("some-hash").Source, ItemSourceRemote)
+
+	// The mirrored copy can't be revalidated, so it isn't used.
+	client.unreachable = true
+	itemStatus, _, _, err = cache.Fetch(root, "some-hash", nil)
+	assert.Assert(t, err != nil, "Fetch")
+	assert.Equal(t, itemStatus.Source, ItemSourceNone)
+	assert.Assert(t, !itemStatus.Local)
+	assert.Assert(t, !itemStatus.Remote)
+
+	// Without an ETag, the mirrored copy is trusted outright.
+	client.unreachable = false
+	client.etag = ""
+	otherRoot := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	uncached := newHTTPCache(Opts{LocalMirrorDir: t.TempDir()}, client, &nullRecorder{}, otherRoot)
+	_, _, _, err = uncached.Fetch(otherRoot, "some-hash", nil)
+	assert.NilError(t, err, "Fetch")
+	itemStatus, _, _, err = uncached.Fetch(otherRoot, "some-hash", nil)
+	assert.NilError(t, err, "Fetch")
+	assert.Equal(t, itemStatus.Source, ItemSourceLocalMirror)
+}
+
+func TestEtagsMatch(t *testing.T) {
+	assert.Assert(t, etagsMatch(`"a"`, `"a"`))
+	assert.Assert(t, etagsMatch(`W/"a"`, `"a"`))
+	assert.Assert(t, etagsMatch(`W/"a"`, `W/"a"`))
+	assert.Assert(t, !etagsMatch(`"a"`, `"b"`))
+	assert.Assert(t, !etagsMatch("", ""))
+}
+
+func TestMissStatusCodes(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	tests := []struct {
+		name     string
+		codes    []int
+		status   int
+		wantMiss bool
+	}{
+		{name: "default 404", status: http.StatusNotFound, wantMiss: true},
+		{name: "default 204", status: http.StatusNoContent, wantMiss: false},
+		{name: "configured 204", codes: []int{http.StatusNoContent}, status: http.StatusNoContent, wantMiss: true},
+		{name: "configured without 404", codes: []int{http.StatusNoContent}, status: http.StatusNotFound, wantMiss: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := newHTTPCache(Opts{MissStatusCodes: tt.codes}, &statusResp{status: tt.status}, &nullRecorder{}, root)
+			itemStatus, _, _, err := cache.Fetch(root, "some-hash", nil)
+			assert.Assert(t, !itemStatus.Remote)
+			if tt.wantMiss {
+				assert.NilError(t, err, "a miss is not an error")
+			} else {
+				assert.Assert(t, err != nil, "expected an error")
+			}
+		})
+	}
+}
+
+func TestPreUploadHook(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	_ = root.Join("a").WriteFile([]byte("a"), 0644)
+	files := turbopath.AnchoredUnixPathArray{"a"}.ToSystemPathArray()
+
+	t.Run("accepts", func(t *testing.T) {
+		client := &artifactResp{}
+		var seen []byte
+		cache := newHTTPCache(Opts{
+			PreUploadHook: func(tarBytes []byte) error {
+				seen = append([]byte(nil), tarBytes...)
+				// Mutations must not leak into the upload.
+				for i := range tarBytes {
+					tarBytes[i] = 0
+				}
+				return nil
+			},
+		}, client, &nullRecorder{}, root)
+		assert.NilError(t, cache.Put(root, "some-hash", 0, files), "Put")
+		assert.Assert(t, bytes.Equal(seen, client.body), "hook sees the uploaded bytes")
+	})
+
+	t.Run("rejects", func(t *testing.T) {
+		client := &artifactResp{}
+		cache := newHTTPCache(Opts{
+			PreUploadHook: func(tarBytes []byte) error {
+				return errors.New("found a secret")
+			},
+		}, client, &nullRecorder{}, root)
+		err := cache.Put(root, "some-hash", 0, files)
+		assert.ErrorContains(t, err, "found a secret")
+		assert.Assert(t, client.body == nil, "nothing was uploaded")
+	})
+}
+
+type existsClient struct {
+	statusResp
+	mu       sync.Mutex
+	requests int
+	respond  func(hash string) (*http.Response, error)
+}
+
+func (ec *existsClient) ArtifactExists(hash string) (*http.Response, error) {
+	ec.mu.Lock()
+	ec.requests++
+	ec.mu.Unlock()
+	return ec.respond(hash)
+}
+
+func TestBatchExists(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	hashes := make([]string, 50)
+	for i := range hashes {
+		hashes[i] = fmt.Sprintf("hash-%v", i)
+	}
+	respond := func(status int) (*http.Response, error) {
+		return &http.Response{StatusCode: status, Body: ioutil.NopCloser(&bytes.Buffer{})}, nil
+	}
+
+	t.Run("transient errors are misses", func(t *testing.T) {
+		client := &existsClient{respond: func(hash string) (*http.Response, error) {
+			switch hash {
+			case "hash-1":
+				return respond(http.StatusOK)
+			case "hash-2":
+				return nil, errors.New("connection reset")
+			case "hash-3":
+				return respond(http.StatusBadGateway)
+			default:
+				return respond(http.StatusNotFound)
+			}
+		}}
+		cache := newHTTPCache(Opts{}, client, &nullRecorder{}, root)
+
+		results, err := cache.BatchExists(context.Background(), hashes)
+		assert.NilError(t, err, "BatchExists")
+		assert.Equal(t, len(results), len(hashes))
+		assert.Assert(t, results["hash-1"].Remote)
+		assert.Assert(t, !results["hash-2"].Remote)
+		assert.Assert(t, !results["hash-3"].Remote)
+	})
+
+	t.Run("hard errors cancel the batch", func(t *testing.T) {
+		client := &existsClient{respond: func(hash string) (*http.Response, error) {
+			return nil, ErrUnauthorized
+		}}
+		cache := newHTTPCache(Opts{}, client, &nullRecorder{}, root)
+		cache.requestLimiter = make(limiter, 1)
+
+		_, err := cache.BatchExists(context.Background(), hashes)
+		assert.ErrorIs(t, err, ErrUnauthorized)
+		assert.Assert(t, client.requests < len(hashes), "made %v requests", client.requests)
+	})
+}
+
+type aliasClient struct {
+	artifactResp
+	uploads []string
+	aliases map[string]string
+}
+
+func (ac *aliasClient) PutArtifact(hash string, body []byte, duration int, tag string) error {
+	ac.uploads = append(ac.uploads, hash)
+	return ac.artifactResp.PutArtifact(hash, body, duration, tag)
+}
+
+func (ac *aliasClient) RegisterArtifactAlias(hash string, alias string) error {
+	ac.aliases[alias] = hash
+	return nil
+}
+
+func TestPutWithAliases(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	_ = root.Join("a").WriteFile([]byte("a"), 0644)
+	files := turbopath.AnchoredUnixPathArray{"a"}.ToSystemPathArray()
+
+	t.Run("registers aliases", func(t *testing.T) {
+		client := &aliasClient{aliases: map[string]string{}}
+		cache := newHTTPCache(Opts{}, client, &nullRecorder{}, root)
+		assert.NilError(t, cache.PutWithAliases(root, "new-hash", []string{"old-hash"}, 0, files), "PutWithAliases")
+		assert.DeepEqual(t, client.uploads, []string{"new-hash"})
+		assert.DeepEqual(t, client.aliases, map[string]string{"old-hash": "new-hash"})
+	})
+
+	t.Run("uploads under each alias when signing", func(t *testing.T) {
+		client := &aliasClient{aliases: map[string]string{}}
+		cache := newHTTPCache(Opts{}, client, &nullRecorder{}, root)
+		cache.signerVerifier = &ArtifactSignatureAuthentication{teamID: "team_id", secretKeyOverride: []byte("key"), enabled: true}
+		assert.NilError(t, cache.PutWithAliases(root, "new-hash", []string{"old-hash"}, 0, files), "PutWithAliases")
+		assert.DeepEqual(t, client.uploads, []string{"new-hash", "old-hash"})
+		assert.Equal(t, len(client.aliases), 0)
+	})
+
+	t.Run("is checked like Put", func(t *testing.T) {
+		client := &aliasClient{aliases: map[string]string{}}
+		cache := newHTTPCache(Opts{
+			Deadline: func() time.Time { return time.Now() },
+		}, client, &nullRecorder{}, root)
+		err := cache.PutWithAliases(root, "new-hash", []string{"old-hash"}, 0, files)
+		assert.ErrorIs(t, err, ErrRunBudgetExhausted)
+		assert.Equal(t, len(client.uploads), 0)
+		assert.Equal(t, len(client.aliases), 0)
+	})
+}
+
+type immutableClient struct {
+	artifactResp
+	pinned map[string]bool
+}
+
+func (ic *immutableClient) PutArtifact(hash string, body []byte, duration int, tag string) error {
+	if ic.pinned[hash] {
+		return ErrArtifactImmutable
+	}
+	return ic.artifactResp.PutArtifact(hash, body, duration, tag)
+}
+
+func (ic *immutableClient) PutArtifactImmutable(hash string, body io.ReadSeeker, size int64, duration int, tag string, signedAt string) error {
+	if ic.pinned[hash] {
+		return ErrArtifactImmutable
+	}
+	ic.pinned[hash] = true
+	artifactBody, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	return ic.artifactResp.PutArtifact(hash, artifactBody, duration, tag)
+}
+
+func TestPutImmutable(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	_ = root.Join("a").WriteFile([]byte("a"), 0644)
+	files := turbopath.AnchoredUnixPathArray{"a"}.ToSystemPathArray()
+
+	t.Run("pins the artifact", func(t *testing.T) {
+		client := &immutableClient{pinned: map[string]bool{}}
+		cache := newHTTPCache(Opts{}, client, &nullRecorder{}, root)
+		assert.NilError(t, cache.PutImmutable(root, "the-hash", 0, files), "PutImmutable")
+		assert.Assert(t, client.pinned["the-hash"])
+		assert.ErrorIs(t, cache.Put(root, "the-hash", 0, files), ErrArtifactImmutable)
+
+		hit, _, _, err := cache.Fetch(root, "the-hash", nil)
+		assert.NilError(t, err, "Fetch")
+		assert.Assert(t, hit.Remote)
+	})
+
+	t.Run("uploads normally without client support", func(t *testing.T) {
+		client := &artifactResp{}
+		cache := newHTTPCache(Opts{}, client, &nullRecorder{}, root)
+		assert.NilError(t, cache.PutImmutable(root, "the-hash", 0, files), "PutImmutable")
+		assert.Assert(t, client.body != nil)
+		assert.NilError(t, cache.Put(root, "the-hash", 0, files), "Put")
+	})
+}
+
+func TestFailedOps(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	_ = root.Join("a").WriteFile([]byte("a"), 0644)
+	files := turbopath.AnchoredUnixPathArray{"a"}.ToSystemPathArray()
+
+	putErr := errors.New("upload failed")
+	cache := newHTTPCache(Opts{}, &statusResp{status: http.StatusInternalServerError, putErr: putErr}, &nullRecorder{}, root)
+	assert.Equal(t, len(cache.FailedOps()), 0)
+
+	assert.ErrorIs(t, cache.Put(root, "put-hash", 0, files), putErr)
+	_, _, _, err := cache.Fetch(root, "fetch-hash", nil)
+	assert.Assert(t, err != nil)
+	cache.Exists("exists-hash")
+
+	failed := cache.FailedOps()
+	assert.Equal(t, len(failed), 3)
+	assert.Equal(t, failed[0].Op, "put")
+	assert.Equal(t, failed[0].Hash, "put-hash")
+	assert.ErrorIs(t, failed[0].Err, putErr)
+	assert.Equal(t, failed[1].Op, "fetch")
+	assert.Equal(t, failed[1].Hash, "fetch-hash")
+	assert.Equal(t, failed[2].Op, "exists")
+	assert.Equal(t, failed[2].Hash, "exists-hash")
+
+	for i := 0; i < 2*_maxFailedOps; i++ {
+		cache.Exists("exists-hash")
+	}
+	assert.Equal(t, len(cache.FailedOps()), _maxFailedOps)
+}
+
+func TestReadAllValidating(t *testing.T) {
+	body := make([]byte, 3*_validateChunkSize+17)
+	_, _ = rand.Read(body)
+	signer := &ArtifactSignatureAuthentication{teamID: "team_id", secretKeyOverride: []byte("key"), enabled: true}
+	tag, err := signer.generateTag("the-hash", body)
+	assert.NilError(t, err, "generateTag")
+
+	validator, err := signer.newStreamValidator("the-hash")
+	assert.NilError(t, err, "newStreamValidator")
+	read, err := readAllValidating(&slowReader{reader: bytes.NewReader(body)}, 0, validator)
+	assert.NilError(t, err, "readAllValidating")
+	assert.Assert(t, bytes.Equal(read, body))
+	assert.Assert(t, validator.Validate(tag))
+
+	validator, err = signer.newStreamValidator("the-hash")
+	assert.NilError(t, err, "newStreamValidator")
+	_, err = readAllValidating(io.MultiReader(bytes.NewReader(body), &errorReader{}), int64(len(body)), validator)
+	assert.ErrorContains(t, err, "connection reset")
+
+	// A bogus Content-Length isn't allocated up front.
+	validator, err = signer.newStreamValidator("the-hash")
+	assert.NilError(t, err, "newStreamValidator")
+	read, err = readAllValidating(bytes.NewReader(body), math.MaxInt64, validator)
+	assert.NilError(t, err, "readAllValidating")
+	assert.Assert(t, bytes.Equal(read, body))
+	assert.Assert(t, validator.Validate(tag))
+}
+
+type errorReader struct{}
+
+func (errorReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+// slowReader simulates a network connection, delivering at most 64KiB per Read
+// with a delay before each.
+type slowReader struct {
+	reader io.Reader
+}
+
+func (sr *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	if len(p) > 64<<10 {
+		p = p[:64<<10]
+	}
+	return sr.reader.Read(p)
+}
+
+// BenchmarkSignedDownload compares verifying a signed artifact after it has
+// downloaded with verifying it as it downloads.
+func BenchmarkSignedDownload(b *testing.B) {
+	body := make([]byte, 16<<20)
+	_, _ = rand.Read(body)
+	signer := &ArtifactSignatureAuthentication{teamID: "team_id", secretKeyOverride: []byte("key"), enabled: true}
+	tag, err := signer.generateTag("the-hash", body)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("serial", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			// Read in the same size chunks as readAllValidating, so that both
+			// wait on the simulated network equally.
+			downloaded := bytes.NewBuffer(make([]byte, 0, len(body)+1))
+			_, _ = io.CopyBuffer(struct{ io.Writer }{downloaded}, &slowReader{reader: bytes.NewReader(body)}, make([]byte, _validateChunkSize))
+			if ok, _ := signer.validate("the-hash", downloaded.Bytes(), tag); !ok {
+				b.Fatal("invalid tag")
+			}
+		}
+	})
+	b.Run("during download", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			validator, _ := signer.newStreamValidator("the-hash")
+			_, _ = readAllValidating(&slowReader{reader: bytes.NewReader(body)}, int64(len(body)), validator)
+			if !validator.Validate(tag) {
+				b.Fatal("invalid tag")
+			}
+		}
+	})
+}
+
+// streamClient serves an artifact from a reader, e.g. one end of a pipe, so a
+// test controls when its bytes arrive.
+type streamClient struct {
+	artifactResp
+	body io.Reader
+}
+
+func (sc *streamClient) FetchArtifact(hash string) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(sc.body),
+	}, nil
+}
+
+func TestRetrieveStreams(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	_ = root.Join("first").WriteFile([]byte("first"), 0644)
+	second := make([]byte, 4<<20)
+	_, _ = rand.Read(second)
+	_ = root.Join("second").WriteFile(second, 0644)
+	files := turbopath.AnchoredUnixPathArray{"first", "second"}.ToSystemPathArray()
+	uploaded := &artifactResp{}
+	assert.NilError(t, newHTTPCache(Opts{}, uploaded, &nullRecorder{}, root).Put(root, "some-hash", 0, files), "Put")
+
+	restoreRoot := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	r, w := io.Pipe()
+	cache := newHTTPCache(Opts{}, &streamClient{body: r}, &nullRecorder{}, restoreRoot)
+	result := make(chan error, 1)
+	go func() {
+		_, _, _, err := cache.Fetch(restoreRoot, "some-hash", nil)
+		result <- err
+	}()
+
+	// Send the first half of the artifact, and wait for the first file to be
+	// staged before sending the rest.
+	half := len(uploaded.body) / 2
+	_, err := w.Write(uploaded.body[:half])
+	assert.NilError(t, err, "Write")
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		staged, _ := filepath.Glob(cache.tempDir.UntypedJoin("*", "first").ToString())
+		if len(staged) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("nothing was restored before the download finished")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert.Assert(t, !restoreRoot.Join("first").FileExists(), "files are moved into place once the download finishes")
+	_, err = w.Write(uploaded.body[half:])
+	assert.NilError(t, err, "Write")
+	assert.NilError(t, w.Close(), "Close")
+	assert.NilError(t, <-result, "Fetch")
+
+	restored, err := restoreRoot.Join("second").ReadFile()
+	assert.NilError(t, err, "ReadFile")
+	assert.Assert(t, bytes.Equal(restored, second))
+}
+
+// _streamRestoreSize is the size of the file in the artifact restored by
+// BenchmarkStreamRestore.
+const _streamRestoreSize = 2 << 30
+
+// BenchmarkStreamRestore restores an unsigned multi-GB artifact as it is
+// generated, and reports the peak heap in use, which stays bounded because
+// the artifact is never buffered in full.
+func BenchmarkStreamRestore(b *testing.B) {
+	root := fs.AbsoluteSystemPathFromUpstream(b.TempDir())
+	b.SetBytes(_streamRestoreSize)
+
+	var peakHeap uint64
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var stats runtime.MemStats
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+				runtime.ReadMemStats(&stats)
+				if stats.HeapInuse > peakHeap {
+					peakHeap = stats.HeapInuse
+				}
+			}
+		}
+	}()
+
+	for i := 0; i < b.N; i++ {
+		r, w := io.Pipe()
+		go func() {
+			_ = w.CloseWithError(writeLargeArtifact(w, _streamRestoreSize))
+		}()
+		cache := newHTTPCache(Opts{}, &streamClient{body: r}, &nullRecorder{}, root)
+		if _, _, _, err := cache.Fetch(root, "some-hash", nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+	b.ReportMetric(float64(peakHeap)/(1<<20), "peak-heap-MiB")
+}
+
+// writeLargeArtifact writes an artifact holding a single file of size bytes.
+func writeLargeArtifact(w io.Writer, size int64) error {
+	zw := zstd.NewWriterLevel(w, zstd.BestSpeed)
+	tw := tar.NewWriter(zw)
+	if err := tw.WriteHeader(&tar.Header{Name: "large", Typeflag: tar.TypeReg, Mode: 0644, Size: size}); err != nil {
+		return err
+	}
+	chunk := bytes.Repeat([]byte("turbo"), 1<<18)
+	for written := int64(0); written < size; {
+		n := int64(len(chunk))
+		if size-written < n {
+			n = size - written
+		}
+		if _, err := tw.Write(chunk[:n]); err != nil {
+			return err
+		}
+		written += n
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+type dialerClient struct {
+	artifactResp
+	dialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+func (dc *dialerClient) SetDialContext(dialContext func(ctx context.Context, network, addr string) (net.Conn, error)) {
+	dc.dialContext = dialContext
+}
+
+func TestDialContext(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	dialErr := errors.New("dialed")
+	client := &dialerClient{}
+	_ = newHTTPCache(Opts{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, dialErr
+		},
+	}, client, &nullRecorder{}, root)
+	assert.Assert(t, client.dialContext != nil)
+	_, err := client.dialContext(context.Background(), "tcp", "cache:443")
+	assert.ErrorIs(t, err, dialErr)
+
+	unset := &dialerClient{}
+	_ = newHTTPCache(Opts{}, unset, &nullRecorder{}, root)
+	assert.Assert(t, unset.dialContext == nil)
+}
+
+func TestEventSizes(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	assert.NilError(t, root.Join("dir").MkdirAll(0755), "MkdirAll")
+	_ = root.Join("dir", "a").WriteFile(bytes.Repeat([]byte("a"), 1000), 0644)
+	_ = root.Join("b").WriteFile(bytes.Repeat([]byte("b"), 500), 0644)
+	files := turbopath.AnchoredUnixPathArray{"dir", "dir/a", "b"}.ToSystemPathArray()
+
+	var events []CacheEvent
+	client := &artifactResp{}
+	recorder := &capturingRecorder{}
+	cache := newHTTPCache(Opts{
+		OnCacheEvent: func(event CacheEvent) {
+			events = append(events, event)
+		},
+	}, client, recorder, root)
+	assert.NilError(t, cache.Put(root, "some-hash", 0, files), "Put")
+
+	assert.Equal(t, len(events), 1)
+	assert.Equal(t, events[0].Event, CacheEventUpload)
+	assert.Equal(t, events[0].UncompressedSize, int64(1500))
+	assert.Equal(t, events[0].CompressedSize, int64(len(client.body)))
+
+	_, _, _, err := cache.Fetch(root, "some-hash", nil)
+	assert.NilError(t, err, "Fetch")
+	assert.Equal(t, len(events), 2)
+	assert.Equal(t, events[1].Event, CacheEventHit)
+	assert.Equal(t, events[1].CompressedSize, int64(len(client.body)))
+	assert.Equal(t, events[1].UncompressedSize, int64(0))
+
+	// The recorder sees the same events, so existing telemetry gets the sizes.
+	assert.Equal(t, len(recorder.events), 2)
+	for i, payload := range recorder.events {
+		assert.DeepEqual(t, *payload.(*CacheEvent), events[i])
+	}
+}
+
+func TestSignatureScopeHashOnly(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	_ = root.Join("a").WriteFile([]byte("a"), 0644)
+	files := turbopath.AnchoredUnixPathArray{"a"}.ToSystemPathArray()
+	signer := func() *ArtifactSignatureAuthentication {
+		return &ArtifactSignatureAuthentication{teamID: "team_id", secretKeyOverride: []byte("key"), enabled: true, signatureScope: SignatureScopeHashOnly}
+	}
+
+	client := &resignClient{}
+	uploader := newHTTPCache(Opts{}, client, &nullRecorder{}, root)
+	uploader.signerVerifier = signer()
+	assert.NilError(t, uploader.Put(root, "some-hash", 0, files), "Put")
+	hashTag, err := signer().generateTag("some-hash", []byte("anything"))
+	assert.NilError(t, err, "generateTag")
+	assert.Equal(t, client.putTag, hashTag, "tag doesn't depend on the body")
+
+	client.headers = http.Header{"X-Artifact-Tag": []string{client.putTag}}
+	restoreRoot := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	downloader := newHTTPCache(Opts{}, client, &nullRecorder{}, restoreRoot)
+	downloader.signerVerifier = signer()
+	itemStatus, _, _, err := downloader.Fetch(restoreRoot, "some-hash", nil)
+	assert.NilError(t, err, "Fetch")
+	assert.Assert(t, itemStatus.Remote)
+	assert.Assert(t, restoreRoot.UntypedJoin("a").FileExists())
+
+	_, _, _, err = downloader.Fetch(restoreRoot, "other-hash", nil)
+	assert.ErrorContains(t, err, "artifact tag does not match")
+
+	bodySigned := newHTTPCache(Opts{}, client, &nullRecorder{}, restoreRoot)
+	bodySigned.signerVerifier = &ArtifactSignatureAuthentication{teamID: "team_id", secretKeyOverride: []byte("key"), enabled: true}
+	_, _, _, err = bodySigned.Fetch(restoreRoot, "some-hash", nil)
+	assert.ErrorContains(t, err, "artifact tag does not match")
+}
+
+func TestClockSkew(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	body := makeValidTar(t).Bytes()
+
+	tests := []struct {
+		name       string
+		date       string
+		wantEvents int
+	}{
+		{name: "in sync", date: time.Now().UTC().Format(http.TimeFormat)},
+		{name: "ahead", date: time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), wantEvents: 1},
+		{name: "behind", date: time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), wantEvents: 1},
+		{name: "missing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var skewEvents []CacheEvent
+			client := &artifactResp{body: body, headers: http.Header{}}
+			if tt.date != "" {
+				client.headers.Set("Date", tt.date)
+			}
+			cache := newHTTPCache(Opts{
+				OnCacheEvent: func(event CacheEvent) {
+					if event.Event == CacheEventClockSkew {
+						skewEvents = append(skewEvents, event)
+					}
+				},
+			}, client, &nullRecorder{}, root)
+
+			_, _, _, err := cache.Fetch(root, "some-hash", nil)
+			assert.NilError(t, err, "Fetch")
+			cache.Exists("some-hash")
+			assert.Equal(t, len(skewEvents), tt.wantEvents)
+			if tt.wantEvents > 0 {
+				skew := skewEvents[0].ClockSkewSeconds
+				assert.Assert(t, skew > 3500 || skew < -3500, "skew of %v seconds", skew)
+			}
+		})
+	}
+}
+
+func TestHashRewriter(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	_ = root.Join("a").WriteFile([]byte("a"), 0644)
+	files := turbopath.AnchoredUnixPathArray{"a"}.ToSystemPathArray()
+
+	client := newHookClient()
+	var events []string
+	cache := newHTTPCache(Opts{
+		HashRewriter: func(hash string) string { return "experiment-" + hash },
+		OnCacheEvent: func(event CacheEvent) { events = append(events, event.Hash) },
+	}, client, &nullRecorder{}, root)
+
+	assert.NilError(t, cache.Put(root, "the-hash", 0, files), "Put")
+	itemStatus, _, _, err := cache.Fetch(root, "the-hash", nil)
+	assert.NilError(t, err, "Fetch")
+	assert.Assert(t, itemStatus.Remote)
+	assert.Assert(t, cache.Exists("the-hash").Remote)
+	statuses, err := cache.BatchExists(context.Background(), []string{"the-hash"})
+	assert.NilError(t, err, "BatchExists")
+	assert.Assert(t, statuses["the-hash"].Remote, "results are keyed by the caller's hash")
+
+	assert.DeepEqual(t, client.requests, []string{
+		"put experiment-the-hash",
+		"fetch experiment-the-hash",
+		"exists experiment-the-hash",
+		"exists experiment-the-hash",
+	})
+	assert.DeepEqual(t, events, []string{"experiment-the-hash", "experiment-the-hash"})
+}
+
+func TestMaxConcurrentRestores(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	client := &artifactResp{body: makeValidTar(t).Bytes()}
+
+	c, err := newSyncCache(Opts{MaxConcurrentRestores: 1, OverrideDir: root.UntypedJoin("cache").ToString()}, root, client, &nullRecorder{}, nil)
+	assert.NilError(t, err, "newSyncCache")
+	caches := c.(*cacheMultiplexer).caches
+	fsLimiter := caches[0].(*fsCache).restoreLimiter
+	cache := caches[1].(*httpCache)
+	assert.Equal(t, cap(fsLimiter), 1)
+	assert.Equal(t, cache.restoreLimiter, fsLimiter, "the caches share one limiter")
+
+	// Occupy the only restore slot; the fetch should wait for it.
+	fsLimiter.acquire()
+	done := make(chan error)
+	go func() {
+		_, _, _, err := cache.Fetch(root, "some-hash", nil)
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Fatal("restore did not wait for a free slot")
+	case <-time.After(50 * time.Millisecond):
+	}
+	fsLimiter.release()
+	assert.NilError(t, <-done, "Fetch")
+}
+
+func TestRemoteReadOnly(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	_ = root.Join("a").WriteFile([]byte("a"), 0644)
+	files := turbopath.AnchoredUnixPathArray{"a"}.ToSystemPathArray()
+
+	client := newHookClient()
+	client.store("the-hash", nil)
+	cache := newHTTPCache(Opts{RemoteReadOnlyReason: "PR build"}, client, &nullRecorder{}, root)
+	writable, reason := cache.Writable()
+	assert.Assert(t, !writable)
+	assert.Equal(t, reason, "PR build")
+
+	result := cache.PutWithResult(root, "the-hash", 0, files)
+	assert.NilError(t, result.Err, "PutWithResult")
+	assert.Assert(t, result.Skipped)
+	assert.NilError(t, cache.PutWithAliases(root, "the-hash", []string{"alias"}, 0, files), "PutWithAliases")
+	assert.Assert(t, cache.Exists("the-hash").Remote)
+	assert.DeepEqual(t, client.requests, []string{"exists the-hash"})
+
+	writable, reason = newHTTPCache(Opts{}, client, &nullRecorder{}, root).Writable()
+	assert.Assert(t, writable)
+	assert.Equal(t, reason, "")
+}
+
+func TestAdaptiveCompression(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	_ = root.Join("small").WriteFile(make([]byte, 10), 0644)
+	_ = root.Join("large").WriteFile(make([]byte, 1000), 0644)
+	small := turbopath.AnchoredUnixPathArray{"small"}.ToSystemPathArray()
+	both := turbopath.AnchoredUnixPathArray{"small", "large"}.ToSystemPathArray()
+
+	fixed := newHTTPCache(Opts{CompressionLevel: 7}, &errorResp{t: t}, &nullRecorder{}, root)
+	assert.Equal(t, fixed.levelFor(root, both), 7)
+
+	adaptive := newHTTPCache(Opts{
+		AdaptiveCompression: true,
+		CompressionTiers: []CompressionTier{
+			{MinInputSize: 1000, Level: 19},
+			{MinInputSize: 0, Level: 2},
+		},
+	}, &errorResp{t: t}, &nullRecorder{}, root)
+	assert.Equal(t, adaptive.levelFor(root, small), 2)
+	assert.Equal(t, adaptive.levelFor(root, both), 19)
+
+	defaults := newHTTPCache(Opts{AdaptiveCompression: true}, &errorResp{t: t}, &nullRecorder{}, root)
+	assert.Equal(t, defaults.levelFor(root, both), DefaultCompressionTiers[0].Level)
+}
+
+// timestampedClient stores artifacts along with their signing time, like a
+// backend that returns x-artifact-signed-at.
+type timestampedClient struct {
+	artifactResp
+}
+
+func (tc *timestampedClient) PutArtifactSignedAt(hash string, body io.ReadSeeker, size int64, duration int, tag string, signedAt string) error {
+	artifactBody, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	tc.headers = http.Header{"X-Artifact-Tag": []string{tag}, "X-Artifact-Signed-At": []string{signedAt}}
+	return tc.artifactResp.PutArtifact(hash, artifactBody, duration, tag)
+}
+
+func TestSignatureFreshness(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	_ = root.Join("a").WriteFile([]byte("a"), 0644)
+	files := turbopath.AnchoredUnixPathArray{"a"}.ToSystemPathArray()
+	signer := func() *ArtifactSignatureAuthentication {
+		return &ArtifactSignatureAuthentication{teamID: "team_id", secretKeyOverride: []byte("key"), enabled: true, freshness: time.Hour}
+	}
+
+	client := &timestampedClient{}
+	cache := newHTTPCache(Opts{}, client, &nullRecorder{}, root)
+	cache.signerVerifier = signer()
+	assert.NilError(t, cache.Put(root, "some-hash", 0, files), "Put")
+	signedAt := client.headers.Get("X-Artifact-Signed-At")
+	assert.Assert(t, signedAt != "", "signing time was sent")
+
+	fetch := func() error {
+		_, _, _, err := cache.Fetch(fs.AbsoluteSystemPathFromUpstream(t.TempDir()), "some-hash", nil)
+		return err
+	}
+	assert.NilError(t, fetch(), "Fetch")
+
+	// The signing time is covered by the tag, so it can't be moved.
+	client.headers.Set("X-Artifact-Signed-At", time.Now().Add(time.Minute).UTC().Format(time.RFC3339))
+	assert.ErrorContains(t, fetch(), "artifact tag does not match")
+
+	stale := time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)
+	staleTag, err := signer().stamp(stale).generateTag("some-hash", client.body)
+	assert.NilError(t, err, "generateTag")
+	client.headers.Set("X-Artifact-Tag", staleTag)
+	client.headers.Set("X-Artifact-Signed-At", stale)
+	assert.ErrorIs(t, fetch(), ErrSignatureExpired)
+
+	client.headers.Del("X-Artifact-Signed-At")
+	assert.ErrorIs(t, fetch(), ErrSignatureExpired)
+}
+
+func TestDebugCaptureHeaders(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	client := &artifactResp{
+		body:    makeValidTar(t).Bytes(),
+		headers: http.Header{"X-Served-By": []string{"edge-1"}},
+	}
+
+	cache := newHTTPCache(Opts{}, client, &nullRecorder{}, root)
+	cache.Exists("some-hash")
+	assert.Assert(t, cache.LastResponseHeaders() == nil, "headers aren't captured by default")
+
+	cache = newHTTPCache(Opts{DebugCaptureHeaders: true}, client, &nullRecorder{}, root)
+	cache.Exists("some-hash")
+	assert.Equal(t, cache.LastResponseHeaders().Get("X-Served-By"), "edge-1")
+
+	client.headers = http.Header{"X-Served-By": []string{"edge-2"}}
+	_, _, _, err := cache.Fetch(root, "other-hash", nil)
+	assert.NilError(t, err, "Fetch")
+	assert.Equal(t, cache.LastResponseHeaders().Get("X-Served-By"), "edge-2")
+	assert.Equal(t, cache.ResponseHeadersFor("some-hash").Get("X-Served-By"), "edge-1")
+	assert.Equal(t, cache.ResponseHeadersFor("other-hash").Get("X-Served-By"), "edge-2")
+	assert.Assert(t, cache.ResponseHeadersFor("unknown") == nil)
+}
+
+func TestArtifactPathPrefixUnsupported(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	cache := newHTTPCache(Opts{ArtifactPathPrefix: "team-a"}, newHookClient(), &nullRecorder{}, root)
+	writable, reason := cache.Writable()
+	assert.Assert(t, !writable, "a prefix that can't be applied makes the cache read-only")
+	assert.Assert(t, strings.HasPrefix(reason, "artifact path prefix not applied"), reason)
+}
+
+func TestShardKeysUnsupported(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	cache := newHTTPCache(Opts{ShardKeys: true}, newHookClient(), &nullRecorder{}, root)
+	writable, reason := cache.Writable()
+	assert.Assert(t, !writable, "sharding that can't be applied makes the cache read-only")
+	assert.Assert(t, strings.HasPrefix(reason, "sharded keys not applied"), reason)
+}
+
+func TestSignatureTeamBinding(t *testing.T) {
+	t.Setenv("TURBO_REMOTE_CACHE_SIGNATURE_KEY", "shared-key")
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	_ = root.Join("a").WriteFile([]byte("a"), 0644)
+	files := turbopath.AnchoredUnixPathArray{"a"}.ToSystemPathArray()
+
+	client := &resignClient{}
+	teamA := newHTTPCache(Opts{RemoteCacheOpts: fs.RemoteCacheOptions{TeamID: "team_a", Signature: true}}, client, &nullRecorder{}, root)
+	assert.NilError(t, teamA.Put(root, "the-hash", 0, files), "Put")
+	client.headers = http.Header{"X-Artifact-Tag": []string{client.putTag}}
+
+	_, _, _, err := teamA.Fetch(root, "the-hash", nil)
+	assert.NilError(t, err, "Fetch as the signing team")
+
+	teamB := newHTTPCache(Opts{RemoteCacheOpts: fs.RemoteCacheOptions{TeamID: "team_b", Signature: true}}, client, &nullRecorder{}, root)
+	_, _, _, err = teamB.Fetch(root, "the-hash", nil)
+	assert.ErrorContains(t, err, "artifact verification failed")
+}
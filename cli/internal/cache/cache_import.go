@@ -0,0 +1,97 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/vercel/turbo/cli/internal/turbopath"
+)
+
+// ImportArtifact uploads an artifact from a .tar.zst file on disk under hash,
+// signing it if signing is enabled, e.g. to seed a cache or restore a backup
+// made with ExportArtifact. The file is uploaded as is, but only if it can be
+// read as an artifact, if Put would upload an artifact for hash, and if none
+// of its files are excluded by Opts.DeniedPatterns or Opts.AllowedPatterns.
+func (cache *httpCache) ImportArtifact(hash string, path turbopath.AbsoluteSystemPath) error {
+	if !cache.writable {
+		return fmt.Errorf("failed to import artifact: remote cache is read-only: %v", cache.writableReason)
+	}
+	body, err := path.ReadFile()
+	if err != nil {
+		return fmt.Errorf("failed to import artifact: %w", err)
+	}
+	entries, err := cache.restoreItem(bytes.NewReader(body), true).Entries()
+	if err != nil {
+		return fmt.Errorf("failed to import artifact: %v is not a readable artifact: %w", path, err)
+	}
+	if err := cache.checkEntries(entries); err != nil {
+		return fmt.Errorf("failed to import artifact: %w", err)
+	}
+
+	result := cache.putWithResult(cache.repoRoot, hash, 0, nil, putOptions{artifact: body})
+	if result.Skipped {
+		return fmt.Errorf("failed to import artifact: %v is excluded from remote caching", hash)
+	}
+	return result.Err
+}
+
+// ExportArtifact downloads the artifact for hash and writes it to path exactly
+// as served, without restoring it, e.g. to back it up or move it to another
+// backend with ImportArtifact. If signing is enabled, the artifact's signature
+// is checked before anything is written.
+func (cache *httpCache) ExportArtifact(hash string, path turbopath.AbsoluteSystemPath) error {
+	body, err := cache.fetchVerified(hash)
+	if err != nil {
+		return err
+	}
+	return path.WriteFile(body, 0644)
+}
+
+// fetchVerified downloads the artifact for hash into memory, checking its
+// signature if signing is enabled. It returns ErrArtifactNotFound on a miss,
+// and an error matching ErrVerificationFailed if the signature is bad.
+func (cache *httpCache) fetchVerified(hash string) ([]byte, error) {
+	cache.requestLimiter.acquire()
+	defer cache.requestLimiter.release()
+
+	hash, err := cache.artifactKey(cache.rewriteHash(hash))
+	if err != nil {
+		return nil, err
+	} else if hash == "" {
+		return nil, ErrArtifactNotFound
+	}
+	resp, err := cache.client.FetchArtifact(hash)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if cache.isMiss(resp.StatusCode) {
+		return nil, ErrArtifactNotFound
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch artifact: %v", resp.Status)
+	}
+	release := cache.memory.acquire(resp.ContentLength)
+	defer release()
+	body, err := ioutil.ReadAll(&countingReader{reader: resp.Body, total: &cache.downloadedBytes})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch artifact: %w", err)
+	}
+
+	if cache.signerVerifier.isEnabled() {
+		signer, err := cache.signerVerifier.verifierFor(resp.Header.Get("x-artifact-signed-at"))
+		if err != nil {
+			return nil, &verificationError{err: err}
+		}
+		isValid, err := signer.validate(hash, body, resp.Header.Get("x-artifact-tag"))
+		if err != nil {
+			return nil, &verificationError{err: err}
+		}
+		if !isValid {
+			return nil, &verificationError{err: errors.New("artifact tag does not match expected tag")}
+		}
+	}
+	return body, nil
+}
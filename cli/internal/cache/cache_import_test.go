@@ -0,0 +1,72 @@
+package cache
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/vercel/turbo/cli/internal/fs"
+	"gotest.tools/v3/assert"
+)
+
+func TestImportExportArtifact(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	artifact := makeValidTar(t).Bytes()
+	path := root.UntypedJoin("backup.tar.zst")
+	assert.NilError(t, path.WriteFile(artifact, 0644), "WriteFile")
+
+	client := &resignClient{}
+	cache := newHTTPCache(Opts{}, client, &nullRecorder{}, root)
+	cache.signerVerifier = &ArtifactSignatureAuthentication{teamID: "team_id", secretKeyOverride: []byte("key"), enabled: true}
+	assert.NilError(t, cache.ImportArtifact("some-hash", path), "ImportArtifact")
+	assert.Assert(t, bytes.Equal(client.body, artifact), "file uploaded unchanged")
+	wantTag, err := cache.signerVerifier.generateTag("some-hash", artifact)
+	assert.NilError(t, err, "generateTag")
+	assert.Equal(t, client.putTag, wantTag, "imported artifact is signed")
+
+	client.headers = http.Header{"X-Artifact-Tag": []string{client.putTag}}
+	exported := root.UntypedJoin("exported.tar.zst")
+	assert.NilError(t, cache.ExportArtifact("some-hash", exported), "ExportArtifact")
+	contents, err := exported.ReadFile()
+	assert.NilError(t, err, "ReadFile")
+	assert.Assert(t, bytes.Equal(contents, artifact), "exported artifact matches")
+
+	client.headers.Set("X-Artifact-Tag", "forged")
+	tampered := root.UntypedJoin("tampered.tar.zst")
+	assert.ErrorContains(t, cache.ExportArtifact("some-hash", tampered), "artifact tag does not match")
+	assert.Assert(t, !tampered.FileExists(), "nothing written for an invalid artifact")
+}
+
+func TestImportArtifactChecks(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	path := root.UntypedJoin("backup.tar.zst")
+	assert.NilError(t, path.WriteFile(makeValidTar(t).Bytes(), 0644), "WriteFile")
+	garbage := root.UntypedJoin("garbage.tar.zst")
+	assert.NilError(t, garbage.WriteFile([]byte("not an artifact"), 0644), "WriteFile")
+
+	client := &resignClient{}
+	cache := newHTTPCache(Opts{}, client, &nullRecorder{}, root)
+	assert.ErrorContains(t, cache.ImportArtifact("some-hash", garbage), "not a readable artifact")
+	assert.Assert(t, client.body == nil, "nothing uploaded")
+
+	cache = newHTTPCache(Opts{
+		CacheablePredicate: func(hash string) bool { return hash != "excluded" },
+	}, client, &nullRecorder{}, root)
+	assert.ErrorContains(t, cache.ImportArtifact("excluded", path), "excluded from remote caching")
+	assert.Assert(t, client.body == nil, "nothing uploaded")
+
+	cache = newHTTPCache(Opts{
+		Deadline: func() time.Time { return time.Now() },
+	}, client, &nullRecorder{}, root)
+	assert.ErrorIs(t, cache.ImportArtifact("some-hash", path), ErrRunBudgetExhausted)
+	assert.Assert(t, client.body == nil, "nothing uploaded")
+
+	cache = newHTTPCache(Opts{DeniedPatterns: []string{"**/some-file"}}, client, &nullRecorder{}, root)
+	assert.ErrorIs(t, cache.ImportArtifact("some-hash", path), ErrDeniedContent)
+	assert.Assert(t, client.body == nil, "nothing uploaded")
+
+	cache = newHTTPCache(Opts{AllowedPatterns: []string{"my-pkg/**"}}, client, &nullRecorder{}, root)
+	assert.ErrorContains(t, cache.ImportArtifact("some-hash", path), "extra-file doesn't match any allowed pattern")
+	assert.Assert(t, client.body == nil, "nothing uploaded")
+}
@@ -0,0 +1,138 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/vercel/turbo/cli/internal/turbopath"
+)
+
+// A journaledCache is a wrapper around a Cache that appends a line to a JSONL
+// journal for every Put and Fetch, recording the hash and the files involved.
+//
+// It is a debugging aid for cache-correctness investigations: a task hash on
+// its own says nothing about what an artifact held, and by the time a bad
+// restore is noticed the artifact may be gone. The journal lets engineers see
+// which files went into, or came out of, a given hash on this machine.
+type journaledCache struct {
+	realCache Cache
+	logger    hclog.Logger
+	// mu serializes writes, so lines from concurrent operations don't
+	// interleave. The file is opened for appending, so that other processes
+	// writing the same journal only ever add whole lines too.
+	mu   sync.Mutex
+	file *os.File
+}
+
+// JournalEntry is a line of the cache journal; see Opts.CacheJournalPath.
+type JournalEntry struct {
+	Time time.Time `json:"time"`
+	// Op is "put" or "fetch".
+	Op   string `json:"op"`
+	Hash string `json:"hash"`
+	// Hit is whether a fetch found the artifact. It is unset for puts.
+	Hit    bool       `json:"hit,omitempty"`
+	Source ItemSource `json:"source,omitempty"`
+	// Files are the files stored by a put, or restored by a fetch, relative
+	// to the anchor and with forward slashes.
+	Files []string `json:"files"`
+	Error string   `json:"error,omitempty"`
+}
+
+func newJournaledCache(realCache Cache, path turbopath.AbsoluteSystemPath, logger hclog.Logger) (Cache, error) {
+	if err := path.Dir().MkdirAll(0755); err != nil {
+		return nil, err
+	}
+	file, err := path.OpenFile(os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &journaledCache{
+		realCache: realCache,
+		logger:    logger,
+		file:      file,
+	}, nil
+}
+
+func (c *journaledCache) record(entry JournalEntry, files []turbopath.AnchoredSystemPath, err error) {
+	entry.Time = time.Now().UTC()
+	entry.Files = make([]string, len(files))
+	for i, file := range files {
+		entry.Files[i] = file.ToUnixPath().ToString()
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	line, marshalErr := json.Marshal(entry)
+	if marshalErr != nil {
+		c.logger.Warn("failed to write cache journal entry", "hash", entry.Hash, "error", marshalErr)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, writeErr := c.file.Write(append(line, '\n')); writeErr != nil {
+		c.logger.Warn("failed to write cache journal entry", "hash", entry.Hash, "error", writeErr)
+	}
+}
+
+func (c *journaledCache) Put(anchor turbopath.AbsoluteSystemPath, key string, duration int, files []turbopath.AnchoredSystemPath) error {
+	err := c.realCache.Put(anchor, key, duration, files)
+	c.record(JournalEntry{Op: "put", Hash: key}, files, err)
+	return err
+}
+
+func (c *journaledCache) Fetch(anchor turbopath.AbsoluteSystemPath, key string, files []string) (ItemStatus, []turbopath.AnchoredSystemPath, int, error) {
+	itemStatus, restored, duration, err := c.realCache.Fetch(anchor, key, files)
+	hit := itemStatus.Local || itemStatus.Remote
+	c.record(JournalEntry{Op: "fetch", Hash: key, Hit: hit, Source: itemStatus.Source}, restored, err)
+	return itemStatus, restored, duration, err
+}
+
+func (c *journaledCache) PutImmutable(anchor turbopath.AbsoluteSystemPath, key string, duration int, files []turbopath.AnchoredSystemPath) error {
+	err := remoteOperations(c.realCache).PutImmutable(anchor, key, duration, files)
+	c.record(JournalEntry{Op: "put", Hash: key}, files, err)
+	return err
+}
+
+func (c *journaledCache) Exists(key string) ItemStatus {
+	return c.realCache.Exists(key)
+}
+
+func (c *journaledCache) Ping(ctx context.Context) error {
+	if pinger, ok := c.realCache.(Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *journaledCache) VerifyManifest(expected map[string]string) ([]ManifestDiscrepancy, error) {
+	return remoteOperations(c.realCache).VerifyManifest(expected)
+}
+
+func (c *journaledCache) EstimateRestoreSize(key string) (int64, error) {
+	return remoteOperations(c.realCache).EstimateRestoreSize(key)
+}
+
+func (c *journaledCache) Capabilities() (BackendCapabilities, error) {
+	return remoteOperations(c.realCache).Capabilities()
+}
+
+func (c *journaledCache) Clean(anchor turbopath.AbsoluteSystemPath) {
+	c.realCache.Clean(anchor)
+}
+
+func (c *journaledCache) CleanAll() {
+	c.realCache.CleanAll()
+}
+
+func (c *journaledCache) Shutdown() {
+	c.realCache.Shutdown()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_ = c.file.Close()
+}
@@ -0,0 +1,87 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/json"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/vercel/turbo/cli/internal/fs"
+	"github.com/vercel/turbo/cli/internal/turbopath"
+)
+
+func readJournal(t *testing.T, path turbopath.AbsoluteSystemPath) []JournalEntry {
+	t.Helper()
+	file, err := path.Open()
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer func() { _ = file.Close() }()
+	var entries []JournalEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("malformed journal line %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestJournaledCache(t *testing.T) {
+	journalPath := fs.AbsoluteSystemPathFromUpstream(t.TempDir()).UntypedJoin("logs", "journal.jsonl")
+	files := turbopath.AnchoredUnixPathArray{"dist/index.js", "dist/index.d.ts"}.ToSystemPathArray()
+
+	cache, err := newJournaledCache(newEnabledCache(), journalPath, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatalf("newJournaledCache: %v", err)
+	}
+	if err := cache.Put("unused", "the-hash", 0, files); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, _, _, err := cache.Fetch("unused", "the-hash", nil); err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if _, _, _, err := cache.Fetch("unused", "missing-hash", nil); err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	cache.Shutdown()
+
+	var got []JournalEntry
+	for _, entry := range readJournal(t, journalPath) {
+		if entry.Time.IsZero() {
+			t.Errorf("entry for %v has no time", entry.Hash)
+		}
+		got = append(got, JournalEntry{Op: entry.Op, Hash: entry.Hash, Hit: entry.Hit, Files: entry.Files})
+	}
+	want := []JournalEntry{
+		{Op: "put", Hash: "the-hash", Files: []string{"dist/index.js", "dist/index.d.ts"}},
+		{Op: "fetch", Hash: "the-hash", Hit: true, Files: []string{"dist/index.js", "dist/index.d.ts"}},
+		{Op: "fetch", Hash: "missing-hash", Files: []string{}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("journal got %+v, want %+v", got, want)
+	}
+
+	// The journal is appended to, and concurrent operations write whole lines.
+	cache, err = newJournaledCache(newEnabledCache(), journalPath, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatalf("newJournaledCache: %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, _, _ = cache.Fetch("unused", "missing-hash", nil)
+		}()
+	}
+	wg.Wait()
+	cache.Shutdown()
+	if entries := readJournal(t, journalPath); len(entries) != 53 {
+		t.Errorf("journal has %v entries, want 53", len(entries))
+	}
+}
@@ -0,0 +1,74 @@
+package cache
+
+import (
+	"bytes"
+	"sync"
+)
+
+// _unknownSizeEstimate is how much memory is reserved for a download whose
+// size the backend didn't declare.
+const _unknownSizeEstimate = 32 << 20
+
+// memoryBudget bounds the total size of the buffers held by in-flight
+// operations; see Opts.MaxCacheMemoryBytes. A nil memoryBudget doesn't limit.
+type memoryBudget struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	capacity int64
+	used     int64
+}
+
+func newMemoryBudget(capacity int64) *memoryBudget {
+	if capacity <= 0 {
+		return nil
+	}
+	mb := &memoryBudget{capacity: capacity}
+	mb.cond = sync.NewCond(&mb.mu)
+	return mb
+}
+
+// acquire blocks until size bytes of the budget are free and reserves them,
+// returning a function that gives them back. A negative size, i.e. unknown,
+// reserves _unknownSizeEstimate. Sizes larger than the whole budget are
+// clamped to it, so such an operation waits to run alone rather than forever.
+// An operation must not acquire again before releasing, or it may deadlock.
+func (mb *memoryBudget) acquire(size int64) func() {
+	if mb == nil {
+		return func() {}
+	}
+	if size < 0 {
+		size = _unknownSizeEstimate
+	}
+	if size > mb.capacity {
+		size = mb.capacity
+	}
+	mb.mu.Lock()
+	for mb.used+size > mb.capacity {
+		mb.cond.Wait()
+	}
+	mb.used += size
+	mb.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			mb.mu.Lock()
+			mb.used -= size
+			mb.mu.Unlock()
+			mb.cond.Broadcast()
+		})
+	}
+}
+
+// bufferedBody is a response body already held in memory, and counted against
+// the memory budget until it is closed.
+type bufferedBody struct {
+	*bytes.Reader
+	data    []byte
+	release func()
+}
+
+func (bb *bufferedBody) Close() error {
+	bb.release()
+	return nil
+}
@@ -0,0 +1,68 @@
+package cache
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vercel/turbo/cli/internal/fs"
+	"github.com/vercel/turbo/cli/internal/turbopath"
+	"gotest.tools/v3/assert"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	budget := newMemoryBudget(100)
+	release := budget.acquire(60)
+
+	acquired := make(chan struct{})
+	go func() {
+		defer close(acquired)
+		budget.acquire(60)()
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired more than the budget")
+	case <-time.After(10 * time.Millisecond):
+	}
+	release()
+	<-acquired
+
+	// Oversized and unknown sizes are clamped to the budget.
+	budget.acquire(1000)()
+	budget.acquire(-1)()
+	assert.Equal(t, budget.used, int64(0))
+
+	var unlimited *memoryBudget
+	unlimited.acquire(1 << 40)()
+	assert.Assert(t, newMemoryBudget(0) == nil)
+}
+
+func TestMaxCacheMemoryBytes(t *testing.T) {
+	t.Setenv("TURBO_REMOTE_CACHE_SIGNATURE_KEY", "key")
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	_ = root.Join("a").WriteFile([]byte("a"), 0644)
+	files := turbopath.AnchoredUnixPathArray{"a"}.ToSystemPathArray()
+	opts := Opts{
+		RemoteCacheOpts:     fs.RemoteCacheOptions{TeamID: "team_id", Signature: true},
+		MaxCacheMemoryBytes: 1,
+	}
+
+	client := &resignClient{}
+	assert.NilError(t, newHTTPCache(opts, client, &nullRecorder{}, root).Put(root, "the-hash", 0, files), "Put")
+	client.headers = http.Header{"X-Artifact-Tag": []string{client.putTag}}
+
+	// Every download needs the whole budget, so they take turns.
+	cache := newHTTPCache(opts, client, &nullRecorder{}, root)
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, _, err := cache.Fetch(root, "the-hash", nil)
+			assert.Check(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, cache.memory.used, int64(0))
+}
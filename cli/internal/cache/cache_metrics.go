@@ -0,0 +1,178 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// _latencyBuckets are the upper bounds, in seconds, of the request latency
+// histogram. Artifacts range from a few kilobytes to hundreds of megabytes, so
+// the buckets span a much wider range than typical API latencies.
+var _latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// _latencyOps are the operations whose latency is tracked, in output order.
+var _latencyOps = []string{"fetch", "put"}
+
+// _phases are the phases of fetches and uploads that are timed separately,
+// in output order, to tell whether CPU or the network is the bottleneck:
+// building and compressing an artifact, uploading it, downloading it, and
+// decompressing and restoring it. Time spent waiting on the network while
+// restoring a download as it streams in counts as downloading.
+var _phases = []string{"compress", "upload", "download", "restore"}
+
+// latencyHistogram is a cumulative histogram in the Prometheus sense: each
+// bucket counts the observations at or below its bound.
+type latencyHistogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// httpMetrics counts remote cache activity for WritePrometheusMetrics.
+// Downloaded bytes are tracked by httpCache.downloadedBytes.
+type httpMetrics struct {
+	mu            sync.Mutex
+	hits          uint64
+	misses        uint64
+	errors        uint64
+	uploads       uint64
+	uploadedBytes uint64
+	latency       map[string]*latencyHistogram
+	phases        map[string]*latencyHistogram
+}
+
+func (m *httpMetrics) fetched(hit bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if hit {
+		m.hits++
+	} else {
+		m.misses++
+	}
+}
+
+func (m *httpMetrics) failed() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errors++
+}
+
+func (m *httpMetrics) uploaded(size int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.uploads++
+	m.uploadedBytes += uint64(size)
+}
+
+// observe records how long a remote cache operation took.
+func (m *httpMetrics) observe(op string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.latency == nil {
+		m.latency = map[string]*latencyHistogram{}
+	}
+	observeIn(m.latency, op, d)
+}
+
+// observePhase records how long a phase of a fetch or upload took; see _phases.
+func (m *httpMetrics) observePhase(phase string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.phases == nil {
+		m.phases = map[string]*latencyHistogram{}
+	}
+	observeIn(m.phases, phase, d)
+}
+
+// timePhase records the time since start as a phase, for use with defer.
+func (m *httpMetrics) timePhase(phase string, start time.Time) {
+	m.observePhase(phase, time.Since(start))
+}
+
+func observeIn(histograms map[string]*latencyHistogram, key string, d time.Duration) {
+	h, ok := histograms[key]
+	if !ok {
+		h = &latencyHistogram{buckets: make([]uint64, len(_latencyBuckets))}
+		histograms[key] = h
+	}
+	seconds := d.Seconds()
+	for i, bound := range _latencyBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// WritePrometheusMetrics writes the remote cache's counters for this run to w
+// in the Prometheus text exposition format, e.g. for a sidecar to scrape.
+func (cache *httpCache) WritePrometheusMetrics(w io.Writer) error {
+	m := &cache.metrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pw := &promWriter{w: w}
+	pw.counter("turbo_remote_cache_hits_total", "Artifacts found in the remote cache.", m.hits)
+	pw.counter("turbo_remote_cache_misses_total", "Artifacts not found in the remote cache.", m.misses)
+	pw.counter("turbo_remote_cache_errors_total", "Remote cache operations that failed.", m.errors)
+	pw.counter("turbo_remote_cache_uploads_total", "Artifacts uploaded to the remote cache.", m.uploads)
+	pw.counter("turbo_remote_cache_downloaded_bytes_total", "Compressed bytes downloaded from the remote cache.", uint64(atomic.LoadInt64(&cache.downloadedBytes)))
+	pw.counter("turbo_remote_cache_uploaded_bytes_total", "Compressed bytes uploaded to the remote cache.", m.uploadedBytes)
+
+	const latencyName = "turbo_remote_cache_request_duration_seconds"
+	pw.header(latencyName, "Time taken by remote cache fetches and uploads.", "histogram")
+	for _, op := range _latencyOps {
+		if h, ok := m.latency[op]; ok {
+			pw.histogram(latencyName, "op", op, h)
+		}
+	}
+
+	const phaseName = "turbo_remote_cache_phase_duration_seconds"
+	pw.header(phaseName, "Time taken by each phase of remote cache fetches and uploads.", "histogram")
+	for _, phase := range _phases {
+		if h, ok := m.phases[phase]; ok {
+			pw.histogram(phaseName, "phase", phase, h)
+		}
+	}
+	return pw.err
+}
+
+// promWriter writes the exposition format, keeping the first error.
+type promWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (pw *promWriter) printf(format string, args ...interface{}) {
+	if pw.err == nil {
+		_, pw.err = fmt.Fprintf(pw.w, format, args...)
+	}
+}
+
+func (pw *promWriter) header(name string, help string, metricType string) {
+	pw.printf("# HELP %v %v\n# TYPE %v %v\n", name, help, name, metricType)
+}
+
+func (pw *promWriter) counter(name string, help string, value uint64) {
+	pw.header(name, help, "counter")
+	pw.printf("%v %v\n", name, value)
+}
+
+// histogram writes the samples of h, labelled with label="value".
+func (pw *promWriter) histogram(name string, label string, value string, h *latencyHistogram) {
+	for i, bound := range _latencyBuckets {
+		pw.printf("%v_bucket{%v=%q,le=%q} %v\n", name, label, value, formatFloat(bound), h.buckets[i])
+	}
+	pw.printf("%v_bucket{%v=%q,le=\"+Inf\"} %v\n", name, label, value, h.count)
+	pw.printf("%v_sum{%v=%q} %v\n", name, label, value, formatFloat(h.sum))
+	pw.printf("%v_count{%v=%q} %v\n", name, label, value, h.count)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,53 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vercel/turbo/cli/internal/fs"
+	"github.com/vercel/turbo/cli/internal/turbopath"
+	"gotest.tools/v3/assert"
+)
+
+func TestWritePrometheusMetrics(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	_ = root.Join("a").WriteFile([]byte("a"), 0644)
+	files := turbopath.AnchoredUnixPathArray{"a"}.ToSystemPathArray()
+
+	client := &artifactResp{}
+	cache := newHTTPCache(Opts{}, client, &nullRecorder{}, root)
+	assert.NilError(t, cache.Put(root, "the-hash", 0, files), "Put")
+	_, _, _, err := cache.Fetch(root, "the-hash", nil)
+	assert.NilError(t, err, "Fetch")
+	cache.recordFailure("exists", "other-hash", errors.New("failed"))
+	cache.metrics.observe("fetch", 3*time.Second)
+
+	var out bytes.Buffer
+	assert.NilError(t, cache.WritePrometheusMetrics(&out), "WritePrometheusMetrics")
+	metrics := out.String()
+	for _, want := range []string{
+		"# TYPE turbo_remote_cache_hits_total counter\nturbo_remote_cache_hits_total 1\n",
+		"turbo_remote_cache_misses_total 0\n",
+		"turbo_remote_cache_errors_total 1\n",
+		"turbo_remote_cache_uploads_total 1\n",
+		"turbo_remote_cache_downloaded_bytes_total " + strconv.Itoa(len(client.body)) + "\n",
+		"turbo_remote_cache_uploaded_bytes_total " + strconv.Itoa(len(client.body)) + "\n",
+		"# TYPE turbo_remote_cache_request_duration_seconds histogram\n",
+		"turbo_remote_cache_request_duration_seconds_bucket{op=\"fetch\",le=\"2.5\"} 1\n",
+		"turbo_remote_cache_request_duration_seconds_bucket{op=\"fetch\",le=\"5\"} 2\n",
+		"turbo_remote_cache_request_duration_seconds_bucket{op=\"fetch\",le=\"+Inf\"} 2\n",
+		"turbo_remote_cache_request_duration_seconds_count{op=\"fetch\"} 2\n",
+		"turbo_remote_cache_request_duration_seconds_count{op=\"put\"} 1\n",
+		"# TYPE turbo_remote_cache_phase_duration_seconds histogram\n",
+		"turbo_remote_cache_phase_duration_seconds_count{phase=\"compress\"} 1\n",
+		"turbo_remote_cache_phase_duration_seconds_count{phase=\"upload\"} 1\n",
+		"turbo_remote_cache_phase_duration_seconds_count{phase=\"download\"} 1\n",
+		"turbo_remote_cache_phase_duration_seconds_count{phase=\"restore\"} 1\n",
+	} {
+		assert.Assert(t, strings.Contains(metrics, want), "missing %q in:\n%v", want, metrics)
+	}
+}
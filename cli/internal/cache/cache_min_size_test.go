@@ -0,0 +1,58 @@
+package cache
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/vercel/turbo/cli/internal/turbopath"
+	"gotest.tools/v3/assert"
+)
+
+func TestMinRemoteArtifactSize(t *testing.T) {
+	root := writeTestFiles(t, map[string]string{
+		"tiny":  "x",
+		"large": strings.Repeat("x", 100),
+	})
+
+	var events []string
+	opts := Opts{
+		MinRemoteArtifactSize:  10,
+		SkipSmallRemoteFetches: true,
+		OnCacheEvent: func(event CacheEvent) {
+			events = append(events, event.Event)
+		},
+	}
+	client := newHookClient()
+	cache := newHTTPCache(opts, client, &nullRecorder{}, root)
+
+	result := cache.PutWithResult(root, "tiny-hash", 0, []turbopath.AnchoredSystemPath{"tiny"})
+	assert.NilError(t, result.Err, "Put")
+	assert.Assert(t, result.Skipped)
+	assert.NilError(t, cache.Put(root, "large-hash", 0, []turbopath.AnchoredSystemPath{"large"}), "Put")
+	_, uploaded := client.stored("tiny-hash")
+	assert.Assert(t, !uploaded, "tiny artifact uploaded")
+	large, uploaded := client.stored("large-hash")
+	assert.Assert(t, uploaded, "large artifact not uploaded")
+
+	// Even if the artifact was uploaded elsewhere, it isn't fetched.
+	client.store("tiny-hash", large)
+	itemStatus, _, _, err := cache.Fetch(root, "tiny-hash", nil)
+	assert.NilError(t, err, "Fetch")
+	assert.Assert(t, !itemStatus.Remote)
+	assert.Equal(t, itemStatus.SkipReason, SkipReasonTooSmall)
+	assert.Equal(t, cache.Exists("tiny-hash"), ItemStatus{SkipReason: SkipReasonTooSmall})
+	assert.DeepEqual(t, events, []string{CacheEventSkippedTooSmall, CacheEventUpload, CacheEventSkippedTooSmall})
+	assert.Equal(t, client.count("fetch"), 0)
+	assert.Equal(t, client.count("exists"), 0)
+
+	cache.skipSmallFetches = false
+	itemStatus, _, _, err = cache.Fetch(root, "tiny-hash", nil)
+	assert.NilError(t, err, "Fetch")
+	assert.Assert(t, itemStatus.Remote)
+	assert.Equal(t, itemStatus.SkipReason, SkipReasonNone)
+
+	// A genuine miss isn't a skip.
+	itemStatus, _, _, err = cache.Fetch(root, "missing-hash", nil)
+	assert.NilError(t, err, "Fetch")
+	assert.Equal(t, itemStatus, ItemStatus{})
+}
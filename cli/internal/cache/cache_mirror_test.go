@@ -0,0 +1,49 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/vercel/turbo/cli/internal/cacheitem"
+	"github.com/vercel/turbo/cli/internal/fs"
+	"gotest.tools/v3/assert"
+)
+
+func TestLocalMirrorDir(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	mirrorDir := t.TempDir()
+	client := newHookClient()
+	client.store("some-hash", makeValidTar(t).Bytes())
+	cache := newHTTPCache(Opts{LocalMirrorDir: mirrorDir}, client, &nullRecorder{}, root)
+
+	itemStatus, files, _, err := cache.Fetch(root, "some-hash", nil)
+	assert.NilError(t, err, "Fetch")
+	assert.Assert(t, itemStatus.Remote)
+	assert.Equal(t, client.count("fetch"), 1)
+
+	itemStatus, mirroredFiles, _, err := cache.Fetch(root, "some-hash", nil)
+	assert.NilError(t, err, "Fetch")
+	assert.Assert(t, itemStatus.Local, "second fetch is served from the mirror")
+	assert.Equal(t, client.count("fetch"), 1)
+	assert.Equal(t, len(mirroredFiles), len(files))
+}
+
+func TestMirrorOpts(t *testing.T) {
+	opts := Opts{
+		OverrideDir:         "local-cache",
+		LocalMirrorDir:      "mirror",
+		TempDir:             "tmp",
+		RestoreMode:         cacheitem.RestoreModeMerge,
+		MaxFilesPerArtifact: 10,
+		RestoreUmask:        0022,
+		VerifyRestoreCount:  true,
+		OnCacheEvent:        func(CacheEvent) {},
+	}
+	mirrorOpts := opts.mirrorOpts()
+	assert.Equal(t, mirrorOpts.OverrideDir, "mirror")
+	assert.Equal(t, mirrorOpts.TempDir, "tmp")
+	assert.Equal(t, mirrorOpts.RestoreMode, opts.RestoreMode)
+	assert.Equal(t, mirrorOpts.MaxFilesPerArtifact, 10)
+	assert.Equal(t, mirrorOpts.RestoreUmask, opts.RestoreUmask)
+	assert.Assert(t, mirrorOpts.VerifyRestoreCount)
+	assert.Assert(t, mirrorOpts.OnCacheEvent == nil, "the mirror's events are reported by the remote cache")
+}
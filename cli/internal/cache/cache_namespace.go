@@ -0,0 +1,100 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/vercel/turbo/cli/internal/turbopath"
+)
+
+// A namespacedCache is a wrapper around a Cache that prefixes every hash with
+// a fixed namespace before handing it to the real cache.
+//
+// Task hashes only capture the inputs turbo knows about. Two environments that
+// share a cache backend but differ in something the hash doesn't see (the
+// Node.js version, the OS, a globally installed tool) can produce the same hash
+// for incompatible artifacts, and one environment would then restore the
+// other's outputs. Giving each environment its own namespace keeps their
+// artifacts apart regardless of what the hash inputs capture.
+type namespacedCache struct {
+	namespace string
+	realCache Cache
+}
+
+func newNamespacedCache(realCache Cache, namespace string) Cache {
+	return &namespacedCache{
+		namespace: namespace,
+		realCache: realCache,
+	}
+}
+
+// validateNamespace checks that namespace, which becomes part of every hash,
+// can't change where the local caches put an artifact.
+func validateNamespace(namespace string) error {
+	if strings.ContainsAny(namespace, "/\\\x00") || strings.Contains(namespace, "..") {
+		return fmt.Errorf("%w %q: it may not contain path separators or \"..\"", ErrInvalidHashNamespace, namespace)
+	}
+	return nil
+}
+
+func (c *namespacedCache) key(hash string) string {
+	return c.namespace + "-" + hash
+}
+
+func (c *namespacedCache) Put(anchor turbopath.AbsoluteSystemPath, key string, duration int, files []turbopath.AnchoredSystemPath) error {
+	return c.realCache.Put(anchor, c.key(key), duration, files)
+}
+
+func (c *namespacedCache) Fetch(anchor turbopath.AbsoluteSystemPath, key string, files []string) (ItemStatus, []turbopath.AnchoredSystemPath, int, error) {
+	return c.realCache.Fetch(anchor, c.key(key), files)
+}
+
+func (c *namespacedCache) Exists(key string) ItemStatus {
+	return c.realCache.Exists(c.key(key))
+}
+
+func (c *namespacedCache) Ping(ctx context.Context) error {
+	if pinger, ok := c.realCache.(Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *namespacedCache) PutImmutable(anchor turbopath.AbsoluteSystemPath, key string, duration int, files []turbopath.AnchoredSystemPath) error {
+	return remoteOperations(c.realCache).PutImmutable(anchor, c.key(key), duration, files)
+}
+
+// VerifyManifest checks expected against the artifacts in the namespace, and
+// reports discrepancies by the hashes expected was keyed by.
+func (c *namespacedCache) VerifyManifest(expected map[string]string) ([]ManifestDiscrepancy, error) {
+	namespaced := make(map[string]string, len(expected))
+	for hash, digest := range expected {
+		namespaced[c.key(hash)] = digest
+	}
+	discrepancies, err := remoteOperations(c.realCache).VerifyManifest(namespaced)
+	for i := range discrepancies {
+		discrepancies[i].Hash = strings.TrimPrefix(discrepancies[i].Hash, c.key(""))
+	}
+	return discrepancies, err
+}
+
+func (c *namespacedCache) EstimateRestoreSize(key string) (int64, error) {
+	return remoteOperations(c.realCache).EstimateRestoreSize(c.key(key))
+}
+
+func (c *namespacedCache) Capabilities() (BackendCapabilities, error) {
+	return remoteOperations(c.realCache).Capabilities()
+}
+
+func (c *namespacedCache) Clean(anchor turbopath.AbsoluteSystemPath) {
+	c.realCache.Clean(anchor)
+}
+
+func (c *namespacedCache) CleanAll() {
+	c.realCache.CleanAll()
+}
+
+func (c *namespacedCache) Shutdown() {
+	c.realCache.Shutdown()
+}
@@ -0,0 +1,71 @@
+package cache
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/vercel/turbo/cli/internal/fs"
+	"github.com/vercel/turbo/cli/internal/turbopath"
+)
+
+func TestNamespacedCache(t *testing.T) {
+	backend := newEnabledCache()
+	node16 := newNamespacedCache(backend, "node16")
+	node18 := newNamespacedCache(backend, "node18")
+
+	files := []turbopath.AnchoredSystemPath{turbopath.AnchoredSystemPath("dist")}
+	if err := node16.Put("unused", "some-hash", 0, files); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	if _, ok := backend.entries["node16-some-hash"]; !ok {
+		t.Errorf("expected namespaced key in backend, got %v", backend.entries)
+	}
+	if status := node16.Exists("some-hash"); !status.Local {
+		t.Error("expected hit in the namespace that stored the artifact")
+	}
+	if status := node18.Exists("some-hash"); status.Local {
+		t.Error("expected miss in a different namespace")
+	}
+	status, _, _, err := node18.Fetch("unused", "some-hash", nil)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if status.Local || status.Remote {
+		t.Error("expected fetch from a different namespace to miss")
+	}
+}
+
+func TestNamespacedVerifyManifest(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	_ = root.Join("a").WriteFile([]byte("a"), 0644)
+	files := turbopath.AnchoredUnixPathArray{"a"}.ToSystemPathArray()
+
+	remote := newHTTPCache(Opts{}, &artifactResp{}, &nullRecorder{}, root)
+	c := newNamespacedCache(remote, "node18").(RemoteOperations)
+	if err := c.PutImmutable(root, "the-hash", 0, files); err != nil {
+		t.Fatalf("PutImmutable: %v", err)
+	}
+	discrepancies, err := c.VerifyManifest(map[string]string{"the-hash": "not-the-digest"})
+	if err != nil {
+		t.Fatalf("VerifyManifest: %v", err)
+	}
+	if len(discrepancies) != 1 || discrepancies[0].Hash != "the-hash" {
+		t.Errorf("expected one discrepancy for the-hash, got %+v", discrepancies)
+	}
+}
+
+func TestNewRejectsInvalidNamespace(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	for _, namespace := range []string{"../escape", "a/b", "a\\b", ".."} {
+		_, err := New(Opts{HashNamespace: namespace, SkipRemote: true}, root, nil, nil, nil)
+		if !errors.Is(err, ErrInvalidHashNamespace) {
+			t.Errorf("New(%q) = %v, want ErrInvalidHashNamespace", namespace, err)
+		}
+	}
+	c, err := New(Opts{HashNamespace: "node-18.x", SkipRemote: true, SkipFilesystem: true}, root, nil, nil, nil)
+	if err != nil && !errors.Is(err, ErrNoCachesEnabled) {
+		t.Fatalf("New: %v", err)
+	}
+	c.Shutdown()
+}
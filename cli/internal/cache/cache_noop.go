@@ -11,11 +11,23 @@ func newNoopCache() *noopCache {
 func (c *noopCache) Put(_ turbopath.AbsoluteSystemPath, _ string, _ int, _ []turbopath.AnchoredSystemPath) error {
 	return nil
 }
+func (c *noopCache) PutImmutable(_ turbopath.AbsoluteSystemPath, _ string, _ int, _ []turbopath.AnchoredSystemPath) error {
+	return nil
+}
+func (c *noopCache) VerifyManifest(_ map[string]string) ([]ManifestDiscrepancy, error) {
+	return nil, ErrNoRemoteCache
+}
+func (c *noopCache) EstimateRestoreSize(_ string) (int64, error) {
+	return 0, ErrNoRemoteCache
+}
+func (c *noopCache) Capabilities() (BackendCapabilities, error) {
+	return BackendCapabilities{}, ErrNoRemoteCache
+}
 func (c *noopCache) Fetch(_ turbopath.AbsoluteSystemPath, _ string, _ []string) (ItemStatus, []turbopath.AnchoredSystemPath, int, error) {
-	return ItemStatus{Local: false, Remote: false}, nil, 0, nil
+	return ItemStatus{Local: false, Remote: false, SkipReason: SkipReasonDisabled}, nil, 0, nil
 }
 func (c *noopCache) Exists(_ string) ItemStatus {
-	return ItemStatus{}
+	return ItemStatus{SkipReason: SkipReasonDisabled}
 }
 
 func (c *noopCache) Clean(_ turbopath.AbsoluteSystemPath) {}
@@ -0,0 +1,195 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	// _provenanceSuffix is appended to an artifact's hash to get the key its
+	// provenance is stored under.
+	_provenanceSuffix = "-provenance"
+	// _provenanceStatementType and _provenancePredicateType identify the
+	// attestation as an in-toto statement carrying SLSA provenance.
+	_provenanceStatementType = "https://in-toto.io/Statement/v0.1"
+	_provenancePredicateType = "https://slsa.dev/provenance/v0.2"
+	// _provenanceBuildType identifies how turbo's artifacts are built.
+	_provenanceBuildType = "https://turbo.build/remote-cache/artifact@v1"
+)
+
+// Provenance describes the build that produces uploaded artifacts, attested
+// alongside each of them; see Opts.Provenance.
+type Provenance struct {
+	// BuilderID identifies the builder, e.g. the URI of the CI workflow.
+	BuilderID string
+	// SourceURI is the repository built, e.g. "git+https://github.com/org/repo".
+	SourceURI string
+	// SourceCommit is the commit built.
+	SourceCommit string
+	// BuildParameters are the inputs to the build worth attesting to, e.g.
+	// the task and its arguments.
+	BuildParameters map[string]string
+}
+
+// ProvenanceStatement is a SLSA provenance attestation for an artifact, in the
+// in-toto statement format.
+type ProvenanceStatement struct {
+	Type          string              `json:"_type"`
+	PredicateType string              `json:"predicateType"`
+	Subject       []ProvenanceSubject `json:"subject"`
+	Predicate     ProvenancePredicate `json:"predicate"`
+}
+
+// ProvenanceSubject identifies the artifact an attestation is about.
+type ProvenanceSubject struct {
+	// Name is the artifact's hash.
+	Name string `json:"name"`
+	// Digest is the sha256 of the artifact as uploaded.
+	Digest map[string]string `json:"digest"`
+}
+
+// ProvenancePredicate describes how an artifact was built.
+type ProvenancePredicate struct {
+	Builder struct {
+		ID string `json:"id"`
+	} `json:"builder"`
+	BuildType  string `json:"buildType"`
+	Invocation struct {
+		Parameters map[string]string `json:"parameters,omitempty"`
+	} `json:"invocation"`
+	Metadata struct {
+		BuildFinishedOn time.Time `json:"buildFinishedOn"`
+	} `json:"metadata"`
+	Materials []ProvenanceMaterial `json:"materials,omitempty"`
+}
+
+// ProvenanceMaterial is a source an artifact was built from.
+type ProvenanceMaterial struct {
+	URI    string            `json:"uri"`
+	Digest map[string]string `json:"digest,omitempty"`
+}
+
+// newProvenanceStatement attests that the artifact stored under hash, whose
+// sha256 is digest, was built as described by p.
+func newProvenanceStatement(p *Provenance, hash string, digest string) ProvenanceStatement {
+	statement := ProvenanceStatement{
+		Type:          _provenanceStatementType,
+		PredicateType: _provenancePredicateType,
+		Subject:       []ProvenanceSubject{{Name: hash, Digest: map[string]string{"sha256": digest}}},
+	}
+	statement.Predicate.Builder.ID = p.BuilderID
+	statement.Predicate.BuildType = _provenanceBuildType
+	statement.Predicate.Invocation.Parameters = p.BuildParameters
+	statement.Predicate.Metadata.BuildFinishedOn = time.Now().UTC().Truncate(time.Second)
+	if p.SourceURI != "" || p.SourceCommit != "" {
+		material := ProvenanceMaterial{URI: p.SourceURI}
+		if p.SourceCommit != "" {
+			material.Digest = map[string]string{"sha1": p.SourceCommit}
+		}
+		statement.Predicate.Materials = []ProvenanceMaterial{material}
+	}
+	return statement
+}
+
+// artifactDigest returns the hex sha256 of an artifact, for its provenance.
+func artifactDigest(body io.Reader) (string, error) {
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// provenanceSigner returns the signer for provenance attestations. They're
+// signed with the key in TURBO_REMOTE_CACHE_PROVENANCE_KEY if it is set, and
+// otherwise with the artifact signing key, whether or not artifacts
+// themselves are signed.
+func (cache *httpCache) provenanceSigner() *ArtifactSignatureAuthentication {
+	signer := &ArtifactSignatureAuthentication{
+		teamID:            cache.signerVerifier.teamID,
+		secretKeyOverride: cache.signerVerifier.secretKeyOverride,
+		enabled:           true,
+		signatureScope:    SignatureScopeBody,
+	}
+	if key := os.Getenv("TURBO_REMOTE_CACHE_PROVENANCE_KEY"); key != "" {
+		signer.secretKeyOverride = []byte(key)
+	}
+	return signer
+}
+
+// checkProvenance returns an error if Opts.Provenance is set but attestations
+// can't be attached: it names no builder, or there's no key to sign with.
+func (cache *httpCache) checkProvenance() error {
+	if cache.provenance == nil {
+		return nil
+	}
+	if cache.provenance.BuilderID == "" {
+		return errors.New("provenance not attached: no builder ID is configured")
+	}
+	if _, err := cache.provenanceSigner().getSecretKey(); err != nil {
+		return fmt.Errorf("provenance not attached: %w", err)
+	}
+	return nil
+}
+
+// putProvenance uploads a signed provenance attestation for the artifact
+// stored under hash, as a sidecar artifact of its own.
+func (cache *httpCache) putProvenance(hash string, digest string) error {
+	body, err := json.Marshal(newProvenanceStatement(cache.provenance, hash, digest))
+	if err != nil {
+		return fmt.Errorf("failed to attach provenance: %w", err)
+	}
+	sidecar := hash + _provenanceSuffix
+	tag, err := cache.provenanceSigner().generateTag(sidecar, body)
+	if err != nil {
+		return fmt.Errorf("failed to attach provenance: %w", err)
+	}
+	if err := cache.client.PutArtifact(sidecar, body, 0, tag); err != nil {
+		return fmt.Errorf("failed to attach provenance: %w", err)
+	}
+	return nil
+}
+
+// getProvenance downloads and verifies the provenance attestation for the
+// artifact stored under hash. It returns nil if there is none.
+func (cache *httpCache) getProvenance(hash string) (*ProvenanceStatement, error) {
+	sidecar := hash + _provenanceSuffix
+	resp, err := cache.client.FetchArtifact(sidecar)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if cache.isMiss(resp.StatusCode) {
+		return nil, nil
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get artifact provenance: %v", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get artifact provenance: %w", err)
+	}
+
+	isValid, err := cache.provenanceSigner().validate(sidecar, body, resp.Header.Get("x-artifact-tag"))
+	if err != nil {
+		return nil, err
+	}
+	if !isValid {
+		return nil, &verificationError{fmt.Errorf("provenance for %v has an invalid signature", hash)}
+	}
+	var statement ProvenanceStatement
+	if err := json.Unmarshal(body, &statement); err != nil {
+		return nil, fmt.Errorf("failed to parse artifact provenance: %w", err)
+	}
+	if len(statement.Subject) != 1 || statement.Subject[0].Name != hash {
+		return nil, &verificationError{fmt.Errorf("provenance for %v attests to a different artifact", hash)}
+	}
+	return &statement, nil
+}
@@ -0,0 +1,119 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/vercel/turbo/cli/internal/fs"
+	"github.com/vercel/turbo/cli/internal/turbopath"
+	"gotest.tools/v3/assert"
+)
+
+// taggedClient stores artifacts and their tags by hash.
+type taggedClient struct {
+	artifactResp
+	artifacts map[string][]byte
+	tags      map[string]string
+}
+
+func (tc *taggedClient) PutArtifact(hash string, body []byte, duration int, tag string) error {
+	tc.artifacts[hash] = body
+	tc.tags[hash] = tag
+	return nil
+}
+
+func (tc *taggedClient) FetchArtifact(hash string) (*http.Response, error) {
+	body, ok := tc.artifacts[hash]
+	if !ok {
+		return &http.Response{StatusCode: http.StatusNotFound, Body: ioutil.NopCloser(&bytes.Buffer{})}, nil
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"X-Artifact-Tag": []string{tc.tags[hash]}},
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+	}, nil
+}
+
+func TestProvenance(t *testing.T) {
+	t.Setenv("TURBO_REMOTE_CACHE_SIGNATURE_KEY", "key")
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	_ = root.Join("a").WriteFile([]byte("a"), 0644)
+	files := turbopath.AnchoredUnixPathArray{"a"}.ToSystemPathArray()
+	provenance := &Provenance{
+		BuilderID:       "https://ci.example.com/workflow",
+		SourceURI:       "git+https://github.com/org/repo",
+		SourceCommit:    "abc123",
+		BuildParameters: map[string]string{"task": "build"},
+	}
+
+	client := &taggedClient{artifacts: map[string][]byte{}, tags: map[string]string{}}
+	cache := newHTTPCache(Opts{Provenance: provenance, VerifyProvenance: true}, client, &nullRecorder{}, root)
+	assert.NilError(t, cache.Put(root, "the-hash", 0, files), "Put")
+	digest := sha256.Sum256(client.artifacts["the-hash"])
+
+	metadata, err := cache.GetMetadata("the-hash")
+	assert.NilError(t, err, "GetMetadata")
+	statement := metadata.Provenance
+	assert.Assert(t, statement != nil)
+	assert.Equal(t, statement.PredicateType, _provenancePredicateType)
+	assert.DeepEqual(t, statement.Subject, []ProvenanceSubject{{Name: "the-hash", Digest: map[string]string{"sha256": hex.EncodeToString(digest[:])}}})
+	assert.Equal(t, statement.Predicate.Builder.ID, provenance.BuilderID)
+	assert.DeepEqual(t, statement.Predicate.Invocation.Parameters, provenance.BuildParameters)
+	assert.DeepEqual(t, statement.Predicate.Materials, []ProvenanceMaterial{{URI: provenance.SourceURI, Digest: map[string]string{"sha1": "abc123"}}})
+
+	// A separate provenance key takes precedence over the signing key.
+	t.Setenv("TURBO_REMOTE_CACHE_PROVENANCE_KEY", "provenance-key")
+	_, err = cache.GetMetadata("the-hash")
+	assert.ErrorIs(t, err, ErrVerificationFailed)
+	assert.NilError(t, cache.Put(root, "the-hash", 0, files), "Put")
+	metadata, err = cache.GetMetadata("the-hash")
+	assert.NilError(t, err, "GetMetadata")
+	assert.Assert(t, metadata.Provenance != nil)
+
+	// Artifacts without provenance have none, and it isn't looked up unless
+	// enabled.
+	delete(client.artifacts, "the-hash"+_provenanceSuffix)
+	metadata, err = cache.GetMetadata("the-hash")
+	assert.NilError(t, err, "GetMetadata")
+	assert.Assert(t, metadata.Provenance == nil)
+	assert.NilError(t, newHTTPCache(Opts{}, client, &nullRecorder{}, root).Put(root, "other-hash", 0, files), "Put")
+	_, attached := client.artifacts["other-hash"+_provenanceSuffix]
+	assert.Assert(t, !attached)
+
+	// Reading attestations doesn't attach any, and attaching them doesn't
+	// read them.
+	reader := newHTTPCache(Opts{VerifyProvenance: true}, client, &nullRecorder{}, root)
+	assert.NilError(t, reader.Put(root, "reader-hash", 0, files), "Put")
+	_, attached = client.artifacts["reader-hash"+_provenanceSuffix]
+	assert.Assert(t, !attached)
+	writer := newHTTPCache(Opts{Provenance: provenance}, client, &nullRecorder{}, root)
+	assert.NilError(t, writer.Put(root, "the-hash", 0, files), "Put")
+	metadata, err = writer.GetMetadata("the-hash")
+	assert.NilError(t, err, "GetMetadata")
+	assert.Assert(t, metadata.Provenance == nil)
+}
+
+func TestProvenanceMisconfigured(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	client := &taggedClient{artifacts: map[string][]byte{}, tags: map[string]string{}}
+
+	t.Setenv("TURBO_REMOTE_CACHE_SIGNATURE_KEY", "key")
+	writable, reason := newHTTPCache(Opts{Provenance: &Provenance{}}, client, &nullRecorder{}, root).Writable()
+	assert.Assert(t, !writable)
+	assert.Equal(t, reason, "provenance not attached: no builder ID is configured")
+
+	t.Setenv("TURBO_REMOTE_CACHE_SIGNATURE_KEY", "")
+	t.Setenv("TURBO_REMOTE_CACHE_PROVENANCE_KEY", "")
+	writable, reason = newHTTPCache(Opts{Provenance: &Provenance{BuilderID: "ci"}}, client, &nullRecorder{}, root).Writable()
+	assert.Assert(t, !writable)
+	assert.Assert(t, strings.HasPrefix(reason, "provenance not attached:"), reason)
+
+	t.Setenv("TURBO_REMOTE_CACHE_PROVENANCE_KEY", "provenance-key")
+	writable, _ = newHTTPCache(Opts{Provenance: &Provenance{BuilderID: "ci"}}, client, &nullRecorder{}, root).Writable()
+	assert.Assert(t, writable)
+}
@@ -0,0 +1,48 @@
+package cache
+
+// badArtifactReporter is implemented by clients that can tell the remote
+// cache about artifacts that failed verification.
+type badArtifactReporter interface {
+	ReportBadArtifact(hash string, reason string) error
+}
+
+// quarantineArtifact records that the artifact for hash failed verification,
+// so it isn't fetched again in this process, and reports it to the remote
+// cache if the client supports it; see Opts.QuarantineBadArtifacts.
+func (cache *httpCache) quarantineArtifact(hash string, err error) {
+	reason := err.Error()
+	cache.quarantineMu.Lock()
+	if cache.quarantine == nil {
+		cache.quarantine = make(map[string]string)
+	}
+	cache.quarantine[hash] = reason
+	cache.quarantineMu.Unlock()
+
+	reporter, ok := cache.client.(badArtifactReporter)
+	if !ok || !cache.capabilities().BadArtifactReports {
+		return
+	}
+	if reportErr := reporter.ReportBadArtifact(hash, reason); reportErr != nil {
+		cache.logger.Warn("failed to report bad artifact to the remote cache", "hash", hash, "error", reportErr)
+	}
+}
+
+// quarantined reports whether the artifact for hash has been quarantined.
+func (cache *httpCache) quarantined(hash string) bool {
+	cache.quarantineMu.Lock()
+	defer cache.quarantineMu.Unlock()
+	_, ok := cache.quarantine[hash]
+	return ok
+}
+
+// QuarantinedArtifacts returns the hashes of the artifacts quarantined so far
+// in this process, with the reason each failed verification.
+func (cache *httpCache) QuarantinedArtifacts() map[string]string {
+	cache.quarantineMu.Lock()
+	defer cache.quarantineMu.Unlock()
+	quarantined := make(map[string]string, len(cache.quarantine))
+	for hash, reason := range cache.quarantine {
+		quarantined[hash] = reason
+	}
+	return quarantined
+}
@@ -0,0 +1,59 @@
+package cache
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/vercel/turbo/cli/internal/fs"
+	"github.com/vercel/turbo/cli/internal/turbopath"
+	"gotest.tools/v3/assert"
+)
+
+// reportingClient is a taggedClient that accepts bad artifact reports.
+type reportingClient struct {
+	taggedClient
+	fetches int
+	reports map[string]string
+}
+
+func (rc *reportingClient) FetchArtifact(hash string) (*http.Response, error) {
+	rc.fetches++
+	return rc.taggedClient.FetchArtifact(hash)
+}
+
+func (rc *reportingClient) ReportBadArtifact(hash string, reason string) error {
+	rc.reports[hash] = reason
+	return nil
+}
+
+func TestQuarantineBadArtifacts(t *testing.T) {
+	t.Setenv("TURBO_REMOTE_CACHE_SIGNATURE_KEY", "key")
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	_ = root.Join("a").WriteFile([]byte("a"), 0644)
+	files := turbopath.AnchoredUnixPathArray{"a"}.ToSystemPathArray()
+
+	client := &reportingClient{
+		taggedClient: taggedClient{artifacts: map[string][]byte{}, tags: map[string]string{}},
+		reports:      map[string]string{},
+	}
+	opts := Opts{
+		RemoteCacheOpts:        fs.RemoteCacheOptions{TeamID: "team_id", Signature: true},
+		QuarantineBadArtifacts: true,
+	}
+	cache := newHTTPCache(opts, client, &nullRecorder{}, root)
+	assert.NilError(t, cache.Put(root, "the-hash", 0, files), "Put")
+	client.tags["the-hash"] = "forged"
+
+	_, _, _, err := cache.Fetch(root, "the-hash", nil)
+	assert.ErrorIs(t, err, ErrVerificationFailed)
+	assert.Equal(t, client.fetches, 1)
+	assert.Assert(t, client.reports["the-hash"] != "", "bad artifact not reported")
+	assert.DeepEqual(t, cache.QuarantinedArtifacts(), client.reports)
+
+	// The artifact isn't downloaded again.
+	itemStatus, _, _, err := cache.Fetch(root, "the-hash", nil)
+	assert.NilError(t, err, "Fetch")
+	assert.Equal(t, itemStatus, ItemStatus{MissReason: MissReasonVerificationFailed})
+	assert.Assert(t, !cache.Exists("the-hash").Remote)
+	assert.Equal(t, client.fetches, 1)
+}
@@ -0,0 +1,78 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/vercel/turbo/cli/internal/turbopath"
+)
+
+// replicaFetcher is implemented by clients that can read artifacts from
+// replicas of the remote cache. Replica 0 is the primary; replica i is the
+// i-th base URL passed to SetReadReplicas.
+type replicaFetcher interface {
+	SetReadReplicas(baseURLs []string)
+	FetchArtifactFromReplica(hash string, replica int) (*http.Response, error)
+}
+
+// verificationError marks an error as a failure to verify an artifact's
+// signature, as opposed to a failure to download or restore it.
+type verificationError struct {
+	err error
+}
+
+func (ve *verificationError) Error() string {
+	return ErrVerificationFailed.Error() + ": " + ve.err.Error()
+}
+
+func (ve *verificationError) Unwrap() error {
+	return ve.err
+}
+
+func (ve *verificationError) Is(target error) bool {
+	return target == ErrVerificationFailed
+}
+
+// retrieve downloads and restores an artifact. If it fails verification and
+// the remote cache has read replicas, each other replica is tried once before
+// giving up, since one replica may hold a corrupted copy. If every replica
+// fails, the signature is systematically wrong, which points at our signing
+// configuration instead. With Opts.ContentAddressed, hash is first resolved
+// to the digest the artifact is stored under.
+func (cache *httpCache) retrieve(hash string, ifNoneMatch string, downloaded *int64) (bool, []turbopath.AnchoredSystemPath, int, error) {
+	hash, err := cache.artifactKey(hash)
+	if err != nil || hash == "" {
+		return false, nil, 0, err
+	}
+	hit, files, duration, err := cache.retrieveFrom(hash, ifNoneMatch, 0, downloaded)
+	if !errors.Is(err, ErrVerificationFailed) || len(cache.verificationFailures) == 0 {
+		return hit, files, duration, err
+	}
+	atomic.AddInt64(&cache.verificationFailures[0], 1)
+	for replica := 1; replica < len(cache.verificationFailures); replica++ {
+		cache.logger.Warn("artifact failed verification, retrying from another replica", "hash", hash, "replica", replica, "error", err)
+		hit, files, duration, err = cache.retrieveFrom(hash, "", replica, downloaded)
+		if !errors.Is(err, ErrVerificationFailed) {
+			return hit, files, duration, err
+		}
+		atomic.AddInt64(&cache.verificationFailures[replica], 1)
+	}
+	return false, nil, 0, fmt.Errorf("%w (on all %v replicas; check the signing key and team)", err, len(cache.verificationFailures))
+}
+
+// ReplicaVerificationFailures returns how many artifacts from each replica of
+// the remote cache have failed verification so far in this run. Index 0 is
+// the primary, and index i is Opts.RemoteCacheReplicas[i-1]. It returns nil
+// if no replicas are configured.
+func (cache *httpCache) ReplicaVerificationFailures() []int64 {
+	if len(cache.verificationFailures) == 0 {
+		return nil
+	}
+	failures := make([]int64, len(cache.verificationFailures))
+	for i := range failures {
+		failures[i] = atomic.LoadInt64(&cache.verificationFailures[i])
+	}
+	return failures
+}
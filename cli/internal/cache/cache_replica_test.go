@@ -0,0 +1,123 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/vercel/turbo/cli/internal/fs"
+	"github.com/vercel/turbo/cli/internal/turbopath"
+	"gotest.tools/v3/assert"
+)
+
+// replicaClient serves the same artifact from every replica, each with its own
+// tag.
+type replicaClient struct {
+	artifactResp
+	replicas []string
+	tags     []string
+	fetches  []int
+}
+
+func (rc *replicaClient) SetReadReplicas(baseURLs []string) {
+	rc.replicas = baseURLs
+}
+
+func (rc *replicaClient) FetchArtifact(hash string) (*http.Response, error) {
+	return rc.FetchArtifactFromReplica(hash, 0)
+}
+
+func (rc *replicaClient) FetchArtifactFromReplica(hash string, replica int) (*http.Response, error) {
+	if replica > len(rc.replicas) {
+		return nil, errors.New("no such replica")
+	}
+	rc.fetches[replica]++
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"X-Artifact-Tag": []string{rc.tags[replica]}},
+		Body:       ioutil.NopCloser(bytes.NewReader(rc.body)),
+	}, nil
+}
+
+func TestReplicaVerificationRetry(t *testing.T) {
+	t.Setenv("TURBO_REMOTE_CACHE_SIGNATURE_KEY", "key")
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	_ = root.Join("a").WriteFile([]byte("a"), 0644)
+	files := turbopath.AnchoredUnixPathArray{"a"}.ToSystemPathArray()
+	opts := Opts{
+		RemoteCacheOpts:     fs.RemoteCacheOptions{TeamID: "team_id", Signature: true},
+		RemoteCacheReplicas: []string{"https://replica-1", "https://replica-2"},
+	}
+
+	signed := &resignClient{}
+	assert.NilError(t, newHTTPCache(opts, signed, &nullRecorder{}, root).Put(root, "the-hash", 0, files), "Put")
+	client := &replicaClient{
+		artifactResp: artifactResp{body: signed.body},
+		tags:         []string{"corrupt", "corrupt", signed.putTag},
+		fetches:      make([]int, 3),
+	}
+	cache := newHTTPCache(opts, client, &nullRecorder{}, root)
+	assert.DeepEqual(t, client.replicas, opts.RemoteCacheReplicas)
+
+	// One bad replica: the next good one is used.
+	itemStatus, _, _, err := cache.Fetch(root, "the-hash", nil)
+	assert.NilError(t, err, "Fetch")
+	assert.Assert(t, itemStatus.Remote)
+	assert.DeepEqual(t, client.fetches, []int{1, 1, 1})
+	assert.DeepEqual(t, cache.ReplicaVerificationFailures(), []int64{1, 1, 0})
+
+	// Every replica bad: each is tried once, and the failure is systematic.
+	client.tags[2] = "corrupt"
+	_, _, _, err = cache.Fetch(root, "the-hash", nil)
+	assert.ErrorIs(t, err, ErrVerificationFailed)
+	assert.ErrorContains(t, err, "on all 3 replicas")
+	assert.DeepEqual(t, client.fetches, []int{2, 2, 2})
+	assert.DeepEqual(t, cache.ReplicaVerificationFailures(), []int64{2, 2, 1})
+
+	// Without replicas, a verification failure isn't retried.
+	client.fetches = make([]int, 3)
+	single := newHTTPCache(Opts{RemoteCacheOpts: opts.RemoteCacheOpts}, client, &nullRecorder{}, root)
+	_, _, _, err = single.Fetch(root, "the-hash", nil)
+	assert.ErrorIs(t, err, ErrVerificationFailed)
+	assert.DeepEqual(t, client.fetches, []int{1, 0, 0})
+	assert.Assert(t, single.ReplicaVerificationFailures() == nil)
+}
+
+func TestVerificationFailureAsMiss(t *testing.T) {
+	t.Setenv("TURBO_REMOTE_CACHE_SIGNATURE_KEY", "key")
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	opts := Opts{
+		RemoteCacheOpts:     fs.RemoteCacheOptions{TeamID: "team_id", Signature: true},
+		RemoteCacheReplicas: []string{"https://replica-1"},
+	}
+	client := &replicaClient{
+		artifactResp: artifactResp{body: makeValidTar(t).Bytes()},
+		tags:         []string{"corrupt", "corrupt"},
+		fetches:      make([]int, 2),
+	}
+
+	opts.VerificationFailureAsMiss = true
+	cache := newHTTPCache(opts, client, &nullRecorder{}, root)
+	itemStatus, files, _, err := cache.Fetch(root, "the-hash", nil)
+	assert.NilError(t, err, "Fetch")
+	assert.Equal(t, itemStatus, ItemStatus{MissReason: MissReasonVerificationFailed})
+	assert.Equal(t, len(files), 0)
+	assert.DeepEqual(t, client.fetches, []int{1, 1})
+	assert.Equal(t, len(cache.FailedOps()), 1)
+
+	// Through the multiplexer, the miss reason is kept, and without the option
+	// the failure fails the fetch.
+	for _, asMiss := range []bool{true, false} {
+		opts.VerificationFailureAsMiss = asMiss
+		mplex := &cacheMultiplexer{caches: []Cache{newEnabledCache(), newHTTPCache(opts, client, &nullRecorder{}, root)}}
+		itemStatus, _, _, err = mplex.Fetch(root, "the-hash", nil)
+		if asMiss {
+			assert.NilError(t, err, "Fetch")
+			assert.Equal(t, itemStatus.MissReason, MissReasonVerificationFailed)
+		} else {
+			assert.ErrorIs(t, err, ErrVerificationFailed)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package cache
+
+import (
+	"context"
+
+	"github.com/vercel/turbo/cli/internal/turbopath"
+)
+
+// A satisfiedCache is a wrapper around a Cache that skips fetching artifacts
+// whose outputs are already in place, as reported by Opts.OutputsSatisfied.
+//
+// In watch mode and during local development, outputs usually persist between
+// runs, and restoring them again from the cache (or downloading them) is wasted
+// work. The cache doesn't know how the caller hashes outputs, so the decision
+// is left to the predicate.
+type satisfiedCache struct {
+	satisfied func(anchor turbopath.AbsoluteSystemPath, hash string) bool
+	realCache Cache
+}
+
+func newSatisfiedCache(realCache Cache, satisfied func(anchor turbopath.AbsoluteSystemPath, hash string) bool) Cache {
+	return &satisfiedCache{
+		satisfied: satisfied,
+		realCache: realCache,
+	}
+}
+
+func (c *satisfiedCache) Put(anchor turbopath.AbsoluteSystemPath, key string, duration int, files []turbopath.AnchoredSystemPath) error {
+	return c.realCache.Put(anchor, key, duration, files)
+}
+
+func (c *satisfiedCache) Fetch(anchor turbopath.AbsoluteSystemPath, key string, files []string) (ItemStatus, []turbopath.AnchoredSystemPath, int, error) {
+	if c.satisfied(anchor, key) {
+		return ItemStatus{Local: true, Source: ItemSourceLocal, AlreadySatisfied: true}, nil, 0, nil
+	}
+	return c.realCache.Fetch(anchor, key, files)
+}
+
+func (c *satisfiedCache) Exists(key string) ItemStatus {
+	return c.realCache.Exists(key)
+}
+
+func (c *satisfiedCache) Ping(ctx context.Context) error {
+	if pinger, ok := c.realCache.(Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *satisfiedCache) PutImmutable(anchor turbopath.AbsoluteSystemPath, key string, duration int, files []turbopath.AnchoredSystemPath) error {
+	return remoteOperations(c.realCache).PutImmutable(anchor, key, duration, files)
+}
+
+func (c *satisfiedCache) VerifyManifest(expected map[string]string) ([]ManifestDiscrepancy, error) {
+	return remoteOperations(c.realCache).VerifyManifest(expected)
+}
+
+func (c *satisfiedCache) EstimateRestoreSize(key string) (int64, error) {
+	return remoteOperations(c.realCache).EstimateRestoreSize(key)
+}
+
+func (c *satisfiedCache) Capabilities() (BackendCapabilities, error) {
+	return remoteOperations(c.realCache).Capabilities()
+}
+
+func (c *satisfiedCache) Clean(anchor turbopath.AbsoluteSystemPath) {
+	c.realCache.Clean(anchor)
+}
+
+func (c *satisfiedCache) CleanAll() {
+	c.realCache.CleanAll()
+}
+
+func (c *satisfiedCache) Shutdown() {
+	c.realCache.Shutdown()
+}
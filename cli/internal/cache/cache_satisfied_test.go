@@ -0,0 +1,41 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/vercel/turbo/cli/internal/turbopath"
+)
+
+func TestSatisfiedCache(t *testing.T) {
+	backend := newEnabledCache()
+	files := []turbopath.AnchoredSystemPath{turbopath.AnchoredSystemPath("dist")}
+	if err := backend.Put("unused", "stored-hash", 0, files); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	var checked []string
+	cache := newSatisfiedCache(backend, func(anchor turbopath.AbsoluteSystemPath, hash string) bool {
+		checked = append(checked, hash)
+		return hash == "present-hash"
+	})
+
+	status, restored, _, err := cache.Fetch("unused", "present-hash", nil)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if !status.Local || !status.AlreadySatisfied || restored != nil {
+		t.Errorf("expected an already-satisfied local hit without restoring, got %+v %v", status, restored)
+	}
+
+	status, restored, _, err = cache.Fetch("unused", "stored-hash", nil)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if !status.Local || status.AlreadySatisfied || len(restored) != 1 {
+		t.Errorf("expected a regular hit from the backend, got %+v %v", status, restored)
+	}
+
+	if len(checked) != 2 {
+		t.Errorf("expected the predicate to be consulted on every fetch, got %v", checked)
+	}
+}
@@ -4,49 +4,165 @@
 package cache
 
 import (
+	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"hash"
+	"io"
 	"os"
+	"sync"
+	"time"
 )
 
+// ErrSignatureExpired is returned when an artifact was signed outside the
+// window allowed by Opts.SignatureFreshness.
+var ErrSignatureExpired = errors.New("artifact signature is outside the freshness window")
+
+// ErrSigningKeyMissing is returned when an artifact is signed or verified
+// while signing is enabled, but no signature key has been configured.
+var ErrSigningKeyMissing = errors.New("signing enabled but no key configured")
+
 type ArtifactSignatureAuthentication struct {
 	teamID string
 	// Used for testing purposes
-	secretKeyOverride []byte
-	enabled           bool
+	secretKeyOverride         []byte
+	previousSecretKeyOverride []byte
+	enabled                   bool
+	signatureScope            SignatureScope
+	// freshness is how long after signing an artifact is accepted, or 0 to
+	// sign without timestamps.
+	freshness time.Duration
+	// signedAt, if set, is the signing time covered by tags; see stamp.
+	signedAt string
+	// key, if set, caches the secret key once it has been read, and is shared
+	// by the signers derived from this one.
+	key *cachedKey
+}
+
+// cachedKey holds a secret key resolved on first use, so that signing can be
+// configured after the cache is created, e.g. by embedders that only set the
+// key once they know signing is needed.
+type cachedKey struct {
+	mu     sync.Mutex
+	secret []byte
 }
 
 func (asa *ArtifactSignatureAuthentication) isEnabled() bool {
 	return asa.enabled
 }
 
-// If the secret key is not found or the secret key length is 0, an error is returned
-// Preference is given to the environment specified secret key.
+// If the secret key is not found or the secret key length is 0, an error
+// matching ErrSigningKeyMissing is returned. Preference is given to the
+// environment specified secret key. The key is read when it's first needed,
+// and cached from then on if the signer has a key cache; a missing key isn't
+// cached, so it can still be configured later.
 func (asa *ArtifactSignatureAuthentication) getSecretKey() ([]byte, error) {
-	var secret []byte
 	if asa.secretKeyOverride != nil {
-		secret = asa.secretKeyOverride
-	} else {
-		secret = []byte(os.Getenv("TURBO_REMOTE_CACHE_SIGNATURE_KEY"))
+		if len(asa.secretKeyOverride) == 0 {
+			return nil, fmt.Errorf("%w: the signature secret key is empty", ErrSigningKeyMissing)
+		}
+		return asa.secretKeyOverride, nil
+	}
+	if asa.key != nil {
+		asa.key.mu.Lock()
+		defer asa.key.mu.Unlock()
+		if asa.key.secret != nil {
+			return asa.key.secret, nil
+		}
 	}
 
+	secret := []byte(os.Getenv("TURBO_REMOTE_CACHE_SIGNATURE_KEY"))
 	if len(secret) == 0 {
-		return nil, errors.New("signature secret key not found. You must specify a secret key in the TURBO_REMOTE_CACHE_SIGNATURE_KEY environment variable")
+		return nil, fmt.Errorf("%w: you must specify a secret key in the TURBO_REMOTE_CACHE_SIGNATURE_KEY environment variable", ErrSigningKeyMissing)
+	}
+	if asa.key != nil {
+		asa.key.secret = secret
 	}
 	return secret, nil
 }
 
+// previousKeySigner returns a signer using the key that was in use before the
+// current one, read from the TURBO_REMOTE_CACHE_PREVIOUS_SIGNATURE_KEY environment variable.
+func (asa *ArtifactSignatureAuthentication) previousKeySigner() (*ArtifactSignatureAuthentication, error) {
+	secret := asa.previousSecretKeyOverride
+	if secret == nil {
+		secret = []byte(os.Getenv("TURBO_REMOTE_CACHE_PREVIOUS_SIGNATURE_KEY"))
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("previous signature secret key not found. You must specify it in the TURBO_REMOTE_CACHE_PREVIOUS_SIGNATURE_KEY environment variable")
+	}
+	return &ArtifactSignatureAuthentication{
+		teamID:            asa.teamID,
+		secretKeyOverride: secret,
+		enabled:           true,
+		signatureScope:    asa.signatureScope,
+		freshness:         asa.freshness,
+		signedAt:          asa.signedAt,
+	}, nil
+}
+
+// signingTime returns the x-artifact-signed-at value for an artifact signed
+// now, or "" if signatures aren't timestamped.
+func (asa *ArtifactSignatureAuthentication) signingTime() string {
+	if asa.freshness == 0 {
+		return ""
+	}
+	return time.Now().UTC().Format(time.RFC3339)
+}
+
+// stamp returns a signer whose tags also cover signedAt, the signing time sent
+// as x-artifact-signed-at. Binding the time into the tag stops it from being
+// changed to make a stale artifact look fresh. An empty signedAt leaves tags
+// as they would be without timestamps.
+func (asa *ArtifactSignatureAuthentication) stamp(signedAt string) *ArtifactSignatureAuthentication {
+	stamped := *asa
+	stamped.signedAt = signedAt
+	return &stamped
+}
+
+// verifierFor returns a signer to validate an artifact downloaded with the
+// given x-artifact-signed-at header. If signatures are timestamped, artifacts
+// signed longer ago than the freshness window, or missing a timestamp, are
+// rejected with ErrSignatureExpired. So are artifacts claiming to have been
+// signed more than the window in the future, which would otherwise stay fresh
+// indefinitely.
+func (asa *ArtifactSignatureAuthentication) verifierFor(signedAt string) (*ArtifactSignatureAuthentication, error) {
+	if asa.freshness > 0 {
+		if signedAt == "" {
+			return nil, fmt.Errorf("%w: artifact has no x-artifact-signed-at header", ErrSignatureExpired)
+		}
+		signedTime, err := time.Parse(time.RFC3339, signedAt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x-artifact-signed-at header %q: %w", signedAt, err)
+		}
+		if age := time.Since(signedTime); age > asa.freshness || age < -asa.freshness {
+			return nil, fmt.Errorf("%w: artifact was signed at %v", ErrSignatureExpired, signedAt)
+		}
+	}
+	return asa.stamp(signedAt), nil
+}
+
 func (asa *ArtifactSignatureAuthentication) generateTag(hash string, artifactBody []byte) (string, error) {
-	tag, err := asa.getTagGenerator(hash)
+	return asa.generateTagReader(hash, bytes.NewReader(artifactBody))
+}
+
+// generateTagReader is like generateTag, but streams the artifact from body,
+// so that it never has to be held in memory. body isn't read if only the hash
+// is signed.
+func (asa *ArtifactSignatureAuthentication) generateTagReader(hash string, body io.Reader) (string, error) {
+	validator, err := asa.newStreamValidator(hash)
 	if err != nil {
 		return "", err
 	}
-	tag.Write(artifactBody)
-	return base64.StdEncoding.EncodeToString(tag.Sum(nil)), nil
+	if asa.signatureScope != SignatureScopeHashOnly {
+		if _, err := io.Copy(validator, body); err != nil {
+			return "", err
+		}
+	}
+	return validator.CurrentValue(), nil
 }
 
 func (asa *ArtifactSignatureAuthentication) getTagGenerator(hash string) (hash.Hash, error) {
@@ -57,6 +173,7 @@ func (asa *ArtifactSignatureAuthentication) getTagGenerator(hash string) (hash.H
 	}
 	metadata := []byte(hash)
 	metadata = append(metadata, []byte(teamID)...)
+	metadata = append(metadata, []byte(asa.signedAt)...)
 
 	// TODO(Gaspar) Support additional signing algorithms here
 	h := hmac.New(sha256.New, secret)
@@ -72,10 +189,27 @@ func (asa *ArtifactSignatureAuthentication) validate(hash string, artifactBody [
 	return hmac.Equal([]byte(computedTag), []byte(expectedTag)), nil
 }
 
+// newStreamValidator returns a StreamValidator that incrementally computes the
+// tag for hash as the artifact body is written to it.
+func (asa *ArtifactSignatureAuthentication) newStreamValidator(hash string) (*StreamValidator, error) {
+	tag, err := asa.getTagGenerator(hash)
+	if err != nil {
+		return nil, err
+	}
+	return &StreamValidator{currentHash: tag}, nil
+}
+
+// StreamValidator computes an artifact tag incrementally so the body never has
+// to be held in memory.
 type StreamValidator struct {
 	currentHash hash.Hash
 }
 
+// Write feeds more of the artifact body into the tag computation.
+func (sv *StreamValidator) Write(p []byte) (int, error) {
+	return sv.currentHash.Write(p)
+}
+
 func (sv *StreamValidator) Validate(expectedTag string) bool {
 	computedTag := base64.StdEncoding.EncodeToString(sv.currentHash.Sum(nil))
 	return hmac.Equal([]byte(computedTag), []byte(expectedTag))
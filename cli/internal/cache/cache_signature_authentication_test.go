@@ -97,6 +97,29 @@ func Test_SecretKeyErrors(t *testing.T) {
 	}
 }
 
+func Test_SecretKeyResolvedLazily(t *testing.T) {
+	asa := &ArtifactSignatureAuthentication{
+		teamID:  "team_someid",
+		enabled: true,
+		key:     &cachedKey{},
+	}
+
+	// Signing was enabled before a key was configured.
+	_, err := asa.generateTag("some-hash", []byte("body"))
+	assert.ErrorIs(t, err, ErrSigningKeyMissing)
+	assert.Contains(t, err.Error(), "TURBO_REMOTE_CACHE_SIGNATURE_KEY")
+
+	t.Setenv("TURBO_REMOTE_CACHE_SIGNATURE_KEY", "my-secret-key-env")
+	tag, err := asa.generateTag("some-hash", []byte("body"))
+	assert.NoError(t, err)
+
+	// The key is cached once it has been read.
+	t.Setenv("TURBO_REMOTE_CACHE_SIGNATURE_KEY", "another-key")
+	isValid, err := asa.stamp("").validate("some-hash", []byte("body"), tag)
+	assert.NoError(t, err)
+	assert.True(t, isValid)
+}
+
 var MinimumLength = 10
 
 func generateRandomBytes() []byte {
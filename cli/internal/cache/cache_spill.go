@@ -0,0 +1,138 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/vercel/turbo/cli/internal/turbopath"
+)
+
+// _spillThreshold is the artifact size above which SpillToDisk buffers
+// artifacts in a temporary file.
+const _spillThreshold = 32 << 20
+
+// readerPutter is implemented by clients that can upload an artifact from a
+// seekable reader, such as a file, rather than from memory.
+type readerPutter interface {
+	PutArtifactReader(hash string, body io.ReadSeeker, size int64, duration int, tag string) error
+}
+
+// spilledArtifact is an artifact held either in memory or, once it grows past
+// the spill threshold, in a temporary file.
+type spilledArtifact struct {
+	body []byte
+	file *os.File
+	size int64
+}
+
+// spillArtifact reads r into memory, switching to a temporary file in dir once
+// more than threshold bytes have been read.
+func spillArtifact(r io.Reader, threshold int64, dir turbopath.AbsoluteSystemPath) (*spilledArtifact, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r, threshold+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) <= threshold {
+		return &spilledArtifact{body: body, size: int64(len(body))}, nil
+	}
+
+	if err := dir.MkdirAll(0755); err != nil {
+		return nil, err
+	}
+	file, err := ioutil.TempFile(dir.ToString(), "turbo-artifact-*")
+	if err != nil {
+		return nil, err
+	}
+	spilled := &spilledArtifact{file: file}
+	size, err := io.Copy(file, io.MultiReader(bytes.NewReader(body), r))
+	if err != nil {
+		spilled.cleanup()
+		return nil, err
+	}
+	spilled.size = size
+	return spilled, nil
+}
+
+// reader returns a reader positioned at the start of the artifact.
+func (sa *spilledArtifact) reader() (io.ReadSeeker, error) {
+	if sa.file == nil {
+		return bytes.NewReader(sa.body), nil
+	}
+	if _, err := sa.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return sa.file, nil
+}
+
+// cleanup removes the temporary file, if there is one.
+func (sa *spilledArtifact) cleanup() {
+	if sa.file != nil {
+		_ = sa.file.Close()
+		_ = os.Remove(sa.file.Name())
+	}
+}
+
+// putSpilled is like put, but buffers large artifacts in a temporary file,
+// computing the signature by streaming the file and uploading from it.
+func (cache *httpCache) putSpilled(putter readerPutter, anchor turbopath.AbsoluteSystemPath, hash string, duration int, files []turbopath.AnchoredSystemPath) (artifactSize, error) {
+	start := time.Now()
+	r, w := io.Pipe()
+
+	var size artifactSize
+	cacheErrorChan := make(chan error, 1)
+	go cache.write(w, anchor, files, &size, cacheErrorChan)
+
+	var spilled *spilledArtifact
+	err := cache.readWithTimeout(r, func() error {
+		var err error
+		spilled, err = spillArtifact(r, cache.spillThreshold, cache.tempDir)
+		return err
+	})
+	if err != nil {
+		return artifactSize{}, fmt.Errorf("failed to store files in HTTP cache: %w", err)
+	}
+	defer spilled.cleanup()
+
+	cacheCreateError := <-cacheErrorChan
+	if cacheCreateError != nil {
+		return artifactSize{}, cacheCreateError
+	}
+	cache.metrics.timePhase("compress", start)
+
+	size.compressed = spilled.size
+	if cache.provenance != nil {
+		body, err := spilled.reader()
+		if err == nil {
+			size.digest, err = artifactDigest(body)
+		}
+		if err != nil {
+			return artifactSize{}, fmt.Errorf("failed to store files in HTTP cache: %w", err)
+		}
+	}
+	if spilled.file == nil {
+		return size, cache.upload(hash, spilled.body, duration)
+	}
+
+	body, err := spilled.reader()
+	if err != nil {
+		return artifactSize{}, fmt.Errorf("failed to store files in HTTP cache: %w", err)
+	}
+	tag, signedAt, err := cache.signReader(hash, body)
+	if err != nil {
+		return artifactSize{}, err
+	}
+
+	body, err = spilled.reader()
+	if err != nil {
+		return artifactSize{}, fmt.Errorf("failed to store files in HTTP cache: %w", err)
+	}
+	defer cache.metrics.timePhase("upload", time.Now())
+	if signedAt != "" {
+		return size, cache.putTimestamped(hash, body, spilled.size, duration, tag, signedAt)
+	}
+	return size, putter.PutArtifactReader(hash, body, spilled.size, duration, tag)
+}
@@ -0,0 +1,75 @@
+package cache
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vercel/turbo/cli/internal/fs"
+	"github.com/vercel/turbo/cli/internal/turbopath"
+	"gotest.tools/v3/assert"
+)
+
+type readerPutClient struct {
+	artifactResp
+	tag       string
+	spillFile string
+}
+
+func (rc *readerPutClient) PutArtifactReader(hash string, body io.ReadSeeker, size int64, duration int, tag string) error {
+	if file, ok := body.(*os.File); ok {
+		rc.spillFile = file.Name()
+	}
+	artifactBody, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if int64(len(artifactBody)) != size {
+		return io.ErrUnexpectedEOF
+	}
+	rc.tag = tag
+	rc.headers = http.Header{"X-Artifact-Tag": []string{tag}}
+	return rc.artifactResp.PutArtifact(hash, artifactBody, duration, tag)
+}
+
+func TestSpillToDisk(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	_ = root.Join("a").WriteFile(bytes.Repeat([]byte("a"), 4096), 0644)
+	files := turbopath.AnchoredUnixPathArray{"a"}.ToSystemPathArray()
+
+	client := &readerPutClient{}
+	cache := newHTTPCache(Opts{SpillToDisk: true}, client, &nullRecorder{}, root)
+	cache.spillThreshold = 16
+	cache.signerVerifier = &ArtifactSignatureAuthentication{teamID: "team_id", secretKeyOverride: []byte("key"), enabled: true}
+
+	assert.NilError(t, cache.Put(root, "some-hash", 0, files), "Put")
+	assert.Assert(t, client.spillFile != "", "artifact was spilled to a file")
+	assert.Equal(t, filepath.Dir(client.spillFile), root.UntypedJoin("node_modules", ".cache", "turbo", "tmp").ToString(), "spill file is staged inside the repo")
+	_, err := os.Stat(client.spillFile)
+	assert.Assert(t, os.IsNotExist(err), "spill file was removed")
+
+	wantTag, err := cache.signerVerifier.generateTag("some-hash", client.body)
+	assert.NilError(t, err, "generateTag")
+	assert.Equal(t, client.tag, wantTag)
+
+	restoreRoot := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	downloader := newHTTPCache(Opts{}, client, &nullRecorder{}, restoreRoot)
+	downloader.signerVerifier = cache.signerVerifier
+	itemStatus, _, _, err := downloader.Fetch(restoreRoot, "some-hash", nil)
+	assert.NilError(t, err, "Fetch")
+	assert.Assert(t, itemStatus.Remote)
+	assert.Assert(t, restoreRoot.UntypedJoin("a").FileExists())
+}
+
+func TestSpillArtifactBelowThreshold(t *testing.T) {
+	spilled, err := spillArtifact(bytes.NewReader([]byte("small")), 16, turbopath.AbsoluteSystemPath(t.TempDir()))
+	assert.NilError(t, err, "spillArtifact")
+	defer spilled.cleanup()
+	assert.Assert(t, spilled.file == nil)
+	assert.Equal(t, string(spilled.body), "small")
+	assert.Equal(t, spilled.size, int64(5))
+}
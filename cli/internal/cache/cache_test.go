@@ -1,10 +1,12 @@
 package cache
 
 import (
+	"errors"
 	"net/http"
 	"reflect"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/vercel/turbo/cli/internal/analytics"
 	"github.com/vercel/turbo/cli/internal/fs"
@@ -147,6 +149,33 @@ func TestExists(t *testing.T) {
 	}
 }
 
+func TestSkipReason(t *testing.T) {
+	// A miss only counts as skipped if no cache was consulted.
+	mplex := &cacheMultiplexer{caches: []Cache{newEnabledCache(), newNoopCache()}}
+	itemStatus, _, _, err := mplex.Fetch("unused-target", "some-hash", nil)
+	if err != nil {
+		t.Errorf("Fetch got error %v, want <nil>", err)
+	}
+	if itemStatus.SkipReason != SkipReasonNone {
+		t.Errorf("Fetch got skip reason %v, want none", itemStatus.SkipReason)
+	}
+	if reason := mplex.Exists("some-hash").SkipReason; reason != SkipReasonNone {
+		t.Errorf("Exists got skip reason %v, want none", reason)
+	}
+
+	mplex = &cacheMultiplexer{caches: []Cache{newNoopCache()}}
+	itemStatus, _, _, err = mplex.Fetch("unused-target", "some-hash", nil)
+	if err != nil {
+		t.Errorf("Fetch got error %v, want <nil>", err)
+	}
+	if itemStatus.SkipReason != SkipReasonDisabled {
+		t.Errorf("Fetch got skip reason %v, want %v", itemStatus.SkipReason, SkipReasonDisabled)
+	}
+	if reason := mplex.Exists("some-hash").SkipReason; reason != SkipReasonDisabled {
+		t.Errorf("Exists got skip reason %v, want %v", reason, SkipReasonDisabled)
+	}
+}
+
 type fakeClient struct{}
 
 // FetchArtifact implements client
@@ -296,6 +325,9 @@ func TestNew(t *testing.T) {
 				t.Errorf("New() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
+			if _, ok := got.(RemoteOperations); !ok {
+				t.Errorf("New() = %T, which doesn't implement RemoteOperations", got)
+			}
 			switch multiplexer := got.(type) {
 			case *cacheMultiplexer:
 				want := tt.want.(*cacheMultiplexer)
@@ -316,3 +348,164 @@ func TestNew(t *testing.T) {
 		})
 	}
 }
+
+func TestRemoteOperations(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	_ = root.Join("a").WriteFile([]byte("a"), 0644)
+	files := turbopath.AnchoredUnixPathArray{"a"}.ToSystemPathArray()
+
+	client := &immutableClient{pinned: map[string]bool{}}
+	c, err := New(Opts{
+		HashNamespace:    "node18",
+		OutputsSatisfied: func(turbopath.AbsoluteSystemPath, string) bool { return false },
+		CacheJournalPath: root.UntypedJoin("journal.jsonl").ToString(),
+		Workers:          2,
+	}, root, client, &nullRecorder{}, func(Cache, error) {})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer c.Shutdown()
+	ops, ok := c.(RemoteOperations)
+	if !ok {
+		t.Fatalf("New() = %T, which doesn't implement RemoteOperations", c)
+	}
+
+	if err := ops.PutImmutable(root, "the-hash", 0, files); err != nil {
+		t.Fatalf("PutImmutable: %v", err)
+	}
+	if !client.pinned["node18-the-hash"] {
+		t.Errorf("expected the namespaced hash to be pinned, got %v", client.pinned)
+	}
+	if status := c.Exists("the-hash"); !status.Local {
+		t.Error("expected PutImmutable to store the artifact locally too")
+	}
+	if size, err := ops.EstimateRestoreSize("the-hash"); err != nil || size != 1 {
+		t.Errorf("EstimateRestoreSize = %v, %v, want 1", size, err)
+	}
+	if caps, err := ops.Capabilities(); err != nil || !caps.Immutable {
+		t.Errorf("Capabilities = %+v, %v, want Immutable", caps, err)
+	}
+
+	fsOnly, err := New(Opts{SkipRemote: true}, root, nil, &nullRecorder{}, nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if _, err := fsOnly.(RemoteOperations).Capabilities(); !errors.Is(err, ErrNoRemoteCache) {
+		t.Errorf("Capabilities without a remote cache = %v, want ErrNoRemoteCache", err)
+	}
+	if err := fsOnly.(RemoteOperations).PutImmutable(root, "other-hash", 0, files); err != nil {
+		t.Errorf("PutImmutable without a remote cache: %v", err)
+	}
+}
+
+func TestResolveConnPool(t *testing.T) {
+	tests := []struct {
+		name                string
+		opts                Opts
+		maxIdleConns        int
+		maxIdleConnsPerHost int
+		idleConnTimeout     time.Duration
+	}{
+		{name: "defaults", maxIdleConns: 100, maxIdleConnsPerHost: _maxConcurrentRequests, idleConnTimeout: 90 * time.Second},
+		{name: "configured", opts: Opts{MaxIdleConns: 10, MaxIdleConnsPerHost: 5, IdleConnTimeout: time.Second}, maxIdleConns: 10, maxIdleConnsPerHost: 5, idleConnTimeout: time.Second},
+		{name: "total raised to per host", opts: Opts{MaxIdleConns: 10, MaxIdleConnsPerHost: 50}, maxIdleConns: 50, maxIdleConnsPerHost: 50, idleConnTimeout: 90 * time.Second},
+		{name: "negative", opts: Opts{MaxIdleConns: -1, MaxIdleConnsPerHost: -1, IdleConnTimeout: -time.Second}, maxIdleConns: 100, maxIdleConnsPerHost: _maxConcurrentRequests, idleConnTimeout: 90 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			maxIdleConns, maxIdleConnsPerHost, idleConnTimeout := tt.opts.resolveConnPool()
+			if maxIdleConns != tt.maxIdleConns || maxIdleConnsPerHost != tt.maxIdleConnsPerHost || idleConnTimeout != tt.idleConnTimeout {
+				t.Errorf("resolveConnPool() got (%v, %v, %v), want (%v, %v, %v)", maxIdleConns, maxIdleConnsPerHost, idleConnTimeout, tt.maxIdleConns, tt.maxIdleConnsPerHost, tt.idleConnTimeout)
+			}
+		})
+	}
+}
+
+// flakyCache blocks every Put until unblocked, and fails the first failures.
+type flakyCache struct {
+	testCache
+	unblock  chan struct{}
+	failures int
+	puts     int32
+}
+
+func (fc *flakyCache) Put(anchor turbopath.AbsoluteSystemPath, hash string, duration int, files []turbopath.AnchoredSystemPath) error {
+	<-fc.unblock
+	atomic.AddInt32(&fc.puts, 1)
+	if fc.failures > 0 {
+		fc.failures--
+		return errors.New("upload failed")
+	}
+	return fc.testCache.Put(anchor, hash, duration, files)
+}
+
+func TestAsyncUploads(t *testing.T) {
+	realCache := &flakyCache{testCache: *newEnabledCache(), unblock: make(chan struct{}), failures: 1}
+	c := newAsyncCache(realCache, Opts{Workers: 1, AsyncUploads: true, AsyncUploadRetries: 1}).(*asyncCache)
+	c.retryDelay = 0
+
+	// Put doesn't wait for the busy worker.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, hash := range []string{"a", "b", "c"} {
+			if err := c.Put("", hash, 0, nil); err != nil {
+				t.Errorf("Put(%v) = %v", hash, err)
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Put blocked on a busy worker")
+	}
+
+	close(realCache.unblock)
+	c.Shutdown()
+	if len(realCache.entries) != 3 {
+		t.Errorf("uploaded %v artifacts, want 3", len(realCache.entries))
+	}
+	if puts := atomic.LoadInt32(&realCache.puts); puts != 4 {
+		t.Errorf("tried %v uploads, want 4 with one retry", puts)
+	}
+}
+
+type capturingRecorder struct {
+	events []analytics.EventPayload
+}
+
+func (cr *capturingRecorder) LogEvent(payload analytics.EventPayload) {
+	cr.events = append(cr.events, payload)
+}
+
+func TestAnalyticsSampleRate(t *testing.T) {
+	defer func(original func() float64) { _sampleFloat = original }(_sampleFloat)
+	draws := []float64{0.1, 0.5, 0.2, 0.9}
+	_sampleFloat = func() float64 {
+		draw := draws[0]
+		draws = draws[1:]
+		return draw
+	}
+
+	recorder := &capturingRecorder{}
+	sampled := newSampledRecorder(recorder, 0.25)
+	for i := 0; i < 4; i++ {
+		sampled.LogEvent(&CacheEvent{Event: CacheEventHit, Hash: "hash"})
+	}
+	want := []analytics.EventPayload{
+		&CacheEvent{Event: CacheEventHit, Hash: "hash", SampleRate: 0.25},
+		&CacheEvent{Event: CacheEventHit, Hash: "hash", SampleRate: 0.25},
+	}
+	if !reflect.DeepEqual(recorder.events, want) {
+		t.Errorf("recorded %+v, want %+v", recorder.events, want)
+	}
+
+	for _, rate := range []float64{0, 1, -1, 2} {
+		if got := newSampledRecorder(recorder, rate); got != recorder {
+			t.Errorf("newSampledRecorder(%v) sampled, want every event kept", rate)
+		}
+	}
+	if got := newSampledRecorder(nil, 0.5); got != nil {
+		t.Errorf("newSampledRecorder(nil) = %v, want nil", got)
+	}
+}
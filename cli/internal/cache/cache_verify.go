@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// ManifestDiscrepancyKind is how the remote cache differs from a manifest.
+type ManifestDiscrepancyKind string
+
+const (
+	// ManifestMissing is an artifact in the manifest that isn't in the cache.
+	ManifestMissing ManifestDiscrepancyKind = "missing"
+	// ManifestMismatched is an artifact whose content digest isn't the one in
+	// the manifest, or which failed signature verification.
+	ManifestMismatched ManifestDiscrepancyKind = "mismatched"
+)
+
+// ManifestDiscrepancy describes an artifact that differs between the remote
+// cache and a manifest passed to VerifyManifest. Digests are hex-encoded
+// SHA-256 of the artifact as stored. ActualDigest is empty for missing
+// artifacts and ones that failed signature verification.
+type ManifestDiscrepancy struct {
+	Hash           string
+	Kind           ManifestDiscrepancyKind
+	ExpectedDigest string
+	ActualDigest   string
+}
+
+// VerifyManifest checks that the remote cache holds the artifacts in
+// expected, a map of hash to content digest, e.g. so a release pipeline can
+// assert that a build's artifacts are present and uncorrupted before
+// promoting it. Every artifact is downloaded, concurrently within the request
+// limit, and signatures are checked if signing is enabled. Artifacts in the
+// cache but not in expected aren't reported: the backend's keys include
+// sidecars, index entries and aliases, and clients may prefix or shard them,
+// so they can't be mapped back to hashes. Discrepancies are sorted by hash;
+// an error means the check couldn't be completed.
+func (cache *httpCache) VerifyManifest(expected map[string]string) ([]ManifestDiscrepancy, error) {
+	var mu sync.Mutex
+	var discrepancies []ManifestDiscrepancy
+	var firstErr error
+
+	var wg sync.WaitGroup
+	for hash, expectedDigest := range expected {
+		hash, expectedDigest := hash, expectedDigest
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			discrepancy, err := cache.verifyArtifact(hash, expectedDigest)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+			} else if discrepancy != nil {
+				discrepancies = append(discrepancies, *discrepancy)
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	sort.Slice(discrepancies, func(i, j int) bool {
+		return discrepancies[i].Hash < discrepancies[j].Hash
+	})
+	return discrepancies, nil
+}
+
+// verifyArtifact downloads the artifact for hash and compares its digest to
+// expectedDigest, returning nil if they match.
+func (cache *httpCache) verifyArtifact(hash string, expectedDigest string) (*ManifestDiscrepancy, error) {
+	discrepancy := &ManifestDiscrepancy{Hash: hash, ExpectedDigest: expectedDigest}
+	body, err := cache.fetchVerified(hash)
+	if errors.Is(err, ErrArtifactNotFound) {
+		discrepancy.Kind = ManifestMissing
+		return discrepancy, nil
+	} else if errors.Is(err, ErrVerificationFailed) {
+		discrepancy.Kind = ManifestMismatched
+		return discrepancy, nil
+	} else if err != nil {
+		return nil, err
+	}
+	discrepancy.ActualDigest, err = artifactDigest(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if discrepancy.ActualDigest == expectedDigest {
+		return nil, nil
+	}
+	discrepancy.Kind = ManifestMismatched
+	return discrepancy, nil
+}
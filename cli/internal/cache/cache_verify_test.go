@@ -0,0 +1,42 @@
+package cache
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/vercel/turbo/cli/internal/fs"
+	"github.com/vercel/turbo/cli/internal/turbopath"
+	"gotest.tools/v3/assert"
+)
+
+func TestVerifyManifest(t *testing.T) {
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	_ = root.Join("a").WriteFile([]byte("a"), 0644)
+	files := turbopath.AnchoredUnixPathArray{"a"}.ToSystemPathArray()
+
+	client := &taggedClient{artifacts: map[string][]byte{}, tags: map[string]string{}}
+	cache := newHTTPCache(Opts{}, client, &nullRecorder{}, root)
+	cache.signerVerifier = &ArtifactSignatureAuthentication{teamID: "team_id", secretKeyOverride: []byte("key"), enabled: true}
+	for _, hash := range []string{"good", "stale", "forged", "extra"} {
+		assert.NilError(t, cache.Put(root, hash, 0, files), "Put")
+	}
+	client.tags["forged"] = "not-the-tag"
+	digest := func(hash string) string {
+		d, err := artifactDigest(bytes.NewReader(client.artifacts[hash]))
+		assert.NilError(t, err, "artifactDigest")
+		return d
+	}
+
+	discrepancies, err := cache.VerifyManifest(map[string]string{
+		"good":    digest("good"),
+		"stale":   "0000",
+		"forged":  digest("forged"),
+		"missing": "1111",
+	})
+	assert.NilError(t, err, "VerifyManifest")
+	assert.DeepEqual(t, discrepancies, []ManifestDiscrepancy{
+		{Hash: "forged", Kind: ManifestMismatched, ExpectedDigest: digest("forged")},
+		{Hash: "missing", Kind: ManifestMissing, ExpectedDigest: "1111"},
+		{Hash: "stale", Kind: ManifestMismatched, ExpectedDigest: "0000", ActualDigest: digest("stale")},
+	})
+}
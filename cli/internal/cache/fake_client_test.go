@@ -0,0 +1,171 @@
+package cache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/vercel/turbo/cli/internal/fs"
+	"github.com/vercel/turbo/cli/internal/turbopath"
+)
+
+// writeTestFiles writes files, a map of name to contents, to a fresh
+// directory and returns it, for tests that need something to Put.
+func writeTestFiles(t *testing.T, files map[string]string) turbopath.AbsoluteSystemPath {
+	t.Helper()
+	root := fs.AbsoluteSystemPathFromUpstream(t.TempDir())
+	for name, contents := range files {
+		if err := root.UntypedJoin(name).WriteFile([]byte(contents), 0644); err != nil {
+			t.Fatalf("writing %v: %v", name, err)
+		}
+	}
+	return root
+}
+
+// hookClient is a remote cache client backed by a map of artifacts. It
+// records every request, and tests change how it responds by setting the
+// hooks, each of which replaces the default behaviour of its method.
+type hookClient struct {
+	mu        sync.Mutex
+	artifacts map[string][]byte
+	// requests are the requests received, as "put <hash>", "fetch <hash>"
+	// or "exists <hash>".
+	requests []string
+
+	onPut    func(hash string, body []byte) error
+	onFetch  func(hash string) (*http.Response, error)
+	onExists func(hash string) (*http.Response, error)
+}
+
+func newHookClient() *hookClient {
+	return &hookClient{artifacts: map[string][]byte{}}
+}
+
+func (hc *hookClient) record(op string, hash string) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.requests = append(hc.requests, op+" "+hash)
+}
+
+func (hc *hookClient) PutArtifact(hash string, body []byte, duration int, tag string) error {
+	hc.record("put", hash)
+	if hc.onPut != nil {
+		return hc.onPut(hash, body)
+	}
+	hc.store(hash, body)
+	return nil
+}
+
+func (hc *hookClient) FetchArtifact(hash string) (*http.Response, error) {
+	hc.record("fetch", hash)
+	if hc.onFetch != nil {
+		return hc.onFetch(hash)
+	}
+	body, ok := hc.stored(hash)
+	if !ok {
+		return &http.Response{StatusCode: http.StatusNotFound, Body: ioutil.NopCloser(&bytes.Buffer{})}, nil
+	}
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(bytes.NewReader(body))}, nil
+}
+
+func (hc *hookClient) ArtifactExists(hash string) (*http.Response, error) {
+	hc.record("exists", hash)
+	if hc.onExists != nil {
+		return hc.onExists(hash)
+	}
+	status := http.StatusOK
+	if _, ok := hc.stored(hash); !ok {
+		status = http.StatusNotFound
+	}
+	return &http.Response{StatusCode: status, Header: http.Header{}, Body: ioutil.NopCloser(&bytes.Buffer{})}, nil
+}
+
+func (hc *hookClient) GetTeamID() string {
+	return ""
+}
+
+// store puts an artifact in the backend, as if another machine uploaded it.
+func (hc *hookClient) store(hash string, body []byte) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.artifacts[hash] = body
+}
+
+func (hc *hookClient) stored(hash string) ([]byte, bool) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	body, ok := hc.artifacts[hash]
+	return body, ok
+}
+
+// count returns how many requests of op, e.g. "fetch", were received.
+func (hc *hookClient) count(op string) int {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	n := 0
+	for _, request := range hc.requests {
+		if strings.HasPrefix(request, op+" ") {
+			n++
+		}
+	}
+	return n
+}
+
+// artifactResp serves every fetch with the same artifact.
+type artifactResp struct {
+	body    []byte
+	headers http.Header
+}
+
+func (ar *artifactResp) PutArtifact(hash string, body []byte, duration int, tag string) error {
+	ar.body = body
+	return nil
+}
+
+func (ar *artifactResp) FetchArtifact(hash string) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     ar.headers.Clone(),
+		Body:       ioutil.NopCloser(bytes.NewReader(ar.body)),
+	}, nil
+}
+
+func (ar *artifactResp) ArtifactExists(hash string) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     ar.headers.Clone(),
+		Body:       ioutil.NopCloser(&bytes.Buffer{}),
+	}, nil
+}
+
+func (ar *artifactResp) GetTeamID() string {
+	return ""
+}
+
+// statusResp answers every request with status.
+type statusResp struct {
+	status int
+	putErr error
+}
+
+func (sr *statusResp) PutArtifact(hash string, body []byte, duration int, tag string) error {
+	return sr.putErr
+}
+
+func (sr *statusResp) FetchArtifact(hash string) (*http.Response, error) {
+	return sr.ArtifactExists(hash)
+}
+
+func (sr *statusResp) ArtifactExists(hash string) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: sr.status,
+		Body:       ioutil.NopCloser(&bytes.Buffer{}),
+	}, nil
+}
+
+func (sr *statusResp) GetTeamID() string {
+	return ""
+}
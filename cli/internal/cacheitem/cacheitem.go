@@ -7,6 +7,8 @@ import (
 	"crypto/sha512"
 	"errors"
 	"io"
+	"os"
+	"time"
 
 	"github.com/vercel/turbo/cli/internal/turbopath"
 )
@@ -18,6 +20,43 @@ var (
 	errNameMalformed        = errors.New("file name is malformed")
 	errNameWindowsUnsafe    = errors.New("file name is not Windows-safe")
 	errUnsupportedFileType  = errors.New("attempted to restore unsupported file type")
+	errKeptExisting         = errors.New("existing file is newer than the cached version")
+)
+
+// _paxXattrPrefix is the PAX record namespace used for extended attributes.
+const _paxXattrPrefix = "SCHILY.xattr."
+
+var (
+	// ErrDecompressionFailed is returned when the compressed stream of a CacheItem cannot be decoded.
+	ErrDecompressionFailed = errors.New("failed to decompress cache item")
+	// ErrMalformedArchive is returned when a CacheItem decompresses cleanly but is not a valid tar.
+	ErrMalformedArchive = errors.New("cache item is not a valid tar archive")
+	// ErrDuplicateEntry is returned when a CacheItem contains more than one entry for the same path.
+	ErrDuplicateEntry = errors.New("cache item contains duplicate entries for a path")
+	// ErrTooManyFiles is returned when a CacheItem contains more entries than CacheItem.MaxFiles allows.
+	ErrTooManyFiles = errors.New("cache item contains too many files")
+	// ErrDecompressionBomb is returned when a CacheItem expands past CacheItem.MaxDecompressedSize or CacheItem.MaxCompressionRatio.
+	ErrDecompressionBomb = errors.New("cache item decompresses to more than allowed")
+	// ErrIncompleteRestore is returned when CacheItem.VerifyRestoreCount is set and Restore wrote fewer entries than the CacheItem contains.
+	ErrIncompleteRestore = errors.New("cache item was not completely restored")
+)
+
+// RestoreMode controls how Restore treats files already on disk.
+type RestoreMode int
+
+const (
+	// RestoreModeOverwrite replaces every file with the cached version.
+	RestoreModeOverwrite RestoreMode = iota
+	// RestoreModeMerge only writes a cached file if there is no regular file at
+	// its path, or the existing one was last modified before CacheItem.CreatedAt.
+	// If CreatedAt is unknown, only missing files are written.
+	//
+	// This protects in-progress edits to outputs, at the cost of correctness:
+	// an existing file that is newer than the item is kept even if it's stale
+	// (e.g. it was touched by a formatter rather than rebuilt), and mtimes from
+	// another machine's clock may be skewed. Kept files are not included in the
+	// files returned by Restore.
+	RestoreModeMerge
 )
 
 // CacheItem is a `tar` utility with a little bit extra.
@@ -26,6 +65,97 @@ type CacheItem struct {
 	Path turbopath.AbsoluteSystemPath
 	// Anchor is the position on disk at which the CacheItem will be restored.
 	Anchor turbopath.AbsoluteSystemPath
+	// PreserveXattrs captures extended attributes into PAX records when adding
+	// files and reapplies them on restore. It is a no-op where unsupported.
+	PreserveXattrs bool
+	// OnDivergentOverwrite, if set, is called on restore for every existing file
+	// whose contents differ from the version being restored over it, e.g. so
+	// callers can warn before clobbering uncommitted edits.
+	OnDivergentOverwrite func(path turbopath.AnchoredSystemPath)
+	// OnDuplicateEntry, if set, is called on restore for every path that has
+	// more than one file or symlink entry in the item. The last entry wins.
+	// turbo never produces such items, so a duplicate points at a buggy producer.
+	OnDuplicateEntry func(path turbopath.AnchoredSystemPath)
+	// RejectDuplicateEntries makes Restore fail with ErrDuplicateEntry on the
+	// first duplicate path instead of letting the last entry win.
+	RejectDuplicateEntries bool
+	// OnFileRestored, if set, is called by Restore after each file, directory
+	// or symlink is written, in the order they appear in the item, e.g. to
+	// build an index of restored outputs. Symlinks whose targets come later in
+	// the item are written, and reported, after everything else. Files skipped
+	// because of RestoreModeMerge or a checkpoint aren't reported. Errors from
+	// the callback don't stop the restore; they're collected and returned by
+	// Restore once it finishes.
+	OnFileRestored func(path turbopath.AnchoredSystemPath) error
+	// MaxFiles, if positive, caps the number of files, directories and
+	// symlinks Restore will create, guarding against items crafted to exhaust
+	// inodes or file descriptors. The item is streamed, so Restore fails with
+	// ErrTooManyFiles when it reaches the first entry over the limit. Entries
+	// before it have already been restored, unless StagingDir is set, in
+	// which case nothing is written to the anchor.
+	MaxFiles int
+	// MaxDecompressedSize, if positive, caps the number of bytes of tar stream
+	// Restore will read, guarding against small items crafted to decompress to
+	// enough data to fill the disk. Like MaxFiles, it is enforced as the item
+	// streams, so Restore fails with ErrDecompressionBomb partway through,
+	// or before writing anything with StagingDir.
+	MaxDecompressedSize int64
+	// MaxCompressionRatio, if positive, makes Restore fail with
+	// ErrDecompressionBomb once the tar stream is more than this many times the
+	// size of the compressed data read so far. It is only checked after the
+	// first _ratioCheckFloor bytes, since small items compress unpredictably.
+	MaxCompressionRatio int
+	// Dictionaries holds the zstd dictionaries available on restore, keyed by
+	// DictionaryID. Items compressed without a dictionary don't need one.
+	Dictionaries map[uint32][]byte
+	// Manifest is populated on restore if the item includes one.
+	Manifest *Manifest
+	// CheckpointPath, if set, is where Restore records the files it has
+	// finished writing. If a restore is interrupted, restoring the same item
+	// again with the same CheckpointPath skips those files rather than
+	// rewriting them. The checkpoint is removed once a restore completes. It
+	// is intended for very large items: files skipped on resume aren't checked
+	// against what's on disk, so they must not have been changed in between.
+	CheckpointPath turbopath.AbsoluteSystemPath
+	// StagingDir, if set, makes Restore extract the item into a new directory
+	// inside it, and only move the entries into the anchor once the whole item
+	// has been read without error and BeforeCommit, if set, has accepted it.
+	// If anything fails, the anchor is left untouched, and the staging
+	// directory is removed either way. RestoreMode and OnDivergentOverwrite
+	// apply as entries are moved, so OnFileRestored sees only entries that
+	// reached the anchor. CheckpointPath is ignored, since nothing is written
+	// to the anchor before the end of the item. StagingDir should be on the
+	// same filesystem as the anchor, so that entries are renamed into place
+	// rather than copied.
+	StagingDir turbopath.AbsoluteSystemPath
+	// BeforeCommit, if set along with StagingDir, is called once the item has
+	// been extracted into the staging directory, before anything is moved
+	// into the anchor, e.g. to check a signature computed as the item was
+	// read. If it returns an error, Restore fails with it.
+	BeforeCommit func() error
+	// Umask, if non-zero, is cleared from the permissions of every file and
+	// directory Restore writes, on top of the process umask, e.g. 0o077 to keep
+	// outputs from being readable by other users. Files are chmodded after
+	// they're written, so it also applies to existing files that are
+	// overwritten. Symlinks are left alone, and it is a no-op on Windows.
+	Umask os.FileMode
+	// Fsync makes Restore flush every file it writes to stable storage, and
+	// then the directories containing them, before returning, so that other
+	// processes and a crash can't observe a partially written restore. It can
+	// make restores of many small files several times slower.
+	Fsync bool
+	// VerifyRestoreCount makes Restore check, once it finishes, that every
+	// file, directory and symlink entry in the item was written, or kept
+	// because of RestoreModeMerge, and fail with ErrIncompleteRestore if any
+	// was skipped without an error. It guards against bugs that drop entries
+	// silently, rather than against malicious items.
+	VerifyRestoreCount bool
+	// RestoreMode controls whether Restore overwrites existing files.
+	RestoreMode RestoreMode
+	// CreatedAt is when the item was created, if known. In RestoreModeMerge,
+	// existing files modified after it are kept. Open sets it from the item's
+	// modification time on disk.
+	CreatedAt time.Time
 
 	// For creation.
 	tw         *tar.Writer
@@ -33,10 +163,27 @@ type CacheItem struct {
 	fileBuffer *bufio.Writer
 	handle     interface{}
 	compressed bool
+
+	compressionThreads int
+	compressionLevel   int
+	seekable           bool
+	dictionary         []byte
+	manifest           *Manifest
+	solid              *solidBlock
 }
 
 // Close any open pipes
 func (ci *CacheItem) Close() error {
+	if ci.tw != nil {
+		if err := ci.flushSolid(); err != nil {
+			return err
+		}
+	}
+	if ci.tw != nil && ci.manifest != nil {
+		if err := ci.writeManifest(); err != nil {
+			return err
+		}
+	}
 	if ci.tw != nil {
 		if err := ci.tw.Close(); err != nil {
 			return err
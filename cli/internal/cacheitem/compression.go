@@ -0,0 +1,47 @@
+package cacheitem
+
+import (
+	"bufio"
+	"bytes"
+)
+
+// compression identifies the encoding wrapped around a cache item's tar stream.
+type compression int
+
+const (
+	compressionNone compression = iota
+	compressionZstd
+	compressionGzip
+)
+
+var (
+	_zstdMagic = []byte{0x28, 0xB5, 0x2F, 0xFD}
+	_gzipMagic = []byte{0x1F, 0x8B}
+	// _tarMagic is the "ustar" magic found at _tarMagicOffset in POSIX tar headers.
+	_tarMagic       = []byte("ustar")
+	_tarMagicOffset = 257
+)
+
+// detectCompression sniffs the leading bytes of reader to determine how the stream
+// is encoded. The peeked bytes remain available to subsequent reads. If the magic
+// bytes are not recognized, compressedHint decides between zstd and raw tar.
+func detectCompression(reader *bufio.Reader, compressedHint bool) compression {
+	// Peek returns as many bytes as are available alongside any error, which is all we need.
+	header, _ := reader.Peek(_tarMagicOffset + len(_tarMagic))
+
+	switch {
+	case bytes.HasPrefix(header, _zstdMagic):
+		return compressionZstd
+	case bytes.HasPrefix(header, _skippableFrameMagic):
+		// Only our dictionary frame is written this way, and it precedes zstd data.
+		return compressionZstd
+	case bytes.HasPrefix(header, _gzipMagic):
+		return compressionGzip
+	case len(header) == _tarMagicOffset+len(_tarMagic) && bytes.Equal(header[_tarMagicOffset:], _tarMagic):
+		return compressionNone
+	case compressedHint:
+		return compressionZstd
+	default:
+		return compressionNone
+	}
+}
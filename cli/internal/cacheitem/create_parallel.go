@@ -0,0 +1,154 @@
+package cacheitem
+
+import (
+	"io"
+	"sync"
+
+	"github.com/DataDog/zstd"
+)
+
+// _parallelChunkSize is the amount of uncompressed input handed to each
+// compression worker. Every chunk becomes its own zstd frame.
+const _parallelChunkSize = 4 << 20
+
+// parallelWriter is a zstd writer that compresses fixed-size chunks of its
+// input on multiple goroutines.
+//
+// Each chunk is emitted as an independent zstd frame, in input order. The zstd
+// format defines a stream of concatenated frames as equivalent to the
+// concatenation of their contents, so the output is still a single valid zstd
+// stream that any conforming decoder (including ours) can read.
+type parallelWriter struct {
+	underlyingWriter io.Writer
+	level            int
+	chunkSize        int
+	buffer           []byte
+	wroteChunk       bool
+
+	// seekTable, if non-nil, collects the size of every frame written so that
+	// Close can append a seek table; see newSeekableWriter.
+	seekTable *seekTable
+
+	// pending holds one result channel per in-flight chunk. Its capacity
+	// bounds the number of chunks being compressed at once.
+	pending chan chan compressedChunk
+	done    chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+type compressedChunk struct {
+	data             []byte
+	decompressedSize int
+	err              error
+}
+
+// newParallelWriter creates a writer that compresses at `level` with `threads` workers.
+func newParallelWriter(w io.Writer, threads int, level int) *parallelWriter {
+	pw := &parallelWriter{
+		underlyingWriter: w,
+		level:            level,
+		chunkSize:        _parallelChunkSize,
+		buffer:           make([]byte, 0, _parallelChunkSize),
+		pending:          make(chan chan compressedChunk, threads),
+		done:             make(chan struct{}),
+	}
+	go pw.drain()
+	return pw
+}
+
+// Write buffers p and dispatches every full chunk for compression.
+func (pw *parallelWriter) Write(p []byte) (int, error) {
+	if err := pw.getErr(); err != nil {
+		return 0, err
+	}
+
+	written := len(p)
+	for len(p) > 0 {
+		n := pw.chunkSize - len(pw.buffer)
+		if n > len(p) {
+			n = len(p)
+		}
+		pw.buffer = append(pw.buffer, p[:n]...)
+		p = p[n:]
+
+		if len(pw.buffer) == pw.chunkSize {
+			pw.dispatch()
+		}
+	}
+	return written, nil
+}
+
+// Close compresses any remaining input and waits for all frames to be written.
+func (pw *parallelWriter) Close() error {
+	// Always emit at least one frame so that empty input is a valid stream.
+	if len(pw.buffer) > 0 || !pw.wroteChunk {
+		pw.dispatch()
+	}
+	close(pw.pending)
+	<-pw.done
+	if err := pw.getErr(); err != nil {
+		return err
+	}
+	if pw.seekTable != nil {
+		_, err := pw.underlyingWriter.Write(pw.seekTable.marshal())
+		return err
+	}
+	return nil
+}
+
+// dispatch hands the current buffer off to a compression goroutine.
+//
+// It blocks once `threads` chunks are in flight, before starting to compress
+// another. Since drain only takes a chunk off pending once the previous one has
+// been written, a slow underlying writer holds up Write rather than letting
+// compressed output pile up: at most threads+1 chunks are held in memory.
+func (pw *parallelWriter) dispatch() {
+	chunk := pw.buffer
+	pw.buffer = make([]byte, 0, pw.chunkSize)
+	pw.wroteChunk = true
+
+	result := make(chan compressedChunk, 1)
+	pw.pending <- result
+	go func() {
+		data, err := zstd.CompressLevel(nil, chunk, pw.level)
+		result <- compressedChunk{data: data, decompressedSize: len(chunk), err: err}
+	}()
+}
+
+// drain writes compressed chunks to the underlying writer in input order.
+func (pw *parallelWriter) drain() {
+	defer close(pw.done)
+	for result := range pw.pending {
+		chunk := <-result
+		if pw.getErr() != nil {
+			continue
+		}
+		if chunk.err != nil {
+			pw.setErr(chunk.err)
+			continue
+		}
+		if _, err := pw.underlyingWriter.Write(chunk.data); err != nil {
+			pw.setErr(err)
+			continue
+		}
+		if pw.seekTable != nil {
+			pw.seekTable.add(len(chunk.data), chunk.decompressedSize)
+		}
+	}
+}
+
+func (pw *parallelWriter) getErr() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	return pw.err
+}
+
+func (pw *parallelWriter) setErr(err error) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if pw.err == nil {
+		pw.err = err
+	}
+}
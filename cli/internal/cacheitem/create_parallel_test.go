@@ -0,0 +1,74 @@
+package cacheitem
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DataDog/zstd"
+	"gotest.tools/v3/assert"
+)
+
+// gatedWriter blocks every write until it is opened.
+type gatedWriter struct {
+	gate    chan struct{}
+	once    sync.Once
+	written int64
+}
+
+func (gw *gatedWriter) Write(p []byte) (int, error) {
+	<-gw.gate
+	atomic.AddInt64(&gw.written, int64(len(p)))
+	return len(p), nil
+}
+
+func (gw *gatedWriter) open() {
+	gw.once.Do(func() { close(gw.gate) })
+}
+
+func TestParallelWriterBackpressure(t *testing.T) {
+	const threads = 2
+	const inputSize = 16 * _parallelChunkSize
+	input := make([]byte, inputSize)
+	rand.New(rand.NewSource(0)).Read(input)
+
+	underlying := &gatedWriter{gate: make(chan struct{})}
+	defer underlying.open()
+	pw := newParallelWriter(underlying, threads, zstd.DefaultCompression)
+
+	var accepted int64
+	done := make(chan error, 1)
+	go func() {
+		for remaining := input; len(remaining) > 0; {
+			n := 1 << 20
+			if n > len(remaining) {
+				n = len(remaining)
+			}
+			if _, err := pw.Write(remaining[:n]); err != nil {
+				done <- err
+				return
+			}
+			atomic.AddInt64(&accepted, int64(n))
+			remaining = remaining[n:]
+		}
+		done <- pw.Close()
+	}()
+
+	// While nothing can be written out, the writer must stop accepting input
+	// once a bounded number of chunks are in flight.
+	time.Sleep(200 * time.Millisecond)
+	select {
+	case err := <-done:
+		t.Fatalf("writer finished without its output being consumed: %v", err)
+	default:
+	}
+	// threads chunks queued, one held by drain, and one being buffered.
+	maxInFlight := int64((threads + 2) * _parallelChunkSize)
+	assert.Assert(t, atomic.LoadInt64(&accepted) <= maxInFlight, "accepted %v bytes with a stalled writer", accepted)
+
+	underlying.open()
+	assert.NilError(t, <-done, "Close")
+	assert.Equal(t, atomic.LoadInt64(&accepted), int64(inputSize))
+}
@@ -1,12 +1,18 @@
 package cacheitem
 
 import (
+	"bytes"
 	"encoding/hex"
+	"fmt"
+	"io"
 	"io/fs"
+	"math/rand"
 	"os"
 	"runtime"
+	"strings"
 	"testing"
 
+	"github.com/DataDog/zstd"
 	"github.com/vercel/turbo/cli/internal/turbopath"
 	"gotest.tools/v3/assert"
 )
@@ -203,3 +209,344 @@ func TestCreate(t *testing.T) {
 		t.Run(tt.name+"zst", getTestFunc(true))
 	}
 }
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// createLargeInput writes a handful of large, compressible files to anchor.
+func createLargeInput(tb testing.TB, anchor turbopath.AbsoluteSystemPath, fileCount int, fileSize int) []turbopath.AnchoredSystemPath {
+	tb.Helper()
+	words := []string{"const", "function", "return", "export", "import", "default", "module", "require", "undefined", "=>", "{", "}", "\n"}
+	random := rand.New(rand.NewSource(0))
+	files := make([]turbopath.AnchoredSystemPath, 0, fileCount)
+	for i := 0; i < fileCount; i++ {
+		contents := make([]byte, 0, fileSize)
+		for len(contents) < fileSize {
+			contents = append(contents, words[random.Intn(len(words))]...)
+			contents = append(contents, ' ')
+		}
+		file := turbopath.AnchoredSystemPath(fmt.Sprintf("file-%v.js", i))
+		if err := file.RestoreAnchor(anchor).WriteFile(contents, 0644); err != nil {
+			tb.Fatalf("WriteFile: %v", err)
+		}
+		files = append(files, file)
+	}
+	return files
+}
+
+func TestCreateWriterThreads(t *testing.T) {
+	inputDir := turbopath.AbsoluteSystemPath(t.TempDir())
+	// Large enough to span several parallel chunks.
+	files := createLargeInput(t, inputDir, 3, 5<<20)
+
+	for _, threads := range []int{0, 1, 4} {
+		t.Run(fmt.Sprintf("threads=%v", threads), func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			cacheItem := CreateWriter(nopWriteCloser{buf}, CreateOpts{CompressionThreads: threads})
+			for _, file := range files {
+				assert.NilError(t, cacheItem.AddFile(inputDir, file), "AddFile")
+			}
+			assert.NilError(t, cacheItem.Close(), "Close")
+
+			outputDir := turbopath.AbsoluteSystemPath(t.TempDir())
+			restored, err := FromReader(buf, true).Restore(outputDir)
+			assert.NilError(t, err, "Restore")
+			assert.DeepEqual(t, restored, files)
+
+			for _, file := range files {
+				want, err := file.RestoreAnchor(inputDir).ReadFile()
+				assert.NilError(t, err, "ReadFile")
+				got, err := file.RestoreAnchor(outputDir).ReadFile()
+				assert.NilError(t, err, "ReadFile")
+				assert.Assert(t, bytes.Equal(got, want), "restored contents match")
+			}
+		})
+	}
+}
+
+func BenchmarkCreateWriter(b *testing.B) {
+	inputDir := turbopath.AbsoluteSystemPath(b.TempDir())
+	files := createLargeInput(b, inputDir, 8, 8<<20)
+
+	for _, threads := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("threads=%v", threads), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				cacheItem := CreateWriter(nopWriteCloser{io.Discard}, CreateOpts{CompressionThreads: threads})
+				for _, file := range files {
+					if err := cacheItem.AddFile(inputDir, file); err != nil {
+						b.Fatalf("AddFile: %v", err)
+					}
+				}
+				if err := cacheItem.Close(); err != nil {
+					b.Fatalf("Close: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateWriterDictionary(t *testing.T) {
+	dict := []byte(`"use strict";Object.defineProperty(exports,"__esModule",{value:true});module.exports=require("./index.js");`)
+	anchor := turbopath.AbsoluteSystemPath(t.TempDir())
+	var files []turbopath.AnchoredSystemPath
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("file-%v.js", i)
+		contents := fmt.Sprintf(`"use strict";Object.defineProperty(exports,"__esModule",{value:true});module.exports=require("./file-%v.js");`, i)
+		assert.NilError(t, anchor.UntypedJoin(name).WriteFile([]byte(contents), 0644), "WriteFile")
+		files = append(files, turbopath.AnchoredSystemPath(name))
+	}
+
+	create := func(opts CreateOpts) []byte {
+		buf := &bytes.Buffer{}
+		cacheItem := CreateWriter(nopWriteCloser{buf}, opts)
+		for _, file := range files {
+			assert.NilError(t, cacheItem.AddFile(anchor, file), "AddFile")
+		}
+		assert.NilError(t, cacheItem.Close(), "Close")
+		return buf.Bytes()
+	}
+	plain := create(CreateOpts{CompressionThreads: 1})
+	withDict := create(CreateOpts{Dictionary: dict})
+
+	restored, err := FromReader(bytes.NewReader(plain), true).Restore(turbopath.AbsoluteSystemPath(t.TempDir()))
+	assert.NilError(t, err, "Restore without dictionary")
+	assert.Equal(t, len(restored), len(files))
+
+	cacheItem := FromReader(bytes.NewReader(withDict), true)
+	cacheItem.Dictionaries = map[uint32][]byte{DictionaryID(dict): dict}
+	restored, err = cacheItem.Restore(turbopath.AbsoluteSystemPath(t.TempDir()))
+	assert.NilError(t, err, "Restore with dictionary")
+	assert.Equal(t, len(restored), len(files))
+
+	_, err = FromReader(bytes.NewReader(withDict), true).Restore(turbopath.AbsoluteSystemPath(t.TempDir()))
+	assert.ErrorIs(t, err, ErrMissingDictionary)
+	assert.ErrorIs(t, err, ErrDecompressionFailed)
+}
+
+func TestCreateWriterManifest(t *testing.T) {
+	anchor := turbopath.AbsoluteSystemPath(t.TempDir())
+	assert.NilError(t, anchor.UntypedJoin("dir").MkdirAll(0755), "MkdirAll")
+	assert.NilError(t, anchor.UntypedJoin("dir", "file").WriteFile([]byte("contents"), 0644), "WriteFile")
+	assert.NilError(t, anchor.UntypedJoin("dir", "link").Symlink("file"), "Symlink")
+	files := turbopath.AnchoredUnixPathArray{"dir", "dir/file", "dir/link"}.ToSystemPathArray()
+
+	buf := &bytes.Buffer{}
+	cacheItem := CreateWriter(nopWriteCloser{buf}, CreateOpts{CompressionThreads: 1, IncludeManifest: true})
+	for _, file := range files {
+		assert.NilError(t, cacheItem.AddFile(anchor, file), "AddFile")
+	}
+	assert.NilError(t, cacheItem.Close(), "Close")
+
+	restoreAnchor := turbopath.AbsoluteSystemPath(t.TempDir())
+	restoredItem := FromReader(bytes.NewReader(buf.Bytes()), true)
+	restored, err := restoredItem.Restore(restoreAnchor)
+	assert.NilError(t, err, "Restore")
+	assert.DeepEqual(t, restored, files)
+	assert.Assert(t, !restoreAnchor.UntypedJoin(ManifestName).Exists(), "manifest is not restored to disk")
+
+	assert.DeepEqual(t, restoredItem.Manifest, &Manifest{Files: []ManifestEntry{
+		{Path: "dir/", Type: "directory"},
+		{Path: "dir/file", Type: "file", Size: 8, Digest: "d1b2a59fbea7e20077af9f91b27e95e865061b270be03ff539ab3b73587882e8"},
+		{Path: "dir/link", Type: "symlink", Linkname: "file"},
+	}})
+}
+
+func TestCreateWriterManifestNamedOutput(t *testing.T) {
+	anchor := turbopath.AbsoluteSystemPath(t.TempDir())
+	assert.NilError(t, anchor.UntypedJoin(ManifestName).WriteFile([]byte("user output"), 0644), "WriteFile")
+	files := turbopath.AnchoredUnixPathArray{ManifestName}.ToSystemPathArray()
+
+	buf := &bytes.Buffer{}
+	cacheItem := CreateWriter(nopWriteCloser{buf}, CreateOpts{CompressionThreads: 1, IncludeManifest: true})
+	assert.NilError(t, cacheItem.AddFile(anchor, files[0]), "AddFile")
+	assert.NilError(t, cacheItem.Close(), "Close")
+
+	size, err := FromReader(bytes.NewReader(buf.Bytes()), true).RestoreSize()
+	assert.NilError(t, err, "RestoreSize")
+	assert.Equal(t, size, int64(len("user output")))
+
+	// Only the member written as the manifest is skipped.
+	restoreAnchor := turbopath.AbsoluteSystemPath(t.TempDir())
+	restoredItem := FromReader(bytes.NewReader(buf.Bytes()), true)
+	restored, err := restoredItem.Restore(restoreAnchor)
+	assert.NilError(t, err, "Restore")
+	assert.DeepEqual(t, restored, files)
+	contents, err := restoreAnchor.UntypedJoin(ManifestName).ReadFile()
+	assert.NilError(t, err, "ReadFile")
+	assert.Equal(t, string(contents), "user output")
+	assert.Equal(t, len(restoredItem.Manifest.Files), 1)
+}
+
+func TestCreateWriterEmptyDirectory(t *testing.T) {
+	anchor := turbopath.AbsoluteSystemPath(t.TempDir())
+	assert.NilError(t, anchor.UntypedJoin("dist", "logs").MkdirAll(0755), "MkdirAll")
+	assert.NilError(t, anchor.UntypedJoin("dist", "index.js").WriteFile([]byte("contents"), 0644), "WriteFile")
+	files := turbopath.AnchoredUnixPathArray{"dist", "dist/index.js", "dist/logs"}.ToSystemPathArray()
+
+	buf := &bytes.Buffer{}
+	cacheItem := CreateWriter(nopWriteCloser{buf}, CreateOpts{})
+	for _, file := range files {
+		assert.NilError(t, cacheItem.AddFile(anchor, file), "AddFile")
+	}
+	assert.NilError(t, cacheItem.Close(), "Close")
+
+	restoreAnchor := turbopath.AbsoluteSystemPath(t.TempDir())
+	restored, err := FromReader(bytes.NewReader(buf.Bytes()), true).Restore(restoreAnchor)
+	assert.NilError(t, err, "Restore")
+	assert.DeepEqual(t, restored, files)
+	assert.Assert(t, restoreAnchor.UntypedJoin("dist", "logs").DirExists(), "empty directory was restored")
+}
+
+func TestCreateWriterManifestHashAlgorithm(t *testing.T) {
+	anchor := turbopath.AbsoluteSystemPath(t.TempDir())
+	assert.NilError(t, anchor.UntypedJoin("file").WriteFile([]byte("contents"), 0644), "WriteFile")
+	assert.NilError(t, anchor.UntypedJoin("empty").WriteFile(nil, 0644), "WriteFile")
+	files := turbopath.AnchoredUnixPathArray{"empty", "file"}.ToSystemPathArray()
+
+	for _, algorithm := range []string{"sha1", "sha256", "sha512", "xxhash"} {
+		t.Run(algorithm, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			cacheItem := CreateWriter(nopWriteCloser{buf}, CreateOpts{IncludeManifest: true, ManifestHashAlgorithm: algorithm})
+			for _, file := range files {
+				assert.NilError(t, cacheItem.AddFile(anchor, file), "AddFile")
+			}
+			assert.NilError(t, cacheItem.Close(), "Close")
+
+			restoredItem := FromReader(bytes.NewReader(buf.Bytes()), true)
+			_, err := restoredItem.Restore(turbopath.AbsoluteSystemPath(t.TempDir()))
+			assert.NilError(t, err, "Restore")
+			manifest := restoredItem.Manifest
+			assert.Equal(t, manifest.Algorithm, algorithm)
+			assert.NilError(t, manifest.Verify(manifest.Files[0], bytes.NewReader(nil)), "Verify")
+			assert.NilError(t, manifest.Verify(manifest.Files[1], strings.NewReader("contents")), "Verify")
+			assert.ErrorIs(t, manifest.Verify(manifest.Files[1], strings.NewReader("CONTENTS")), ErrDigestMismatch)
+		})
+	}
+
+	cacheItem := CreateWriter(nopWriteCloser{&bytes.Buffer{}}, CreateOpts{IncludeManifest: true, ManifestHashAlgorithm: "md4"})
+	assert.ErrorIs(t, cacheItem.AddFile(anchor, "file"), ErrUnknownHashAlgorithm)
+	_ = cacheItem.Close()
+
+	unknown := &Manifest{Algorithm: "md4"}
+	assert.ErrorIs(t, unknown.Verify(ManifestEntry{}, strings.NewReader("")), ErrUnknownHashAlgorithm)
+}
+
+func TestCreateWriterSeekable(t *testing.T) {
+	inputDir := turbopath.AbsoluteSystemPath(t.TempDir())
+	files := createLargeInput(t, inputDir, 3, _seekableFrameSize)
+
+	create := func(opts CreateOpts) []byte {
+		buf := &bytes.Buffer{}
+		cacheItem := CreateWriter(nopWriteCloser{buf}, opts)
+		for _, file := range files {
+			assert.NilError(t, cacheItem.AddFile(inputDir, file), "AddFile")
+		}
+		assert.NilError(t, cacheItem.Close(), "Close")
+		return buf.Bytes()
+	}
+	seekable := create(CreateOpts{CompressionThreads: 2, SeekableCompression: true})
+
+	// Seekable items restore like any other.
+	outputDir := turbopath.AbsoluteSystemPath(t.TempDir())
+	restored, err := FromReader(bytes.NewReader(seekable), true).Restore(outputDir)
+	assert.NilError(t, err, "Restore")
+	assert.DeepEqual(t, restored, files)
+
+	tarStream, err := io.ReadAll(zstd.NewReader(bytes.NewReader(seekable)))
+	assert.NilError(t, err, "ReadAll")
+	reader, err := OpenSeekable(bytes.NewReader(seekable), int64(len(seekable)))
+	assert.NilError(t, err, "OpenSeekable")
+	assert.Assert(t, len(reader.table.entries) > 3)
+
+	// A range spanning a frame boundary, and one running past the end.
+	got, err := reader.ReadRange(_seekableFrameSize-100, 200)
+	assert.NilError(t, err, "ReadRange")
+	assert.Assert(t, bytes.Equal(got, tarStream[_seekableFrameSize-100:_seekableFrameSize+100]))
+	got, err = reader.ReadRange(int64(len(tarStream)-10), 100)
+	assert.NilError(t, err, "ReadRange")
+	assert.Assert(t, bytes.Equal(got, tarStream[len(tarStream)-10:]))
+
+	plain := create(CreateOpts{CompressionThreads: 2})
+	_, err = OpenSeekable(bytes.NewReader(plain), int64(len(plain)))
+	assert.ErrorIs(t, err, ErrNotSeekable)
+}
+
+func TestCreateWriterSolid(t *testing.T) {
+	anchor := turbopath.AbsoluteSystemPath(t.TempDir())
+	assert.NilError(t, anchor.UntypedJoin("pkg").MkdirAll(0755), "MkdirAll")
+	files := turbopath.AnchoredUnixPathArray{"pkg"}.ToSystemPathArray()
+	for i := 0; i < 500; i++ {
+		name := fmt.Sprintf("pkg/file-%v.js", i)
+		assert.NilError(t, anchor.UntypedJoin(name).WriteFile([]byte(fmt.Sprintf("module.exports = %v;\n", i)), 0644), "WriteFile")
+		files = append(files, turbopath.AnchoredUnixPath(name).ToSystemPath())
+	}
+	assert.NilError(t, anchor.UntypedJoin("pkg", "run.sh").WriteFile([]byte("#!/bin/sh"), 0755), "WriteFile")
+	assert.NilError(t, anchor.UntypedJoin("pkg", "large").WriteFile(bytes.Repeat([]byte("x"), _solidMaxFileSize+1), 0644), "WriteFile")
+	assert.NilError(t, anchor.UntypedJoin("pkg", "link").Symlink("file-0.js"), "Symlink")
+	files = append(files, turbopath.AnchoredUnixPathArray{"pkg/run.sh", "pkg/large", "pkg/link"}.ToSystemPathArray()...)
+
+	create := func(opts CreateOpts) []byte {
+		buf := &bytes.Buffer{}
+		cacheItem := CreateWriter(nopWriteCloser{buf}, opts)
+		for _, file := range files {
+			assert.NilError(t, cacheItem.AddFile(anchor, file), "AddFile")
+		}
+		assert.NilError(t, cacheItem.Close(), "Close")
+		return buf.Bytes()
+	}
+	solid := create(CreateOpts{SolidCompression: true, IncludeManifest: true})
+	plain := create(CreateOpts{IncludeManifest: true})
+	assert.Assert(t, len(solid) < len(plain), "solid %v bytes, plain %v bytes", len(solid), len(plain))
+
+	restoreAnchor := turbopath.AbsoluteSystemPath(t.TempDir())
+	restoredItem := FromReader(bytes.NewReader(solid), true)
+	restored, err := restoredItem.Restore(restoreAnchor)
+	assert.NilError(t, err, "Restore")
+	assert.Equal(t, len(restored), len(files))
+	assert.Equal(t, len(restoredItem.Manifest.Files), len(files))
+	assert.Assert(t, !restoreAnchor.UntypedJoin(_solidBlockName).Exists(), "solid blocks are not restored to disk")
+
+	for _, file := range files {
+		want, err := os.Readlink(file.RestoreAnchor(anchor).ToString())
+		if err == nil {
+			got, err := os.Readlink(file.RestoreAnchor(restoreAnchor).ToString())
+			assert.NilError(t, err, "Readlink")
+			assert.Equal(t, got, want)
+			continue
+		}
+		wantInfo, err := file.RestoreAnchor(anchor).Lstat()
+		assert.NilError(t, err, "Lstat")
+		gotInfo, err := file.RestoreAnchor(restoreAnchor).Lstat()
+		assert.NilError(t, err, "Lstat")
+		assert.Equal(t, gotInfo.Mode(), wantInfo.Mode(), file)
+		if wantInfo.Mode().IsRegular() {
+			wantContents, _ := file.RestoreAnchor(anchor).ReadFile()
+			gotContents, _ := file.RestoreAnchor(restoreAnchor).ReadFile()
+			assert.Assert(t, bytes.Equal(gotContents, wantContents), file)
+		}
+	}
+}
+
+func TestRestoreSolidMaxFiles(t *testing.T) {
+	anchor := turbopath.AbsoluteSystemPath(t.TempDir())
+	var files []turbopath.AnchoredSystemPath
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("file-%v", i)
+		assert.NilError(t, anchor.UntypedJoin(name).WriteFile([]byte(name), 0644), "WriteFile")
+		files = append(files, turbopath.AnchoredSystemPath(name))
+	}
+	buf := &bytes.Buffer{}
+	cacheItem := CreateWriter(nopWriteCloser{buf}, CreateOpts{SolidCompression: true})
+	for _, file := range files {
+		assert.NilError(t, cacheItem.AddFile(anchor, file), "AddFile")
+	}
+	assert.NilError(t, cacheItem.Close(), "Close")
+
+	restoredItem := FromReader(bytes.NewReader(buf.Bytes()), true)
+	restoredItem.MaxFiles = 5
+	_, err := restoredItem.Restore(turbopath.AbsoluteSystemPath(t.TempDir()))
+	assert.ErrorIs(t, err, ErrTooManyFiles)
+}
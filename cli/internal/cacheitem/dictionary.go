@@ -0,0 +1,55 @@
+package cacheitem
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// ErrMissingDictionary is returned when a CacheItem was compressed with a
+// dictionary that was not supplied on restore.
+var ErrMissingDictionary = errors.New("cache item requires a compression dictionary that is not available")
+
+// Cache items compressed with a dictionary start with a zstd skippable frame
+// recording which dictionary was used. Decoders skip these frames, so the
+// stream remains valid zstd; we peek at it to pick the dictionary on restore.
+//
+//	magic (4 bytes LE) | payload size (4 bytes LE) | "tdic" | dictionary id (4 bytes LE)
+var (
+	_skippableFrameMagic = []byte{0x5E, 0x2A, 0x4D, 0x18}
+	_dictionaryFrameTag  = []byte("tdic")
+)
+
+const _dictionaryFrameSize = 16
+
+// DictionaryID returns the identifier recorded in cache items compressed with dict.
+func DictionaryID(dict []byte) uint32 {
+	return crc32.ChecksumIEEE(dict)
+}
+
+// writeDictionaryFrame records the dictionary used to compress the rest of the stream.
+func writeDictionaryFrame(w io.Writer, dict []byte) error {
+	frame := make([]byte, _dictionaryFrameSize)
+	copy(frame[0:4], _skippableFrameMagic)
+	binary.LittleEndian.PutUint32(frame[4:8], _dictionaryFrameSize-8)
+	copy(frame[8:12], _dictionaryFrameTag)
+	binary.LittleEndian.PutUint32(frame[12:16], DictionaryID(dict))
+	_, err := w.Write(frame)
+	return err
+}
+
+// peekDictionaryID returns the dictionary id recorded at the start of reader, if any.
+// The peeked bytes remain available to subsequent reads.
+func peekDictionaryID(reader *bufio.Reader) (uint32, bool) {
+	frame, err := reader.Peek(_dictionaryFrameSize)
+	if err != nil {
+		return 0, false
+	}
+	if !bytes.HasPrefix(frame, _skippableFrameMagic) || !bytes.Equal(frame[8:12], _dictionaryFrameTag) {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(frame[12:]), true
+}
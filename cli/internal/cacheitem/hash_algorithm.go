@@ -0,0 +1,42 @@
+package cacheitem
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+
+	"github.com/vercel/turbo/cli/internal/xxhash"
+)
+
+// DefaultHashAlgorithm is the algorithm used for manifest digests when none is
+// specified, and assumed for manifests that don't name one.
+const DefaultHashAlgorithm = "sha256"
+
+// ErrUnknownHashAlgorithm is returned when asked for a digest algorithm that
+// isn't in the registry.
+var ErrUnknownHashAlgorithm = errors.New("unknown hash algorithm")
+
+// _hashAlgorithms maps the names of the supported digest algorithms to their
+// constructors.
+var _hashAlgorithms = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+	"xxhash": func() hash.Hash { return xxhash.New() },
+}
+
+// NewHasher returns a hash.Hash for the named algorithm, or DefaultHashAlgorithm
+// if name is empty.
+func NewHasher(name string) (hash.Hash, error) {
+	if name == "" {
+		name = DefaultHashAlgorithm
+	}
+	newHash, ok := _hashAlgorithms[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownHashAlgorithm, name)
+	}
+	return newHash(), nil
+}
@@ -0,0 +1,101 @@
+package cacheitem
+
+import (
+	"archive/tar"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ManifestName is the name of the tar member holding a CacheItem's manifest.
+// It is never restored to disk.
+const ManifestName = ".turbo-manifest.json"
+
+// _paxManifestRecord is the PAX record that marks the manifest member, so
+// that a cached output that happens to be named ManifestName is still
+// restored.
+const _paxManifestRecord = "TURBO.manifest"
+
+// isManifest reports whether header is the manifest written by writeManifest.
+func isManifest(header *tar.Header) bool {
+	return header.Name == ManifestName && header.PAXRecords[_paxManifestRecord] == "1"
+}
+
+// Manifest lists the contents of a CacheItem, so tooling can answer "what is
+// in this cache entry" without restoring it.
+type Manifest struct {
+	// Algorithm names the algorithm used for digests. Empty means
+	// DefaultHashAlgorithm, as in manifests written before it was recorded.
+	Algorithm string          `json:"algorithm,omitempty"`
+	Files     []ManifestEntry `json:"files"`
+}
+
+// ErrDigestMismatch is returned by Verify when contents don't match the digest
+// recorded in the manifest.
+var ErrDigestMismatch = errors.New("contents do not match manifest digest")
+
+// Verify checks that contents match the digest recorded for entry, using the
+// manifest's algorithm.
+func (m *Manifest) Verify(entry ManifestEntry, contents io.Reader) error {
+	hasher, err := NewHasher(m.Algorithm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(hasher, contents); err != nil {
+		return err
+	}
+	if hex.EncodeToString(hasher.Sum(nil)) != entry.Digest {
+		return fmt.Errorf("%w: %v", ErrDigestMismatch, entry.Path)
+	}
+	return nil
+}
+
+// ManifestEntry describes a single file in a CacheItem.
+type ManifestEntry struct {
+	Path string `json:"path"`
+	// Type is one of "file", "directory", or "symlink".
+	Type string `json:"type"`
+	// Size and Digest (hex-encoded, using Manifest.Algorithm) are only set for
+	// regular files.
+	Size     int64  `json:"size,omitempty"`
+	Digest   string `json:"digest,omitempty"`
+	Linkname string `json:"linkname,omitempty"`
+}
+
+// manifestEntryType maps a tar type flag to a ManifestEntry type.
+func manifestEntryType(typeflag byte) string {
+	switch typeflag {
+	case tar.TypeDir:
+		return "directory"
+	case tar.TypeSymlink:
+		return "symlink"
+	default:
+		return "file"
+	}
+}
+
+// writeManifest appends the manifest to the tar as its final member.
+func (ci *CacheItem) writeManifest() error {
+	contents, err := json.Marshal(ci.manifest)
+	if err != nil {
+		return err
+	}
+	header := &tar.Header{
+		Name:       ManifestName,
+		Typeflag:   tar.TypeReg,
+		Mode:       0644,
+		Size:       int64(len(contents)),
+		AccessTime: time.Unix(0, 0),
+		ModTime:    time.Unix(0, 0),
+		ChangeTime: time.Unix(0, 0),
+		PAXRecords: map[string]string{_paxManifestRecord: "1"},
+	}
+	if err := ci.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = ci.tw.Write(contents)
+	return err
+}
@@ -2,19 +2,27 @@ package cacheitem
 
 import (
 	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"runtime"
 	"strings"
 
 	"github.com/DataDog/zstd"
+	"github.com/hashicorp/go-multierror"
 
 	"github.com/moby/sys/sequential"
 	"github.com/vercel/turbo/cli/internal/turbopath"
 )
 
-// FromReader returns an existing CacheItem at the specified path.
+// FromReader returns an existing CacheItem backed by the specified reader.
+// The compression format is detected from the stream's magic bytes; compressed
+// is only used as a hint when the format can't be determined.
 func FromReader(reader io.Reader, compressed bool) *CacheItem {
 	return &CacheItem{
 		handle:     reader,
@@ -29,36 +37,94 @@ func Open(path turbopath.AbsoluteSystemPath) (*CacheItem, error) {
 		return nil, err
 	}
 
-	return &CacheItem{
+	cacheItem := &CacheItem{
 		Path:       path,
 		handle:     handle,
 		compressed: strings.HasSuffix(path.ToString(), ".zst"),
-	}, nil
+	}
+	if info, err := handle.Stat(); err == nil {
+		cacheItem.CreatedAt = info.ModTime()
+	}
+	return cacheItem, nil
 }
 
 // Restore extracts a cache to a specified disk location.
 func (ci *CacheItem) Restore(anchor turbopath.AbsoluteSystemPath) ([]turbopath.AnchoredSystemPath, error) {
-	var tr *tar.Reader
-	var closeError error
+	var callbackErrs []error
+	var restored []turbopath.AnchoredSystemPath
+	var err error
+	if ci.StagingDir != "" {
+		restored, err = ci.restoreStaged(anchor, &callbackErrs)
+	} else {
+		restored, err = ci.restore(anchor, &callbackErrs)
+	}
+	if len(callbackErrs) > 0 {
+		return restored, multierror.Append(err, callbackErrs...)
+	}
+	return restored, err
+}
 
-	reader, isReader := ci.handle.(io.Reader)
-	if !isReader {
-		panic("can't read from this cache item")
+// RestoreSize returns how many bytes of file contents restoring the item would
+// write, from the sizes declared in its tar headers. It reads through the item
+// without writing anything, so the item can't be restored afterwards.
+func (ci *CacheItem) RestoreSize() (int64, error) {
+	entries, err := ci.Entries()
+	if err != nil {
+		return 0, err
 	}
+	var size int64
+	for _, entry := range entries {
+		if entry.Typeflag == tar.TypeReg {
+			size += entry.Size
+		}
+	}
+	return size, nil
+}
 
-	// We're reading a tar, possibly wrapped in zstd.
-	if ci.compressed {
-		zr := zstd.NewReader(reader)
+// Entries returns the headers of the entries restoring the item would write,
+// including the members of solid blocks, e.g. to check what an artifact holds
+// before uploading it. Like RestoreSize, it reads through the item without
+// writing anything, so the item can't be restored afterwards.
+func (ci *CacheItem) Entries() ([]*tar.Header, error) {
+	tr, closeTar, err := ci.tarReader()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = closeTar() }()
 
-		// The `Close` function for compression effectively just returns the singular
-		// error field on the decompressor instance. This is extremely unlikely to be
-		// set without triggering one of the numerous other errors, but we should still
-		// handle that possible edge case.
-		defer func() { closeError = zr.Close() }()
-		tr = tar.NewReader(zr)
-	} else {
-		tr = tar.NewReader(reader)
+	var entries []*tar.Header
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, archiveError(err)
+		}
+		switch {
+		case isManifest(header):
+			// Not restored to disk.
+		case header.Typeflag == _typeSolidBlock:
+			members, _, err := readSolidBlock(header, tr)
+			if err != nil {
+				return nil, archiveError(err)
+			}
+			entries = append(entries, members...)
+		default:
+			entries = append(entries, header)
+		}
 	}
+}
+
+// restore does the work of Restore, collecting errors from OnFileRestored in
+// callbackErrs.
+func (ci *CacheItem) restore(anchor turbopath.AbsoluteSystemPath, callbackErrs *[]error) ([]turbopath.AnchoredSystemPath, error) {
+	var closeError error
+	tr, closeTar, err := ci.tarReader()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { closeError = closeTar() }()
 
 	// On first attempt to restore it's possible that a link target doesn't exist.
 	// Save them and topsort them.
@@ -71,6 +137,15 @@ func (ci *CacheItem) Restore(anchor turbopath.AbsoluteSystemPath) ([]turbopath.A
 		return nil, restorePointErr
 	}
 
+	var checkpoint *restoreCheckpoint
+	if ci.CheckpointPath != "" {
+		var err error
+		if checkpoint, err = openCheckpoint(ci.CheckpointPath); err != nil {
+			return nil, err
+		}
+		defer checkpoint.close()
+	}
+
 	// We're going to make the following two assumptions here for "fast" path restoration:
 	// - All directories are enumerated in the `tar`.
 	// - The contents of the tar are enumerated depth-first.
@@ -87,12 +162,89 @@ func (ci *CacheItem) Restore(anchor turbopath.AbsoluteSystemPath) ([]turbopath.A
 		anchorAtDepth: []turbopath.AbsoluteSystemPath{anchor},
 	}
 
+	// Directories may legitimately be listed more than once, so only files and
+	// symlinks are tracked for OnDuplicateEntry and RejectDuplicateEntries.
+	seen := make(map[turbopath.AnchoredSystemPath]bool)
+	entries := 0
+	// kept counts entries not written because of RestoreModeMerge, for
+	// VerifyRestoreCount.
+	kept := 0
+
+	// restoreOne restores a single file, directory or symlink, reading a
+	// file's contents from body.
+	restoreOne := func(header *tar.Header, body io.Reader) error {
+		entries++
+		if ci.MaxFiles > 0 && entries > ci.MaxFiles {
+			return fmt.Errorf("%w: more than %v entries", ErrTooManyFiles, ci.MaxFiles)
+		}
+
+		if header.Typeflag != tar.TypeDir && (ci.RejectDuplicateEntries || ci.OnDuplicateEntry != nil) {
+			// Malformed names are rejected by restoreEntry below.
+			if name, err := canonicalizeName(header.Name); err == nil {
+				if seen[name] {
+					if ci.RejectDuplicateEntries {
+						return fmt.Errorf("%w: %v", ErrDuplicateEntry, name)
+					}
+					if ci.OnDuplicateEntry != nil {
+						ci.OnDuplicateEntry(name)
+					}
+				}
+				seen[name] = true
+			}
+		}
+
+		if checkpoint != nil && header.Typeflag == tar.TypeReg && checkpoint.isDone(header.Name) {
+			file, err := canonicalizeName(header.Name)
+			if err != nil {
+				return archiveError(err)
+			}
+			restored = append(restored, file)
+			return nil
+		}
+
+		// Attempt to place the file on disk.
+		file, restoreErr := restoreEntry(dirCache, anchor, header, body, ci.OnDivergentOverwrite, ci.keepExisting(), ci.Fsync)
+		if restoreErr != nil {
+			if errors.Is(restoreErr, errKeptExisting) {
+				kept++
+				return nil
+			}
+			if errors.Is(restoreErr, errMissingSymlinkTarget) {
+				// Links get one shot to be valid, then they're accumulated, DAG'd, and restored on delay.
+				symlinks = append(symlinks, header)
+				return nil
+			}
+			return archiveError(restoreErr)
+		}
+		if ci.Umask != 0 && header.Typeflag != tar.TypeSymlink && runtime.GOOS != "windows" {
+			if err := ci.applyUmask(file.RestoreAnchor(anchor)); err != nil {
+				return err
+			}
+		}
+		if ci.PreserveXattrs && header.Typeflag != tar.TypeSymlink {
+			if err := writeXattrs(file.RestoreAnchor(anchor), header.PAXRecords); err != nil {
+				return err
+			}
+		}
+		if checkpoint != nil && header.Typeflag == tar.TypeReg {
+			if err := checkpoint.record(header.Name); err != nil {
+				return err
+			}
+		}
+		restored = append(restored, file)
+		ci.fileRestored(file, callbackErrs)
+		return nil
+	}
+
 	for {
 		header, trErr := tr.Next()
 		if trErr == io.EOF {
 			// The end, time to restore any missing links.
 			symlinksRestored, symlinksErr := topologicallyRestoreSymlinks(dirCache, anchor, symlinks, tr)
 			restored = append(restored, symlinksRestored...)
+			for _, symlink := range symlinksRestored {
+				ci.fileRestored(symlink, callbackErrs)
+			}
 			if symlinksErr != nil {
 				return restored, symlinksErr
 			}
@@ -100,30 +252,249 @@ func (ci *CacheItem) Restore(anchor turbopath.AbsoluteSystemPath) ([]turbopath.A
 			break
 		}
 		if trErr != nil {
-			return restored, trErr
+			return restored, archiveError(trErr)
 		}
 
 		// The reader will not advance until tr.Next is called.
 		// We can treat this as file metadata + body reader.
 
-		// Attempt to place the file on disk.
-		file, restoreErr := restoreEntry(dirCache, anchor, header, tr)
-		if restoreErr != nil {
-			if errors.Is(restoreErr, errMissingSymlinkTarget) {
-				// Links get one shot to be valid, then they're accumulated, DAG'd, and restored on delay.
-				symlinks = append(symlinks, header)
-				continue
+		if isManifest(header) {
+			manifest := &Manifest{}
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				return restored, archiveError(fmt.Errorf("invalid manifest: %w", err))
 			}
-			return restored, restoreErr
+			ci.Manifest = manifest
+			continue
+		}
+
+		if header.Typeflag == _typeSolidBlock {
+			headers, contents, err := readSolidBlock(header, tr)
+			if err != nil {
+				return restored, archiveError(err)
+			}
+			for i, member := range headers {
+				if err := restoreOne(member, bytes.NewReader(contents[i])); err != nil {
+					return restored, err
+				}
+			}
+			continue
+		}
+		if err := restoreOne(header, tr); err != nil {
+			return restored, err
 		}
-		restored = append(restored, file)
 	}
 
+	if ci.VerifyRestoreCount && len(restored)+kept != entries {
+		return restored, fmt.Errorf("%w: wrote %v of %v entries", ErrIncompleteRestore, len(restored)+kept, entries)
+	}
+	if ci.Fsync {
+		if err := syncDirs(anchor, restored); err != nil {
+			return restored, err
+		}
+	}
+	if checkpoint != nil {
+		if err := checkpoint.remove(); err != nil {
+			return restored, err
+		}
+	}
 	return restored, closeError
 }
 
+// tarReader returns a reader for the tar in the item, decompressing it if
+// needed, and a function to close the decompressor.
+func (ci *CacheItem) tarReader() (*tar.Reader, func() error, error) {
+	reader, isReader := ci.handle.(io.Reader)
+	if !isReader {
+		panic("can't read from this cache item")
+	}
+
+	// We're reading a tar, possibly wrapped in zstd or gzip. Rather than trusting
+	// the caller, sniff the magic bytes to pick the right decoder.
+	compressedBytes := &byteCounter{reader: reader}
+	bufferedReader := bufio.NewReader(compressedBytes)
+	switch detectCompression(bufferedReader, ci.compressed) {
+	case compressionZstd:
+		var zr io.ReadCloser
+		if id, ok := peekDictionaryID(bufferedReader); ok {
+			dict, ok := ci.Dictionaries[id]
+			if !ok {
+				return nil, nil, &decompressionError{err: fmt.Errorf("%w (id %v)", ErrMissingDictionary, id)}
+			}
+			// The skippable frame is valid zstd, but consume it ourselves rather
+			// than rely on the streaming decoder handling it.
+			if _, err := bufferedReader.Discard(_dictionaryFrameSize); err != nil {
+				return nil, nil, &decompressionError{err: err}
+			}
+			zr = zstd.NewReaderDict(bufferedReader, dict)
+		} else {
+			zr = zstd.NewReader(bufferedReader)
+		}
+
+		// The `Close` function for compression effectively just returns the singular
+		// error field on the decompressor instance. This is extremely unlikely to be
+		// set without triggering one of the numerous other errors, but we should still
+		// handle that possible edge case.
+		return tar.NewReader(ci.limitReader(&decompressionReader{reader: zr}, compressedBytes)), zr.Close, nil
+	case compressionGzip:
+		gr, gzipErr := gzip.NewReader(bufferedReader)
+		if gzipErr != nil {
+			return nil, nil, &decompressionError{err: gzipErr}
+		}
+		return tar.NewReader(ci.limitReader(&decompressionReader{reader: gr}, compressedBytes)), gr.Close, nil
+	default:
+		return tar.NewReader(ci.limitReader(bufferedReader, nil)), func() error { return nil }, nil
+	}
+}
+
+// decompressionReader tags every error coming out of the decompressor so that
+// it can be distinguished from errors in the tar stream it contains.
+type decompressionReader struct {
+	reader io.Reader
+}
+
+func (dr *decompressionReader) Read(p []byte) (int, error) {
+	n, err := dr.reader.Read(p)
+	if err != nil && err != io.EOF {
+		err = &decompressionError{err: err}
+	}
+	return n, err
+}
+
+type decompressionError struct {
+	err error
+}
+
+func (de *decompressionError) Error() string {
+	return ErrDecompressionFailed.Error() + ": " + de.err.Error()
+}
+
+func (de *decompressionError) Unwrap() error {
+	return de.err
+}
+
+func (de *decompressionError) Is(target error) bool {
+	return target == ErrDecompressionFailed
+}
+
+// syncDirs flushes the directories containing files to stable storage, so that
+// the entries for newly created files survive a crash. Directories can't be
+// synced on Windows, where this is a no-op.
+func syncDirs(anchor turbopath.AbsoluteSystemPath, files []turbopath.AnchoredSystemPath) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	dirs := make(map[turbopath.AbsoluteSystemPath]bool)
+	for _, file := range files {
+		dirs[file.RestoreAnchor(anchor).Dir()] = true
+	}
+	for dir := range dirs {
+		d, err := dir.Open()
+		if err != nil {
+			return err
+		}
+		err = d.Sync()
+		_ = d.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileRestored calls OnFileRestored, if set, collecting its error.
+func (ci *CacheItem) fileRestored(file turbopath.AnchoredSystemPath, callbackErrs *[]error) {
+	if ci.OnFileRestored == nil {
+		return
+	}
+	if err := ci.OnFileRestored(file); err != nil {
+		*callbackErrs = append(*callbackErrs, fmt.Errorf("%v: %w", file, err))
+	}
+}
+
+// _ratioCheckFloor is how much of the tar stream is read before
+// CacheItem.MaxCompressionRatio is enforced. Headers and small files compress
+// unpredictably, so the ratio means little before then.
+const _ratioCheckFloor = 1 << 20
+
+// byteCounter counts the bytes read through it.
+type byteCounter struct {
+	reader io.Reader
+	n      int64
+}
+
+func (bc *byteCounter) Read(p []byte) (int, error) {
+	n, err := bc.reader.Read(p)
+	bc.n += int64(n)
+	return n, err
+}
+
+// limitReader returns reader, wrapped to enforce MaxDecompressedSize and
+// MaxCompressionRatio if either is set. compressed counts the bytes read from
+// the underlying item, or is nil if the item isn't compressed.
+func (ci *CacheItem) limitReader(reader io.Reader, compressed *byteCounter) io.Reader {
+	if ci.MaxDecompressedSize <= 0 && (ci.MaxCompressionRatio <= 0 || compressed == nil) {
+		return reader
+	}
+	return &bombReader{
+		reader:     reader,
+		compressed: compressed,
+		maxSize:    ci.MaxDecompressedSize,
+		maxRatio:   int64(ci.MaxCompressionRatio),
+	}
+}
+
+// bombReader tracks the running total of decompressed bytes and fails with
+// ErrDecompressionBomb once a limit is crossed.
+type bombReader struct {
+	reader       io.Reader
+	compressed   *byteCounter
+	decompressed int64
+	maxSize      int64
+	maxRatio     int64
+}
+
+func (br *bombReader) Read(p []byte) (int, error) {
+	n, err := br.reader.Read(p)
+	br.decompressed += int64(n)
+	if br.maxSize > 0 && br.decompressed > br.maxSize {
+		return n, fmt.Errorf("%w: more than %v bytes", ErrDecompressionBomb, br.maxSize)
+	}
+	if br.maxRatio > 0 && br.compressed != nil && br.decompressed > _ratioCheckFloor && br.decompressed > br.compressed.n*br.maxRatio {
+		return n, fmt.Errorf("%w: expands more than %v times", ErrDecompressionBomb, br.maxRatio)
+	}
+	return n, err
+}
+
+// archiveError classifies an error encountered while reading the tar stream.
+// Decompression errors pass through unchanged, tar parsing errors are wrapped
+// in ErrMalformedArchive, and anything else (e.g. filesystem errors) is left alone.
+func archiveError(err error) error {
+	if errors.Is(err, ErrDecompressionFailed) {
+		return err
+	}
+	if errors.Is(err, tar.ErrHeader) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: %v", ErrMalformedArchive, err)
+	}
+	return err
+}
+
+// keepExisting returns a predicate reporting whether the file at a path should
+// be kept rather than overwritten, or nil if every file is overwritten.
+func (ci *CacheItem) keepExisting() func(turbopath.AbsoluteSystemPath) bool {
+	if ci.RestoreMode != RestoreModeMerge {
+		return nil
+	}
+	return func(path turbopath.AbsoluteSystemPath) bool {
+		info, err := path.Lstat()
+		if err != nil || !info.Mode().IsRegular() {
+			return false
+		}
+		return ci.CreatedAt.IsZero() || !info.ModTime().Before(ci.CreatedAt)
+	}
+}
+
 // restoreRegular is the entry point for all things read from the tar.
-func restoreEntry(dirCache *cachedDirTree, anchor turbopath.AbsoluteSystemPath, header *tar.Header, reader *tar.Reader) (turbopath.AnchoredSystemPath, error) {
+func restoreEntry(dirCache *cachedDirTree, anchor turbopath.AbsoluteSystemPath, header *tar.Header, reader io.Reader, onDivergent func(turbopath.AnchoredSystemPath), keepExisting func(turbopath.AbsoluteSystemPath) bool, fsync bool) (turbopath.AnchoredSystemPath, error) {
 	// We're permissive on creation, but restrictive on restoration.
 	// There is no need to prevent the cache creation in any case.
 	// And on restoration, if we fail, we simply run the task.
@@ -131,7 +502,7 @@ func restoreEntry(dirCache *cachedDirTree, anchor turbopath.AbsoluteSystemPath,
 	case tar.TypeDir:
 		return restoreDirectory(dirCache, anchor, header)
 	case tar.TypeReg:
-		return restoreRegular(dirCache, anchor, header, reader)
+		return restoreRegular(dirCache, anchor, header, reader, onDivergent, keepExisting, fsync)
 	case tar.TypeSymlink:
 		return restoreSymlink(dirCache, anchor, header)
 	default:
@@ -211,3 +582,13 @@ func checkName(name string) (bool, bool) {
 
 	return wellFormed, windowsSafe
 }
+
+// applyUmask clears Umask from the permissions of the entry at path, keeping
+// whatever the process umask already cleared.
+func (ci *CacheItem) applyUmask(path turbopath.AbsoluteSystemPath) error {
+	info, err := path.Lstat()
+	if err != nil {
+		return err
+	}
+	return os.Chmod(path.ToString(), info.Mode().Perm()&^ci.Umask)
+}
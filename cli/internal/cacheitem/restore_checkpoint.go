@@ -0,0 +1,62 @@
+package cacheitem
+
+import (
+	"bufio"
+	"os"
+
+	"github.com/vercel/turbo/cli/internal/turbopath"
+)
+
+// restoreCheckpoint records the regular files a restore has finished writing,
+// so that a restore that is interrupted can be resumed without rewriting them.
+// The checkpoint is a list of tar entry names, one per line.
+type restoreCheckpoint struct {
+	path turbopath.AbsoluteSystemPath
+	done map[string]bool
+	file *os.File
+}
+
+// openCheckpoint loads the checkpoint at path, if there is one, and opens it
+// for recording further progress.
+func openCheckpoint(path turbopath.AbsoluteSystemPath) (*restoreCheckpoint, error) {
+	checkpoint := &restoreCheckpoint{path: path, done: map[string]bool{}}
+	if existing, err := path.Open(); err == nil {
+		scanner := bufio.NewScanner(existing)
+		for scanner.Scan() {
+			checkpoint.done[scanner.Text()] = true
+		}
+		_ = existing.Close()
+		// A line cut short by the interruption is simply never matched.
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	file, err := path.OpenFile(os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	checkpoint.file = file
+	return checkpoint, nil
+}
+
+// isDone reports whether the entry was restored by an earlier attempt.
+func (rc *restoreCheckpoint) isDone(name string) bool {
+	return rc.done[name]
+}
+
+// record notes that the entry has been restored.
+func (rc *restoreCheckpoint) record(name string) error {
+	_, err := rc.file.WriteString(name + "\n")
+	return err
+}
+
+// close closes the checkpoint, leaving it in place for a later attempt.
+func (rc *restoreCheckpoint) close() {
+	_ = rc.file.Close()
+}
+
+// remove closes and deletes the checkpoint once the restore has completed.
+func (rc *restoreCheckpoint) remove() error {
+	rc.close()
+	return rc.path.Remove()
+}
@@ -2,6 +2,8 @@ package cacheitem
 
 import (
 	"archive/tar"
+	"bytes"
+	"hash/fnv"
 	"io"
 	"os"
 
@@ -9,7 +11,7 @@ import (
 )
 
 // restoreRegular restores a file.
-func restoreRegular(dirCache *cachedDirTree, anchor turbopath.AbsoluteSystemPath, header *tar.Header, reader *tar.Reader) (turbopath.AnchoredSystemPath, error) {
+func restoreRegular(dirCache *cachedDirTree, anchor turbopath.AbsoluteSystemPath, header *tar.Header, reader io.Reader, onDivergent func(turbopath.AnchoredSystemPath), keepExisting func(turbopath.AbsoluteSystemPath) bool, fsync bool) (turbopath.AnchoredSystemPath, error) {
 	// Assuming this was a `turbo`-created input, we currently have an AnchoredUnixPath.
 	// Assuming this is malicious input we don't really care if we do the wrong thing.
 	processedName, err := canonicalizeName(header.Name)
@@ -24,17 +26,72 @@ func restoreRegular(dirCache *cachedDirTree, anchor turbopath.AbsoluteSystemPath
 		return "", err
 	}
 
+	if keepExisting != nil && keepExisting(processedName.RestoreAnchor(anchor)) {
+		return processedName, errKeptExisting
+	}
+
+	// Digest whatever is already there so we can tell if we're about to clobber it.
+	var existingDigest []byte
+	if onDivergent != nil {
+		existingDigest = digestExistingFile(processedName.RestoreAnchor(anchor), header.Size)
+	}
+	incoming := fnv.New64a()
+	var source io.Reader = reader
+	if existingDigest != nil {
+		source = io.TeeReader(reader, incoming)
+	}
+
 	// Create the file.
 	if f, err := processedName.RestoreAnchor(anchor).OpenFile(os.O_WRONLY|os.O_TRUNC|os.O_CREATE, os.FileMode(header.Mode)); err != nil {
 		return "", err
-	} else if _, err := io.Copy(f, reader); err != nil {
+	} else if _, err := io.Copy(f, source); err != nil {
+		return "", err
+	} else if err := syncFile(f, fsync); err != nil {
 		return "", err
 	} else if err := f.Close(); err != nil {
 		return "", err
 	}
+
+	if existingDigest != nil && !bytes.Equal(existingDigest, incoming.Sum(nil)) {
+		onDivergent(processedName)
+	}
 	return processedName, nil
 }
 
+// syncFile flushes f to stable storage if fsync is set.
+func syncFile(f *os.File, fsync bool) error {
+	if !fsync {
+		return nil
+	}
+	return f.Sync()
+}
+
+// _divergentSize is a sentinel digest for an existing file whose size already
+// differs from the incoming one; it never matches a real digest.
+var _divergentSize = []byte("size")
+
+// digestExistingFile returns a cheap digest of the regular file at path, or nil
+// if there is no regular file there to be overwritten.
+func digestExistingFile(path turbopath.AbsoluteSystemPath, incomingSize int64) []byte {
+	info, err := path.Lstat()
+	if err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+	if info.Size() != incomingSize {
+		return _divergentSize
+	}
+	f, err := path.Open()
+	if err != nil {
+		return nil
+	}
+	defer func() { _ = f.Close() }()
+	existing := fnv.New64a()
+	if _, err := io.Copy(existing, f); err != nil {
+		return nil
+	}
+	return existing.Sum(nil)
+}
+
 // safeMkdirAll creates all directories, assuming that the leaf node is a file.
 func safeMkdirFile(dirCache *cachedDirTree, anchor turbopath.AbsoluteSystemPath, processedName turbopath.AnchoredSystemPath, mode int64) error {
 	isRootFile := processedName.Dir() == "."
@@ -0,0 +1,171 @@
+package cacheitem
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+
+	"github.com/vercel/turbo/cli/internal/turbopath"
+)
+
+// restoreStaged does the work of Restore when StagingDir is set: the item is
+// extracted into a staging directory, and moved into anchor only once it has
+// been read completely and BeforeCommit has accepted it.
+func (ci *CacheItem) restoreStaged(anchor turbopath.AbsoluteSystemPath, callbackErrs *[]error) ([]turbopath.AnchoredSystemPath, error) {
+	if err := ci.StagingDir.MkdirAll(0755); err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir(ci.StagingDir.ToString(), "restore-*")
+	if err != nil {
+		return nil, err
+	}
+	stage := turbopath.AbsoluteSystemPathFromUpstream(dir)
+	defer func() { _ = stage.RemoveAll() }()
+
+	// Options that depend on what's already in the anchor apply as entries
+	// are moved into it.
+	staging := *ci
+	staging.StagingDir = ""
+	staging.CheckpointPath = ""
+	staging.RestoreMode = RestoreModeOverwrite
+	staging.OnDivergentOverwrite = nil
+	staging.OnFileRestored = nil
+	staged, err := staging.restore(stage, callbackErrs)
+	ci.Manifest = staging.Manifest
+	if err != nil {
+		return nil, err
+	}
+	if ci.BeforeCommit != nil {
+		if err := ci.BeforeCommit(); err != nil {
+			return nil, err
+		}
+	}
+	return ci.commitStaged(stage, anchor, staged, callbackErrs)
+}
+
+// commitStaged moves staged entries, in the order they were restored, from
+// stage into anchor.
+func (ci *CacheItem) commitStaged(stage turbopath.AbsoluteSystemPath, anchor turbopath.AbsoluteSystemPath, staged []turbopath.AnchoredSystemPath, callbackErrs *[]error) ([]turbopath.AnchoredSystemPath, error) {
+	dirCache := &cachedDirTree{
+		anchorAtDepth: []turbopath.AbsoluteSystemPath{anchor},
+	}
+	keepExisting := ci.keepExisting()
+	moved := make(map[turbopath.AnchoredSystemPath]bool, len(staged))
+	restored := make([]turbopath.AnchoredSystemPath, 0, len(staged))
+	for _, file := range staged {
+		if moved[file] {
+			// A duplicate entry; the last one was staged.
+			continue
+		}
+		from := file.RestoreAnchor(stage)
+		to := file.RestoreAnchor(anchor)
+		info, err := from.Lstat()
+		if err != nil {
+			return restored, err
+		}
+		if info.IsDir() {
+			// Directories are created rather than moved, since the anchor may
+			// already have them, with other contents.
+			if err := safeMkdirAll(dirCache, anchor, file, int64(info.Mode().Perm())); err != nil {
+				return restored, err
+			}
+			if err := ci.copyDirAttributes(from, to, info); err != nil {
+				return restored, err
+			}
+		} else {
+			if err := safeMkdirFile(dirCache, anchor, file, 0); err != nil {
+				return restored, err
+			}
+			if info.Mode().IsRegular() {
+				if keepExisting != nil && keepExisting(to) {
+					moved[file] = true
+					continue
+				}
+				if ci.OnDivergentOverwrite != nil {
+					existing := digestExistingFile(to, info.Size())
+					if existing != nil && !bytes.Equal(existing, digestExistingFile(from, info.Size())) {
+						ci.OnDivergentOverwrite(file)
+					}
+				}
+			}
+			if err := moveEntry(from, to, info); err != nil {
+				return restored, err
+			}
+			moved[file] = true
+		}
+		restored = append(restored, file)
+		ci.fileRestored(file, callbackErrs)
+	}
+	if ci.Fsync {
+		if err := syncDirs(anchor, restored); err != nil {
+			return restored, err
+		}
+	}
+	return restored, nil
+}
+
+// copyDirAttributes applies the permissions and extended attributes restored
+// onto a staged directory to the directory in the anchor, as restoring into
+// the anchor directly would have.
+func (ci *CacheItem) copyDirAttributes(from turbopath.AbsoluteSystemPath, to turbopath.AbsoluteSystemPath, info os.FileInfo) error {
+	if ci.Umask != 0 && runtime.GOOS != "windows" {
+		// The staged directory was created under the process umask, so its
+		// permissions only ever narrow.
+		if err := os.Chmod(to.ToString(), info.Mode().Perm()&^ci.Umask); err != nil {
+			return err
+		}
+	}
+	if !ci.PreserveXattrs {
+		return nil
+	}
+	xattrs, err := readXattrs(from)
+	if err != nil || len(xattrs) == 0 {
+		return err
+	}
+	records := make(map[string]string, len(xattrs))
+	for name, value := range xattrs {
+		records[_paxXattrPrefix+name] = value
+	}
+	return writeXattrs(to, records)
+}
+
+// moveEntry moves a staged file or symlink into place, replacing whatever is
+// at to. If it can't be renamed, e.g. because the staging directory is on
+// another filesystem, it is copied instead.
+func moveEntry(from turbopath.AbsoluteSystemPath, to turbopath.AbsoluteSystemPath, info os.FileInfo) error {
+	if err := from.Rename(to); err == nil {
+		return nil
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := from.Readlink()
+		if err != nil {
+			return err
+		}
+		_ = to.Remove()
+		return to.Symlink(target)
+	}
+	source, err := from.Open()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = source.Close() }()
+	if existing, err := to.Lstat(); err == nil && existing.Mode()&os.ModeSymlink != 0 {
+		// Replace the link, rather than writing through it.
+		_ = to.Remove()
+	}
+	dest, err := to.OpenFile(os.O_WRONLY|os.O_TRUNC|os.O_CREATE, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dest, source); err != nil {
+		_ = dest.Close()
+		return err
+	}
+	if err := dest.Close(); err != nil {
+		return err
+	}
+	// An existing file keeps its permissions when truncated.
+	return os.Chmod(to.ToString(), info.Mode().Perm())
+}
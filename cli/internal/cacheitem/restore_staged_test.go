@@ -0,0 +1,91 @@
+package cacheitem
+
+import (
+	"archive/tar"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/vercel/turbo/cli/internal/turbopath"
+	"gotest.tools/v3/assert"
+)
+
+func TestCacheItem_StagingDir(t *testing.T) {
+	archive := generateTar(t, []tarFile{
+		{Header: &tar.Header{Name: "pkg/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{Header: &tar.Header{Name: "pkg/link", Typeflag: tar.TypeSymlink, Linkname: "a"}},
+		{Header: &tar.Header{Name: "pkg/a", Typeflag: tar.TypeReg, Mode: 0644}, Body: "cached"},
+	})
+	restore := func(t *testing.T, anchor turbopath.AbsoluteSystemPath, setup func(ci *CacheItem)) ([]turbopath.AnchoredSystemPath, error) {
+		t.Helper()
+		staging := generateAnchor(t)
+		cacheItem, err := Open(archive)
+		assert.NilError(t, err, "Open")
+		cacheItem.StagingDir = staging
+		setup(cacheItem)
+		restored, err := cacheItem.Restore(anchor)
+		assert.NilError(t, cacheItem.Close(), "Close")
+		entries, readErr := ioutil.ReadDir(staging.ToString())
+		assert.NilError(t, readErr, "ReadDir")
+		assert.Equal(t, len(entries), 0, "staging directory is cleaned up")
+		return restored, err
+	}
+	withExisting := func(t *testing.T) turbopath.AbsoluteSystemPath {
+		anchor := generateAnchor(t)
+		assert.NilError(t, anchor.UntypedJoin("pkg").MkdirAll(0755), "MkdirAll")
+		assert.NilError(t, anchor.UntypedJoin("pkg", "a").WriteFile([]byte("edited"), 0644), "WriteFile")
+		return anchor
+	}
+	contents := func(t *testing.T, anchor turbopath.AbsoluteSystemPath) string {
+		b, err := anchor.UntypedJoin("pkg", "a").ReadFile()
+		assert.NilError(t, err, "ReadFile")
+		return string(b)
+	}
+
+	t.Run("commits", func(t *testing.T) {
+		anchor := withExisting(t)
+		var divergent, reported []turbopath.AnchoredSystemPath
+		restored, err := restore(t, anchor, func(ci *CacheItem) {
+			ci.OnDivergentOverwrite = func(path turbopath.AnchoredSystemPath) { divergent = append(divergent, path) }
+			ci.OnFileRestored = func(path turbopath.AnchoredSystemPath) error {
+				reported = append(reported, path)
+				return nil
+			}
+		})
+		assert.NilError(t, err, "Restore")
+		want := turbopath.AnchoredUnixPathArray{"pkg", "pkg/a", "pkg/link"}.ToSystemPathArray()
+		assert.DeepEqual(t, restored, want)
+		assert.DeepEqual(t, reported, want)
+		assert.DeepEqual(t, divergent, turbopath.AnchoredUnixPathArray{"pkg/a"}.ToSystemPathArray())
+		assert.Equal(t, contents(t, anchor), "cached")
+		target, err := anchor.UntypedJoin("pkg", "link").Readlink()
+		assert.NilError(t, err, "Readlink")
+		assert.Equal(t, target, "a")
+	})
+
+	t.Run("rejected before commit", func(t *testing.T) {
+		anchor := withExisting(t)
+		errRejected := errors.New("rejected")
+		_, err := restore(t, anchor, func(ci *CacheItem) {
+			ci.BeforeCommit = func() error { return errRejected }
+		})
+		assert.ErrorIs(t, err, errRejected)
+		assert.Equal(t, contents(t, anchor), "edited")
+		assert.Assert(t, !anchor.UntypedJoin("pkg", "link").Exists(), "nothing is moved into place")
+	})
+
+	t.Run("too many files", func(t *testing.T) {
+		anchor := generateAnchor(t)
+		_, err := restore(t, anchor, func(ci *CacheItem) { ci.MaxFiles = 2 })
+		assert.ErrorIs(t, err, ErrTooManyFiles)
+		assert.Assert(t, !anchor.UntypedJoin("pkg").Exists(), "nothing is written")
+	})
+
+	t.Run("merge keeps newer files", func(t *testing.T) {
+		anchor := withExisting(t)
+		restored, err := restore(t, anchor, func(ci *CacheItem) { ci.RestoreMode = RestoreModeMerge })
+		assert.NilError(t, err, "Restore")
+		assert.DeepEqual(t, restored, turbopath.AnchoredUnixPathArray{"pkg", "pkg/link"}.ToSystemPathArray())
+		assert.Equal(t, contents(t, anchor), "edited")
+	})
+}
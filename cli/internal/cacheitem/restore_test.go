@@ -2,6 +2,8 @@ package cacheitem
 
 import (
 	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"errors"
 	"fmt"
 	"io"
@@ -12,6 +14,7 @@ import (
 	"runtime"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/DataDog/zstd"
 	"github.com/vercel/turbo/cli/internal/turbopath"
@@ -1491,3 +1494,455 @@ func TestCacheItem_Restore(t *testing.T) {
 		t.Run(tt.name, getTestFunc(false))
 	}
 }
+
+func TestFromReader_DetectsCompression(t *testing.T) {
+	tarFiles := []tarFile{
+		{
+			Header: &tar.Header{
+				Name:     "file",
+				Typeflag: tar.TypeReg,
+				Mode:     0644,
+			},
+			Body: "contents",
+		},
+	}
+	want := turbopath.AnchoredUnixPathArray{"file"}.ToSystemPathArray()
+
+	rawTar, err := generateTar(t, tarFiles).ReadFile()
+	assert.NilError(t, err, "ReadFile")
+
+	zstdTar, err := compressTar(t, generateTar(t, tarFiles)).ReadFile()
+	assert.NilError(t, err, "ReadFile")
+
+	gzipTar := &bytes.Buffer{}
+	gw := gzip.NewWriter(gzipTar)
+	_, err = gw.Write(rawTar)
+	assert.NilError(t, err, "Write")
+	assert.NilError(t, gw.Close(), "Close")
+
+	tests := []struct {
+		name string
+		body []byte
+	}{
+		{name: "raw tar", body: rawTar},
+		{name: "zstd", body: zstdTar},
+		{name: "gzip", body: gzipTar.Bytes()},
+	}
+	for _, tt := range tests {
+		// The hint should be ignored whenever the magic bytes are recognized.
+		for _, hint := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%v hint=%v", tt.name, hint), func(t *testing.T) {
+				anchor := generateAnchor(t)
+				restored, err := FromReader(bytes.NewReader(tt.body), hint).Restore(anchor)
+				assert.NilError(t, err, "Restore")
+				assert.DeepEqual(t, restored, want)
+			})
+		}
+	}
+}
+
+func TestCacheItem_OnDivergentOverwrite(t *testing.T) {
+	archive := generateTar(t, []tarFile{
+		{
+			Header: &tar.Header{Name: "same", Typeflag: tar.TypeReg, Mode: 0644},
+			Body:   "contents",
+		},
+		{
+			Header: &tar.Header{Name: "edited", Typeflag: tar.TypeReg, Mode: 0644},
+			Body:   "contents",
+		},
+		{
+			Header: &tar.Header{Name: "resized", Typeflag: tar.TypeReg, Mode: 0644},
+			Body:   "contents",
+		},
+		{
+			Header: &tar.Header{Name: "new", Typeflag: tar.TypeReg, Mode: 0644},
+			Body:   "contents",
+		},
+	})
+
+	anchor := generateAnchor(t)
+	assert.NilError(t, anchor.UntypedJoin("same").WriteFile([]byte("contents"), 0644), "WriteFile")
+	assert.NilError(t, anchor.UntypedJoin("edited").WriteFile([]byte("CONTENTS"), 0644), "WriteFile")
+	assert.NilError(t, anchor.UntypedJoin("resized").WriteFile([]byte("more contents"), 0644), "WriteFile")
+
+	cacheItem, err := Open(archive)
+	assert.NilError(t, err, "Open")
+	var divergent []turbopath.AnchoredSystemPath
+	cacheItem.OnDivergentOverwrite = func(path turbopath.AnchoredSystemPath) {
+		divergent = append(divergent, path)
+	}
+	_, err = cacheItem.Restore(anchor)
+	assert.NilError(t, err, "Restore")
+	assert.NilError(t, cacheItem.Close(), "Close")
+
+	assert.DeepEqual(t, divergent, turbopath.AnchoredUnixPathArray{"edited", "resized"}.ToSystemPathArray())
+	contents, err := anchor.UntypedJoin("edited").ReadFile()
+	assert.NilError(t, err, "ReadFile")
+	assert.Equal(t, string(contents), "contents")
+}
+
+func TestCacheItem_RestoreModeMerge(t *testing.T) {
+	archive := generateTar(t, []tarFile{
+		{
+			Header: &tar.Header{Name: "edited", Typeflag: tar.TypeReg, Mode: 0644},
+			Body:   "cached",
+		},
+		{
+			Header: &tar.Header{Name: "stale", Typeflag: tar.TypeReg, Mode: 0644},
+			Body:   "cached",
+		},
+		{
+			Header: &tar.Header{Name: "missing", Typeflag: tar.TypeReg, Mode: 0644},
+			Body:   "cached",
+		},
+	})
+
+	anchor := generateAnchor(t)
+	createdAt := time.Now()
+	edited := anchor.UntypedJoin("edited")
+	assert.NilError(t, edited.WriteFile([]byte("in progress"), 0644), "WriteFile")
+	assert.NilError(t, os.Chtimes(edited.ToString(), createdAt.Add(time.Minute), createdAt.Add(time.Minute)), "Chtimes")
+	stale := anchor.UntypedJoin("stale")
+	assert.NilError(t, stale.WriteFile([]byte("old build"), 0644), "WriteFile")
+	assert.NilError(t, os.Chtimes(stale.ToString(), createdAt.Add(-time.Minute), createdAt.Add(-time.Minute)), "Chtimes")
+
+	cacheItem, err := Open(archive)
+	assert.NilError(t, err, "Open")
+	cacheItem.RestoreMode = RestoreModeMerge
+	cacheItem.CreatedAt = createdAt
+	restored, err := cacheItem.Restore(anchor)
+	assert.NilError(t, err, "Restore")
+	assert.NilError(t, cacheItem.Close(), "Close")
+
+	assert.DeepEqual(t, restored, turbopath.AnchoredUnixPathArray{"stale", "missing"}.ToSystemPathArray())
+	for name, want := range map[string]string{"edited": "in progress", "stale": "cached", "missing": "cached"} {
+		contents, err := anchor.UntypedJoin(name).ReadFile()
+		assert.NilError(t, err, "ReadFile")
+		assert.Equal(t, string(contents), want, name)
+	}
+}
+
+func TestCacheItem_RestoreCheckpoint(t *testing.T) {
+	archive := generateTar(t, []tarFile{
+		{
+			Header: &tar.Header{Name: "first", Typeflag: tar.TypeReg, Mode: 0644},
+			Body:   "cached",
+		},
+		{
+			Header: &tar.Header{Name: "second", Typeflag: tar.TypeReg, Mode: 0644},
+			Body:   "cached",
+		},
+	})
+
+	// Simulate an earlier restore that was interrupted partway through
+	// recording "second".
+	anchor := generateAnchor(t)
+	assert.NilError(t, anchor.UntypedJoin("first").WriteFile([]byte("earlier attempt"), 0644), "WriteFile")
+	checkpointPath := turbopath.AbsoluteSystemPath(t.TempDir()).UntypedJoin("checkpoint")
+	assert.NilError(t, checkpointPath.WriteFile([]byte("first\nsec"), 0644), "WriteFile")
+
+	cacheItem, err := Open(archive)
+	assert.NilError(t, err, "Open")
+	cacheItem.CheckpointPath = checkpointPath
+	restored, err := cacheItem.Restore(anchor)
+	assert.NilError(t, err, "Restore")
+	assert.NilError(t, cacheItem.Close(), "Close")
+
+	assert.DeepEqual(t, restored, turbopath.AnchoredUnixPathArray{"first", "second"}.ToSystemPathArray())
+	for name, want := range map[string]string{"first": "earlier attempt", "second": "cached"} {
+		contents, err := anchor.UntypedJoin(name).ReadFile()
+		assert.NilError(t, err, "ReadFile")
+		assert.Equal(t, string(contents), want, name)
+	}
+	assert.Assert(t, !checkpointPath.FileExists(), "checkpoint should be removed after a complete restore")
+}
+
+func TestCacheItem_DuplicateEntry(t *testing.T) {
+	files := []tarFile{
+		{
+			Header: &tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755},
+		},
+		{
+			Header: &tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755},
+		},
+		{
+			Header: &tar.Header{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0644},
+			Body:   "first",
+		},
+		{
+			Header: &tar.Header{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0644},
+			Body:   "second",
+		},
+	}
+
+	t.Run("rejects", func(t *testing.T) {
+		cacheItem, err := Open(generateTar(t, files))
+		assert.NilError(t, err, "Open")
+		cacheItem.RejectDuplicateEntries = true
+		_, err = cacheItem.Restore(generateAnchor(t))
+		assert.ErrorIs(t, err, ErrDuplicateEntry)
+		assert.NilError(t, cacheItem.Close(), "Close")
+	})
+
+	t.Run("reports", func(t *testing.T) {
+		cacheItem, err := Open(generateTar(t, files))
+		assert.NilError(t, err, "Open")
+		var duplicates []turbopath.AnchoredSystemPath
+		cacheItem.OnDuplicateEntry = func(path turbopath.AnchoredSystemPath) {
+			duplicates = append(duplicates, path)
+		}
+		anchor := generateAnchor(t)
+		_, err = cacheItem.Restore(anchor)
+		assert.NilError(t, err, "Restore")
+		assert.NilError(t, cacheItem.Close(), "Close")
+
+		assert.DeepEqual(t, duplicates, turbopath.AnchoredUnixPathArray{"dir/file"}.ToSystemPathArray())
+		contents, err := anchor.UntypedJoin("dir", "file").ReadFile()
+		assert.NilError(t, err, "ReadFile")
+		assert.Equal(t, string(contents), "second")
+	})
+}
+
+func TestCacheItem_MaxFiles(t *testing.T) {
+	var files []tarFile
+	for i := 0; i < 5; i++ {
+		files = append(files, tarFile{
+			Header: &tar.Header{Name: fmt.Sprintf("file-%v", i), Typeflag: tar.TypeReg, Mode: 0644},
+			Body:   "contents",
+		})
+	}
+	archive := generateTar(t, files)
+
+	cacheItem, err := Open(archive)
+	assert.NilError(t, err, "Open")
+	cacheItem.MaxFiles = 5
+	restored, err := cacheItem.Restore(generateAnchor(t))
+	assert.NilError(t, err, "Restore")
+	assert.Equal(t, len(restored), 5)
+	assert.NilError(t, cacheItem.Close(), "Close")
+
+	cacheItem, err = Open(archive)
+	assert.NilError(t, err, "Open")
+	cacheItem.MaxFiles = 4
+	anchor := generateAnchor(t)
+	_, err = cacheItem.Restore(anchor)
+	assert.ErrorIs(t, err, ErrTooManyFiles)
+	assert.NilError(t, cacheItem.Close(), "Close")
+	assert.Assert(t, !anchor.UntypedJoin("file-4").FileExists(), "nothing past the limit is written")
+}
+
+func TestCacheItem_DecompressionBomb(t *testing.T) {
+	// 4 MiB of zeros compresses to almost nothing.
+	archive := compressTar(t, generateTar(t, []tarFile{
+		{
+			Header: &tar.Header{Name: "zeros", Typeflag: tar.TypeReg, Mode: 0644, Size: 4 << 20},
+			Body:   string(make([]byte, 4<<20)),
+		},
+	}))
+
+	tests := []struct {
+		name  string
+		setup func(ci *CacheItem)
+		err   error
+	}{
+		{name: "no limits", setup: func(ci *CacheItem) {}},
+		{name: "within size", setup: func(ci *CacheItem) { ci.MaxDecompressedSize = 8 << 20 }},
+		{name: "over size", setup: func(ci *CacheItem) { ci.MaxDecompressedSize = 1 << 20 }, err: ErrDecompressionBomb},
+		{name: "over ratio", setup: func(ci *CacheItem) { ci.MaxCompressionRatio = 100 }, err: ErrDecompressionBomb},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cacheItem, err := Open(archive)
+			assert.NilError(t, err, "Open")
+			tt.setup(cacheItem)
+			_, err = cacheItem.Restore(generateAnchor(t))
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+			} else {
+				assert.NilError(t, err, "Restore")
+			}
+			assert.NilError(t, cacheItem.Close(), "Close")
+		})
+	}
+}
+
+func TestCacheItem_OnFileRestored(t *testing.T) {
+	archive := generateTar(t, []tarFile{
+		{Header: &tar.Header{Name: "link", Linkname: "dir/file", Typeflag: tar.TypeSymlink, Mode: 0777}},
+		{Header: &tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{Header: &tar.Header{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0644}, Body: "file"},
+		{Header: &tar.Header{Name: "dir/other", Typeflag: tar.TypeReg, Mode: 0644}, Body: "other"},
+	})
+
+	cacheItem, err := Open(archive)
+	assert.NilError(t, err, "Open")
+	var seen []turbopath.AnchoredSystemPath
+	errCallback := errors.New("callback failed")
+	cacheItem.OnFileRestored = func(path turbopath.AnchoredSystemPath) error {
+		seen = append(seen, path)
+		if path == turbopath.AnchoredUnixPath("dir/file").ToSystemPath() {
+			return errCallback
+		}
+		return nil
+	}
+	anchor := generateAnchor(t)
+	restored, err := cacheItem.Restore(anchor)
+	assert.NilError(t, cacheItem.Close(), "Close")
+
+	assert.ErrorContains(t, err, errCallback.Error())
+	assert.DeepEqual(t, seen, turbopath.AnchoredUnixPathArray{"dir", "dir/file", "dir/other", "link"}.ToSystemPathArray())
+	assert.DeepEqual(t, restored, seen)
+	assert.Assert(t, anchor.UntypedJoin("dir", "other").FileExists(), "restore continues after a callback error")
+}
+
+func TestCacheItem_Fsync(t *testing.T) {
+	archive := generateTar(t, []tarFile{
+		{Header: &tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{Header: &tar.Header{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0644}, Body: "contents"},
+		{Header: &tar.Header{Name: "link", Linkname: "dir/file", Typeflag: tar.TypeSymlink, Mode: 0777}},
+	})
+
+	cacheItem, err := Open(archive)
+	assert.NilError(t, err, "Open")
+	cacheItem.Fsync = true
+	anchor := generateAnchor(t)
+	restored, err := cacheItem.Restore(anchor)
+	assert.NilError(t, err, "Restore")
+	assert.NilError(t, cacheItem.Close(), "Close")
+	assert.Equal(t, len(restored), 3)
+
+	contents, err := anchor.UntypedJoin("dir", "file").ReadFile()
+	assert.NilError(t, err, "ReadFile")
+	assert.Equal(t, string(contents), "contents")
+}
+
+func TestCacheItem_Umask(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("umask is a no-op on Windows")
+	}
+	archive := generateTar(t, []tarFile{
+		{Header: &tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{Header: &tar.Header{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0644}, Body: "contents"},
+		{Header: &tar.Header{Name: "dir/script", Typeflag: tar.TypeReg, Mode: 0755}, Body: "#!/bin/sh"},
+	})
+
+	cacheItem, err := Open(archive)
+	assert.NilError(t, err, "Open")
+	cacheItem.Umask = 0o077
+	anchor := generateAnchor(t)
+	_, err = cacheItem.Restore(anchor)
+	assert.NilError(t, err, "Restore")
+	assert.NilError(t, cacheItem.Close(), "Close")
+
+	for name, want := range map[string]os.FileMode{"dir": 0700, "dir/file": 0600, "dir/script": 0700} {
+		info, err := anchor.UntypedJoin(name).Lstat()
+		assert.NilError(t, err, "Lstat")
+		assert.Equal(t, info.Mode().Perm(), want, name)
+	}
+
+	// A Umask weaker than the process umask doesn't loosen what the process
+	// umask cleared.
+	probe := generateAnchor(t).UntypedJoin("probe")
+	assert.NilError(t, probe.WriteFile(nil, 0777), "WriteFile")
+	probeInfo, err := probe.Lstat()
+	assert.NilError(t, err, "Lstat")
+	processMode := probeInfo.Mode().Perm()
+
+	cacheItem, err = Open(generateTar(t, []tarFile{
+		{Header: &tar.Header{Name: "open/", Typeflag: tar.TypeDir, Mode: 0777}},
+		{Header: &tar.Header{Name: "open/script", Typeflag: tar.TypeReg, Mode: 0777}, Body: "#!/bin/sh"},
+	}))
+	assert.NilError(t, err, "Open")
+	cacheItem.Umask = 0o002
+	anchor = generateAnchor(t)
+	_, err = cacheItem.Restore(anchor)
+	assert.NilError(t, err, "Restore")
+	assert.NilError(t, cacheItem.Close(), "Close")
+
+	for _, name := range []string{"open", "open/script"} {
+		info, err := anchor.UntypedJoin(name).Lstat()
+		assert.NilError(t, err, "Lstat")
+		assert.Equal(t, info.Mode().Perm(), processMode&^0o002, name)
+	}
+}
+
+func TestCacheItem_RestoreSize(t *testing.T) {
+	archive := compressTar(t, generateTar(t, []tarFile{
+		{Header: &tar.Header{Name: "pkg/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{Header: &tar.Header{Name: "pkg/a", Typeflag: tar.TypeReg, Mode: 0644}, Body: "aaaa"},
+		{Header: &tar.Header{Name: "pkg/b", Typeflag: tar.TypeReg, Mode: 0644}, Body: "bbbbbb"},
+		{Header: &tar.Header{Name: "pkg/link", Typeflag: tar.TypeSymlink, Linkname: "a"}},
+	}))
+	cacheItem, err := Open(archive)
+	assert.NilError(t, err, "Open")
+	size, err := cacheItem.RestoreSize()
+	assert.NilError(t, err, "RestoreSize")
+	assert.Equal(t, size, int64(10))
+	assert.NilError(t, cacheItem.Close(), "Close")
+
+	// Solid blocks count their members, not the block.
+	anchor := turbopath.AbsoluteSystemPath(t.TempDir())
+	assert.NilError(t, anchor.UntypedJoin("a").WriteFile([]byte("aaaa"), 0644), "WriteFile")
+	assert.NilError(t, anchor.UntypedJoin("b").WriteFile([]byte("bbbbbb"), 0644), "WriteFile")
+	buf := &bytes.Buffer{}
+	solid := CreateWriter(nopWriteCloser{buf}, CreateOpts{SolidCompression: true, IncludeManifest: true})
+	files := turbopath.AnchoredUnixPathArray{"a", "b"}.ToSystemPathArray()
+	for _, file := range files {
+		assert.NilError(t, solid.AddFile(anchor, file), "AddFile")
+	}
+	assert.NilError(t, solid.Close(), "Close")
+	size, err = FromReader(buf, true).RestoreSize()
+	assert.NilError(t, err, "RestoreSize")
+	assert.Equal(t, size, int64(10))
+}
+
+func TestCacheItem_VerifyRestoreCount(t *testing.T) {
+	complete := generateTar(t, []tarFile{
+		{Header: &tar.Header{Name: "pkg/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{Header: &tar.Header{Name: "pkg/link", Typeflag: tar.TypeSymlink, Linkname: "a"}},
+		{Header: &tar.Header{Name: "pkg/a", Typeflag: tar.TypeReg, Mode: 0644}, Body: "a"},
+	})
+	cacheItem, err := Open(complete)
+	assert.NilError(t, err, "Open")
+	cacheItem.VerifyRestoreCount = true
+	restored, err := cacheItem.Restore(generateAnchor(t))
+	assert.NilError(t, err, "Restore")
+	assert.Equal(t, len(restored), 3)
+	assert.NilError(t, cacheItem.Close(), "Close")
+
+	// Files kept by RestoreModeMerge are accounted for.
+	anchor := generateAnchor(t)
+	assert.NilError(t, anchor.UntypedJoin("pkg").MkdirAll(0755), "MkdirAll")
+	assert.NilError(t, anchor.UntypedJoin("pkg", "a").WriteFile([]byte("edited"), 0644), "WriteFile")
+	cacheItem, err = Open(complete)
+	assert.NilError(t, err, "Open")
+	cacheItem.VerifyRestoreCount = true
+	cacheItem.RestoreMode = RestoreModeMerge
+	_, err = cacheItem.Restore(anchor)
+	assert.NilError(t, err, "Restore")
+	assert.NilError(t, cacheItem.Close(), "Close")
+	contents, err := anchor.UntypedJoin("pkg", "a").ReadFile()
+	assert.NilError(t, err, "ReadFile")
+	assert.Equal(t, string(contents), "edited")
+
+	// The second of two dangling symlinks at the same path is skipped when
+	// deferred symlinks are restored, without an error.
+	skipped := generateTar(t, []tarFile{
+		{Header: &tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "missing-a"}},
+		{Header: &tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "missing-b"}},
+	})
+	cacheItem, err = Open(skipped)
+	assert.NilError(t, err, "Open")
+	_, err = cacheItem.Restore(generateAnchor(t))
+	assert.NilError(t, err, "Restore")
+	assert.NilError(t, cacheItem.Close(), "Close")
+
+	cacheItem, err = Open(skipped)
+	assert.NilError(t, err, "Open")
+	cacheItem.VerifyRestoreCount = true
+	_, err = cacheItem.Restore(generateAnchor(t))
+	assert.ErrorIs(t, err, ErrIncompleteRestore)
+	assert.ErrorContains(t, err, "wrote 1 of 2 entries")
+	assert.NilError(t, cacheItem.Close(), "Close")
+}
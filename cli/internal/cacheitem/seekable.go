@@ -0,0 +1,161 @@
+package cacheitem
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/DataDog/zstd"
+)
+
+// ErrNotSeekable is returned when a CacheItem was not written with
+// CreateOpts.SeekableCompression.
+var ErrNotSeekable = errors.New("cache item is not in the seekable format")
+
+// Seekable cache items follow the zstd seekable format: the tar stream is
+// compressed as a series of independent frames of _seekableFrameSize
+// uncompressed bytes, followed by a skippable frame holding a seek table. The
+// seek table lists the compressed and decompressed size of every frame, so a
+// reader can find and decompress just the frames covering a range of the tar
+// stream. Decoders that don't know the format skip the seek table, so a
+// seekable item restores like any other.
+//
+//	magic (4 bytes LE) | frame size (4 bytes LE) |
+//	    compressed size (4 bytes LE) | decompressed size (4 bytes LE)   (per frame)
+//	    number of frames (4 bytes LE) | descriptor (1 byte) | seekable magic (4 bytes LE)
+const (
+	_seekableFrameSize    = 1 << 20
+	_seekTableEntrySize   = 8
+	_seekTableFooterSize  = 9
+	_seekableMagic        = 0x8F92EAB1
+	_skippableFrameHeader = 8
+)
+
+// seekTableEntry describes one frame of a seekable item.
+type seekTableEntry struct {
+	compressedSize   uint32
+	decompressedSize uint32
+}
+
+// seekTable indexes the frames of a seekable item.
+type seekTable struct {
+	entries []seekTableEntry
+}
+
+// newSeekableWriter creates a writer that compresses at `level` with `threads`
+// workers, in the seekable format.
+func newSeekableWriter(w io.Writer, threads int, level int) *parallelWriter {
+	pw := newParallelWriter(w, threads, level)
+	pw.chunkSize = _seekableFrameSize
+	pw.buffer = make([]byte, 0, _seekableFrameSize)
+	pw.seekTable = &seekTable{}
+	return pw
+}
+
+func (st *seekTable) add(compressedSize int, decompressedSize int) {
+	st.entries = append(st.entries, seekTableEntry{
+		compressedSize:   uint32(compressedSize),
+		decompressedSize: uint32(decompressedSize),
+	})
+}
+
+// marshal encodes the seek table as a skippable frame.
+func (st *seekTable) marshal() []byte {
+	payloadSize := len(st.entries)*_seekTableEntrySize + _seekTableFooterSize
+	frame := make([]byte, _skippableFrameHeader+payloadSize)
+	copy(frame[0:4], _skippableFrameMagic)
+	binary.LittleEndian.PutUint32(frame[4:8], uint32(payloadSize))
+	offset := _skippableFrameHeader
+	for _, entry := range st.entries {
+		binary.LittleEndian.PutUint32(frame[offset:], entry.compressedSize)
+		binary.LittleEndian.PutUint32(frame[offset+4:], entry.decompressedSize)
+		offset += _seekTableEntrySize
+	}
+	binary.LittleEndian.PutUint32(frame[offset:], uint32(len(st.entries)))
+	// The descriptor byte is left zero: frames carry no checksums.
+	binary.LittleEndian.PutUint32(frame[offset+5:], _seekableMagic)
+	return frame
+}
+
+// SeekableReader reads ranges of the uncompressed tar stream of a seekable
+// cache item without decompressing the whole item.
+type SeekableReader struct {
+	reader io.ReaderAt
+	table  *seekTable
+	size   int64
+}
+
+// OpenSeekable reads the seek table at the end of a cache item of the given
+// size. It returns ErrNotSeekable if the item has no seek table.
+func OpenSeekable(reader io.ReaderAt, size int64) (*SeekableReader, error) {
+	if size < _skippableFrameHeader+_seekTableFooterSize {
+		return nil, ErrNotSeekable
+	}
+	footer := make([]byte, _seekTableFooterSize)
+	if _, err := reader.ReadAt(footer, size-_seekTableFooterSize); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(footer[5:]) != _seekableMagic {
+		return nil, ErrNotSeekable
+	}
+	frames := int64(binary.LittleEndian.Uint32(footer[0:4]))
+	tableSize := _skippableFrameHeader + frames*_seekTableEntrySize + _seekTableFooterSize
+	if tableSize > size {
+		return nil, fmt.Errorf("%w: seek table is larger than the item", ErrMalformedArchive)
+	}
+
+	entries := make([]byte, frames*_seekTableEntrySize)
+	if _, err := reader.ReadAt(entries, size-tableSize+_skippableFrameHeader); err != nil {
+		return nil, err
+	}
+	table := &seekTable{}
+	for offset := 0; offset < len(entries); offset += _seekTableEntrySize {
+		table.add(int(binary.LittleEndian.Uint32(entries[offset:])), int(binary.LittleEndian.Uint32(entries[offset+4:])))
+	}
+	return &SeekableReader{reader: reader, table: table, size: size - tableSize}, nil
+}
+
+// ReadRange returns length bytes of the uncompressed tar stream starting at
+// offset, decompressing only the frames that overlap the range. The result is
+// shorter than length if the stream ends first.
+func (sr *SeekableReader) ReadRange(offset int64, length int64) ([]byte, error) {
+	out := make([]byte, 0, length)
+	var compressedOffset, decompressedOffset int64
+	for _, entry := range sr.table.entries {
+		frameStart := decompressedOffset
+		frameEnd := decompressedOffset + int64(entry.decompressedSize)
+		compressedStart := compressedOffset
+		compressedOffset += int64(entry.compressedSize)
+		decompressedOffset = frameEnd
+		if frameEnd <= offset {
+			continue
+		}
+		if frameStart >= offset+length {
+			break
+		}
+
+		if compressedOffset > sr.size {
+			return nil, fmt.Errorf("%w: seek table does not match the item", ErrMalformedArchive)
+		}
+		compressed := make([]byte, entry.compressedSize)
+		if _, err := sr.reader.ReadAt(compressed, compressedStart); err != nil {
+			return nil, err
+		}
+		frame, err := zstd.Decompress(make([]byte, 0, entry.decompressedSize), compressed)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrDecompressionFailed, err)
+		}
+
+		start := int64(0)
+		if offset > frameStart {
+			start = offset - frameStart
+		}
+		end := int64(len(frame))
+		if offset+length < frameEnd {
+			end = offset + length - frameStart
+		}
+		out = append(out, frame[start:end]...)
+	}
+	return out, nil
+}
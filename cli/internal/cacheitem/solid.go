@@ -0,0 +1,149 @@
+package cacheitem
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Solid blocks pack many small regular files into a single tar member, see
+// CreateOpts.SolidCompression. A block's contents are an index followed by
+// the contents of every file in it, back to back:
+//
+//	index length (4 bytes LE) | index (JSON) | file contents...
+//
+// Blocks use their own type flag, so that versions of turbo that don't know
+// about them fail to restore the item rather than restoring the block as a
+// file.
+const (
+	_typeSolidBlock = 'T'
+	// _solidBlockName names every block member. It is never restored to disk.
+	_solidBlockName = ".turbo-solid"
+	// _solidMaxFileSize is the largest file packed into a block. Anything
+	// larger gains little from saving its tar header.
+	_solidMaxFileSize = 64 << 10
+	// _solidBlockSize is how much file content is gathered before a block is
+	// written.
+	_solidBlockSize = 1 << 20
+	// _solidMaxMembers bounds the size of a block's index.
+	_solidMaxMembers = 4096
+	// _solidMaxBlockBytes is the largest block Restore will read into memory.
+	_solidMaxBlockBytes = 16 << 20
+)
+
+// solidMember describes one file in a solid block.
+type solidMember struct {
+	Name string `json:"name"`
+	Mode int64  `json:"mode"`
+	Size int64  `json:"size"`
+}
+
+// solidBlock gathers files until there are enough to write a block.
+type solidBlock struct {
+	members []solidMember
+	data    bytes.Buffer
+}
+
+// packable reports whether the file described by header can go in a solid
+// block. Files carrying PAX records, e.g. extended attributes, are written as
+// members of their own so those records are kept.
+func packable(header *tar.Header) bool {
+	return header.Typeflag == tar.TypeReg && header.Size <= _solidMaxFileSize && len(header.PAXRecords) == 0
+}
+
+// addSolid adds a file's contents to the pending solid block, writing the block
+// out once it is full.
+func (ci *CacheItem) addSolid(header *tar.Header, contents io.Reader) error {
+	start := ci.solid.data.Len()
+	if _, err := io.Copy(&ci.solid.data, contents); err != nil {
+		return err
+	}
+	if size := int64(ci.solid.data.Len() - start); size != header.Size {
+		return fmt.Errorf("%v changed size while being cached", header.Name)
+	}
+	ci.solid.members = append(ci.solid.members, solidMember{Name: header.Name, Mode: header.Mode, Size: header.Size})
+	if ci.solid.data.Len() >= _solidBlockSize || len(ci.solid.members) >= _solidMaxMembers {
+		return ci.flushSolid()
+	}
+	return nil
+}
+
+// flushSolid writes the pending solid block, if it has any files in it.
+func (ci *CacheItem) flushSolid() error {
+	if ci.solid == nil || len(ci.solid.members) == 0 {
+		return nil
+	}
+	index, err := json.Marshal(ci.solid.members)
+	if err != nil {
+		return err
+	}
+	var indexLength [4]byte
+	binary.LittleEndian.PutUint32(indexLength[:], uint32(len(index)))
+
+	header := &tar.Header{
+		Name:       _solidBlockName,
+		Typeflag:   _typeSolidBlock,
+		Mode:       0644,
+		Size:       int64(len(indexLength) + len(index) + ci.solid.data.Len()),
+		AccessTime: time.Unix(0, 0),
+		ModTime:    time.Unix(0, 0),
+		ChangeTime: time.Unix(0, 0),
+	}
+	if err := ci.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := ci.tw.Write(indexLength[:]); err != nil {
+		return err
+	}
+	if _, err := ci.tw.Write(index); err != nil {
+		return err
+	}
+	if _, err := ci.tw.Write(ci.solid.data.Bytes()); err != nil {
+		return err
+	}
+	ci.solid.members = ci.solid.members[:0]
+	ci.solid.data.Reset()
+	return nil
+}
+
+// readSolidBlock reads a solid block member, returning a header and the
+// contents for every file in it.
+func readSolidBlock(header *tar.Header, reader io.Reader) ([]*tar.Header, [][]byte, error) {
+	if header.Size < 4 || header.Size > _solidMaxBlockBytes {
+		return nil, nil, fmt.Errorf("%w: solid block of %v bytes", ErrMalformedArchive, header.Size)
+	}
+	block := make([]byte, header.Size)
+	if _, err := io.ReadFull(reader, block); err != nil {
+		return nil, nil, err
+	}
+	indexLength := int64(binary.LittleEndian.Uint32(block))
+	if 4+indexLength > int64(len(block)) {
+		return nil, nil, fmt.Errorf("%w: solid block index is larger than the block", ErrMalformedArchive)
+	}
+	var members []solidMember
+	if err := json.Unmarshal(block[4:4+indexLength], &members); err != nil {
+		return nil, nil, fmt.Errorf("%w: invalid solid block index: %v", ErrMalformedArchive, err)
+	}
+
+	data := block[4+indexLength:]
+	headers := make([]*tar.Header, 0, len(members))
+	contents := make([][]byte, 0, len(members))
+	for _, member := range members {
+		if member.Size < 0 || member.Size > int64(len(data)) {
+			return nil, nil, fmt.Errorf("%w: solid block is shorter than its index", ErrMalformedArchive)
+		}
+		headers = append(headers, &tar.Header{
+			Name:     member.Name,
+			Typeflag: tar.TypeReg,
+			Mode:     member.Mode,
+			Size:     member.Size,
+		})
+		contents = append(contents, data[:member.Size])
+		data = data[member.Size:]
+	}
+	return headers, contents, nil
+}
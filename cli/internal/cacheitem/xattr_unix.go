@@ -0,0 +1,82 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package cacheitem
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+
+	"github.com/vercel/turbo/cli/internal/turbopath"
+	"golang.org/x/sys/unix"
+)
+
+// readXattrs returns the extended attributes set on path, without following symlinks.
+// Filesystems that don't support extended attributes report none.
+func readXattrs(path turbopath.AbsoluteSystemPath) (map[string]string, error) {
+	size, err := unix.Llistxattr(path.ToString(), nil)
+	if err != nil {
+		if isXattrUnsupported(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if size == 0 {
+		return nil, nil
+	}
+
+	names := make([]byte, size)
+	size, err = unix.Llistxattr(path.ToString(), names)
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string]string)
+	for _, name := range bytes.Split(names[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		value, err := getXattr(path, string(name))
+		if err != nil {
+			return nil, err
+		}
+		xattrs[string(name)] = string(value)
+	}
+	return xattrs, nil
+}
+
+func getXattr(path turbopath.AbsoluteSystemPath, name string) ([]byte, error) {
+	size, err := unix.Lgetxattr(path.ToString(), name, nil)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, size)
+	size, err = unix.Lgetxattr(path.ToString(), name, value)
+	if err != nil {
+		return nil, err
+	}
+	return value[:size], nil
+}
+
+// writeXattrs applies the xattr PAX records from a tar header to path.
+// Attributes the filesystem refuses are skipped.
+func writeXattrs(path turbopath.AbsoluteSystemPath, paxRecords map[string]string) error {
+	for key, value := range paxRecords {
+		name := strings.TrimPrefix(key, _paxXattrPrefix)
+		if name == key {
+			continue
+		}
+		if err := unix.Lsetxattr(path.ToString(), name, []byte(value), 0); err != nil {
+			if isXattrUnsupported(err) || errors.Is(err, unix.EPERM) {
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func isXattrUnsupported(err error) bool {
+	return errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EOPNOTSUPP)
+}
@@ -0,0 +1,40 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package cacheitem
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/vercel/turbo/cli/internal/turbopath"
+	"golang.org/x/sys/unix"
+	"gotest.tools/v3/assert"
+)
+
+func TestPreserveXattrs(t *testing.T) {
+	inputDir := turbopath.AbsoluteSystemPath(t.TempDir())
+	file := turbopath.AnchoredSystemPath("signed-binary")
+	sourcePath := file.RestoreAnchor(inputDir)
+	assert.NilError(t, sourcePath.WriteFile([]byte("binary"), 0755), "WriteFile")
+
+	if err := unix.Lsetxattr(sourcePath.ToString(), "user.turbo.test", []byte("signed"), 0); err != nil {
+		t.Skipf("filesystem does not support extended attributes: %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	cacheItem := CreateWriter(nopWriteCloser{buf}, CreateOpts{})
+	cacheItem.PreserveXattrs = true
+	assert.NilError(t, cacheItem.AddFile(inputDir, file), "AddFile")
+	assert.NilError(t, cacheItem.Close(), "Close")
+
+	outputDir := turbopath.AbsoluteSystemPath(t.TempDir())
+	restoredItem := FromReader(buf, true)
+	restoredItem.PreserveXattrs = true
+	_, err := restoredItem.Restore(outputDir)
+	assert.NilError(t, err, "Restore")
+
+	value, err := getXattr(file.RestoreAnchor(outputDir), "user.turbo.test")
+	assert.NilError(t, err, "getXattr")
+	assert.Equal(t, string(value), "signed")
+}
@@ -0,0 +1,16 @@
+//go:build !darwin && !linux
+// +build !darwin,!linux
+
+package cacheitem
+
+import "github.com/vercel/turbo/cli/internal/turbopath"
+
+// readXattrs is a no-op on platforms without extended attribute support.
+func readXattrs(_ turbopath.AbsoluteSystemPath) (map[string]string, error) {
+	return nil, nil
+}
+
+// writeXattrs is a no-op on platforms without extended attribute support.
+func writeXattrs(_ turbopath.AbsoluteSystemPath, _ map[string]string) error {
+	return nil
+}
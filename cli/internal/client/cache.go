@@ -1,6 +1,8 @@
 package client
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -14,11 +16,105 @@ import (
 	"github.com/vercel/turbo/cli/internal/util"
 )
 
+// SetArtifactPathPrefix stores artifacts under prefix, e.g. "team-a/ci/", by
+// prepending it to the hash in artifact URLs. It is a storage layout concern
+// of the backend: artifacts remain scoped to the team as before, and the
+// prefix is not part of the hash that artifacts are signed for. prefix is
+// made of "/"-separated segments, each of which is escaped.
+func (c *APIClient) SetArtifactPathPrefix(prefix string) error {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		c.artifactPathPrefix = ""
+		return nil
+	}
+	segments := strings.Split(prefix, "/")
+	for i, segment := range segments {
+		if segment == "" || segment == "." || segment == ".." {
+			return fmt.Errorf("invalid artifact path prefix %q: empty or relative segment", prefix)
+		}
+		segments[i] = url.PathEscape(segment)
+	}
+	c.artifactPathPrefix = strings.Join(segments, "/") + "/"
+	return nil
+}
+
+// SetReadReplicas sets the base URLs of read replicas of the remote cache,
+// which FetchArtifactFromReplica can read artifacts from. Everything else,
+// including uploads, still goes to the primary.
+func (c *APIClient) SetReadReplicas(baseURLs []string) {
+	c.replicaURLs = baseURLs
+}
+
+// SetShardKeys, if enabled, stores each artifact under a shard of its key,
+// e.g. "3f/" + hash, for backends that partition storage by key prefix. The
+// shard is the start of the SHA-256 of the hash, so artifacts are spread
+// evenly even when hashes cluster. Like the path prefix, it only changes the
+// backend's storage layout, and artifacts stored with and without sharding
+// can't be read by the other.
+func (c *APIClient) SetShardKeys(enabled bool) {
+	c.shardKeys = enabled
+}
+
+// artifactKey returns the backend key for the artifact with the given hash.
+func (c *APIClient) artifactKey(hash string) string {
+	if c.shardKeys {
+		return c.artifactPathPrefix + keyShard(hash) + "/" + hash
+	}
+	return c.artifactPathPrefix + hash
+}
+
+// keyShard returns the shard an artifact is stored under; see SetShardKeys.
+func keyShard(hash string) string {
+	sum := sha256.Sum256([]byte(hash))
+	return hex.EncodeToString(sum[:1])
+}
+
 // PutArtifact uploads an artifact associated with a given hash string to the remote cache
 func (c *APIClient) PutArtifact(hash string, artifactBody []byte, duration int, tag string) error {
+	return c.putArtifact(hash, artifactBody, int64(len(artifactBody)), duration, tag, "", "", false)
+}
+
+// PutArtifactReader is like PutArtifact, but streams the artifact from body,
+// which is rewound for each retry, rather than holding it in memory.
+func (c *APIClient) PutArtifactReader(hash string, body io.ReadSeeker, size int64, duration int, tag string) error {
+	return c.putArtifact(hash, body, size, duration, tag, "", "", false)
+}
+
+// PutArtifactSignedAt is like PutArtifactReader, but also sends the time the
+// artifact's tag was generated, as x-artifact-signed-at.
+func (c *APIClient) PutArtifactSignedAt(hash string, body io.ReadSeeker, size int64, duration int, tag string, signedAt string) error {
+	return c.putArtifact(hash, body, size, duration, tag, signedAt, "", false)
+}
+
+// PutArtifactDelta uploads a delta that the remote cache applies to the
+// artifact it holds for baseHash to reconstruct the artifact for hash. tag and
+// signedAt are for the reconstructed artifact. The base is identified by its
+// key, including any artifact path prefix. Backends without support for
+// deltas are expected to respond with 415 or 501, which is reported as
+// util.ErrDeltaUnsupported.
+func (c *APIClient) PutArtifactDelta(hash string, baseHash string, delta []byte, duration int, tag string, signedAt string) error {
+	return c.putArtifact(hash, delta, int64(len(delta)), duration, tag, signedAt, c.artifactKey(baseHash), false)
+}
+
+// PutArtifactImmutable is like PutArtifactSignedAt, but also asks the remote
+// cache to protect the artifact from being overwritten, with
+// x-artifact-immutable. Later uploads for hash are then rejected with
+// util.ErrArtifactImmutable. Backends without support for immutable
+// artifacts ignore the header and store the artifact as usual.
+func (c *APIClient) PutArtifactImmutable(hash string, body io.ReadSeeker, size int64, duration int, tag string, signedAt string) error {
+	return c.putArtifact(hash, body, size, duration, tag, signedAt, "", true)
+}
+
+// putArtifact uploads artifactBody, which may be anything accepted by
+// retryablehttp.NewRequest.
+func (c *APIClient) putArtifact(hash string, artifactBody interface{}, size int64, duration int, tag string, signedAt string, deltaBase string, immutable bool) error {
 	if err := c.okToRequest(); err != nil {
 		return err
 	}
+	token, err := c.currentToken()
+	if err != nil {
+		return err
+	}
 	params := url.Values{}
 	c.addTeamParam(&params)
 	// only add a ? if it's actually needed (makes logging cleaner)
@@ -27,10 +123,20 @@ func (c *APIClient) PutArtifact(hash string, artifactBody []byte, duration int,
 		encoded = "?" + encoded
 	}
 
-	requestURL := c.makeURL("/v8/artifacts/" + hash + encoded)
+	requestURL := c.makeURL("/v8/artifacts/" + c.artifactKey(hash) + encoded)
 	allowAuth := true
 	if c.usePreflight {
-		resp, latestRequestURL, err := c.doPreflight(requestURL, http.MethodPut, "Content-Type, x-artifact-duration, Authorization, User-Agent, x-artifact-tag")
+		requestHeaders := "Content-Type, x-artifact-duration, Authorization, User-Agent, x-artifact-tag"
+		if signedAt != "" {
+			requestHeaders += ", x-artifact-signed-at"
+		}
+		if deltaBase != "" {
+			requestHeaders += ", x-artifact-delta-base"
+		}
+		if immutable {
+			requestHeaders += ", x-artifact-immutable"
+		}
+		resp, latestRequestURL, err := c.doPreflight(requestURL, http.MethodPut, requestHeaders)
 		if err != nil {
 			return fmt.Errorf("pre-flight request failed before trying to store in HTTP cache: %w", err)
 		}
@@ -41,9 +147,13 @@ func (c *APIClient) PutArtifact(hash string, artifactBody []byte, duration int,
 
 	req, err := retryablehttp.NewRequest(http.MethodPut, requestURL, artifactBody)
 	req.Header.Set("Content-Type", "application/octet-stream")
+	if deltaBase != "" {
+		req.Header.Set("Content-Type", "application/vnd.turbo.artifact-delta")
+		req.Header.Set("x-artifact-delta-base", deltaBase)
+	}
 	req.Header.Set("x-artifact-duration", fmt.Sprintf("%v", duration))
 	if allowAuth {
-		req.Header.Set("Authorization", "Bearer "+c.token)
+		req.Header.Set("Authorization", "Bearer "+token)
 	}
 	req.Header.Set("User-Agent", c.userAgent())
 	if ci.IsCi() {
@@ -52,18 +162,35 @@ func (c *APIClient) PutArtifact(hash string, artifactBody []byte, duration int,
 	if tag != "" {
 		req.Header.Set("x-artifact-tag", tag)
 	}
+	if signedAt != "" {
+		req.Header.Set("x-artifact-signed-at", signedAt)
+	}
+	if immutable {
+		req.Header.Set("x-artifact-immutable", "true")
+	}
 	if err != nil {
 		return fmt.Errorf("[WARNING] Invalid cache URL: %w", err)
 	}
+	req.ContentLength = size
 
 	resp, err := c.HTTPClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("[ERROR] Failed to store files in HTTP cache: %w", err)
 	}
 	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode == http.StatusUnauthorized {
+		c.expireToken()
+		return util.ErrUnauthorized
+	}
 	if resp.StatusCode == http.StatusForbidden {
 		return c.handle403(resp.Body)
 	}
+	if deltaBase != "" && (resp.StatusCode == http.StatusUnsupportedMediaType || resp.StatusCode == http.StatusNotImplemented) {
+		return util.ErrDeltaUnsupported
+	}
+	if resp.StatusCode == http.StatusConflict || resp.StatusCode == http.StatusLocked {
+		return util.ErrArtifactImmutable
+	}
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("[ERROR] Failed to store files in HTTP cache: %s against URL %s", resp.Status, requestURL)
 	}
@@ -72,16 +199,95 @@ func (c *APIClient) PutArtifact(hash string, artifactBody []byte, duration int,
 
 // FetchArtifact attempts to retrieve the build artifact with the given hash from the remote cache
 func (c *APIClient) FetchArtifact(hash string) (*http.Response, error) {
-	return c.getArtifact(hash, http.MethodGet)
+	return c.getArtifact(hash, http.MethodGet, "", "", 0)
+}
+
+// FetchArtifactIfNoneMatch is like FetchArtifact, but sends If-None-Match so the
+// server can respond with 304 Not Modified if our copy with the given ETag is current.
+func (c *APIClient) FetchArtifactIfNoneMatch(hash string, etag string) (*http.Response, error) {
+	return c.getArtifact(hash, http.MethodGet, etag, "", 0)
+}
+
+// FetchArtifactRange is like FetchArtifact, but requests only bytes start
+// through end, inclusive, of the artifact as the backend stores it. Backends
+// that support ranges respond with 206 Partial Content; others may ignore the
+// range and respond with the whole artifact.
+func (c *APIClient) FetchArtifactRange(hash string, start int64, end int64) (*http.Response, error) {
+	return c.getArtifact(hash, http.MethodGet, "", fmt.Sprintf("bytes=%d-%d", start, end), 0)
+}
+
+// FetchArtifactFromReplica is like FetchArtifact, but reads from the given
+// replica: 0 is the primary, and i is the i-th base URL passed to
+// SetReadReplicas.
+func (c *APIClient) FetchArtifactFromReplica(hash string, replica int) (*http.Response, error) {
+	if replica < 0 || replica > len(c.replicaURLs) {
+		return nil, fmt.Errorf("no replica %v of the remote cache", replica)
+	}
+	return c.getArtifact(hash, http.MethodGet, "", "", replica)
+}
+
+// ReportBadArtifact tells the remote cache that the artifact for hash failed
+// verification, and why, so that operators can investigate and purge it.
+// Backends that don't accept reports respond with 404, 405 or 501, and the
+// report is dropped without an error.
+func (c *APIClient) ReportBadArtifact(hash string, reason string) error {
+	body, err := json.Marshal(map[string]string{"reason": reason})
+	if err != nil {
+		return err
+	}
+	resp, err := c.request("/v8/artifacts/"+c.artifactKey(hash)+"/report", http.MethodPost, body)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusAccepted, http.StatusNoContent:
+		return nil
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return nil
+	case http.StatusUnauthorized:
+		c.expireToken()
+		return util.ErrUnauthorized
+	}
+	return fmt.Errorf("failed to report bad artifact: %s", resp.Status)
+}
+
+// FetchCapabilities asks the remote cache which optional features it
+// supports, with GET /v8/artifacts/capabilities, to which a backend responds
+// with a JSON object like {"capabilities": ["ranges", "deltas"]}. It reports
+// false, without an error, if the backend has no such endpoint and responds
+// with 404, 405 or 501.
+func (c *APIClient) FetchCapabilities() ([]string, bool, error) {
+	resp, err := c.request("/v8/artifacts/capabilities", http.MethodGet, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var discovery struct {
+			Capabilities []string `json:"capabilities"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&discovery); err != nil {
+			return nil, false, fmt.Errorf("failed to parse remote cache capabilities: %w", err)
+		}
+		return discovery.Capabilities, true, nil
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return nil, false, nil
+	case http.StatusUnauthorized:
+		c.expireToken()
+		return nil, false, util.ErrUnauthorized
+	}
+	return nil, false, fmt.Errorf("failed to fetch remote cache capabilities: %s", resp.Status)
 }
 
 // ArtifactExists attempts to determine if the build artifact with the given hash exists in the Remote Caching server
 func (c *APIClient) ArtifactExists(hash string) (*http.Response, error) {
-	return c.getArtifact(hash, http.MethodHead)
+	return c.getArtifact(hash, http.MethodHead, "", "", 0)
 }
 
 // getArtifact attempts to retrieve the build artifact with the given hash from the remote cache
-func (c *APIClient) getArtifact(hash string, httpMethod string) (*http.Response, error) {
+func (c *APIClient) getArtifact(hash string, httpMethod string, ifNoneMatch string, byteRange string, replica int) (*http.Response, error) {
 	if httpMethod != http.MethodHead && httpMethod != http.MethodGet {
 		return nil, fmt.Errorf("invalid httpMethod %v, expected GET or HEAD", httpMethod)
 	}
@@ -89,6 +295,10 @@ func (c *APIClient) getArtifact(hash string, httpMethod string) (*http.Response,
 	if err := c.okToRequest(); err != nil {
 		return nil, err
 	}
+	token, err := c.currentToken()
+	if err != nil {
+		return nil, err
+	}
 	params := url.Values{}
 	c.addTeamParam(&params)
 	// only add a ? if it's actually needed (makes logging cleaner)
@@ -97,7 +307,10 @@ func (c *APIClient) getArtifact(hash string, httpMethod string) (*http.Response,
 		encoded = "?" + encoded
 	}
 
-	requestURL := c.makeURL("/v8/artifacts/" + hash + encoded)
+	requestURL := c.makeURL("/v8/artifacts/" + c.artifactKey(hash) + encoded)
+	if replica > 0 {
+		requestURL = fmt.Sprintf("%v/v8/artifacts/%v%v", c.replicaURLs[replica-1], c.artifactKey(hash), encoded)
+	}
 	allowAuth := true
 	if c.usePreflight {
 		resp, latestRequestURL, err := c.doPreflight(requestURL, http.MethodGet, "Authorization, User-Agent")
@@ -111,9 +324,21 @@ func (c *APIClient) getArtifact(hash string, httpMethod string) (*http.Response,
 
 	req, err := retryablehttp.NewRequest(httpMethod, requestURL, nil)
 	if allowAuth {
-		req.Header.Set("Authorization", "Bearer "+c.token)
+		req.Header.Set("Authorization", "Bearer "+token)
 	}
 	req.Header.Set("User-Agent", c.userAgent())
+	if httpMethod == http.MethodGet {
+		// Let the backend serve artifacts in whichever compression it stored them.
+		// Setting this ourselves also stops net/http from transparently un-gzipping
+		// the body, which we handle when restoring.
+		req.Header.Set("Accept-Encoding", "zstd, gzip")
+	}
+	if ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("invalid cache URL: %w", err)
 	}
@@ -121,6 +346,10 @@ func (c *APIClient) getArtifact(hash string, httpMethod string) (*http.Response,
 	resp, err := c.HTTPClient.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch artifact: %v", err)
+	} else if resp.StatusCode == http.StatusUnauthorized {
+		_ = resp.Body.Close()
+		c.expireToken()
+		return nil, util.ErrUnauthorized
 	} else if resp.StatusCode == http.StatusForbidden {
 		err = c.handle403(resp.Body)
 		_ = resp.Body.Close()
@@ -141,7 +370,8 @@ func (c *APIClient) handle403(body io.Reader) error {
 	}
 	disabledErr, err := apiError.cacheDisabled()
 	if err != nil {
-		return err
+		// Any other 403 means our credentials aren't good enough.
+		return fmt.Errorf("%w: %v", util.ErrUnauthorized, err)
 	}
 	return disabledErr
 }
@@ -7,10 +7,12 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"runtime"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -18,6 +20,7 @@ import (
 	"github.com/hashicorp/go-retryablehttp"
 	"github.com/vercel/turbo/cli/internal/ci"
 	"github.com/vercel/turbo/cli/internal/turbostate"
+	"github.com/vercel/turbo/cli/internal/util"
 )
 
 // APIClient is the main interface for making network requests to Vercel
@@ -29,13 +32,36 @@ type APIClient struct {
 
 	// Must be used via atomic package
 	currentFailCount uint64
+	// connectionResets counts dropped connections; see _freeConnectionResets.
+	// Must be used via atomic package.
+	connectionResets uint64
 	HTTPClient       *retryablehttp.Client
 	teamID           string
 	teamSlug         string
 	// Whether or not to send preflight requests before uploads
 	usePreflight bool
+	// If set, retries are only attempted while the budget allows them
+	retryBudget *util.RetryBudget
+	// Prepended to hashes to form artifact keys; see SetArtifactPathPrefix
+	artifactPathPrefix string
+	// Whether artifact keys start with a shard of the hash; see SetShardKeys
+	shardKeys bool
+	// Base URLs of read replicas; see SetReadReplicas
+	replicaURLs []string
+	// If set, consulted for the token before requests; see SetTokenProvider
+	tokenProvider TokenProvider
+	tokenExpiry   time.Time
+	tokenMu       sync.Mutex
 }
 
+// TokenProvider returns a token for the API and when it expires. A zero expiry
+// means the token doesn't expire.
+type TokenProvider = func() (token string, expiry time.Time, err error)
+
+// _tokenRefreshMargin is how long before a provided token expires that the
+// provider is asked for a new one, so requests in flight don't outlive it.
+const _tokenRefreshMargin = time.Minute
+
 // ErrTooManyFailures is returned from remote cache API methods after `maxRemoteFailCount` errors have occurred
 var ErrTooManyFailures = errors.New("skipping HTTP Request, too many failures have occurred")
 
@@ -43,11 +69,63 @@ var ErrTooManyFailures = errors.New("skipping HTTP Request, too many failures ha
 // artifacts to the remote cache
 const _maxRemoteFailCount = uint64(3)
 
+// _freeConnectionResets is how many dropped connections are retried before
+// further ones count towards _maxRemoteFailCount. Backends recycle
+// connections routinely, but one that keeps dropping them is failing.
+const _freeConnectionResets = uint64(3)
+
 // SetToken updates the APIClient's Token
 func (c *APIClient) SetToken(token string) {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
 	c.token = token
 }
 
+// SetTokenProvider makes the client get its token from provider, e.g. so a
+// long-running daemon's scoped token can rotate without a restart. The token
+// is kept until shortly before its expiry, or until a request is rejected as
+// unauthorized, and then the provider is asked for a new one.
+func (c *APIClient) SetTokenProvider(provider TokenProvider) {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	c.tokenProvider = provider
+	c.tokenExpiry = time.Time{}
+	c.token = ""
+}
+
+// currentToken returns the token to send, first getting a new one from the
+// token provider if the current one is missing or about to expire. Provider
+// failures are returned as util.ErrTokenUnavailable.
+func (c *APIClient) currentToken() (string, error) {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	if c.tokenProvider == nil {
+		return c.token, nil
+	}
+	if c.token != "" && (c.tokenExpiry.IsZero() || time.Now().Add(_tokenRefreshMargin).Before(c.tokenExpiry)) {
+		return c.token, nil
+	}
+	token, expiry, err := c.tokenProvider()
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", util.ErrTokenUnavailable, err)
+	}
+	if token == "" {
+		return "", fmt.Errorf("%w: the token provider returned an empty token", util.ErrTokenUnavailable)
+	}
+	c.token, c.tokenExpiry = token, expiry
+	return token, nil
+}
+
+// expireToken discards a provided token that was rejected, so that the next
+// request gets a new one.
+func (c *APIClient) expireToken() {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	if c.tokenProvider != nil {
+		c.token = ""
+	}
+}
+
 // NewClient creates a new APIClient
 func NewClient(config turbostate.APIClientConfig, logger hclog.Logger, turboVersion string) *APIClient {
 	client := &APIClient{
@@ -72,9 +150,87 @@ func NewClient(config turbostate.APIClientConfig, logger hclog.Logger, turboVers
 	return client
 }
 
+// SetRetryBudget shares a retry budget across every request made by this client.
+// Once the budget is exhausted, failed requests are not retried.
+func (c *APIClient) SetRetryBudget(budget *util.RetryBudget) {
+	c.retryBudget = budget
+}
+
+// SetDialContext makes the client open connections with dialContext instead of
+// the standard dialer, e.g. to resolve the API host with a custom resolver or
+// to route it through a local proxy.
+func (c *APIClient) SetDialContext(dialContext func(ctx context.Context, network, addr string) (net.Conn, error)) {
+	c.transport().DialContext = dialContext
+}
+
+// SetConnectionPool configures how many idle connections the client keeps
+// open, in total and per host, and how long they're kept before closing.
+func (c *APIClient) SetConnectionPool(maxIdleConns int, maxIdleConnsPerHost int, idleConnTimeout time.Duration) {
+	transport := c.transport()
+	transport.MaxIdleConns = maxIdleConns
+	transport.MaxIdleConnsPerHost = maxIdleConnsPerHost
+	transport.IdleConnTimeout = idleConnTimeout
+}
+
+// SetPipelining makes concurrent requests share a single HTTP/2 connection,
+// if the backend negotiates HTTP/2, rather than each dialing their own when
+// a burst of them starts at once. The first request is made alone; the rest
+// wait for its response and are then multiplexed over its connection.
+// Backends that only speak HTTP/1.1 see just that first request serialized.
+func (c *APIClient) SetPipelining(enabled bool) {
+	transport := c.transport()
+	if !enabled {
+		c.HTTPClient.HTTPClient.Transport = transport
+		return
+	}
+	transport.ForceAttemptHTTP2 = true
+	c.HTTPClient.HTTPClient.Transport = &pipelinedTransport{Transport: transport, ready: make(chan struct{})}
+}
+
+// pipelinedTransport holds back requests until the first one has a response,
+// by which time its connection has negotiated HTTP/2 and can be shared.
+// Requests waiting here may hold a slot of the caller's concurrency limit,
+// but so does the first request, so it always completes and lets them go.
+type pipelinedTransport struct {
+	*http.Transport
+	first sync.Once
+	ready chan struct{}
+}
+
+func (pt *pipelinedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	isFirst := false
+	pt.first.Do(func() { isFirst = true })
+	if isFirst {
+		defer close(pt.ready)
+		return pt.Transport.RoundTrip(req)
+	}
+	select {
+	case <-pt.ready:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	return pt.Transport.RoundTrip(req)
+}
+
+// transport returns the client's own transport, creating it from the default
+// transport the first time it's customized.
+func (c *APIClient) transport() *http.Transport {
+	switch transport := c.HTTPClient.HTTPClient.Transport.(type) {
+	case *http.Transport:
+		return transport
+	case *pipelinedTransport:
+		return transport.Transport
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	c.HTTPClient.HTTPClient.Transport = transport
+	return transport
+}
+
 // hasUser returns true if we have credentials for a user
 func (c *APIClient) hasUser() bool {
-	return c.token != ""
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	return c.token != "" || c.tokenProvider != nil
 }
 
 // IsLinked returns true if we have a user and linked team
@@ -94,6 +250,17 @@ func (c *APIClient) retryCachePolicy(resp *http.Response, err error) (bool, erro
 			atomic.AddUint64(&c.currentFailCount, 1)
 			return false, err
 		}
+		if util.IsConnectionReset(err) {
+			// The server dropped the connection, e.g. with a GOAWAY while
+			// scaling down, rather than failing the request. Retry on a fresh
+			// connection, only counting it against the server if it keeps
+			// happening.
+			c.HTTPClient.HTTPClient.CloseIdleConnections()
+			if atomic.AddUint64(&c.connectionResets, 1) > _freeConnectionResets {
+				atomic.AddUint64(&c.currentFailCount, 1)
+			}
+			return true, nil
+		}
 		atomic.AddUint64(&c.currentFailCount, 1)
 		return true, nil
 	}
@@ -134,6 +301,13 @@ func (c *APIClient) checkRetry(ctx context.Context, resp *http.Response, err err
 		if retryErr := c.okToRequest(); retryErr != nil {
 			return false, retryErr
 		}
+		if c.retryBudget != nil && !c.retryBudget.TryRetry() {
+			return false, err
+		}
+	} else if err == nil && c.retryBudget != nil && resp != nil && resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		// Only requests that succeeded earn retries; a 4xx is final, but it
+		// isn't a success.
+		c.retryBudget.RecordSuccess()
 	}
 	return shouldRetry, err
 }
@@ -157,11 +331,15 @@ func (c *APIClient) userAgent() string {
 
 // doPreflight returns response with closed body, latest request url, and any errors to the caller
 func (c *APIClient) doPreflight(requestURL string, requestMethod string, requestHeaders string) (*http.Response, string, error) {
+	token, err := c.currentToken()
+	if err != nil {
+		return nil, requestURL, err
+	}
 	req, err := retryablehttp.NewRequest(http.MethodOptions, requestURL, nil)
 	req.Header.Set("User-Agent", c.userAgent())
 	req.Header.Set("Access-Control-Request-Method", requestMethod)
 	req.Header.Set("Access-Control-Request-Headers", requestHeaders)
-	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Authorization", "Bearer "+token)
 	if err != nil {
 		return nil, requestURL, fmt.Errorf("[WARNING] Invalid cache URL: %w", err)
 	}
@@ -240,6 +418,10 @@ func (c *APIClient) request(endpoint string, method string, body []byte) (*http.
 	if err := c.okToRequest(); err != nil {
 		return nil, err
 	}
+	token, err := c.currentToken()
+	if err != nil {
+		return nil, err
+	}
 
 	params := url.Values{}
 	c.addTeamParam(&params)
@@ -272,7 +454,7 @@ func (c *APIClient) request(endpoint string, method string, body []byte) (*http.
 	req.Header.Set("User-Agent", c.userAgent())
 
 	if allowAuth {
-		req.Header.Set("Authorization", "Bearer "+c.token)
+		req.Header.Set("Authorization", "Bearer "+token)
 	}
 
 	if ci.IsCi() {
@@ -2,13 +2,19 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/hashicorp/go-hclog"
@@ -130,6 +136,130 @@ func Test_PutWhenCachingDisabled(t *testing.T) {
 	}
 }
 
+func Test_PutArtifactImmutable(t *testing.T) {
+	protected := map[string]bool{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer func() { _ = req.Body.Close() }()
+		if protected[req.URL.Path] {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		protected[req.URL.Path] = req.Header.Get("x-artifact-immutable") == "true"
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	apiClient := NewClient(turbostate.APIClientConfig{
+		TeamSlug: "my-team-slug",
+		APIURL:   ts.URL,
+		Token:    "my-token",
+	}, hclog.Default(), "v1")
+	artifactBody := []byte("My string artifact")
+
+	if err := apiClient.PutArtifact("mutable", artifactBody, 500, ""); err != nil {
+		t.Fatalf("PutArtifact: %v", err)
+	}
+	if err := apiClient.PutArtifact("mutable", artifactBody, 500, ""); err != nil {
+		t.Errorf("overwriting a regular artifact: %v", err)
+	}
+	if err := apiClient.PutArtifactImmutable("pinned", bytes.NewReader(artifactBody), int64(len(artifactBody)), 500, "", ""); err != nil {
+		t.Fatalf("PutArtifactImmutable: %v", err)
+	}
+	if err := apiClient.PutArtifact("pinned", artifactBody, 500, ""); !errors.Is(err, util.ErrArtifactImmutable) {
+		t.Errorf("overwriting a pinned artifact got %v, want %v", err, util.ErrArtifactImmutable)
+	}
+}
+
+func Test_RetryConnectionReset(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		if requests%2 == 1 {
+			// Drop the connection partway through the response, like a
+			// backend recycling connections. Some of the response is sent,
+			// so that the transport doesn't quietly retry the request itself.
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Errorf("Hijack: %v", err)
+				return
+			}
+			_, _ = conn.Write([]byte("HTTP/1.1 200 OK\r\n"))
+			_ = conn.Close()
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	apiClient := NewClient(turbostate.APIClientConfig{
+		TeamSlug: "my-team-slug",
+		APIURL:   ts.URL,
+		Token:    "my-token",
+	}, hclog.Default(), "v1")
+	apiClient.HTTPClient.RetryWaitMin = time.Millisecond
+	apiClient.HTTPClient.RetryWaitMax = time.Millisecond
+
+	// The first few resets are retried for free; after that they count
+	// against the server like any other failure.
+	fetches := int(_freeConnectionResets + _maxRemoteFailCount - 1)
+	for i := 0; i < fetches; i++ {
+		resp, err := apiClient.FetchArtifact("hash")
+		if err != nil {
+			t.Fatalf("FetchArtifact: %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("FetchArtifact got status %v, want 200", resp.StatusCode)
+		}
+	}
+	if requests != 2*fetches {
+		t.Errorf("server got %v requests, want %v", requests, 2*fetches)
+	}
+	// retryablehttp reports why it gave up without wrapping the error.
+	if _, err := apiClient.FetchArtifact("hash"); err == nil || !strings.Contains(err.Error(), ErrTooManyFailures.Error()) {
+		t.Errorf("FetchArtifact after repeated resets = %v, want ErrTooManyFailures", err)
+	}
+}
+
+func Test_RetryBudgetCountsOnlySuccesses(t *testing.T) {
+	status := http.StatusNotFound
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	apiClient := NewClient(turbostate.APIClientConfig{
+		TeamSlug: "my-team-slug",
+		APIURL:   ts.URL,
+		Token:    "my-token",
+	}, hclog.Default(), "v1")
+	budget := util.NewRetryBudget(1, 1)
+	apiClient.SetRetryBudget(budget)
+	if !budget.TryRetry() {
+		t.Fatal("expected the reserve to allow a retry")
+	}
+
+	// A miss isn't a success, so it doesn't replenish the budget.
+	resp, err := apiClient.FetchArtifact("hash")
+	if err != nil {
+		t.Fatalf("FetchArtifact: %v", err)
+	}
+	_ = resp.Body.Close()
+	if budget.TryRetry() {
+		t.Error("a 404 replenished the retry budget")
+	}
+
+	status = http.StatusOK
+	resp, err = apiClient.FetchArtifact("hash")
+	if err != nil {
+		t.Fatalf("FetchArtifact: %v", err)
+	}
+	_ = resp.Body.Close()
+	if !budget.TryRetry() {
+		t.Error("a 200 didn't replenish the retry budget")
+	}
+}
+
 func Test_FetchWhenCachingDisabled(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		defer func() { _ = req.Body.Close() }()
@@ -158,3 +288,318 @@ func Test_FetchWhenCachingDisabled(t *testing.T) {
 		t.Errorf("response got %v, want <nil>", resp)
 	}
 }
+
+func Test_SetDialContext(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	apiClientConfig := turbostate.APIClientConfig{
+		TeamSlug: "my-team-slug",
+		// Not resolvable, so the request only succeeds via the custom dialer.
+		APIURL: "http://cache.invalid",
+		Token:  "my-token",
+	}
+	apiClient := NewClient(apiClientConfig, hclog.Default(), "v1")
+	var dialed string
+	apiClient.SetDialContext(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = addr
+		return (&net.Dialer{}).DialContext(ctx, network, ts.Listener.Addr().String())
+	})
+
+	resp, err := apiClient.ArtifactExists("hash")
+	if err != nil {
+		t.Fatalf("ArtifactExists: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status got %v, want %v", resp.StatusCode, http.StatusNotFound)
+	}
+	if dialed != "cache.invalid:80" {
+		t.Errorf("dialed %v, want cache.invalid:80", dialed)
+	}
+}
+
+func Test_SetConnectionPool(t *testing.T) {
+	apiClient := NewClient(turbostate.APIClientConfig{APIURL: "http://cache.invalid"}, hclog.Default(), "v1")
+	dialContext := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, errors.New("not dialing")
+	}
+	apiClient.SetDialContext(dialContext)
+	apiClient.SetConnectionPool(50, 20, time.Minute)
+
+	transport, ok := apiClient.HTTPClient.HTTPClient.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("transport got %T, want *http.Transport", apiClient.HTTPClient.HTTPClient.Transport)
+	}
+	if transport.MaxIdleConns != 50 || transport.MaxIdleConnsPerHost != 20 || transport.IdleConnTimeout != time.Minute {
+		t.Errorf("pool got (%v, %v, %v), want (50, 20, 1m0s)", transport.MaxIdleConns, transport.MaxIdleConnsPerHost, transport.IdleConnTimeout)
+	}
+	if transport.DialContext == nil {
+		t.Error("custom dialer was dropped when tuning the connection pool")
+	}
+	if http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost == 20 {
+		t.Error("default transport was modified")
+	}
+}
+
+func Test_SetArtifactPathPrefix(t *testing.T) {
+	var paths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		paths = append(paths, req.URL.EscapedPath())
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	apiClient := NewClient(turbostate.APIClientConfig{APIURL: ts.URL, TeamID: "team_id"}, hclog.Default(), "v1")
+	if err := apiClient.SetArtifactPathPrefix("/team a/ci/"); err != nil {
+		t.Fatalf("SetArtifactPathPrefix: %v", err)
+	}
+	resp, err := apiClient.FetchArtifact("hash")
+	if err != nil {
+		t.Fatalf("FetchArtifact: %v", err)
+	}
+	resp.Body.Close()
+	if err := apiClient.PutArtifact("hash", []byte("body"), 0, ""); err != nil {
+		t.Fatalf("PutArtifact: %v", err)
+	}
+	want := []string{"/v8/artifacts/team%20a/ci/hash", "/v8/artifacts/team%20a/ci/hash"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("paths got %v, want %v", paths, want)
+	}
+
+	for _, prefix := range []string{"a//b", "../b", "a/./b"} {
+		if err := apiClient.SetArtifactPathPrefix(prefix); err == nil {
+			t.Errorf("SetArtifactPathPrefix(%q) succeeded, want an error", prefix)
+		}
+	}
+}
+
+func Test_SetShardKeys(t *testing.T) {
+	var paths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		paths = append(paths, req.URL.EscapedPath())
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	apiClient := NewClient(turbostate.APIClientConfig{APIURL: ts.URL, TeamID: "team_id"}, hclog.Default(), "v1")
+	if err := apiClient.SetArtifactPathPrefix("ci"); err != nil {
+		t.Fatalf("SetArtifactPathPrefix: %v", err)
+	}
+	apiClient.SetShardKeys(true)
+	for _, hash := range []string{"hash", "other-hash"} {
+		resp, err := apiClient.FetchArtifact(hash)
+		if err != nil {
+			t.Fatalf("FetchArtifact: %v", err)
+		}
+		resp.Body.Close()
+		if err := apiClient.PutArtifact(hash, []byte("body"), 0, ""); err != nil {
+			t.Fatalf("PutArtifact: %v", err)
+		}
+	}
+	// The shards are the first byte of sha256("hash") and sha256("other-hash").
+	want := []string{
+		"/v8/artifacts/ci/d0/hash", "/v8/artifacts/ci/d0/hash",
+		"/v8/artifacts/ci/71/other-hash", "/v8/artifacts/ci/71/other-hash",
+	}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("paths got %v, want %v", paths, want)
+	}
+}
+
+func Test_FetchArtifactFromReplica(t *testing.T) {
+	serve := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte(name + " " + req.URL.Path))
+		}))
+	}
+	primary := serve("primary")
+	defer primary.Close()
+	replica := serve("replica")
+	defer replica.Close()
+
+	apiClient := NewClient(turbostate.APIClientConfig{APIURL: primary.URL, TeamID: "team_id"}, hclog.Default(), "v1")
+	apiClient.SetReadReplicas([]string{replica.URL})
+	for i, want := range []string{"primary /v8/artifacts/hash", "replica /v8/artifacts/hash"} {
+		resp, err := apiClient.FetchArtifactFromReplica("hash", i)
+		if err != nil {
+			t.Fatalf("FetchArtifactFromReplica(%v): %v", i, err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != want {
+			t.Errorf("FetchArtifactFromReplica(%v) got %q, want %q", i, body, want)
+		}
+	}
+	if _, err := apiClient.FetchArtifactFromReplica("hash", 2); err == nil {
+		t.Error("FetchArtifactFromReplica(2) succeeded, want an error")
+	}
+}
+
+func Test_SetPipelining(t *testing.T) {
+	var conns, http2 int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor == 2 {
+			atomic.AddInt32(&http2, 1)
+		}
+		time.Sleep(10 * time.Millisecond)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	ts.EnableHTTP2 = true
+	ts.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	apiClient := NewClient(turbostate.APIClientConfig{APIURL: ts.URL, TeamID: "team_id"}, hclog.Default(), "v1")
+	apiClient.SetPipelining(true)
+	apiClient.transport().TLSClientConfig = ts.Client().Transport.(*http.Transport).TLSClientConfig
+
+	const requests = 10
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := apiClient.FetchArtifact("hash")
+			if err != nil {
+				t.Errorf("FetchArtifact: %v", err)
+				return
+			}
+			_ = resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+	if got := atomic.LoadInt32(&http2); got != requests {
+		t.Errorf("HTTP/2 requests got %v, want %v", got, requests)
+	}
+	if got := atomic.LoadInt32(&conns); got != 1 {
+		t.Errorf("connections got %v, want 1", got)
+	}
+
+	apiClient.SetPipelining(false)
+	if _, ok := apiClient.HTTPClient.HTTPClient.Transport.(*http.Transport); !ok {
+		t.Errorf("transport got %T, want *http.Transport", apiClient.HTTPClient.HTTPClient.Transport)
+	}
+}
+
+func Test_ReportBadArtifact(t *testing.T) {
+	status := http.StatusOK
+	var gotPath, gotReason string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer func() { _ = req.Body.Close() }()
+		var report struct{ Reason string }
+		if err := json.NewDecoder(req.Body).Decode(&report); err != nil {
+			t.Errorf("decoding report: %v", err)
+		}
+		gotPath, gotReason = req.URL.Path, report.Reason
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	apiClient := NewClient(turbostate.APIClientConfig{APIURL: ts.URL, TeamID: "team_id", Token: "my-token"}, hclog.Default(), "v1")
+	if err := apiClient.ReportBadArtifact("hash", "tag mismatch"); err != nil {
+		t.Fatalf("ReportBadArtifact: %v", err)
+	}
+	if gotPath != "/v8/artifacts/hash/report" || gotReason != "tag mismatch" {
+		t.Errorf("report sent to %v with reason %q", gotPath, gotReason)
+	}
+
+	// Backends without reports aren't an error.
+	status = http.StatusNotImplemented
+	if err := apiClient.ReportBadArtifact("hash", "tag mismatch"); err != nil {
+		t.Errorf("ReportBadArtifact to a backend without reports: %v", err)
+	}
+	status = http.StatusBadRequest
+	if err := apiClient.ReportBadArtifact("hash", "tag mismatch"); err == nil {
+		t.Error("ReportBadArtifact succeeded despite a 400")
+	}
+}
+
+func Test_FetchCapabilities(t *testing.T) {
+	status := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v8/artifacts/capabilities" {
+			t.Errorf("capabilities requested from %v", req.URL.Path)
+		}
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(`{"capabilities":["ranges","deltas"]}`))
+	}))
+	defer ts.Close()
+
+	apiClient := NewClient(turbostate.APIClientConfig{APIURL: ts.URL, TeamID: "team_id", Token: "my-token"}, hclog.Default(), "v1")
+	capabilities, ok, err := apiClient.FetchCapabilities()
+	if err != nil {
+		t.Fatalf("FetchCapabilities: %v", err)
+	}
+	if !ok || !reflect.DeepEqual(capabilities, []string{"ranges", "deltas"}) {
+		t.Errorf("FetchCapabilities got (%v, %v), want ([ranges deltas], true)", capabilities, ok)
+	}
+
+	// Backends without discovery aren't an error.
+	status = http.StatusNotFound
+	if _, ok, err := apiClient.FetchCapabilities(); ok || err != nil {
+		t.Errorf("FetchCapabilities from a backend without discovery got (%v, %v), want (false, <nil>)", ok, err)
+	}
+	status = http.StatusBadRequest
+	if _, _, err := apiClient.FetchCapabilities(); err == nil {
+		t.Error("FetchCapabilities succeeded despite a 400")
+	}
+}
+
+func Test_SetTokenProvider(t *testing.T) {
+	var auths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		auths = append(auths, req.Header.Get("Authorization"))
+		if req.Header.Get("Authorization") == "Bearer revoked" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	tokens := []string{"expiring", "revoked", "fresh"}
+	expiries := []time.Time{time.Now().Add(30 * time.Second), time.Now().Add(time.Hour), {}}
+	calls := 0
+	apiClient := NewClient(turbostate.APIClientConfig{APIURL: ts.URL, TeamID: "team_id", Token: "static"}, hclog.Default(), "v1")
+	apiClient.SetTokenProvider(func() (string, time.Time, error) {
+		calls++
+		return tokens[calls-1], expiries[calls-1], nil
+	})
+
+	// A token near expiry is replaced before the next request, as is one the
+	// server rejects. Otherwise the token is reused.
+	for i, wantErr := range []error{nil, util.ErrUnauthorized, nil, nil} {
+		resp, err := apiClient.FetchArtifact("hash")
+		if !errors.Is(err, wantErr) {
+			t.Fatalf("FetchArtifact #%v got %v, want %v", i, err, wantErr)
+		}
+		if err == nil {
+			resp.Body.Close()
+		}
+	}
+	want := []string{"Bearer expiring", "Bearer revoked", "Bearer fresh", "Bearer fresh"}
+	if !reflect.DeepEqual(auths, want) {
+		t.Errorf("sent %v, want %v", auths, want)
+	}
+	if calls != 3 {
+		t.Errorf("provider called %v times, want 3", calls)
+	}
+
+	apiClient.SetTokenProvider(func() (string, time.Time, error) {
+		return "", time.Time{}, errors.New("vault is sealed")
+	})
+	if _, err := apiClient.FetchArtifact("hash"); !errors.Is(err, util.ErrTokenUnavailable) {
+		t.Errorf("FetchArtifact got %v, want ErrTokenUnavailable", err)
+	}
+	if err := apiClient.PutArtifact("hash", []byte("body"), 0, ""); !errors.Is(err, util.ErrTokenUnavailable) {
+		t.Errorf("PutArtifact got %v, want ErrTokenUnavailable", err)
+	}
+}
@@ -439,7 +439,10 @@ func (r *run) initCache(ctx gocontext.Context, rs *runSpec, analyticsClient anal
 	// Theoretically this is overkill, but bias towards not spamming the console
 	once := &sync.Once{}
 
-	return cache.New(rs.Opts.cacheOpts, r.base.RepoRoot, apiClient, analyticsClient, func(_cache cache.Cache, err error) {
+	cacheOpts := rs.Opts.cacheOpts
+	cacheOpts.Logger = r.base.Logger.Named("cache")
+
+	return cache.New(cacheOpts, r.base.RepoRoot, apiClient, analyticsClient, func(_cache cache.Cache, err error) {
 		// Currently the HTTP Cache is the only one that can be disabled.
 		// With a cache system refactor, we might consider giving names to the caches so
 		// we can accurately report them here.
@@ -115,7 +115,7 @@ func (tc *TaskCache) RestoreOutputs(ctx context.Context, prefixedUI *cli.Prefixe
 		if tc.taskOutputMode != util.NoTaskOutput && tc.taskOutputMode != util.ErrorTaskOutput {
 			prefixedUI.Output(fmt.Sprintf("cache bypass, force executing %s", ui.Dim(tc.hash)))
 		}
-		return cache.ItemStatus{Local: false, Remote: false}, 0, nil
+		return cache.ItemStatus{Local: false, Remote: false, SkipReason: cache.SkipReasonBypassed}, 0, nil
 	}
 
 	changedOutputGlobs, timeSavedFromDaemon, err := tc.rc.outputWatcher.GetChangedOutputs(ctx, tc.hash, tc.repoRelativeGlobs.Inclusions)
@@ -143,11 +143,14 @@ func (tc *TaskCache) RestoreOutputs(ctx context.Context, prefixedUI *cli.Prefixe
 			// If there was an error fetching from cache, we'll say there was no cache hit
 			return cache.ItemStatus{Local: false, Remote: false}, 0, err
 		} else if !hit {
+			if itemStatus.MissReason == cache.MissReasonVerificationFailed {
+				prefixedUI.Warn(fmt.Sprintf("cached artifact for %v failed verification, rebuilding %s", tc.pt.TaskID, ui.Dim(tc.hash)))
+			}
 			if tc.taskOutputMode != util.NoTaskOutput && tc.taskOutputMode != util.ErrorTaskOutput {
 				prefixedUI.Output(fmt.Sprintf("cache miss, executing %s", ui.Dim(tc.hash)))
 			}
 			// If there was no hit, we can also say there was no hit
-			return cache.ItemStatus{Local: false, Remote: false}, 0, nil
+			return cache.ItemStatus{Local: false, Remote: false, MissReason: itemStatus.MissReason, SkipReason: itemStatus.SkipReason}, 0, nil
 		}
 
 		if err := tc.rc.outputWatcher.NotifyOutputsWritten(ctx, tc.hash, tc.repoRelativeGlobs, timeSavedFromDaemon); err != nil {
@@ -157,6 +160,7 @@ func (tc *TaskCache) RestoreOutputs(ctx context.Context, prefixedUI *cli.Prefixe
 	} else {
 		// If no outputs have changed, that means we have a local cache hit.
 		cacheStatus.Local = true
+		cacheStatus.Source = cache.ItemSourceLocal
 		timeSaved = timeSavedFromDaemon
 		prefixedUI.Warn(fmt.Sprintf("Skipping cache check for %v, outputs have not changed since previous run.", tc.pt.TaskID))
 	}
@@ -12,36 +12,43 @@ import (
 // TaskCacheSummary is an extended version of cache.ItemStatus
 // that includes TimeSaved and some better data.
 type TaskCacheSummary struct {
-	Local     bool   `json:"local"`            // Deprecated, but keeping around for --dry=json
-	Remote    bool   `json:"remote"`           // Deprecated, but keeping around for --dry=json
-	Status    string `json:"status"`           // should always be there
-	Source    string `json:"source,omitempty"` // can be empty on status:miss
-	TimeSaved int    `json:"timeSaved"`        // always include, but can be 0
+	Local      bool   `json:"local"`                // Deprecated, but keeping around for --dry=json
+	Remote     bool   `json:"remote"`               // Deprecated, but keeping around for --dry=json
+	Status     string `json:"status"`               // should always be there
+	Source     string `json:"source,omitempty"`     // can be empty on status:miss
+	SkipReason string `json:"skipReason,omitempty"` // only set on status:skipped
+	TimeSaved  int    `json:"timeSaved"`            // always include, but can be 0
 }
 
 // NewTaskCacheSummary decorates a cache.ItemStatus into a TaskCacheSummary
-// Importantly, it adds the derived keys of `source` and `status` based on
-// the local/remote booleans. It would be nice if these were just included
-// from upstream, but that is a more invasive change.
+// Importantly, it adds the derived key of `status` based on the local/remote
+// booleans, and `source` from the item, falling back to the booleans for
+// caches that don't report one. A lookup the cache skipped is reported as
+// skipped rather than as a miss, so it doesn't count against the hit rate.
 func NewTaskCacheSummary(itemStatus cache.ItemStatus, timeSaved *int) TaskCacheSummary {
 	status := cache.CacheEventMiss
 	if itemStatus.Local || itemStatus.Remote {
 		status = cache.CacheEventHit
+	} else if itemStatus.SkipReason != cache.SkipReasonNone {
+		status = cache.CacheEventSkipped
 	}
 
-	var source string
-	if itemStatus.Local {
+	// Prefer the layer the cache reports, e.g. its local mirror, over the
+	// one implied by the booleans.
+	source := string(itemStatus.Source)
+	if source == "" && itemStatus.Local {
 		source = cache.CacheSourceFS
-	} else if itemStatus.Remote {
+	} else if source == "" && itemStatus.Remote {
 		source = cache.CacheSourceRemote
 	}
 
 	cs := TaskCacheSummary{
 		// copy these over
-		Local:  itemStatus.Local,
-		Remote: itemStatus.Remote,
-		Status: status,
-		Source: source,
+		Local:      itemStatus.Local,
+		Remote:     itemStatus.Remote,
+		Status:     status,
+		Source:     source,
+		SkipReason: string(itemStatus.SkipReason),
 	}
 	// add in a dereferences timeSaved, should be 0 if nil
 	if timeSaved != nil {
@@ -0,0 +1,28 @@
+package util
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"syscall"
+)
+
+// IsConnectionReset reports whether err means the connection to a server went
+// away mid-request, rather than the server failing the request: an HTTP/2
+// GOAWAY, a connection reset by the peer or a write to a closed connection, or
+// a connection closed before the response was complete. A plain io.EOF isn't
+// one: readers return it at the end of every complete body. Load-balanced backends that recycle connections
+// cause these routinely, and a retry on a fresh connection usually succeeds.
+//
+// The standard library bundles its HTTP/2 implementation with unexported
+// error types, so GOAWAYs are recognized by their message.
+func IsConnectionReset(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	return strings.Contains(err.Error(), "GOAWAY")
+}
@@ -0,0 +1,30 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"testing"
+)
+
+func TestIsConnectionReset(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{io.EOF, false},
+		{fmt.Errorf("reading body: %w", io.EOF), false},
+		{errors.New("500 Internal Server Error"), false},
+		{io.ErrUnexpectedEOF, true},
+		{fmt.Errorf("read tcp: %w", syscall.ECONNRESET), true},
+		{fmt.Errorf("write tcp: %w", syscall.EPIPE), true},
+		{errors.New("http2: server sent GOAWAY and closed the connection"), true},
+	}
+	for _, tt := range tests {
+		if got := IsConnectionReset(tt.err); got != tt.want {
+			t.Errorf("IsConnectionReset(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package util
+
+import (
+	"math"
+	"sync"
+)
+
+// _retryTokenScale is the number of units in one retry token. Balances are kept
+// as integers so that repeated deposits of fractional ratios add up exactly.
+const _retryTokenScale = 1000
+
+// RetryBudget caps retries across many concurrent operations as a fraction of
+// successful requests, so that a struggling backend isn't hit by a storm of
+// retries from every in-flight operation at once.
+//
+// It is a token bucket: every success deposits `ratio` tokens, every retry
+// withdraws one. The bucket starts full and holds at most `reserve` tokens,
+// which allows a small burst of retries before any request has succeeded.
+type RetryBudget struct {
+	mu      sync.Mutex
+	deposit int64
+	reserve int64
+	balance int64
+}
+
+// NewRetryBudget creates a retry budget that allows retries up to `ratio`
+// times the number of successful requests, plus a burst of `reserve` retries.
+func NewRetryBudget(ratio float64, reserve int) *RetryBudget {
+	return &RetryBudget{
+		deposit: int64(math.Round(ratio * _retryTokenScale)),
+		reserve: int64(reserve) * _retryTokenScale,
+		balance: int64(reserve) * _retryTokenScale,
+	}
+}
+
+// RecordSuccess credits the budget for a successful request.
+func (rb *RetryBudget) RecordSuccess() {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.balance += rb.deposit
+	if rb.balance > rb.reserve {
+		rb.balance = rb.reserve
+	}
+}
+
+// TryRetry withdraws a retry from the budget. It returns false, without
+// withdrawing anything, if the budget is exhausted.
+func (rb *RetryBudget) TryRetry() bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if rb.balance < _retryTokenScale {
+		return false
+	}
+	rb.balance -= _retryTokenScale
+	return true
+}
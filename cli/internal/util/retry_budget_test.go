@@ -0,0 +1,40 @@
+package util
+
+import "testing"
+
+func TestRetryBudget(t *testing.T) {
+	budget := NewRetryBudget(0.1, 2)
+
+	// The reserve allows a burst of retries up front.
+	if !budget.TryRetry() || !budget.TryRetry() {
+		t.Fatal("expected the reserve to allow two retries")
+	}
+	if budget.TryRetry() {
+		t.Fatal("expected the budget to be exhausted")
+	}
+
+	// Ten successes earn one more retry at a 10% ratio.
+	for i := 0; i < 9; i++ {
+		budget.RecordSuccess()
+	}
+	if budget.TryRetry() {
+		t.Fatal("expected nine successes to not yet earn a retry")
+	}
+	budget.RecordSuccess()
+	if !budget.TryRetry() {
+		t.Fatal("expected ten successes to earn a retry")
+	}
+
+	// Successes never push the balance past the reserve.
+	for i := 0; i < 1000; i++ {
+		budget.RecordSuccess()
+	}
+	for i := 0; i < 2; i++ {
+		if !budget.TryRetry() {
+			t.Fatalf("expected retry %v to be allowed", i)
+		}
+	}
+	if budget.TryRetry() {
+		t.Fatal("expected the balance to be capped at the reserve")
+	}
+}
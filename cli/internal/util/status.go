@@ -1,6 +1,9 @@
 package util
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
 
 // CachingStatus represents the api server's perspective
 // on whether remote caching should be allowed
@@ -35,6 +38,22 @@ func CachingStatusFromString(raw string) (CachingStatus, error) {
 	}
 }
 
+// ErrUnauthorized is returned when the remote cache rejects our credentials,
+// e.g. because a short-lived token expired partway through a run.
+var ErrUnauthorized = errors.New("remote cache credentials were rejected")
+
+// ErrTokenUnavailable is returned when a token provider fails to supply a
+// token for the remote cache.
+var ErrTokenUnavailable = errors.New("remote cache token is unavailable")
+
+// ErrDeltaUnsupported is returned when the remote cache doesn't accept
+// artifacts uploaded as a delta against another artifact.
+var ErrDeltaUnsupported = errors.New("remote cache does not support delta uploads")
+
+// ErrArtifactImmutable is returned when the remote cache refuses to overwrite
+// an artifact that was uploaded as immutable.
+var ErrArtifactImmutable = errors.New("remote cache artifact is immutable and can't be overwritten")
+
 // CacheDisabledError is an error used to indicate that remote caching
 // is not available.
 type CacheDisabledError struct {